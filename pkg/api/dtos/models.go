@@ -43,6 +43,9 @@ type CurrentUser struct {
 	HelpFlags1                 models.HelpFlags1  `json:"helpFlags1"`
 	HasEditPermissionInFolders bool               `json:"hasEditPermissionInFolders"`
 	Permissions                UserPermissionsMap `json:"permissions,omitempty"`
+
+	// DefaultExploreDatasourceUid is only set when the preferred datasource still exists in the org
+	DefaultExploreDatasourceUid string `json:"defaultExploreDatasourceUid,omitempty"`
 }
 
 type UserPermissionsMap map[string]bool
@@ -1,10 +1,18 @@
 package dtos
 
+import "github.com/grafana/grafana/pkg/models"
+
 type Prefs struct {
 	Theme           string `json:"theme"`
 	HomeDashboardID int64  `json:"homeDashboardId"`
 	Timezone        string `json:"timezone"`
 	WeekStart       string `json:"weekStart"`
+	AccentColor     string `json:"accentColor"`
+
+	DefaultExploreDatasourceUID string               `json:"defaultExploreDatasourceUid"`
+	DigestCadence               string               `json:"digestCadence"`
+	LastExploreRange            *models.ExploreRange `json:"lastExploreRange"`
+	DefaultRefreshInterval      string               `json:"defaultRefreshInterval"`
 }
 
 type UpdatePrefsCmd struct {
@@ -12,4 +20,10 @@ type UpdatePrefsCmd struct {
 	HomeDashboardID int64  `json:"homeDashboardId"`
 	Timezone        string `json:"timezone"`
 	WeekStart       string `json:"weekStart"`
+	AccentColor     string `json:"accentColor"`
+
+	DefaultExploreDatasourceUID string               `json:"defaultExploreDatasourceUid"`
+	DigestCadence               string               `json:"digestCadence"`
+	LastExploreRange            *models.ExploreRange `json:"lastExploreRange"`
+	DefaultRefreshInterval      string               `json:"defaultRefreshInterval"`
 }
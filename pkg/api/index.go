@@ -570,6 +570,8 @@ func (hs *HTTPServer) setIndexViewData(c *models.ReqContext) (*dtos.IndexViewDat
 			Locale:                     locale,
 			HelpFlags1:                 c.HelpFlags1,
 			HasEditPermissionInFolders: hasEditPerm,
+
+			DefaultExploreDatasourceUid: prefs.DefaultExploreDatasourceUid,
 		},
 		Settings:                settings,
 		Theme:                   prefs.Theme,
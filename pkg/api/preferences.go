@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"errors"
 
 	"github.com/grafana/grafana/pkg/api/dtos"
 	"github.com/grafana/grafana/pkg/api/response"
@@ -19,6 +20,7 @@ const (
 func SetHomeDashboard(c *models.ReqContext, cmd models.SavePreferencesCommand) response.Response {
 	cmd.UserId = c.UserId
 	cmd.OrgId = c.OrgId
+	cmd.UpdatedBy = c.UserId
 
 	if err := bus.DispatchCtx(c.Req.Context(), &cmd); err != nil {
 		return response.Error(500, "Failed to set home dashboard", err)
@@ -44,17 +46,38 @@ func (hs *HTTPServer) getPreferencesFor(ctx context.Context, orgID, userID, team
 		HomeDashboardID: prefsQuery.Result.HomeDashboardId,
 		Timezone:        prefsQuery.Result.Timezone,
 		WeekStart:       prefsQuery.Result.WeekStart,
+		AccentColor:     prefsQuery.Result.AccentColor,
+
+		DefaultExploreDatasourceUID: hs.resolveDefaultExploreDatasource(ctx, orgID, prefsQuery.Result.DefaultExploreDatasourceUid),
+		DigestCadence:               prefsQuery.Result.DigestCadence,
+		LastExploreRange:            models.ParseExploreRange(prefsQuery.Result.LastExploreRange),
+		DefaultRefreshInterval:      prefsQuery.Result.DefaultRefreshInterval,
 	}
 
 	return response.JSON(200, &dto)
 }
 
+// resolveDefaultExploreDatasource returns uid when it is a datasource of the org. Otherwise, e.g. when the
+// datasource was deleted after the preference was saved, it returns an empty uid so that Explore picks one itself.
+func (hs *HTTPServer) resolveDefaultExploreDatasource(ctx context.Context, orgID int64, uid string) string {
+	if uid == "" {
+		return ""
+	}
+
+	query := models.GetDataSourceQuery{Uid: uid, OrgId: orgID}
+	if err := hs.Bus.DispatchCtx(ctx, &query); err != nil {
+		hs.log.Warn("Ignoring default Explore datasource preference", "uid", uid, "err", err)
+		return ""
+	}
+	return query.Result.Uid
+}
+
 // PUT /api/user/preferences
 func (hs *HTTPServer) UpdateUserPreferences(c *models.ReqContext, dtoCmd dtos.UpdatePrefsCmd) response.Response {
-	return hs.updatePreferencesFor(c.Req.Context(), c.OrgId, c.UserId, 0, &dtoCmd)
+	return hs.updatePreferencesFor(c.Req.Context(), c.OrgId, c.UserId, 0, c.UserId, &dtoCmd)
 }
 
-func (hs *HTTPServer) updatePreferencesFor(ctx context.Context, orgID, userID, teamId int64, dtoCmd *dtos.UpdatePrefsCmd) response.Response {
+func (hs *HTTPServer) updatePreferencesFor(ctx context.Context, orgID, userID, teamId, updatedBy int64, dtoCmd *dtos.UpdatePrefsCmd) response.Response {
 	if dtoCmd.Theme != lightTheme && dtoCmd.Theme != darkTheme && dtoCmd.Theme != defaultTheme {
 		return response.Error(400, "Invalid theme", nil)
 	}
@@ -62,13 +85,29 @@ func (hs *HTTPServer) updatePreferencesFor(ctx context.Context, orgID, userID, t
 		UserId:          userID,
 		OrgId:           orgID,
 		TeamId:          teamId,
+		UpdatedBy:       updatedBy,
 		Theme:           dtoCmd.Theme,
 		Timezone:        dtoCmd.Timezone,
 		WeekStart:       dtoCmd.WeekStart,
 		HomeDashboardId: dtoCmd.HomeDashboardID,
+		AccentColor:     dtoCmd.AccentColor,
+
+		DefaultExploreDatasourceUid: dtoCmd.DefaultExploreDatasourceUID,
+		DigestCadence:               dtoCmd.DigestCadence,
+		LastExploreRange:            dtoCmd.LastExploreRange,
+		DefaultRefreshInterval:      dtoCmd.DefaultRefreshInterval,
 	}
 
 	if err := hs.SQLStore.SavePreferences(ctx, &saveCmd); err != nil {
+		if errors.Is(err, models.ErrInvalidAccentColor) {
+			return response.Error(400, "Invalid accent color", err)
+		}
+		if errors.Is(err, models.ErrInvalidDigestCadence) {
+			return response.Error(400, "Invalid digest cadence", err)
+		}
+		if errors.Is(err, models.ErrInvalidRefreshInterval) {
+			return response.Error(400, "Invalid default refresh interval", err)
+		}
 		return response.Error(500, "Failed to save preferences", err)
 	}
 
@@ -82,5 +121,5 @@ func (hs *HTTPServer) GetOrgPreferences(c *models.ReqContext) response.Response
 
 // PUT /api/org/preferences
 func (hs *HTTPServer) UpdateOrgPreferences(c *models.ReqContext, dtoCmd dtos.UpdatePrefsCmd) response.Response {
-	return hs.updatePreferencesFor(c.Req.Context(), c.OrgId, 0, 0, &dtoCmd)
+	return hs.updatePreferencesFor(c.Req.Context(), c.OrgId, 0, 0, c.UserId, &dtoCmd)
 }
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"strings"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/accesscontrol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -109,3 +113,24 @@ func TestAPIEndpoint_PutCurrentOrgPreferences_AccessControl(t *testing.T) {
 		assert.Equal(t, http.StatusForbidden, response.Code)
 	})
 }
+
+func TestResolveDefaultExploreDatasource(t *testing.T) {
+	hs := &HTTPServer{Bus: bus.New(), log: log.New("test")}
+	hs.Bus.AddHandlerCtx(func(_ context.Context, query *models.GetDataSourceQuery) error {
+		if query.OrgId == 1 && query.Uid == "loki" {
+			query.Result = &models.DataSource{OrgId: 1, Uid: "loki"}
+			return nil
+		}
+		return models.ErrDataSourceNotFound
+	})
+
+	t.Run("should keep a datasource of the org", func(t *testing.T) {
+		assert.Equal(t, "loki", hs.resolveDefaultExploreDatasource(context.Background(), 1, "loki"))
+	})
+	t.Run("should ignore a datasource which does not exist", func(t *testing.T) {
+		assert.Empty(t, hs.resolveDefaultExploreDatasource(context.Background(), 1, "deleted"))
+	})
+	t.Run("should not look up an unset preference", func(t *testing.T) {
+		assert.Empty(t, hs.resolveDefaultExploreDatasource(context.Background(), 1, ""))
+	})
+}
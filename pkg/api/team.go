@@ -167,7 +167,7 @@ func (hs *HTTPServer) UpdateTeamPreferences(c *models.ReqContext, dtoCmd dtos.Up
 		return response.Error(403, "Not allowed to update team preferences.", err)
 	}
 
-	return hs.updatePreferencesFor(c.Req.Context(), orgId, 0, teamId, &dtoCmd)
+	return hs.updatePreferencesFor(c.Req.Context(), orgId, 0, teamId, c.UserId, &dtoCmd)
 }
 
 // createTeam creates a team.
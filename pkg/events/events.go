@@ -55,6 +55,14 @@ type DataSourceDeleted struct {
 	OrgID     int64     `json:"org_id"`
 }
 
+type DataSourceUpdated struct {
+	Timestamp time.Time `json:"timestamp"`
+	Name      string    `json:"name"`
+	ID        int64     `json:"id"`
+	UID       string    `json:"uid"`
+	OrgID     int64     `json:"org_id"`
+}
+
 type DataSourceCreated struct {
 	Timestamp time.Time `json:"timestamp"`
 	Name      string    `json:"name"`
@@ -62,3 +70,17 @@ type DataSourceCreated struct {
 	UID       string    `json:"uid"`
 	OrgID     int64     `json:"org_id"`
 }
+
+type PreferencesUpdated struct {
+	Timestamp time.Time                   `json:"timestamp"`
+	OrgID     int64                       `json:"org_id"`
+	UserID    int64                       `json:"user_id"`
+	TeamID    int64                       `json:"team_id"`
+	UpdatedBy int64                       `json:"updated_by"`
+	Changes   map[string]PreferenceChange `json:"changes"`
+}
+
+type PreferenceChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
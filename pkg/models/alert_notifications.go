@@ -88,7 +88,10 @@ type UpdateAlertNotificationWithUidCommand struct {
 	Settings              *simplejson.Json  `json:"settings"  binding:"Required"`
 	SecureSettings        map[string]string `json:"secureSettings"`
 
-	OrgId  int64
+	OrgId int64
+	// EncryptedSecureSettings are stored as they are instead of encrypting SecureSettings again when not nil
+	EncryptedSecureSettings map[string][]byte `json:"-"`
+
 	Result *AlertNotification
 }
 
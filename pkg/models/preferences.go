@@ -1,9 +1,81 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
+	"regexp"
 	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+var ErrInvalidAccentColor = errors.New("accent color must be a hex color such as #1f60c4")
+
+var accentColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// IsValidAccentColor tells whether color can be saved as an accent color, an empty color unsets it
+func IsValidAccentColor(color string) bool {
+	return color == "" || accentColorPattern.MatchString(color)
+}
+
+// Digest cadences tell how often a user wants to receive alert digests, digests are off by default.
+// The cadence is only stored and resolved for now, no notification scheduler sends digests yet.
+const (
+	DigestCadenceOff    = "off"
+	DigestCadenceHourly = "hourly"
+	DigestCadenceDaily  = "daily"
+	DigestCadenceWeekly = "weekly"
 )
 
+var ErrInvalidDigestCadence = errors.New("digest cadence must be one of off, hourly, daily or weekly")
+
+// IsValidDigestCadence tells whether cadence can be saved as a digest cadence, an empty cadence unsets it
+func IsValidDigestCadence(cadence string) bool {
+	switch cadence {
+	case "", DigestCadenceOff, DigestCadenceHourly, DigestCadenceDaily, DigestCadenceWeekly:
+		return true
+	default:
+		return false
+	}
+}
+
+// RefreshIntervalOff disables the auto-refresh of the dashboards, whatever refresh interval they are saved with
+const RefreshIntervalOff = "off"
+
+var ErrInvalidRefreshInterval = errors.New("default refresh interval must be off or a positive duration such as 30s, 5m or 1h")
+
+// ErrPreferencesLockTimeout is returned when saving preferences waited longer than the configured lock timeout
+var ErrPreferencesLockTimeout = errors.New("timed out waiting for the preferences to be unlocked")
+
+// IsValidRefreshInterval tells whether interval can be saved as a default refresh interval, an empty interval unsets it
+func IsValidRefreshInterval(interval string) bool {
+	if interval == "" || interval == RefreshIntervalOff {
+		return true
+	}
+	d, err := gtime.ParseDuration(interval)
+	return err == nil && d > 0
+}
+
+// ExploreRange is the time range of Explore, e.g. from "now-6h" to "now"
+type ExploreRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ParseExploreRange returns the explore range stored as JSON in Preferences.LastExploreRange,
+// or nil when none is stored or the stored JSON is malformed
+func ParseExploreRange(raw string) *ExploreRange {
+	if raw == "" {
+		return nil
+	}
+
+	var r *ExploreRange
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		return nil
+	}
+	return r
+}
+
 type Preferences struct {
 	Id              int64
 	OrgId           int64
@@ -14,8 +86,20 @@ type Preferences struct {
 	Timezone        string
 	WeekStart       string
 	Theme           string
+	AccentColor     string
 	Created         time.Time
 	Updated         time.Time
+
+	// DefaultExploreDatasourceUid is the datasource Explore opens with, Explore picks one itself when it is empty
+	DefaultExploreDatasourceUid string
+	// DigestCadence is how often the user wants to receive alert digests, see IsValidDigestCadence
+	DigestCadence string
+	// DefaultRefreshInterval is the auto-refresh dashboards open with, see IsValidRefreshInterval.
+	// Dashboards keep the refresh interval they are saved with when it is empty.
+	DefaultRefreshInterval string
+	// LastExploreRange is the JSON of the ExploreRange last used by the user, see ParseExploreRange.
+	// It is only saved in user preferences, teams and orgs don't pass it down.
+	LastExploreRange string
 }
 
 // ---------------------
@@ -30,21 +114,101 @@ type GetPreferencesQuery struct {
 	Result *Preferences
 }
 
+// GetTeamPreferencesQuery returns the preferences of a team, ignoring the ones of its members
+type GetTeamPreferencesQuery struct {
+	OrgId  int64
+	TeamId int64
+
+	Result *Preferences
+}
+
+// GetTeamsPreferencesQuery returns the preferences of several teams of an org keyed by team id,
+// teams without preferences are left out
+type GetTeamsPreferencesQuery struct {
+	OrgId   int64
+	TeamIds []int64
+
+	Result map[int64]*Preferences
+}
+
 type GetPreferencesWithDefaultsQuery struct {
 	User *SignedInUser
 
 	Result *Preferences
 }
 
+// GetPreferencesWithNonDefaultsQuery returns the effective preferences of a user
+// along with the names of those differing from their defaults
+type GetPreferencesWithNonDefaultsQuery struct {
+	User *SignedInUser
+
+	Result *PreferencesWithNonDefaults
+}
+
+type PreferencesWithNonDefaults struct {
+	Preferences *Preferences
+	// NonDefault holds the JSON names, e.g. "theme", of the preferences differing from their defaults
+	NonDefault map[string]struct{}
+}
+
+// PreferencesLevel is the level supplying an effective preference
+type PreferencesLevel string
+
+const (
+	PreferencesLevelDefault PreferencesLevel = "default"
+	PreferencesLevelOrg     PreferencesLevel = "org"
+	PreferencesLevelTeam    PreferencesLevel = "team"
+	PreferencesLevelUser    PreferencesLevel = "user"
+)
+
+// ExplainedPreference is an effective preference value along with the level it comes from
+type ExplainedPreference struct {
+	Value  interface{}      `json:"value"`
+	Source PreferencesLevel `json:"source"`
+	// TeamId is set when the preference comes from a team
+	TeamId int64 `json:"teamId,omitempty"`
+}
+
+// GetPreferencesWithDefaultsExplainedQuery returns the effective preferences of a user keyed by their JSON name,
+// e.g. "theme", along with the level supplying them
+type GetPreferencesWithDefaultsExplainedQuery struct {
+	User *SignedInUser
+
+	Result map[string]ExplainedPreference
+}
+
+// ExportedPreferences is the portable representation of the preferences of a user,
+// see SQLStore.ExportUserPreferences and SQLStore.ImportUserPreferences
+type ExportedPreferences struct {
+	HomeDashboardId int64  `json:"homeDashboardId"`
+	Timezone        string `json:"timezone"`
+	WeekStart       string `json:"weekStart"`
+	Theme           string `json:"theme"`
+	AccentColor     string `json:"accentColor"`
+
+	DefaultExploreDatasourceUid string        `json:"defaultExploreDatasourceUid"`
+	DigestCadence               string        `json:"digestCadence"`
+	LastExploreRange            *ExploreRange `json:"lastExploreRange"`
+	DefaultRefreshInterval      string        `json:"defaultRefreshInterval"`
+}
+
 // ---------------------
 // COMMANDS
 type SavePreferencesCommand struct {
 	UserId int64
 	OrgId  int64
 	TeamId int64
+	// UpdatedBy is the ID of the user making the change, reported to audit subscribers
+	UpdatedBy int64 `json:"-"`
 
 	HomeDashboardId int64  `json:"homeDashboardId"`
 	Timezone        string `json:"timezone"`
 	WeekStart       string `json:"weekStart"`
 	Theme           string `json:"theme"`
+	AccentColor     string `json:"accentColor"`
+
+	DefaultExploreDatasourceUid string        `json:"defaultExploreDatasourceUid"`
+	DigestCadence               string        `json:"digestCadence"`
+	LastExploreRange            *ExploreRange `json:"lastExploreRange"`
+	DefaultRefreshInterval      string        `json:"defaultRefreshInterval"`
 }
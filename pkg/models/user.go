@@ -182,6 +182,8 @@ type SignedInUser struct {
 	HelpFlags1     HelpFlags1
 	LastSeenAt     time.Time
 	Teams          []int64
+	// IsServiceAccount is set when the user is the service account linked to the API key of the request
+	IsServiceAccount bool
 }
 
 func (u *SignedInUser) ShouldUpdateLastSeenAt() bool {
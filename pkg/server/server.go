@@ -22,6 +22,7 @@ import (
 	"github.com/grafana/grafana/pkg/login/social"
 	"github.com/grafana/grafana/pkg/registry"
 	"github.com/grafana/grafana/pkg/services/provisioning"
+	"github.com/grafana/grafana/pkg/services/secrets"
 
 	"github.com/grafana/grafana/pkg/setting"
 	"golang.org/x/sync/errgroup"
@@ -40,8 +41,9 @@ type Options struct {
 // New returns a new instance of Server.
 func New(opts Options, cfg *setting.Cfg, httpServer *api.HTTPServer, roleRegistry accesscontrol.RoleRegistry,
 	provisioningService provisioning.ProvisioningService, backgroundServiceProvider registry.BackgroundServiceRegistry,
+	secretsProviders secrets.ProvidersRegistrar,
 ) (*Server, error) {
-	s, err := newServer(opts, cfg, httpServer, roleRegistry, provisioningService, backgroundServiceProvider)
+	s, err := newServer(opts, cfg, httpServer, roleRegistry, provisioningService, backgroundServiceProvider, secretsProviders)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +57,7 @@ func New(opts Options, cfg *setting.Cfg, httpServer *api.HTTPServer, roleRegistr
 
 func newServer(opts Options, cfg *setting.Cfg, httpServer *api.HTTPServer, roleRegistry accesscontrol.RoleRegistry,
 	provisioningService provisioning.ProvisioningService, backgroundServiceProvider registry.BackgroundServiceRegistry,
+	secretsProviders secrets.ProvidersRegistrar,
 ) (*Server, error) {
 	rootCtx, shutdownFn := context.WithCancel(context.Background())
 	childRoutines, childCtx := errgroup.WithContext(rootCtx)
@@ -65,6 +68,7 @@ func newServer(opts Options, cfg *setting.Cfg, httpServer *api.HTTPServer, roleR
 		HTTPServer:          httpServer,
 		provisioningService: provisioningService,
 		roleRegistry:        roleRegistry,
+		secretsProviders:    secretsProviders,
 		shutdownFn:          shutdownFn,
 		shutdownFinished:    make(chan struct{}),
 		log:                 log.New("server"),
@@ -99,6 +103,7 @@ type Server struct {
 
 	HTTPServer          *api.HTTPServer
 	roleRegistry        accesscontrol.RoleRegistry
+	secretsProviders    secrets.ProvidersRegistrar
 	provisioningService provisioning.ProvisioningService
 }
 
@@ -124,6 +129,10 @@ func (s *Server) init() error {
 		return err
 	}
 
+	if err := s.secretsProviders.InitProviders(); err != nil {
+		return err
+	}
+
 	return s.provisioningService.RunInitProvisioners(s.context)
 }
 
@@ -189,6 +198,10 @@ func (s *Server) Shutdown(ctx context.Context, reason string) error {
 			s.log.Warn("Timed out while waiting for server to shut down")
 			err = fmt.Errorf("timeout waiting for shutdown")
 		}
+		// The providers are closed once the services using them have stopped
+		if closeErr := s.secretsProviders.Close(ctx); closeErr != nil {
+			s.log.Error("Failed to close the encryption providers", "error", closeErr)
+		}
 	})
 
 	return err
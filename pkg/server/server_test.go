@@ -10,7 +10,9 @@ import (
 	"github.com/grafana/grafana/pkg/registry"
 	"github.com/grafana/grafana/pkg/server/backgroundsvcs"
 	"github.com/grafana/grafana/pkg/services/accesscontrol/ossaccesscontrol"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -47,7 +49,7 @@ func (s *testService) IsDisabled() bool {
 
 func testServer(t *testing.T, services ...registry.BackgroundService) *Server {
 	t.Helper()
-	s, err := newServer(Options{}, setting.NewCfg(), nil, &ossaccesscontrol.OSSAccessControlService{}, nil, backgroundsvcs.NewBackgroundServiceRegistry(services...))
+	s, err := newServer(Options{}, setting.NewCfg(), nil, &ossaccesscontrol.OSSAccessControlService{}, nil, backgroundsvcs.NewBackgroundServiceRegistry(services...), fakes.NewFakeSecretsService())
 	require.NoError(t, err)
 	// Required to skip configuration initialization that causes
 	// DI errors in this test.
@@ -91,3 +93,35 @@ func TestServer_Shutdown(t *testing.T) {
 	err = <-ch
 	require.NoError(t, err)
 }
+
+// closingSecretsService records whether the providers have been closed
+type closingSecretsService struct {
+	fakes.FakeSecretsService
+	closed chan struct{}
+}
+
+func (s closingSecretsService) Close(context.Context) error {
+	close(s.closed)
+	return errors.New("provider failed to close")
+}
+
+func TestServer_Shutdown_ClosesSecretsProviders(t *testing.T) {
+	secretsService := closingSecretsService{closed: make(chan struct{})}
+	s, err := newServer(Options{}, setting.NewCfg(), nil, &ossaccesscontrol.OSSAccessControlService{}, nil, backgroundsvcs.NewBackgroundServiceRegistry(), secretsService)
+	require.NoError(t, err)
+	s.isInitialized = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		// the errors closing the providers are logged, they don't fail the shutdown
+		assert.NoError(t, s.Shutdown(ctx, "test interrupt"))
+	}()
+	require.NoError(t, s.Run())
+
+	select {
+	case <-secretsService.closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the secrets providers have not been closed")
+	}
+}
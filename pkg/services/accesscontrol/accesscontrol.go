@@ -29,6 +29,10 @@ type AccessControl interface {
 	// DeclareFixedRoles allow the caller to declare, to the service, fixed roles and their
 	// assignments to organization roles ("Viewer", "Editor", "Admin") or "Grafana Admin"
 	DeclareFixedRoles(...RoleRegistration) error
+
+	// RegisterAttributeScopeResolver allows the caller to register a resolver translating the scopes starting
+	// with scopePrefix, e.g. "datasources:name:", Evaluate resolves the scopes of evaluators with it
+	RegisterAttributeScopeResolver(scopePrefix string, resolver AttributeScopeResolveFunc)
 }
 
 func HasAccess(ac AccessControl, c *models.ReqContext) func(fallback func(*models.ReqContext) bool, evaluator Evaluator) bool {
@@ -77,7 +81,63 @@ func GroupScopesByAction(permissions []*Permission) map[string]map[string]struct
 	return m
 }
 
-func ValidateScope(scope string) bool {
+// MergePermissions returns the union of two sets of scopes grouped by action, scopes are deduplicated per action
+func MergePermissions(a, b map[string]map[string]struct{}) map[string]map[string]struct{} {
+	m := make(map[string]map[string]struct{}, len(a))
+	for _, permissions := range []map[string]map[string]struct{}{a, b} {
+		for action, scopes := range permissions {
+			if _, ok := m[action]; !ok {
+				m[action] = make(map[string]struct{}, len(scopes))
+			}
+			for scope := range scopes {
+				m[action][scope] = struct{}{}
+			}
+		}
+	}
+	return m
+}
+
+// MergePermissionList returns the permissions of both lists, without duplicated action and scope pairs
+func MergePermissionList(a, b []*Permission) []*Permission {
+	type key struct{ action, scope string }
+
+	seen := make(map[key]struct{}, len(a)+len(b))
+	merged := make([]*Permission, 0, len(a)+len(b))
+	for _, permissions := range [][]*Permission{a, b} {
+		for _, p := range permissions {
+			k := key{action: p.Action, scope: p.Scope}
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// ScopeValidationOption hardens the validation of ValidateScope
+type ScopeValidationOption func(*scopeValidation)
+
+type scopeValidation struct {
+	rejectKindWildcards bool
+}
+
+// RejectKindWildcards makes ValidateScope reject wildcards spanning the kind of the scope, such as `*`,
+// which would grant the action on every kind of resource. Wildcards on the attribute or the value of a scope,
+// such as `datasources:*` or `datasources:uid:*`, are still valid.
+func RejectKindWildcards() ScopeValidationOption {
+	return func(v *scopeValidation) {
+		v.rejectKindWildcards = true
+	}
+}
+
+func ValidateScope(scope string, opts ...ScopeValidationOption) bool {
+	validation := scopeValidation{}
+	for _, opt := range opts {
+		opt(&validation)
+	}
+
 	prefix, last := scope[:len(scope)-1], scope[len(scope)-1]
 	// verify that last char is either ':' or '/' if last character of scope is '*'
 	if len(prefix) > 0 && last == '*' {
@@ -86,5 +146,9 @@ func ValidateScope(scope string) bool {
 			return false
 		}
 	}
+	// the kind is the first segment of the scope, a wildcard before its ':' separator spans every kind
+	if validation.rejectKindWildcards && last == '*' && !strings.Contains(prefix, ":") {
+		return false
+	}
 	return !strings.ContainsAny(prefix, "*?")
 }
@@ -0,0 +1,121 @@
+package accesscontrol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePermissions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		a        map[string]map[string]struct{}
+		b        map[string]map[string]struct{}
+		expected map[string]map[string]struct{}
+	}{
+		{
+			desc:     "should merge disjoint actions",
+			a:        map[string]map[string]struct{}{"users:read": {"users:*": {}}},
+			b:        map[string]map[string]struct{}{"teams:read": {"teams:id:1": {}}},
+			expected: map[string]map[string]struct{}{"users:read": {"users:*": {}}, "teams:read": {"teams:id:1": {}}},
+		},
+		{
+			desc:     "should merge disjoint scopes of the same action",
+			a:        map[string]map[string]struct{}{"teams:read": {"teams:id:1": {}}},
+			b:        map[string]map[string]struct{}{"teams:read": {"teams:id:2": {}}},
+			expected: map[string]map[string]struct{}{"teams:read": {"teams:id:1": {}, "teams:id:2": {}}},
+		},
+		{
+			desc:     "should deduplicate overlapping scopes",
+			a:        map[string]map[string]struct{}{"teams:read": {"teams:id:1": {}, "teams:id:2": {}}},
+			b:        map[string]map[string]struct{}{"teams:read": {"teams:id:2": {}, "teams:id:3": {}}},
+			expected: map[string]map[string]struct{}{"teams:read": {"teams:id:1": {}, "teams:id:2": {}, "teams:id:3": {}}},
+		},
+		{
+			desc:     "should handle nil sets",
+			a:        nil,
+			b:        map[string]map[string]struct{}{"teams:read": {"": {}}},
+			expected: map[string]map[string]struct{}{"teams:read": {"": {}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			merged := MergePermissions(tt.a, tt.b)
+			assert.Equal(t, tt.expected, merged)
+
+			// the merged set must not share scopes with its inputs
+			for _, scopes := range merged {
+				scopes["extra"] = struct{}{}
+			}
+			for _, permissions := range []map[string]map[string]struct{}{tt.a, tt.b} {
+				for _, scopes := range permissions {
+					assert.NotContains(t, scopes, "extra")
+				}
+			}
+		})
+	}
+}
+
+func TestMergePermissionList(t *testing.T) {
+	tests := []struct {
+		desc     string
+		a        []*Permission
+		b        []*Permission
+		expected []*Permission
+	}{
+		{
+			desc:     "should merge disjoint permissions",
+			a:        []*Permission{{Action: "users:read", Scope: "users:*"}},
+			b:        []*Permission{{Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read", Scope: "teams:id:2"}},
+			expected: []*Permission{{Action: "users:read", Scope: "users:*"}, {Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read", Scope: "teams:id:2"}},
+		},
+		{
+			desc:     "should deduplicate overlapping permissions",
+			a:        []*Permission{{Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read"}},
+			b:        []*Permission{{Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read"}, {Action: "teams:write", Scope: "teams:id:1"}},
+			expected: []*Permission{{Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read"}, {Action: "teams:write", Scope: "teams:id:1"}},
+		},
+		{
+			desc:     "should deduplicate permissions within the same list",
+			a:        []*Permission{{Action: "teams:read", Scope: "teams:id:1"}, {Action: "teams:read", Scope: "teams:id:1"}},
+			b:        nil,
+			expected: []*Permission{{Action: "teams:read", Scope: "teams:id:1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, MergePermissionList(tt.a, tt.b))
+		})
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	tests := []struct {
+		desc   string
+		scope  string
+		opts   []ScopeValidationOption
+		expect bool
+	}{
+		{desc: "should allow a scope without wildcard", scope: "datasources:uid:abc", expect: true},
+		{desc: "should allow a wildcard on the value", scope: "datasources:uid:*", expect: true},
+		{desc: "should allow a wildcard on the attribute", scope: "datasources:*", expect: true},
+		{desc: "should allow a wildcard on the kind by default", scope: "*", expect: true},
+		{desc: "should reject a wildcard before the end", scope: "*:read", expect: false},
+		{desc: "should reject a wildcard within a segment", scope: "datasources*", expect: false},
+		{desc: "should reject a question mark", scope: "datasources:uid:?bc", expect: false},
+		{desc: "should allow a scope without wildcard when rejecting kind wildcards", scope: "datasources:uid:abc", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: true},
+		{desc: "should allow a wildcard on the value when rejecting kind wildcards", scope: "datasources:uid:*", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: true},
+		{desc: "should allow a wildcard on the attribute when rejecting kind wildcards", scope: "datasources:*", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: true},
+		{desc: "should reject a wildcard on the kind when rejecting kind wildcards", scope: "*", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: false},
+		{desc: "should reject a path wildcard spanning the kind when rejecting kind wildcards", scope: "folders/*", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: false},
+		{desc: "should reject a wildcard before the end when rejecting kind wildcards", scope: "*:read", opts: []ScopeValidationOption{RejectKindWildcards()}, expect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expect, ValidateScope(tt.scope, tt.opts...))
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package accesscontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CanonicalString returns an unambiguous representation of the evaluator that can be parsed back with ParseEvaluator.
+// Actions and scopes are quoted, so they survive containing commas, spaces or parentheses.
+// e.g. any(permission("users:read","users:id:1"),all(permission("teams:read")))
+func CanonicalString(evaluator Evaluator) (string, error) {
+	b := strings.Builder{}
+	if err := writeCanonical(&b, evaluator); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeCanonical(b *strings.Builder, evaluator Evaluator) error {
+	switch e := evaluator.(type) {
+	case permissionEvaluator:
+		b.WriteString("permission(")
+		b.WriteString(strconv.Quote(e.Action))
+		for _, scope := range e.Scopes {
+			b.WriteRune(',')
+			b.WriteString(strconv.Quote(scope))
+		}
+	case allEvaluator:
+		b.WriteString("all(")
+		if err := writeCanonicalList(b, e.allOf); err != nil {
+			return err
+		}
+	case anyEvaluator:
+		b.WriteString("any(")
+		if err := writeCanonicalList(b, e.anyOf); err != nil {
+			return err
+		}
+	case adaptiveAnyEvaluator:
+		// The evaluation order is an optimization, it is not part of the representation
+		b.WriteString("any(")
+		if err := writeCanonicalList(b, e.anyOf); err != nil {
+			return err
+		}
+	case inheritanceEvaluator:
+		b.WriteString("inherit(")
+		inheritance, err := json.Marshal(e.inheritance)
+		if err != nil {
+			return err
+		}
+		b.Write(inheritance)
+		b.WriteRune(',')
+		if err := writeCanonical(b, e.wrapped); err != nil {
+			return err
+		}
+	case duringEvaluator:
+		// The clock is not part of the representation, parsed evaluators use time.Now
+		b.WriteString("during(")
+		b.WriteString(strconv.Quote(formatCanonicalTime(e.start)))
+		b.WriteRune(',')
+		b.WriteString(strconv.Quote(formatCanonicalTime(e.end)))
+		b.WriteRune(',')
+		if err := writeCanonical(b, e.inner); err != nil {
+			return err
+		}
+	case xorEvaluator:
+		b.WriteString("xor(")
+		if err := writeCanonicalList(b, []Evaluator{e.a, e.b}); err != nil {
+			return err
+		}
+	case compiledPermissionEvaluator:
+		// Compiling is an optimization, compiled evaluators are represented like their source
+		return writeCanonical(b, e.source())
+	case cachingEvaluator:
+		// Caching is an optimization as well, cached evaluators are represented like the evaluator they wrap
+		return writeCanonical(b, e.inner)
+	default:
+		return fmt.Errorf("evaluator %T has no canonical representation", evaluator)
+	}
+	b.WriteRune(')')
+	return nil
+}
+
+// formatCanonicalTime formats a bound of a time window, the zero time is formatted as an empty string
+func formatCanonicalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func writeCanonicalList(b *strings.Builder, evaluators []Evaluator) error {
+	for i, e := range evaluators {
+		if i != 0 {
+			b.WriteRune(',')
+		}
+		if err := writeCanonical(b, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseEvaluator reconstructs an evaluator from its canonical representation, see CanonicalString.
+// For authoring, e.g. config-driven policies, it also accepts perm(<action>, <scopes>...) where the action and
+// the scopes may be left unquoted unless they contain spaces, commas, parentheses or quotes, and evaluators may be
+// separated by spaces instead of commas, e.g. all(perm(datasources:read, datasources:id:1) any(perm(teams:read))).
+func ParseEvaluator(s string) (Evaluator, error) {
+	p := &evaluatorParser{input: s}
+	evaluator, err := p.parseEvaluator()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected trailing characters")
+	}
+	return evaluator, nil
+}
+
+type evaluatorParser struct {
+	input string
+	pos   int
+}
+
+func (p *evaluatorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("could not parse evaluator at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *evaluatorParser) skipSpaces() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// consume skips the expected character, it returns false when the next character is a different one
+func (p *evaluatorParser) consume(c byte) bool {
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *evaluatorParser) expect(c byte) error {
+	if !p.consume(c) {
+		return p.errorf("expected '%c'", c)
+	}
+	return nil
+}
+
+func (p *evaluatorParser) parseEvaluator() (Evaluator, error) {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && p.input[p.pos] >= 'a' && p.input[p.pos] <= 'z' {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	var evaluator Evaluator
+	switch name {
+	case "permission", "perm":
+		values, err := p.parseValueList(name == "perm")
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, p.errorf("permission requires an action")
+		}
+		if len(values) == 1 {
+			evaluator = EvalPermission(values[0])
+		} else {
+			evaluator = EvalPermission(values[0], values[1:]...)
+		}
+	case "all":
+		evaluators, err := p.parseEvaluatorList()
+		if err != nil {
+			return nil, err
+		}
+		evaluator = EvalAll(evaluators...)
+	case "any":
+		evaluators, err := p.parseEvaluatorList()
+		if err != nil {
+			return nil, err
+		}
+		evaluator = EvalAny(evaluators...)
+	case "xor":
+		evaluators, err := p.parseEvaluatorList()
+		if err != nil {
+			return nil, err
+		}
+		if len(evaluators) != 2 {
+			return nil, p.errorf("xor requires two evaluators")
+		}
+		evaluator = EvalXor(evaluators[0], evaluators[1])
+	case "inherit":
+		inheritance, err := p.parseInheritance()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+		wrapped, err := p.parseEvaluator()
+		if err != nil {
+			return nil, err
+		}
+		evaluator = EvalWithInheritance(inheritance, wrapped)
+	case "during":
+		start, err := p.parseTime()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+		end, err := p.parseTime()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseEvaluator()
+		if err != nil {
+			return nil, err
+		}
+		evaluator = EvalDuring(start, end, inner)
+	default:
+		return nil, p.errorf("unknown evaluator %q", name)
+	}
+
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	return evaluator, nil
+}
+
+// parseValueList parses comma separated quoted values, bare values are accepted as well when allowBare is set
+func (p *evaluatorParser) parseValueList(allowBare bool) ([]string, error) {
+	var values []string
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == ')' {
+		return values, nil
+	}
+	for {
+		parse := p.parseQuoted
+		if allowBare && (p.pos >= len(p.input) || p.input[p.pos] != '"') {
+			parse = p.parseBare
+		}
+		value, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !p.consume(',') {
+			return values, nil
+		}
+		p.skipSpaces()
+	}
+}
+
+// parseBare parses an unquoted value, which ends at a space, a comma, a parenthesis or a quote
+func (p *evaluatorParser) parseBare() (string, error) {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(" ,()\"", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected value")
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *evaluatorParser) parseQuoted() (string, error) {
+	p.skipSpaces()
+	quoted, err := strconv.QuotedPrefix(p.input[p.pos:])
+	if err != nil {
+		return "", p.errorf("expected quoted string")
+	}
+	value, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", p.errorf("invalid quoted string %s", quoted)
+	}
+	p.pos += len(quoted)
+	return value, nil
+}
+
+// parseTime parses a quoted bound of a time window, see formatCanonicalTime
+func (p *evaluatorParser) parseTime() (time.Time, error) {
+	value, err := p.parseQuoted()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, p.errorf("invalid time %q", value)
+	}
+	return t, nil
+}
+
+func (p *evaluatorParser) parseEvaluatorList() ([]Evaluator, error) {
+	var evaluators []Evaluator
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == ')' {
+		return evaluators, nil
+	}
+	for {
+		evaluator, err := p.parseEvaluator()
+		if err != nil {
+			return nil, err
+		}
+		evaluators = append(evaluators, evaluator)
+		// evaluators are separated by a comma, or only by spaces when authored
+		if !p.consume(',') {
+			p.skipSpaces()
+			if p.pos >= len(p.input) || p.input[p.pos] == ')' {
+				return evaluators, nil
+			}
+		}
+	}
+}
+
+func (p *evaluatorParser) parseInheritance() (ScopeInheritance, error) {
+	p.skipSpaces()
+	decoder := json.NewDecoder(strings.NewReader(p.input[p.pos:]))
+	var inheritance ScopeInheritance
+	if err := decoder.Decode(&inheritance); err != nil {
+		return nil, p.errorf("invalid scope inheritance: %v", err)
+	}
+	p.pos += int(decoder.InputOffset())
+	return inheritance, nil
+}
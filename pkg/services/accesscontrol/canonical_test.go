@@ -0,0 +1,167 @@
+package accesscontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalString_RoundTrip(t *testing.T) {
+	tests := []struct {
+		desc      string
+		evaluator Evaluator
+		expected  string
+	}{
+		{
+			desc:      "should represent permission without scope",
+			evaluator: EvalPermission("users:read"),
+			expected:  `permission("users:read")`,
+		},
+		{
+			desc:      "should quote scopes containing commas and spaces",
+			evaluator: EvalPermission("settings:write", "settings:auth saml:a,b", "settings:*"),
+			expected:  `permission("settings:write","settings:auth saml:a,b","settings:*")`,
+		},
+		{
+			desc:      "should escape quotes and parentheses in scopes",
+			evaluator: EvalPermission("reports:read", `reports:"quoted"`, "reports:(1)"),
+			expected:  `permission("reports:read","reports:\"quoted\"","reports:(1)")`,
+		},
+		{
+			desc: "should represent nested evaluators",
+			evaluator: EvalAny(
+				EvalPermission("settings:write", "settings:*"),
+				EvalAll(
+					EvalPermission("settings:write", "settings:auth.saml:enabled"),
+					EvalPermission("settings:write", "settings:auth.saml:max_issue_delay"),
+				),
+			),
+			expected: `any(permission("settings:write","settings:*"),all(permission("settings:write","settings:auth.saml:enabled"),permission("settings:write","settings:auth.saml:max_issue_delay")))`,
+		},
+		{
+			desc:      "should represent empty combinations",
+			evaluator: EvalAll(EvalAny()),
+			expected:  `all(any())`,
+		},
+		{
+			desc: "should represent inheritance",
+			evaluator: EvalWithInheritance(
+				ScopeInheritance{"folders:id:1": {"dashboards:id:1"}},
+				EvalPermission("dashboards:read", "dashboards:id:1"),
+			),
+			expected: `inherit({"folders:id:1":["dashboards:id:1"]},permission("dashboards:read","dashboards:id:1"))`,
+		},
+		{
+			desc:      "should represent xor",
+			evaluator: EvalXor(EvalPermission("reports:read"), EvalPermission("reports:write", "reports:1")),
+			expected:  `xor(permission("reports:read"),permission("reports:write","reports:1"))`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			canonical, err := CanonicalString(test.evaluator)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, canonical)
+
+			parsed, err := ParseEvaluator(canonical)
+			require.NoError(t, err)
+			assert.Equal(t, test.evaluator, parsed)
+		})
+	}
+}
+
+func TestCanonicalString_During(t *testing.T) {
+	evaluator := EvalAny(
+		EvalDuring(
+			time.Date(2021, 11, 1, 8, 0, 0, 0, time.UTC),
+			time.Date(2021, 11, 1, 18, 30, 0, 0, time.FixedZone("CET", 3600)),
+			EvalPermission("datasources:query", "datasources:id:1"),
+		),
+		EvalDuring(time.Time{}, time.Time{}, EvalPermission("users:read")),
+	)
+
+	canonical, err := CanonicalString(evaluator)
+	require.NoError(t, err)
+	assert.Equal(t, `any(during("2021-11-01T08:00:00Z","2021-11-01T18:30:00+01:00",permission("datasources:query","datasources:id:1")),during("","",permission("users:read")))`, canonical)
+
+	// evaluators hold a clock, which can't be compared, so compare their representations instead
+	parsed, err := ParseEvaluator(canonical)
+	require.NoError(t, err)
+	reparsed, err := CanonicalString(parsed)
+	require.NoError(t, err)
+	assert.Equal(t, canonical, reparsed)
+
+	_, err = ParseEvaluator(`during("yesterday","",permission("users:read"))`)
+	assert.Error(t, err)
+}
+
+func TestCanonicalString_Caching(t *testing.T) {
+	canonical, err := CanonicalString(EvalAll(CachingEvaluator(time.Minute, EvalPermission("users:read", "users:id:1"))))
+	require.NoError(t, err)
+	assert.Equal(t, `all(permission("users:read","users:id:1"))`, canonical)
+}
+
+func TestParseEvaluator(t *testing.T) {
+	t.Run("should allow spaces between tokens", func(t *testing.T) {
+		parsed, err := ParseEvaluator(`any( permission("users:read", "users:*") , permission("teams:read") )`)
+		require.NoError(t, err)
+		assert.Equal(t, EvalAny(EvalPermission("users:read", "users:*"), EvalPermission("teams:read")), parsed)
+	})
+
+	dsl := []struct {
+		desc     string
+		input    string
+		expected Evaluator
+	}{
+		{
+			desc:     "should parse unquoted values",
+			input:    `perm(datasources:read, datasources:id:1)`,
+			expected: EvalPermission("datasources:read", "datasources:id:1"),
+		},
+		{
+			desc:     "should parse quoted values containing separators",
+			input:    `perm(folders:read, "folders:name:a, b", "folders:name:(c d)")`,
+			expected: EvalPermission("folders:read", "folders:name:a, b", "folders:name:(c d)"),
+		},
+		{
+			desc:  "should parse evaluators separated by spaces",
+			input: `all(perm(datasources:read, datasources:id:1) any(perm(users:read, "users:id:1") perm(teams:read)))`,
+			expected: EvalAll(
+				EvalPermission("datasources:read", "datasources:id:1"),
+				EvalAny(EvalPermission("users:read", "users:id:1"), EvalPermission("teams:read")),
+			),
+		},
+	}
+	for _, test := range dsl {
+		t.Run(test.desc, func(t *testing.T) {
+			parsed, err := ParseEvaluator(test.input)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected.String(), parsed.String())
+		})
+	}
+
+	invalid := []string{
+		``,
+		`permission()`,
+		`permission(users:read)`,
+		`perm()`,
+		`perm(users:read,)`,
+		`perm(users:read users:id:1)`,
+		`all(perm(users:read),)`,
+		`permission("users:read"`,
+		`permission("users:read"))`,
+		`none(permission("users:read"))`,
+		`all(permission("users:read"),)`,
+		`inherit(permission("users:read"))`,
+		`inherit({"folders:id:1":["dashboards:id:1"]})`,
+	}
+	for _, s := range invalid {
+		t.Run("should fail to parse "+s, func(t *testing.T) {
+			_, err := ParseEvaluator(s)
+			assert.Error(t, err)
+		})
+	}
+}
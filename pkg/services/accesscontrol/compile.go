@@ -0,0 +1,257 @@
+package accesscontrol
+
+import (
+	"context"
+	"strings"
+)
+
+// Compile returns an evaluator granting exactly the same permissions as evaluator, optimized for evaluators which
+// are built once and evaluated many times, e.g. the ones of registered roles:
+//   - nested EvalAll and EvalAny are flattened
+//   - permissions on the same action are merged, and their scopes deduplicated
+//   - the user scopes granting each scope, the scope itself and the wildcards covering it, are precomputed,
+//     so that matching a scope takes a few lookups instead of a pass over all the user scopes
+//
+// Evaluators with side effects or lookups, such as EvalOwnership, are kept as is.
+// Compiled evaluators can be injected and have their scopes modified, the result is compiled again.
+func Compile(evaluator Evaluator) Evaluator {
+	switch e := evaluator.(type) {
+	case permissionEvaluator:
+		return compilePermission(e.Action, e.Scopes, false)
+	case allEvaluator:
+		return compileAll(e.allOf)
+	case anyEvaluator:
+		return compileAny(e.anyOf)
+	case adaptiveAnyEvaluator:
+		compiled := make([]Evaluator, 0, len(e.anyOf))
+		for _, sub := range e.anyOf {
+			compiled = append(compiled, Compile(sub))
+		}
+		return adaptiveAnyEvaluator{anyOf: compiled, stats: e.stats}
+	case inheritanceEvaluator:
+		return EvalWithInheritance(e.inheritance, Compile(e.wrapped))
+	case duringEvaluator:
+		return EvalDuringWithClock(e.clock, e.start, e.end, Compile(e.inner))
+	case featureEvaluator:
+		return EvalFeature(e.flag, Compile(e.inner), e.isEnabled)
+	case xorEvaluator:
+		return EvalXor(Compile(e.a), Compile(e.b))
+	default:
+		return evaluator
+	}
+}
+
+var _ Evaluator = new(compiledPermissionEvaluator)
+
+// compiledPermissionEvaluator is the compiled form of EvalPermission(action, scopes...),
+// or of EvalAny of single scope permissions on action when anyScope is set
+type compiledPermissionEvaluator struct {
+	action string
+	scopes []string
+	// grants lists for each scope the user scopes granting it
+	grants   [][]string
+	anyScope bool
+}
+
+func compilePermission(action string, scopes []string, anyScope bool) compiledPermissionEvaluator {
+	c := compiledPermissionEvaluator{action: action, anyScope: anyScope}
+	seen := make(map[string]struct{}, len(scopes))
+	for _, scope := range scopes {
+		if _, ok := seen[scope]; ok {
+			continue
+		}
+		seen[scope] = struct{}{}
+		c.scopes = append(c.scopes, scope)
+		c.grants = append(c.grants, scopeGrants(scope))
+	}
+	return c
+}
+
+// scopeGrants returns the user scopes matching target, see match: target itself when it is a valid scope,
+// and the wildcards of its prefixes ending with a separator, e.g. "*", "datasources:*" and "datasources:id:*"
+// for "datasources:id:1"
+func scopeGrants(target string) []string {
+	var grants []string
+	if target != "" && ValidateScope(target) {
+		grants = append(grants, target)
+	}
+	for i := 0; i <= len(target); i++ {
+		if i > 0 && target[i-1] != ':' && target[i-1] != '/' {
+			continue
+		}
+		prefix := target[:i]
+		if strings.ContainsAny(prefix, "*?") {
+			break
+		}
+		if wildcard := prefix + "*"; wildcard != target {
+			grants = append(grants, wildcard)
+		}
+	}
+	return grants
+}
+
+func (c compiledPermissionEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if len(permissions) == 0 {
+		return false, nil
+	}
+
+	userScopes, ok := permissions[c.action]
+	if !ok {
+		return false, nil
+	}
+
+	if len(c.grants) == 0 {
+		return true, nil
+	}
+
+	for _, grants := range c.grants {
+		granted := false
+		for _, grant := range grants {
+			if _, ok := userScopes[grant]; ok {
+				granted = true
+				break
+			}
+		}
+		if granted == c.anyScope {
+			return granted, nil
+		}
+	}
+	return !c.anyScope, nil
+}
+
+// source returns the uncompiled evaluator
+func (c compiledPermissionEvaluator) source() Evaluator {
+	if !c.anyScope {
+		return EvalPermission(c.action, c.scopes...)
+	}
+
+	anyOf := make([]Evaluator, 0, len(c.scopes))
+	for _, scope := range c.scopes {
+		anyOf = append(anyOf, EvalPermission(c.action, scope))
+	}
+	return EvalAny(anyOf...)
+}
+
+func (c compiledPermissionEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := c.source().Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(injected), nil
+}
+
+func (c compiledPermissionEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := c.source().MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(modified), nil
+}
+
+func (c compiledPermissionEvaluator) String() string {
+	return c.source().String()
+}
+
+// compiledPermissions returns the evaluators as compiled permissions, or false when one of them is something else.
+// Compiled permissions never fail, so they can be merged and reordered without changing the outcome.
+func compiledPermissions(evaluators []Evaluator) ([]compiledPermissionEvaluator, bool) {
+	permissions := make([]compiledPermissionEvaluator, 0, len(evaluators))
+	for _, e := range evaluators {
+		p, ok := e.(compiledPermissionEvaluator)
+		if !ok {
+			return nil, false
+		}
+		permissions = append(permissions, p)
+	}
+	return permissions, true
+}
+
+func compileAll(allOf []Evaluator) Evaluator {
+	flattened := make([]Evaluator, 0, len(allOf))
+	for _, sub := range allOf {
+		compiled := Compile(sub)
+		// an empty EvalAll grants users without permissions, it can't be flattened into a non-empty one
+		if nested, ok := compiled.(allEvaluator); ok && len(nested.allOf) > 0 {
+			flattened = append(flattened, nested.allOf...)
+			continue
+		}
+		flattened = append(flattened, compiled)
+	}
+
+	permissions, ok := compiledPermissions(flattened)
+	if !ok {
+		return EvalAll(flattened...)
+	}
+
+	// all the scopes of the permissions on an action are required, they can be required by a single permission
+	var merged []Evaluator
+	byAction := make(map[string]int)
+	for _, p := range permissions {
+		if p.anyScope {
+			merged = append(merged, p)
+			continue
+		}
+		i, exists := byAction[p.action]
+		if !exists {
+			byAction[p.action] = len(merged)
+			merged = append(merged, p)
+			continue
+		}
+		previous := merged[i].(compiledPermissionEvaluator)
+		merged[i] = compilePermission(p.action, append(append([]string(nil), previous.scopes...), p.scopes...), false)
+	}
+
+	if len(merged) == 1 {
+		return merged[0]
+	}
+	return EvalAll(merged...)
+}
+
+func compileAny(anyOf []Evaluator) Evaluator {
+	flattened := make([]Evaluator, 0, len(anyOf))
+	for _, sub := range anyOf {
+		compiled := Compile(sub)
+		if nested, ok := compiled.(anyEvaluator); ok && len(nested.anyOf) > 0 {
+			flattened = append(flattened, nested.anyOf...)
+			continue
+		}
+		flattened = append(flattened, compiled)
+	}
+
+	permissions, ok := compiledPermissions(flattened)
+	if !ok {
+		return EvalAny(flattened...)
+	}
+
+	// one scope of the single scope permissions on an action is enough, they can be granted by a single permission
+	var merged []Evaluator
+	byAction := make(map[string]int)
+	seen := make(map[string]struct{})
+	for _, p := range permissions {
+		if !p.anyScope && len(p.scopes) != 1 {
+			if key := p.String(); !hasKey(seen, key) {
+				seen[key] = struct{}{}
+				merged = append(merged, p)
+			}
+			continue
+		}
+		i, exists := byAction[p.action]
+		if !exists {
+			byAction[p.action] = len(merged)
+			merged = append(merged, compilePermission(p.action, p.scopes, true))
+			continue
+		}
+		previous := merged[i].(compiledPermissionEvaluator)
+		merged[i] = compilePermission(p.action, append(append([]string(nil), previous.scopes...), p.scopes...), true)
+	}
+
+	if len(merged) == 1 {
+		return merged[0]
+	}
+	return EvalAny(merged...)
+}
+
+func hasKey(set map[string]struct{}, key string) bool {
+	_, ok := set[key]
+	return ok
+}
@@ -0,0 +1,188 @@
+package accesscontrol
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompile_SameResults(t *testing.T) {
+	evaluators := []Evaluator{
+		EvalPermission("reports:read"),
+		EvalPermission("reports:read", "reports:1", "reports:2", "reports:1"),
+		EvalPermission("datasources:query", "datasources:id:1"),
+		EvalPermission("datasources:query", "datasources:"),
+		EvalPermission("datasources:query", ""),
+		EvalPermission("datasources:query", "datasources:id:*"),
+		EvalPermission("datasources:query", "datasources:id:1?"),
+		EvalAll(),
+		EvalAny(),
+		EvalAll(EvalAll()),
+		EvalAll(EvalPermission("reports:read"), EvalAll()),
+		EvalAny(EvalAll(), EvalPermission("reports:read")),
+		EvalAll(
+			EvalPermission("datasources:query", "datasources:id:1"),
+			EvalAll(EvalPermission("datasources:query", "datasources:id:2"), EvalPermission("reports:read")),
+		),
+		EvalAny(
+			EvalPermission("datasources:query", "datasources:id:1"),
+			EvalAny(EvalPermission("datasources:query", "datasources:id:2"), EvalPermission("reports:read")),
+			EvalPermission("datasources:query", "datasources:id:1"),
+		),
+		EvalAny(
+			EvalPermission("datasources:query", "datasources:id:1", "datasources:id:2"),
+			EvalPermission("datasources:query"),
+			EvalAll(EvalPermission("reports:read", "reports:1"), EvalPermission("reports:write", "reports:1")),
+		),
+		EvalAll(
+			EvalAny(EvalPermission("datasources:query", "datasources:id:1"), EvalPermission("datasources:query", "datasources:id:2")),
+			EvalPermission("datasources:query", "datasources:id:3"),
+		),
+		EvalAnyAdaptive(EvalPermission("reports:read", "reports:1"), EvalPermission("datasources:query", "datasources:id:2")),
+		EvalWithInheritance(ScopeInheritance{"datasources:uid:child": {"datasources:uid:parent"}}, EvalAny(
+			EvalPermission("datasources:query", "datasources:uid:child"),
+			EvalPermission("datasources:query", "datasources:uid:other"),
+		)),
+	}
+
+	permissionSets := []map[string]map[string]struct{}{
+		nil,
+		{},
+		{"reports:read": {}},
+		{"reports:read": {"reports:1": {}}, "reports:write": {"reports:1": {}}},
+		{"reports:read": {"reports:1": {}, "reports:2": {}}},
+		{"datasources:query": {"datasources:id:1": {}}},
+		{"datasources:query": {"datasources:id:1": {}, "datasources:id:2": {}}},
+		{"datasources:query": {"datasources:id:3": {}, "datasources:id:2": {}}},
+		{"datasources:query": {"datasources:*": {}}},
+		{"datasources:query": {"datasources:id:*": {}}},
+		{"datasources:query": {"*": {}}, "reports:read": {"*": {}}},
+		{"datasources:query": {"": {}}},
+		{"datasources:query": {"datasources:id:1?": {}}},
+		{"datasources:query": {"datasources:i*": {}, "datasources:id:1*": {}}},
+		{"datasources:query": {"datasources:uid:parent": {}}},
+	}
+
+	for _, evaluator := range evaluators {
+		compiled := Compile(evaluator)
+		for _, permissions := range permissionSets {
+			expected, err := evaluator.Evaluate(permissions)
+			require.NoError(t, err)
+			actual, err := compiled.Evaluate(permissions)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, "evaluator %s compiled as %s with permissions %v", evaluator, compiled, permissions)
+		}
+	}
+}
+
+func TestCompile_Optimizes(t *testing.T) {
+	tests := []struct {
+		desc      string
+		evaluator Evaluator
+		expected  string
+	}{
+		{
+			desc:      "should deduplicate scopes",
+			evaluator: EvalPermission("reports:read", "reports:1", "reports:1"),
+			expected:  EvalPermission("reports:read", "reports:1").String(),
+		},
+		{
+			desc: "should merge required permissions on the same action",
+			evaluator: EvalAll(
+				EvalPermission("reports:read", "reports:1"),
+				EvalAll(EvalPermission("reports:write"), EvalPermission("reports:read", "reports:2")),
+			),
+			expected: EvalAll(EvalPermission("reports:read", "reports:1", "reports:2"), EvalPermission("reports:write")).String(),
+		},
+		{
+			desc: "should merge alternative permissions on the same action",
+			evaluator: EvalAny(
+				EvalPermission("reports:read", "reports:1"),
+				EvalAny(EvalPermission("reports:read", "reports:2"), EvalPermission("reports:read", "reports:1")),
+			),
+			expected: EvalAny(EvalPermission("reports:read", "reports:1"), EvalPermission("reports:read", "reports:2")).String(),
+		},
+		{
+			desc:      "should unwrap a single permission",
+			evaluator: EvalAny(EvalAll(EvalPermission("reports:read"))),
+			expected:  EvalPermission("reports:read").String(),
+		},
+		{
+			desc:      "should keep empty evaluators",
+			evaluator: EvalAll(EvalAll(), EvalPermission("reports:read")),
+			expected:  EvalAll(EvalAll(), EvalPermission("reports:read")).String(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, Compile(test.evaluator).String())
+		})
+	}
+}
+
+func TestCompile_Inject(t *testing.T) {
+	compiled := Compile(EvalAny(
+		EvalPermission("orgs:read", Scope("orgs", "id", Parameter(":orgId"))),
+		EvalPermission("orgs:read", Scope("orgs", "id", "1")),
+	))
+
+	injected, err := compiled.Inject(ScopeParams{URLParams: map[string]string{":orgId": "3"}})
+	require.NoError(t, err)
+
+	granted, err := injected.Evaluate(map[string]map[string]struct{}{"orgs:read": {"orgs:id:3": {}}})
+	require.NoError(t, err)
+	assert.True(t, granted)
+	granted, err = injected.Evaluate(map[string]map[string]struct{}{"orgs:read": {"orgs:id:2": {}}})
+	require.NoError(t, err)
+	assert.False(t, granted)
+}
+
+func TestCompile_ModifyScopesAndCanonicalString(t *testing.T) {
+	evaluator := EvalAny(EvalPermission("datasources:query", "datasources:name:a"), EvalPermission("datasources:query", "datasources:name:b"))
+
+	modified, err := ModifyScopes(context.Background(), Compile(evaluator), func(_ context.Context, scope string) (string, error) {
+		return scope + "-resolved", nil
+	})
+	require.NoError(t, err)
+	granted, err := modified.Evaluate(map[string]map[string]struct{}{"datasources:query": {"datasources:name:b-resolved": {}}})
+	require.NoError(t, err)
+	assert.True(t, granted)
+
+	expected, err := CanonicalString(evaluator)
+	require.NoError(t, err)
+	actual, err := CanonicalString(Compile(evaluator))
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func BenchmarkCompiledEvalAny_Skewed(b *testing.B) {
+	benchmarkAnyDatasources(b, func(evaluators ...Evaluator) Evaluator {
+		return Compile(EvalAny(evaluators...))
+	})
+}
+
+// benchmarkManyUserScopes evaluates a permission for users holding many scopes on its action
+func benchmarkManyUserScopes(b *testing.B, evaluator Evaluator) {
+	scopes := make(map[string]struct{})
+	for i := 0; i < 500; i++ {
+		scopes[Scope("datasources", "id", fmt.Sprint(i))] = struct{}{}
+	}
+	permissions := map[string]map[string]struct{}{"datasources:query": scopes}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = evaluator.Evaluate(permissions)
+	}
+}
+
+func BenchmarkEvalPermission_ManyUserScopes(b *testing.B) {
+	benchmarkManyUserScopes(b, EvalPermission("datasources:query", "datasources:id:1000"))
+}
+
+func BenchmarkCompiledEvalPermission_ManyUserScopes(b *testing.B) {
+	benchmarkManyUserScopes(b, Compile(EvalPermission("datasources:query", "datasources:id:1000")))
+}
@@ -2,9 +2,14 @@ package accesscontrol
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 )
@@ -16,6 +21,9 @@ type Evaluator interface {
 	Evaluate(permissions map[string]map[string]struct{}) (bool, error)
 	// Inject params into the evaluator's templated scopes. e.g. "settings:" + eval.Parameters(":id") and returns a new Evaluator
 	Inject(params ScopeParams) (Evaluator, error)
+	// MutateScopes returns a copy of the evaluator where every scope has been replaced by the result of modifier,
+	// e.g. to resolve attribute scopes before evaluating
+	MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error)
 	// String returns a string representation of permission required by the evaluator
 	String() string
 }
@@ -33,6 +41,10 @@ type permissionEvaluator struct {
 }
 
 func (p permissionEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if len(permissions) == 0 {
+		return false, nil
+	}
+
 	userScopes, ok := permissions[p.Action]
 	if !ok {
 		return false, nil
@@ -105,6 +117,21 @@ func (p permissionEvaluator) Inject(params ScopeParams) (Evaluator, error) {
 	return EvalPermission(p.Action, scopes...), nil
 }
 
+func (p permissionEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	if len(p.Scopes) == 0 {
+		return p, nil
+	}
+	scopes := make([]string, 0, len(p.Scopes))
+	for _, scope := range p.Scopes {
+		modified, err := modifier(ctx, scope)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, modified)
+	}
+	return EvalPermission(p.Action, scopes...), nil
+}
+
 func (p permissionEvaluator) String() string {
 	return fmt.Sprintf("action:%s scopes:%s", p.Action, strings.Join(p.Scopes, ", "))
 }
@@ -120,7 +147,23 @@ type allEvaluator struct {
 	allOf []Evaluator
 }
 
+// onlyPermissions tells whether all the evaluators are permissions, which deny access without permissions.
+// Other evaluators may grant access without permissions, e.g. an empty EvalAll, so they have to be evaluated.
+func onlyPermissions(evaluators []Evaluator) bool {
+	for _, e := range evaluators {
+		if _, ok := e.(permissionEvaluator); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (a allEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	// Without permissions, users are denied as soon as one permission is required
+	if len(permissions) == 0 && len(a.allOf) > 0 && onlyPermissions(a.allOf) {
+		return false, nil
+	}
+
 	for _, e := range a.allOf {
 		if ok, err := e.Evaluate(permissions); !ok || err != nil {
 			return false, err
@@ -141,6 +184,14 @@ func (a allEvaluator) Inject(params ScopeParams) (Evaluator, error) {
 	return EvalAll(injected...), nil
 }
 
+func (a allEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := mutateScopesList(ctx, a.allOf, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalAll(modified...), nil
+}
+
 func (a allEvaluator) String() string {
 	permissions := make([]string, 0, len(a.allOf))
 	for _, e := range a.allOf {
@@ -161,6 +212,10 @@ type anyEvaluator struct {
 }
 
 func (a anyEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if len(permissions) == 0 && onlyPermissions(a.anyOf) {
+		return false, nil
+	}
+
 	for _, e := range a.anyOf {
 		ok, err := e.Evaluate(permissions)
 		if err != nil {
@@ -185,6 +240,14 @@ func (a anyEvaluator) Inject(params ScopeParams) (Evaluator, error) {
 	return EvalAny(injected...), nil
 }
 
+func (a anyEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := mutateScopesList(ctx, a.anyOf, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalAny(modified...), nil
+}
+
 func (a anyEvaluator) String() string {
 	permissions := make([]string, 0, len(a.anyOf))
 	for _, e := range a.anyOf {
@@ -192,3 +255,552 @@ func (a anyEvaluator) String() string {
 	}
 	return fmt.Sprintf("any(%s)", strings.Join(permissions, " "))
 }
+
+var _ Evaluator = new(adaptiveAnyEvaluator)
+
+// adaptiveReorderInterval is the number of evaluations between two reorderings of an adaptive EvalAny
+const adaptiveReorderInterval = 64
+
+// EvalAnyAdaptive returns an evaluator that, like EvalAny, requires at least one of passed evaluators to evaluate to true.
+// It keeps track of which evaluators pass and periodically reorders them so the most frequently passing ones
+// are evaluated first. This speeds up long lists with skewed hit distributions, e.g. "any of N datasources",
+// when the evaluator is reused across requests. The outcome does not depend on the order.
+// Evaluators returned by Inject share the hit statistics of the evaluator they are injected from.
+func EvalAnyAdaptive(anyOf ...Evaluator) Evaluator {
+	return adaptiveAnyEvaluator{anyOf: anyOf, stats: newAdaptiveStats(len(anyOf))}
+}
+
+type adaptiveAnyEvaluator struct {
+	anyOf []Evaluator
+	stats *adaptiveStats
+}
+
+type adaptiveStats struct {
+	evaluations uint64
+	hits        []uint64
+	// order holds a []int of indexes into anyOf, it is replaced and never modified in place
+	order atomic.Value
+	mtx   sync.Mutex
+}
+
+func newAdaptiveStats(size int) *adaptiveStats {
+	order := make([]int, size)
+	for i := range order {
+		order[i] = i
+	}
+	stats := &adaptiveStats{hits: make([]uint64, size)}
+	stats.order.Store(order)
+	return stats
+}
+
+func (s *adaptiveStats) currentOrder() []int {
+	return s.order.Load().([]int)
+}
+
+func (s *adaptiveStats) hit(index int) {
+	atomic.AddUint64(&s.hits[index], 1)
+}
+
+// evaluated counts an evaluation and reorders the evaluators by decreasing number of hits every adaptiveReorderInterval evaluations
+func (s *adaptiveStats) evaluated() {
+	if atomic.AddUint64(&s.evaluations, 1)%adaptiveReorderInterval != 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hits := make([]uint64, len(s.hits))
+	for i := range s.hits {
+		hits[i] = atomic.LoadUint64(&s.hits[i])
+	}
+	order := append([]int(nil), s.currentOrder()...)
+	sort.SliceStable(order, func(i, j int) bool {
+		return hits[order[i]] > hits[order[j]]
+	})
+	s.order.Store(order)
+}
+
+func (a adaptiveAnyEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if len(permissions) == 0 && onlyPermissions(a.anyOf) {
+		return false, nil
+	}
+
+	defer a.stats.evaluated()
+
+	for _, i := range a.stats.currentOrder() {
+		ok, err := a.anyOf[i].Evaluate(permissions)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			a.stats.hit(i)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (a adaptiveAnyEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected := make([]Evaluator, 0, len(a.anyOf))
+	for _, e := range a.anyOf {
+		i, err := e.Inject(params)
+		if err != nil {
+			return nil, err
+		}
+		injected = append(injected, i)
+	}
+	return adaptiveAnyEvaluator{anyOf: injected, stats: a.stats}, nil
+}
+
+func (a adaptiveAnyEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := mutateScopesList(ctx, a.anyOf, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return adaptiveAnyEvaluator{anyOf: modified, stats: a.stats}, nil
+}
+
+func (a adaptiveAnyEvaluator) String() string {
+	return EvalAny(a.anyOf...).String()
+}
+
+// ScopeInheritance maps a parent scope to the child scopes it grants access to.
+// e.g. ScopeInheritance{"folders:id:1": {"dashboards:id:1", "dashboards:id:2"}}
+type ScopeInheritance map[string][]string
+
+// expand returns a copy of permissions where every user scope matching a parent scope
+// is complemented with the parent's child scopes, following grand-children as well
+func (i ScopeInheritance) expand(permissions map[string]map[string]struct{}) (map[string]map[string]struct{}, error) {
+	expanded := make(map[string]map[string]struct{}, len(permissions))
+	for action, scopes := range permissions {
+		userScopes := make(map[string]struct{}, len(scopes))
+		for scope := range scopes {
+			userScopes[scope] = struct{}{}
+		}
+
+		visited := make(map[string]struct{})
+		for {
+			added := false
+			for parent, children := range i {
+				if _, ok := visited[parent]; ok {
+					continue
+				}
+				for scope := range userScopes {
+					matches, err := match(scope, parent)
+					if err != nil {
+						return nil, err
+					}
+					if matches {
+						visited[parent] = struct{}{}
+						for _, child := range children {
+							userScopes[child] = struct{}{}
+						}
+						added = true
+						break
+					}
+				}
+			}
+			if !added {
+				break
+			}
+		}
+		expanded[action] = userScopes
+	}
+	return expanded, nil
+}
+
+var _ Evaluator = new(inheritanceEvaluator)
+
+// EvalWithInheritance returns an evaluator that grants the child scopes listed in inheritance to users
+// holding the parent scope before evaluating wrapped
+func EvalWithInheritance(inheritance ScopeInheritance, wrapped Evaluator) Evaluator {
+	return inheritanceEvaluator{inheritance: inheritance, wrapped: wrapped}
+}
+
+type inheritanceEvaluator struct {
+	inheritance ScopeInheritance
+	wrapped     Evaluator
+}
+
+func (i inheritanceEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if len(i.inheritance) == 0 || len(permissions) == 0 {
+		return i.wrapped.Evaluate(permissions)
+	}
+
+	expanded, err := i.inheritance.expand(permissions)
+	if err != nil {
+		return false, err
+	}
+	return i.wrapped.Evaluate(expanded)
+}
+
+func (i inheritanceEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := i.wrapped.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalWithInheritance(i.inheritance, injected), nil
+}
+
+func (i inheritanceEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := i.wrapped.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalWithInheritance(i.inheritance, modified), nil
+}
+
+func (i inheritanceEvaluator) String() string {
+	return fmt.Sprintf("inherit(%s)", i.wrapped.String())
+}
+
+var _ Evaluator = new(duringEvaluator)
+
+// EvalDuring returns an evaluator that evaluates inner between start, included, and end, excluded,
+// and evaluates to false outside of this window, e.g. for on-call access. A zero start or end leaves the window open on that side.
+func EvalDuring(start, end time.Time, inner Evaluator) Evaluator {
+	return EvalDuringWithClock(time.Now, start, end, inner)
+}
+
+// EvalDuringWithClock returns an evaluator like EvalDuring that reads the current time from clock
+func EvalDuringWithClock(clock func() time.Time, start, end time.Time, inner Evaluator) Evaluator {
+	return duringEvaluator{start: start, end: end, inner: inner, clock: clock}
+}
+
+type duringEvaluator struct {
+	start time.Time
+	end   time.Time
+	inner Evaluator
+	clock func() time.Time
+}
+
+// within tells whether t is within the window of the evaluator
+func (d duringEvaluator) within(t time.Time) bool {
+	if !d.start.IsZero() && t.Before(d.start) {
+		return false
+	}
+	if !d.end.IsZero() && !t.Before(d.end) {
+		return false
+	}
+	return true
+}
+
+func (d duringEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if !d.within(d.clock()) {
+		return false, nil
+	}
+	return d.inner.Evaluate(permissions)
+}
+
+func (d duringEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := d.inner.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalDuringWithClock(d.clock, d.start, d.end, injected), nil
+}
+
+func (d duringEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := d.inner.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalDuringWithClock(d.clock, d.start, d.end, modified), nil
+}
+
+func (d duringEvaluator) String() string {
+	return fmt.Sprintf("during(%s %s %s)", formatWindowBound(d.start), formatWindowBound(d.end), d.inner.String())
+}
+
+// formatWindowBound formats a bound of a time window, open bounds are formatted as "*"
+func formatWindowBound(t time.Time) string {
+	if t.IsZero() {
+		return "*"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// OwnershipLookupFunc tells whether the user being evaluated owns the resource identified by scope, e.g. "annotations:id:1"
+type OwnershipLookupFunc func(scope string) (bool, error)
+
+var _ Evaluator = new(ownershipEvaluator)
+
+// EvalOwnership returns an evaluator that, like EvalPermission, requires action in combination with scope to match,
+// and that also grants action to the owner of the resource identified by scope when its scope doesn't match.
+// Either way the user needs the action, isOwner is only called when scope doesn't match.
+func EvalOwnership(action, scope string, isOwner OwnershipLookupFunc) Evaluator {
+	return ownershipEvaluator{action: action, scope: scope, isOwner: isOwner}
+}
+
+type ownershipEvaluator struct {
+	action  string
+	scope   string
+	isOwner OwnershipLookupFunc
+}
+
+func (o ownershipEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if _, ok := permissions[o.action]; !ok {
+		return false, nil
+	}
+
+	ok, err := EvalPermission(o.action, o.scope).Evaluate(permissions)
+	if ok || err != nil {
+		return ok, err
+	}
+	return o.isOwner(o.scope)
+}
+
+func (o ownershipEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := EvalPermission(o.action, o.scope).Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalOwnership(o.action, injected.(permissionEvaluator).Scopes[0], o.isOwner), nil
+}
+
+func (o ownershipEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := modifier(ctx, o.scope)
+	if err != nil {
+		return nil, err
+	}
+	return EvalOwnership(o.action, modified, o.isOwner), nil
+}
+
+func (o ownershipEvaluator) String() string {
+	return fmt.Sprintf("owner(action:%s scope:%s)", o.action, o.scope)
+}
+
+// EvalOwnAll returns an evaluator requiring action on every resource identified by scopes, as EvalOwnership does
+// for a single one, e.g. for bulk operations. Owning or matching only some of the resources is denied.
+// Without scopes, it only requires the action.
+func EvalOwnAll(action string, isOwner OwnershipLookupFunc, scopes ...string) Evaluator {
+	if len(scopes) == 0 {
+		return EvalPermission(action)
+	}
+
+	allOf := make([]Evaluator, 0, len(scopes))
+	for _, scope := range scopes {
+		allOf = append(allOf, EvalOwnership(action, scope, isOwner))
+	}
+	return EvalAll(allOf...)
+}
+
+// EvalScopeHierarchy returns an evaluator granting action when it matches either childScope or parentScope,
+// e.g. a dashboard and its folder. It is an EvalAny of both permissions, so it can be injected and have its scopes
+// modified like any other.
+func EvalScopeHierarchy(action, childScope, parentScope string) Evaluator {
+	return EvalAny(EvalPermission(action, childScope), EvalPermission(action, parentScope))
+}
+
+// FeatureChecker tells whether a feature flag is enabled, e.g. setting.Provider's IsFeatureToggleEnabled
+type FeatureChecker func(flag string) bool
+
+var _ Evaluator = new(featureEvaluator)
+
+// EvalFeature returns an evaluator that evaluates inner when isEnabled reports the feature flag as enabled,
+// and evaluates to false otherwise, e.g. for endpoints behind a feature toggle
+func EvalFeature(flag string, inner Evaluator, isEnabled FeatureChecker) Evaluator {
+	return featureEvaluator{flag: flag, inner: inner, isEnabled: isEnabled}
+}
+
+type featureEvaluator struct {
+	flag      string
+	inner     Evaluator
+	isEnabled FeatureChecker
+}
+
+func (f featureEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if !f.isEnabled(f.flag) {
+		return false, nil
+	}
+	return f.inner.Evaluate(permissions)
+}
+
+func (f featureEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := f.inner.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalFeature(f.flag, injected, f.isEnabled), nil
+}
+
+func (f featureEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := f.inner.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalFeature(f.flag, modified, f.isEnabled), nil
+}
+
+func (f featureEvaluator) String() string {
+	return fmt.Sprintf("feature(%s %s)", f.flag, f.inner.String())
+}
+
+var _ Evaluator = new(notInEvaluator)
+
+// EvalNotIn returns an evaluator that evaluates to false when any scope inner refers to is blacklisted, whatever
+// the permissions grant, and delegates to inner otherwise, e.g. to guard scopes no role may access.
+// Blacklisted scopes may end with a wildcard, e.g. "users:id:1" and "teams:*", and a scope inner refers to with
+// a wildcard covering a blacklisted scope, e.g. "users:*", is blacklisted as well.
+// Like RequiredPermissions, every alternative of EvalAny is considered, so a blacklisted alternative denies access
+// even if another alternative would be enough. Evaluating fails when inner wraps an evaluator whose scopes are unknown.
+func EvalNotIn(blacklist []string, inner Evaluator) Evaluator {
+	return notInEvaluator{blacklist: blacklist, inner: inner}
+}
+
+type notInEvaluator struct {
+	blacklist []string
+	inner     Evaluator
+}
+
+// blacklisted tells whether inner refers to a blacklisted scope
+func (n notInEvaluator) blacklisted() (bool, error) {
+	scopes, err := referredScopes(n.inner)
+	if err != nil {
+		return false, err
+	}
+	for _, scope := range scopes {
+		for _, blacklisted := range n.blacklist {
+			covered, err := match(blacklisted, scope)
+			if err != nil || covered {
+				return covered, err
+			}
+			if covered, err = match(scope, blacklisted); err != nil || covered {
+				return covered, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// referredScopes returns every scope the evaluator refers to. Unlike RequiredPermissions, it fails on evaluators it
+// can't look into, so that a blacklist can't be bypassed by wrapping the blacklisted scopes.
+func referredScopes(evaluator Evaluator) ([]string, error) {
+	switch e := evaluator.(type) {
+	case permissionEvaluator:
+		return e.Scopes, nil
+	case allEvaluator:
+		return referredScopesList(e.allOf)
+	case anyEvaluator:
+		return referredScopesList(e.anyOf)
+	case adaptiveAnyEvaluator:
+		return referredScopesList(e.anyOf)
+	case xorEvaluator:
+		return referredScopesList([]Evaluator{e.a, e.b})
+	case inheritanceEvaluator:
+		return referredScopes(e.wrapped)
+	case duringEvaluator:
+		return referredScopes(e.inner)
+	case featureEvaluator:
+		return referredScopes(e.inner)
+	case notInEvaluator:
+		return referredScopes(e.inner)
+	case cachingEvaluator:
+		return referredScopes(e.inner)
+	case compiledPermissionEvaluator:
+		return referredScopes(e.source())
+	case ownershipEvaluator:
+		return []string{e.scope}, nil
+	default:
+		return nil, fmt.Errorf("cannot look up the scopes of evaluator %T", evaluator)
+	}
+}
+
+func referredScopesList(evaluators []Evaluator) ([]string, error) {
+	var scopes []string
+	for _, e := range evaluators {
+		s, err := referredScopes(e)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, s...)
+	}
+	return scopes, nil
+}
+
+func (n notInEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	blacklisted, err := n.blacklisted()
+	if blacklisted || err != nil {
+		return false, err
+	}
+	return n.inner.Evaluate(permissions)
+}
+
+func (n notInEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := n.inner.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalNotIn(n.blacklist, injected), nil
+}
+
+func (n notInEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	// blacklisted scopes are modified as well, so they keep matching the modified scopes of inner
+	blacklist := make([]string, 0, len(n.blacklist))
+	for _, scope := range n.blacklist {
+		modified, err := modifier(ctx, scope)
+		if err != nil {
+			return nil, err
+		}
+		blacklist = append(blacklist, modified)
+	}
+	modified, err := n.inner.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalNotIn(blacklist, modified), nil
+}
+
+func (n notInEvaluator) String() string {
+	return fmt.Sprintf("notIn(%s %s)", strings.Join(n.blacklist, " "), n.inner.String())
+}
+
+var _ Evaluator = new(xorEvaluator)
+
+// EvalXor returns an evaluator that requires exactly one of a and b to evaluate to true, e.g. for toggle-style
+// policies where either of two mutually exclusive conditions applies. Both evaluators are always evaluated.
+func EvalXor(a, b Evaluator) Evaluator {
+	return xorEvaluator{a: a, b: b}
+}
+
+type xorEvaluator struct {
+	a Evaluator
+	b Evaluator
+}
+
+func (x xorEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	a, err := x.a.Evaluate(permissions)
+	if err != nil {
+		return false, err
+	}
+	b, err := x.b.Evaluate(permissions)
+	if err != nil {
+		return false, err
+	}
+	return a != b, nil
+}
+
+func (x xorEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	a, err := x.a.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x.b.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return EvalXor(a, b), nil
+}
+
+func (x xorEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := mutateScopesList(ctx, []Evaluator{x.a, x.b}, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return EvalXor(modified[0], modified[1]), nil
+}
+
+func (x xorEvaluator) String() string {
+	return fmt.Sprintf("xor(%s %s)", x.a.String(), x.b.String())
+}
@@ -0,0 +1,185 @@
+package accesscontrol
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cachingEvaluatorMaxEntries bounds the number of permission sets the results are cached for by a caching evaluator
+const cachingEvaluatorMaxEntries = 1024
+
+var _ Evaluator = new(cachingEvaluator)
+
+// CachingEvaluator returns an evaluator caching the results of inner for ttl, keyed by a fingerprint of the evaluated
+// permissions and by inner itself. Repeated checks of the same user, or of users with the same permissions, within ttl
+// are answered from the cache, while a change of permissions changes the fingerprint and thus evaluates inner again.
+// Errors aren't cached. Only wrap evaluators whose outcome depends on the permissions alone, not e.g. EvalDuring.
+// The evaluators returned by Inject and MutateScopes share the cache, e.g. across requests, each evaluator being
+// identified by its canonical representation, or by its type and String when it has none.
+func CachingEvaluator(ttl time.Duration, inner Evaluator) Evaluator {
+	return CachingEvaluatorWithClock(time.Now, ttl, inner)
+}
+
+// CachingEvaluatorWithClock returns an evaluator like CachingEvaluator that reads the current time from clock
+func CachingEvaluatorWithClock(clock func() time.Time, ttl time.Duration, inner Evaluator) Evaluator {
+	return newCachingEvaluator(newEvaluationCache(clock, ttl), inner)
+}
+
+func newCachingEvaluator(cache *evaluationCache, inner Evaluator) cachingEvaluator {
+	identity, err := CanonicalString(inner)
+	if err != nil {
+		identity = fmt.Sprintf("%T:%s", inner, inner.String())
+	}
+	return cachingEvaluator{inner: inner, identity: identity, cache: cache}
+}
+
+type cachingEvaluator struct {
+	inner Evaluator
+	// identity tells inner apart from the other evaluators sharing the cache
+	identity string
+	cache    *evaluationCache
+}
+
+type evaluationCache struct {
+	clock   func() time.Time
+	ttl     time.Duration
+	mtx     sync.Mutex
+	entries map[[sha256.Size]byte]cachedEvaluation
+}
+
+type cachedEvaluation struct {
+	result  bool
+	expires time.Time
+}
+
+func newEvaluationCache(clock func() time.Time, ttl time.Duration) *evaluationCache {
+	return &evaluationCache{clock: clock, ttl: ttl, entries: make(map[[sha256.Size]byte]cachedEvaluation)}
+}
+
+func (c *evaluationCache) get(key [sha256.Size]byte) (bool, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	if !c.clock().Before(entry.expires) {
+		delete(c.entries, key)
+		return false, false
+	}
+	return entry.result, true
+}
+
+// set caches result, dropping the expired entries first when the cache is full, and all of them if none has expired
+func (c *evaluationCache) set(key [sha256.Size]byte, result bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.clock()
+	if len(c.entries) >= cachingEvaluatorMaxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= cachingEvaluatorMaxEntries {
+			c.entries = make(map[[sha256.Size]byte]cachedEvaluation)
+		}
+	}
+	c.entries[key] = cachedEvaluation{result: result, expires: now.Add(c.ttl)}
+}
+
+// fingerprintPermissions hashes permissions independently of the iteration order of the maps
+func fingerprintPermissions(permissions map[string]map[string]struct{}) [sha256.Size]byte {
+	actions := make([]string, 0, len(permissions))
+	for action := range permissions {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	h := sha256.New()
+	for _, action := range actions {
+		scopes := make([]string, 0, len(permissions[action]))
+		for scope := range permissions[action] {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+
+		// values are prefixed with their length and actions followed by their number of scopes,
+		// so that different permissions can't produce the same stream
+		writeFingerprintValue(h, action)
+		writeFingerprintLength(h, len(scopes))
+		for _, scope := range scopes {
+			writeFingerprintValue(h, scope)
+		}
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// evaluationKey identifies the evaluation of the evaluator with the given identity against permissions
+func evaluationKey(identity string, permissions map[string]map[string]struct{}) [sha256.Size]byte {
+	fingerprint := fingerprintPermissions(permissions)
+
+	h := sha256.New()
+	writeFingerprintValue(h, identity)
+	_, _ = h.Write(fingerprint[:])
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func writeFingerprintValue(h hash.Hash, value string) {
+	writeFingerprintLength(h, len(value))
+	_, _ = h.Write([]byte(value))
+}
+
+func writeFingerprintLength(h hash.Hash, length int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(length))
+	_, _ = h.Write(b[:])
+}
+
+func (c cachingEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	key := evaluationKey(c.identity, permissions)
+	if result, ok := c.cache.get(key); ok {
+		return result, nil
+	}
+
+	result, err := c.inner.Evaluate(permissions)
+	if err != nil {
+		return false, err
+	}
+	c.cache.set(key, result)
+	return result, nil
+}
+
+func (c cachingEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := c.inner.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return newCachingEvaluator(c.cache, injected), nil
+}
+
+func (c cachingEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := c.inner.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return newCachingEvaluator(c.cache, modified), nil
+}
+
+func (c cachingEvaluator) String() string {
+	return c.inner.String()
+}
@@ -0,0 +1,183 @@
+package accesscontrol
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingEvaluator counts the evaluations of the wrapped evaluator
+type countingEvaluator struct {
+	Evaluator
+	count *int
+	err   error
+}
+
+func (c countingEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	*c.count++
+	if c.err != nil {
+		return false, c.err
+	}
+	return c.Evaluator.Evaluate(permissions)
+}
+
+func (c countingEvaluator) Inject(params ScopeParams) (Evaluator, error) {
+	injected, err := c.Evaluator.Inject(params)
+	if err != nil {
+		return nil, err
+	}
+	return countingEvaluator{Evaluator: injected, count: c.count, err: c.err}, nil
+}
+
+func (c countingEvaluator) MutateScopes(ctx context.Context, modifier ScopeModifier) (Evaluator, error) {
+	modified, err := c.Evaluator.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+	return countingEvaluator{Evaluator: modified, count: c.count, err: c.err}, nil
+}
+
+func TestCachingEvaluator(t *testing.T) {
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	withAccess := map[string]map[string]struct{}{
+		"reports:read": {"reports:*": struct{}{}},
+	}
+	withoutAccess := map[string]map[string]struct{}{
+		"reports:read": {"reports:2": struct{}{}},
+	}
+
+	setup := func() (Evaluator, *int) {
+		count := 0
+		inner := countingEvaluator{Evaluator: EvalPermission("reports:read", "reports:1"), count: &count}
+		return CachingEvaluatorWithClock(clock, time.Minute, inner), &count
+	}
+
+	t.Run("should answer repeated evaluations from the cache", func(t *testing.T) {
+		evaluator, count := setup()
+		for i := 0; i < 3; i++ {
+			ok, err := evaluator.Evaluate(withAccess)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		}
+		assert.Equal(t, 1, *count)
+	})
+
+	t.Run("should hit the cache for equal permissions", func(t *testing.T) {
+		evaluator, count := setup()
+		_, err := evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+
+		ok, err := evaluator.Evaluate(map[string]map[string]struct{}{
+			"reports:read": {"reports:*": struct{}{}},
+		})
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, *count)
+	})
+
+	t.Run("should evaluate again after the ttl", func(t *testing.T) {
+		evaluator, count := setup()
+		_, err := evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+
+		now = now.Add(59 * time.Second)
+		_, err = evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+		assert.Equal(t, 1, *count)
+
+		now = now.Add(time.Second)
+		ok, err := evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 2, *count)
+	})
+
+	t.Run("should evaluate again when the permissions change", func(t *testing.T) {
+		evaluator, count := setup()
+		ok, err := evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = evaluator.Evaluate(withoutAccess)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Equal(t, 2, *count)
+
+		ok, err = evaluator.Evaluate(withAccess)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 2, *count)
+	})
+
+	t.Run("should not cache errors", func(t *testing.T) {
+		count := 0
+		inner := countingEvaluator{Evaluator: EvalPermission("reports:read", "reports:1"), count: &count, err: errors.New("failed")}
+		evaluator := CachingEvaluatorWithClock(clock, time.Minute, inner)
+
+		for i := 0; i < 2; i++ {
+			_, err := evaluator.Evaluate(withAccess)
+			require.Error(t, err)
+		}
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("should cache injected evaluators separately", func(t *testing.T) {
+		evaluator := CachingEvaluatorWithClock(clock, time.Minute, EvalPermission("reports:read", Scope("reports", Parameter(":reportId"))))
+		injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":reportId": "1"}})
+		require.NoError(t, err)
+
+		ok, err := injected.Evaluate(withoutAccess)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		other, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":reportId": "2"}})
+		require.NoError(t, err)
+		ok, err = other.Evaluate(withoutAccess)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, EvalPermission("reports:read", "reports:2").String(), other.String())
+	})
+
+	t.Run("should share the cache with the injected and modified evaluators", func(t *testing.T) {
+		count := 0
+		inner := countingEvaluator{Evaluator: EvalPermission("reports:read", Scope("reports", Parameter(":reportId"))), count: &count}
+		evaluator := CachingEvaluatorWithClock(clock, time.Minute, inner)
+		params := ScopeParams{URLParams: map[string]string{":reportId": "1"}}
+		modifier := func(_ context.Context, scope string) (string, error) { return scope, nil }
+
+		// as on every request, the evaluator is injected then has its scopes modified before being evaluated
+		for i := 0; i < 3; i++ {
+			injected, err := evaluator.Inject(params)
+			require.NoError(t, err)
+			modified, err := injected.MutateScopes(context.Background(), modifier)
+			require.NoError(t, err)
+
+			ok, err := modified.Evaluate(withAccess)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		}
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestFingerprintPermissions(t *testing.T) {
+	fingerprints := map[[sha256.Size]byte]string{}
+	for desc, permissions := range map[string]map[string]map[string]struct{}{
+		"none":                  {},
+		"action without scopes": {"a": {}},
+		"scope of action":       {"a": {"b": struct{}{}}},
+		"actions":               {"a": {}, "b": {}},
+		"concatenated scope":    {"a": {"bc": struct{}{}}},
+		"split scopes":          {"a": {"b": struct{}{}, "c": struct{}{}}},
+	} {
+		fingerprint := fingerprintPermissions(permissions)
+		assert.NotContains(t, fingerprints, fingerprint, "%s collides with %s", desc, fingerprints[fingerprint])
+		fingerprints[fingerprint] = desc
+	}
+}
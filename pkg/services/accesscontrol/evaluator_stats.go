@@ -0,0 +1,101 @@
+package accesscontrol
+
+// EvaluationStats reports how much of an evaluator tree was visited during an evaluation
+type EvaluationStats struct {
+	// Visited is the number of evaluators that have been evaluated, combinations included
+	Visited int
+	// Skipped is the number of evaluators that have not been evaluated because an EvalAll or EvalAny short-circuited
+	Skipped int
+	// ShortCircuits is the number of EvalAll or EvalAny that stopped before evaluating all their evaluators
+	ShortCircuits int
+}
+
+// EvaluateWithStats evaluates permissions like evaluator.Evaluate does, and reports visit counts.
+// It is meant to help ordering cheap checks first when tuning role definitions, prefer Evaluate otherwise.
+func EvaluateWithStats(evaluator Evaluator, permissions map[string]map[string]struct{}) (bool, EvaluationStats, error) {
+	stats := EvaluationStats{}
+	ok, err := evaluateWithStats(evaluator, permissions, &stats)
+	return ok, stats, err
+}
+
+func evaluateWithStats(evaluator Evaluator, permissions map[string]map[string]struct{}, stats *EvaluationStats) (bool, error) {
+	stats.Visited++
+
+	switch e := evaluator.(type) {
+	case allEvaluator:
+		for i, sub := range e.allOf {
+			if ok, err := evaluateWithStats(sub, permissions, stats); !ok || err != nil {
+				stats.shortCircuit(len(e.allOf) - i - 1)
+				return false, err
+			}
+		}
+		return true, nil
+	case anyEvaluator:
+		for i, sub := range e.anyOf {
+			ok, err := evaluateWithStats(sub, permissions, stats)
+			if err != nil {
+				stats.shortCircuit(len(e.anyOf) - i - 1)
+				return false, err
+			}
+			if ok {
+				stats.shortCircuit(len(e.anyOf) - i - 1)
+				return true, nil
+			}
+		}
+		return false, nil
+	case adaptiveAnyEvaluator:
+		order := e.stats.currentOrder()
+		for i, index := range order {
+			ok, err := evaluateWithStats(e.anyOf[index], permissions, stats)
+			if err != nil {
+				stats.shortCircuit(len(order) - i - 1)
+				return false, err
+			}
+			if ok {
+				stats.shortCircuit(len(order) - i - 1)
+				return true, nil
+			}
+		}
+		return false, nil
+	case inheritanceEvaluator:
+		expanded, err := e.inheritance.expand(permissions)
+		if err != nil {
+			return false, err
+		}
+		return evaluateWithStats(e.wrapped, expanded, stats)
+	case duringEvaluator:
+		if !e.within(e.clock()) {
+			return false, nil
+		}
+		return evaluateWithStats(e.inner, permissions, stats)
+	case featureEvaluator:
+		if !e.isEnabled(e.flag) {
+			return false, nil
+		}
+		return evaluateWithStats(e.inner, permissions, stats)
+	case notInEvaluator:
+		if blacklisted, err := e.blacklisted(); blacklisted || err != nil {
+			return false, err
+		}
+		return evaluateWithStats(e.inner, permissions, stats)
+	case xorEvaluator:
+		a, err := evaluateWithStats(e.a, permissions, stats)
+		if err != nil {
+			return false, err
+		}
+		b, err := evaluateWithStats(e.b, permissions, stats)
+		if err != nil {
+			return false, err
+		}
+		return a != b, nil
+	default:
+		return evaluator.Evaluate(permissions)
+	}
+}
+
+func (s *EvaluationStats) shortCircuit(skipped int) {
+	if skipped > 0 {
+		s.Skipped += skipped
+		s.ShortCircuits++
+	}
+}
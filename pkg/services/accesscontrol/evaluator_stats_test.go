@@ -0,0 +1,94 @@
+package accesscontrol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateWithStats(t *testing.T) {
+	permissions := map[string]map[string]struct{}{
+		"settings:write": {"settings:*": struct{}{}},
+	}
+
+	tests := []struct {
+		desc      string
+		evaluator Evaluator
+		expected  bool
+		stats     EvaluationStats
+	}{
+		{
+			desc:      "should visit a single permission",
+			evaluator: EvalPermission("settings:write", "settings:auth.saml:enabled"),
+			expected:  true,
+			stats:     EvaluationStats{Visited: 1},
+		},
+		{
+			desc: "should short-circuit any on first match",
+			evaluator: EvalAny(
+				EvalPermission("settings:write", "settings:auth.saml:enabled"),
+				EvalPermission("reports:read", "reports:1"),
+				EvalPermission("reports:write", "reports:1"),
+			),
+			expected: true,
+			stats:    EvaluationStats{Visited: 2, Skipped: 2, ShortCircuits: 1},
+		},
+		{
+			desc: "should not short-circuit any on last match",
+			evaluator: EvalAny(
+				EvalPermission("reports:read", "reports:1"),
+				EvalPermission("reports:write", "reports:1"),
+				EvalPermission("settings:write", "settings:auth.saml:enabled"),
+			),
+			expected: true,
+			stats:    EvaluationStats{Visited: 4},
+		},
+		{
+			desc: "should short-circuit all on first mismatch",
+			evaluator: EvalAll(
+				EvalPermission("reports:read", "reports:1"),
+				EvalPermission("settings:write", "settings:auth.saml:enabled"),
+				EvalPermission("settings:write", "settings:auth.saml:max_issue_delay"),
+			),
+			expected: false,
+			stats:    EvaluationStats{Visited: 2, Skipped: 2, ShortCircuits: 1},
+		},
+		{
+			desc: "should not short-circuit all on last mismatch",
+			evaluator: EvalAll(
+				EvalPermission("settings:write", "settings:auth.saml:enabled"),
+				EvalPermission("settings:write", "settings:auth.saml:max_issue_delay"),
+				EvalPermission("reports:read", "reports:1"),
+			),
+			expected: false,
+			stats:    EvaluationStats{Visited: 4},
+		},
+		{
+			desc: "should count nested evaluators",
+			evaluator: EvalAny(
+				EvalAll(
+					EvalPermission("reports:read", "reports:1"),
+					EvalPermission("settings:write", "settings:auth.saml:enabled"),
+				),
+				EvalPermission("settings:write", "settings:auth.saml:enabled"),
+				EvalPermission("reports:write", "reports:1"),
+			),
+			expected: true,
+			stats:    EvaluationStats{Visited: 4, Skipped: 2, ShortCircuits: 2},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, stats, err := EvaluateWithStats(test.evaluator, permissions)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+			assert.Equal(t, test.stats, stats)
+
+			expected, err := test.evaluator.Evaluate(permissions)
+			require.NoError(t, err)
+			assert.Equal(t, expected, ok, "should evaluate like Evaluate")
+		})
+	}
+}
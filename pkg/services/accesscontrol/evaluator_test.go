@@ -1,7 +1,10 @@
 package accesscontrol
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -317,6 +320,57 @@ func TestAny_Evaluate(t *testing.T) {
 	}
 }
 
+func TestAnyAdaptive_Evaluate(t *testing.T) {
+	var datasources []Evaluator
+	for i := 0; i < 10; i++ {
+		datasources = append(datasources, EvalPermission("datasources:query", Scope("datasources", "id", fmt.Sprint(i))))
+	}
+	permissionsFor := func(ids ...int) map[string]map[string]struct{} {
+		scopes := map[string]struct{}{}
+		for _, id := range ids {
+			scopes[Scope("datasources", "id", fmt.Sprint(id))] = struct{}{}
+		}
+		return map[string]map[string]struct{}{"datasources:query": scopes}
+	}
+
+	adaptive := EvalAnyAdaptive(datasources...)
+	reference := EvalAny(datasources...)
+
+	t.Run("should evaluate like EvalAny whatever the order", func(t *testing.T) {
+		for i := 0; i < 5*adaptiveReorderInterval; i++ {
+			permissions := permissionsFor(9)
+			if i%7 == 0 {
+				permissions = permissionsFor(3, 5)
+			} else if i%11 == 0 {
+				permissions = permissionsFor(42)
+			}
+
+			expected, err := reference.Evaluate(permissions)
+			assert.NoError(t, err)
+			ok, err := adaptive.Evaluate(permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, ok)
+		}
+	})
+
+	t.Run("should evaluate the most frequently passing evaluator first", func(t *testing.T) {
+		order := adaptive.(adaptiveAnyEvaluator).stats.currentOrder()
+		assert.Equal(t, 9, order[0])
+		assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order)
+
+		_, stats, err := EvaluateWithStats(adaptive, permissionsFor(9))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, stats.Visited)
+	})
+
+	t.Run("should share statistics with injected evaluators", func(t *testing.T) {
+		injected, err := adaptive.Inject(ScopeParams{})
+		assert.NoError(t, err)
+		assert.Equal(t, adaptive.(adaptiveAnyEvaluator).stats, injected.(adaptiveAnyEvaluator).stats)
+		assert.Equal(t, reference.String(), injected.String())
+	})
+}
+
 func TestAny_Inject(t *testing.T) {
 	tests := []injectTestCase{
 		{
@@ -458,3 +512,727 @@ func TestEval(t *testing.T) {
 		})
 	}
 }
+
+func TestInheritance_Evaluate(t *testing.T) {
+	inheritance := ScopeInheritance{
+		"folders:id:1": {"dashboards:id:1", "dashboards:id:2", "folders:id:2"},
+		"folders:id:2": {"dashboards:id:3"},
+	}
+
+	tests := []evaluateTestCase{
+		{
+			desc:      "should grant dashboard inside of folder",
+			expected:  true,
+			evaluator: EvalWithInheritance(inheritance, EvalPermission("dashboards:read", "dashboards:id:1")),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read": {"folders:id:1": struct{}{}},
+			},
+		},
+		{
+			desc:      "should grant dashboard inside of nested folder",
+			expected:  true,
+			evaluator: EvalWithInheritance(inheritance, EvalPermission("dashboards:read", "dashboards:id:3")),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read": {"folders:id:1": struct{}{}},
+			},
+		},
+		{
+			desc:      "should grant dashboards inside of folders matched by wildcard",
+			expected:  true,
+			evaluator: EvalWithInheritance(inheritance, EvalPermission("dashboards:read", "dashboards:id:1", "dashboards:id:3")),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read": {"folders:*": struct{}{}},
+			},
+		},
+		{
+			desc:      "should not grant dashboard from parent folder",
+			expected:  false,
+			evaluator: EvalWithInheritance(inheritance, EvalPermission("dashboards:read", "dashboards:id:1")),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read": {"folders:id:2": struct{}{}},
+			},
+		},
+		{
+			desc:      "should not grant inherited scopes to other actions",
+			expected:  false,
+			evaluator: EvalWithInheritance(inheritance, EvalPermission("dashboards:write", "dashboards:id:1")),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read":  {"folders:id:1": struct{}{}},
+				"dashboards:write": {"dashboards:id:2": struct{}{}},
+			},
+		},
+		{
+			desc:      "should not inherit without inheritance evaluator",
+			expected:  false,
+			evaluator: EvalPermission("dashboards:read", "dashboards:id:1"),
+			permissions: map[string]map[string]struct{}{
+				"dashboards:read": {"folders:id:1": struct{}{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestInheritance_Inject(t *testing.T) {
+	evaluator := EvalWithInheritance(
+		ScopeInheritance{"folders:id:1": {"dashboards:id:1"}},
+		EvalPermission("dashboards:read", Scope("dashboards", "id", Parameter(":id"))),
+	)
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":id": "1"}})
+	assert.NoError(t, err)
+
+	ok, err := injected.Evaluate(map[string]map[string]struct{}{
+		"dashboards:read": {"folders:id:1": struct{}{}},
+	})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestDuring_Evaluate(t *testing.T) {
+	start := time.Date(2021, 11, 1, 8, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 11, 1, 18, 0, 0, 0, time.UTC)
+	clock := func(t time.Time) func() time.Time {
+		return func() time.Time { return t }
+	}
+	permissions := map[string]map[string]struct{}{
+		"datasources:query": {"datasources:id:1": struct{}{}},
+	}
+	inner := EvalPermission("datasources:query", "datasources:id:1")
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should evaluate inner evaluator within the window",
+			expected:    true,
+			evaluator:   EvalDuringWithClock(clock(start.Add(time.Hour)), start, end, inner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should include the start of the window",
+			expected:    true,
+			evaluator:   EvalDuringWithClock(clock(start), start, end, inner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false before the window",
+			expected:    false,
+			evaluator:   EvalDuringWithClock(clock(start.Add(-time.Second)), start, end, inner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should exclude the end of the window",
+			expected:    false,
+			evaluator:   EvalDuringWithClock(clock(end), start, end, inner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false within the window without permissions",
+			expected:    false,
+			evaluator:   EvalDuringWithClock(clock(start.Add(time.Hour)), start, end, EvalPermission("datasources:query", "datasources:id:2")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should leave the window open without start",
+			expected:    true,
+			evaluator:   EvalDuringWithClock(clock(start.Add(-24*time.Hour)), time.Time{}, end, inner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should leave the window open without end",
+			expected:    true,
+			evaluator:   EvalDuringWithClock(clock(end.Add(24*time.Hour)), start, time.Time{}, inner),
+			permissions: permissions,
+		},
+		{
+			desc:     "should compose with other evaluators",
+			expected: true,
+			evaluator: EvalAny(
+				EvalDuringWithClock(clock(end), start, end, inner),
+				EvalAll(EvalDuringWithClock(clock(start), start, end, inner)),
+			),
+			permissions: permissions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestDuring_Inject(t *testing.T) {
+	start := time.Date(2021, 11, 1, 8, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 11, 1, 18, 0, 0, 0, time.UTC)
+	evaluator := EvalDuringWithClock(
+		func() time.Time { return end },
+		start, end,
+		EvalPermission("datasources:query", Scope("datasources", "id", Parameter(":id"))),
+	)
+
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":id": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "during(2021-11-01T08:00:00Z 2021-11-01T18:00:00Z action:datasources:query scopes:datasources:id:1)", injected.String())
+
+	// the injected evaluator keeps the clock, which is outside of the window
+	ok, err := injected.Evaluate(map[string]map[string]struct{}{
+		"datasources:query": {"datasources:id:1": struct{}{}},
+	})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDuring_String(t *testing.T) {
+	start := time.Date(2021, 11, 1, 8, 0, 0, 0, time.UTC)
+	evaluator := EvalAll(EvalDuring(start, time.Time{}, EvalPermission("users:read", "users:*")))
+	assert.Equal(t, "all(during(2021-11-01T08:00:00Z * action:users:read scopes:users:*))", evaluator.String())
+}
+
+func TestOwnership_Evaluate(t *testing.T) {
+	// the user owns the annotation 1
+	isOwner := func(scope string) (bool, error) {
+		return scope == "annotations:id:1", nil
+	}
+	permissions := map[string]map[string]struct{}{
+		"annotations:write": {"annotations:type:organization": struct{}{}},
+	}
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should grant an owned resource without matching scope",
+			expected:    true,
+			evaluator:   EvalOwnership("annotations:write", "annotations:id:1", isOwner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should deny a resource owned by someone else",
+			expected:    false,
+			evaluator:   EvalOwnership("annotations:write", "annotations:id:2", isOwner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should grant a resource owned by someone else with matching scope",
+			expected:    true,
+			evaluator:   EvalOwnership("annotations:write", "annotations:id:2", isOwner),
+			permissions: map[string]map[string]struct{}{"annotations:write": {"annotations:*": struct{}{}}},
+		},
+		{
+			desc:        "should deny an owned resource without the action",
+			expected:    false,
+			evaluator:   EvalOwnership("annotations:delete", "annotations:id:1", isOwner),
+			permissions: permissions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+
+	t.Run("should not look the owner up when scope matches", func(t *testing.T) {
+		evaluator := EvalOwnership("annotations:write", "annotations:id:2", func(scope string) (bool, error) {
+			t.Fatal("unexpected ownership lookup")
+			return false, nil
+		})
+		ok, err := evaluator.Evaluate(map[string]map[string]struct{}{"annotations:write": {"annotations:id:2": struct{}{}}})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("should return the lookup error", func(t *testing.T) {
+		lookupErr := errors.New("lookup failed")
+		evaluator := EvalOwnership("annotations:write", "annotations:id:1", func(scope string) (bool, error) {
+			return false, lookupErr
+		})
+		ok, err := evaluator.Evaluate(permissions)
+		assert.ErrorIs(t, err, lookupErr)
+		assert.False(t, ok)
+	})
+}
+
+func TestOwnAll_Evaluate(t *testing.T) {
+	// the user owns the annotations 1 and 2
+	isOwner := func(scope string) (bool, error) {
+		return scope == "annotations:id:1" || scope == "annotations:id:2", nil
+	}
+	permissions := map[string]map[string]struct{}{
+		"annotations:delete": {"annotations:type:organization": struct{}{}},
+	}
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should grant resources which are all owned",
+			expected:    true,
+			evaluator:   EvalOwnAll("annotations:delete", isOwner, "annotations:id:1", "annotations:id:2"),
+			permissions: permissions,
+		},
+		{
+			desc:        "should deny resources which are partially owned",
+			expected:    false,
+			evaluator:   EvalOwnAll("annotations:delete", isOwner, "annotations:id:1", "annotations:id:3"),
+			permissions: permissions,
+		},
+		{
+			desc:        "should grant resources which are not owned with matching scope",
+			expected:    true,
+			evaluator:   EvalOwnAll("annotations:delete", isOwner, "annotations:id:1", "annotations:id:3"),
+			permissions: map[string]map[string]struct{}{"annotations:delete": {"annotations:id:3": struct{}{}}},
+		},
+		{
+			desc:        "should deny owned resources without the action",
+			expected:    false,
+			evaluator:   EvalOwnAll("annotations:write", isOwner, "annotations:id:1", "annotations:id:2"),
+			permissions: permissions,
+		},
+		{
+			desc:        "should only require the action without scopes",
+			expected:    true,
+			evaluator:   EvalOwnAll("annotations:delete", isOwner),
+			permissions: permissions,
+		},
+		{
+			desc:        "should deny without scopes nor the action",
+			expected:    false,
+			evaluator:   EvalOwnAll("annotations:write", isOwner),
+			permissions: permissions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestScopeHierarchy_Evaluate(t *testing.T) {
+	evaluator := EvalScopeHierarchy("dashboards:read", "dashboards:uid:a", "folders:uid:f")
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should grant via the child scope",
+			expected:    true,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"dashboards:uid:a": {}}},
+		},
+		{
+			desc:        "should grant via the parent scope",
+			expected:    true,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"folders:uid:f": {}}},
+		},
+		{
+			desc:        "should grant via a wildcard",
+			expected:    true,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"folders:*": {}}},
+		},
+		{
+			desc:        "should deny other scopes",
+			expected:    false,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"dashboards:uid:b": {}, "folders:uid:g": {}}},
+		},
+		{
+			desc:        "should deny without the action",
+			expected:    false,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"dashboards:write": {"dashboards:uid:a": {}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestOwnership_Inject(t *testing.T) {
+	var looked []string
+	evaluator := EvalOwnership("annotations:write", Scope("annotations", "id", Parameter(":annotationId")), func(scope string) (bool, error) {
+		looked = append(looked, scope)
+		return true, nil
+	})
+
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":annotationId": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "owner(action:annotations:write scope:annotations:id:1)", injected.String())
+
+	ok, err := injected.Evaluate(map[string]map[string]struct{}{"annotations:write": {"annotations:id:2": struct{}{}}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"annotations:id:1"}, looked)
+}
+
+func TestFeature_Evaluate(t *testing.T) {
+	flags := map[string]bool{"reporting": true, "recordedQueries": false}
+	isEnabled := func(flag string) bool { return flags[flag] }
+	permissions := map[string]map[string]struct{}{
+		"reports:read": {"reports:*": struct{}{}},
+	}
+	inner := EvalPermission("reports:read", "reports:id:1")
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should evaluate inner evaluator when the flag is enabled",
+			expected:    true,
+			evaluator:   EvalFeature("reporting", inner, isEnabled),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when the flag is disabled",
+			expected:    false,
+			evaluator:   EvalFeature("recordedQueries", inner, isEnabled),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when the flag is unknown",
+			expected:    false,
+			evaluator:   EvalFeature("unknown", inner, isEnabled),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when the flag is enabled without permissions",
+			expected:    false,
+			evaluator:   EvalFeature("reporting", EvalPermission("reports:write"), isEnabled),
+			permissions: permissions,
+		},
+		{
+			desc:     "should compose with other evaluators",
+			expected: true,
+			evaluator: EvalAny(
+				EvalFeature("recordedQueries", inner, isEnabled),
+				EvalAll(inner, EvalFeature("reporting", inner, isEnabled)),
+			),
+			permissions: permissions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestFeature_Inject(t *testing.T) {
+	evaluator := EvalFeature("reporting", EvalPermission("reports:read", Scope("reports", "id", Parameter(":id"))), func(flag string) bool {
+		return flag == "reporting"
+	})
+
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":id": "1"}})
+	assert.NoError(t, err)
+
+	ok, err := injected.Evaluate(map[string]map[string]struct{}{"reports:read": {"reports:id:1": struct{}{}}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestFeature_String(t *testing.T) {
+	evaluator := EvalAll(EvalFeature("reporting", EvalPermission("reports:read", "reports:*"), func(string) bool { return true }))
+	assert.Equal(t, "all(feature(reporting action:reports:read scopes:reports:*))", evaluator.String())
+}
+
+func TestNotIn_Evaluate(t *testing.T) {
+	permissions := map[string]map[string]struct{}{
+		"users:read":  {"users:*": struct{}{}},
+		"teams:write": {"teams:id:1": struct{}{}},
+	}
+	blacklist := []string{"users:id:1", "teams:*"}
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should evaluate to false when a granted scope is blacklisted",
+			expected:    false,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("users:read", "users:id:1")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should delegate when no scope is blacklisted",
+			expected:    true,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("users:read", "users:id:2")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should delegate denials when no scope is blacklisted",
+			expected:    false,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("users:write", "users:id:2")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when a blacklisted wildcard covers a scope",
+			expected:    false,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("teams:write", "teams:id:1")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when a wildcard scope covers a blacklisted one",
+			expected:    false,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("users:read", "users:*")),
+			permissions: permissions,
+		},
+		{
+			desc:     "should evaluate to false when a blacklisted scope is nested",
+			expected: false,
+			evaluator: EvalNotIn(blacklist, EvalAll(
+				EvalPermission("users:read", "users:id:2"),
+				EvalAny(EvalPermission("users:read", "users:id:3"), EvalPermission("users:read", "users:id:1")),
+			)),
+			permissions: permissions,
+		},
+		{
+			desc:        "should delegate without blacklist",
+			expected:    true,
+			evaluator:   EvalNotIn(nil, EvalPermission("users:read", "users:id:1")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should delegate evaluators without scopes",
+			expected:    true,
+			evaluator:   EvalNotIn(blacklist, EvalPermission("users:read")),
+			permissions: permissions,
+		},
+		{
+			desc:        "should evaluate to false when a blacklisted scope is cached",
+			expected:    false,
+			evaluator:   EvalNotIn(blacklist, CachingEvaluator(time.Minute, EvalPermission("users:read", "users:id:1"))),
+			permissions: permissions,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+
+			ok, _, err = EvaluateWithStats(test.evaluator, test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+
+	t.Run("should fail when the scopes of inner are unknown", func(t *testing.T) {
+		count := 0
+		unknown := countingEvaluator{Evaluator: EvalPermission("users:read", "users:id:1"), count: &count}
+		ok, err := EvalNotIn(blacklist, EvalAll(unknown)).Evaluate(permissions)
+		assert.Error(t, err)
+		assert.False(t, ok)
+		assert.Zero(t, count)
+	})
+}
+
+func TestNotIn_Inject(t *testing.T) {
+	evaluator := EvalNotIn([]string{"users:id:1"}, EvalPermission("users:read", Scope("users", "id", Parameter(":id"))))
+	permissions := map[string]map[string]struct{}{
+		"users:read": {"users:*": struct{}{}},
+	}
+
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":id": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "notIn(users:id:1 action:users:read scopes:users:id:1)", injected.String())
+	ok, err := injected.Evaluate(permissions)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	injected, err = evaluator.Inject(ScopeParams{URLParams: map[string]string{":id": "2"}})
+	assert.NoError(t, err)
+	ok, err = injected.Evaluate(permissions)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestXor_Evaluate(t *testing.T) {
+	evaluator := EvalXor(EvalPermission("reports:read", "reports:1"), EvalPermission("reports:write", "reports:1"))
+
+	tests := []evaluateTestCase{
+		{
+			desc:        "should evaluate to false when neither evaluator passes",
+			expected:    false,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:2": struct{}{}}},
+		},
+		{
+			desc:        "should evaluate to true when only the first evaluator passes",
+			expected:    true,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:1": struct{}{}}},
+		},
+		{
+			desc:        "should evaluate to true when only the second evaluator passes",
+			expected:    true,
+			evaluator:   evaluator,
+			permissions: map[string]map[string]struct{}{"reports:write": {"reports:*": struct{}{}}},
+		},
+		{
+			desc:      "should evaluate to false when both evaluators pass",
+			expected:  false,
+			evaluator: evaluator,
+			permissions: map[string]map[string]struct{}{
+				"reports:read":  {"reports:1": struct{}{}},
+				"reports:write": {"reports:*": struct{}{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ok, err := test.evaluator.Evaluate(test.permissions)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, ok)
+		})
+	}
+}
+
+func TestXor_Inject(t *testing.T) {
+	evaluator := EvalXor(
+		EvalPermission("reports:read", Scope("reports", Parameter(":reportId"))),
+		EvalPermission("reports:write", Scope("reports", Parameter(":reportId"))),
+	)
+	permissions := map[string]map[string]struct{}{
+		"reports:read":  {"reports:*": struct{}{}},
+		"reports:write": {"reports:2": struct{}{}},
+	}
+
+	injected, err := evaluator.Inject(ScopeParams{URLParams: map[string]string{":reportId": "1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "xor(action:reports:read scopes:reports:1 action:reports:write scopes:reports:1)", injected.String())
+	ok, err := injected.Evaluate(permissions)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	injected, err = evaluator.Inject(ScopeParams{URLParams: map[string]string{":reportId": "2"}})
+	assert.NoError(t, err)
+	ok, err = injected.Evaluate(permissions)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestEval_EmptyPermissions(t *testing.T) {
+	evaluators := []Evaluator{
+		EvalPermission("reports:read"),
+		EvalPermission("reports:read", "reports:1"),
+		EvalAll(EvalPermission("reports:read"), EvalPermission("reports:write")),
+		EvalAny(EvalPermission("reports:read"), EvalPermission("reports:write")),
+		EvalAnyAdaptive(EvalPermission("reports:read"), EvalPermission("reports:write")),
+		EvalWithInheritance(ScopeInheritance{"folders:*": {"dashboards:*"}}, EvalPermission("dashboards:read", "dashboards:id:1")),
+	}
+
+	for _, permissions := range []map[string]map[string]struct{}{nil, {}} {
+		for _, evaluator := range evaluators {
+			t.Run("should deny "+evaluator.String(), func(t *testing.T) {
+				ok, err := evaluator.Evaluate(permissions)
+				assert.NoError(t, err)
+				assert.False(t, ok)
+			})
+		}
+	}
+
+	t.Run("should allow an empty EvalAll", func(t *testing.T) {
+		ok, err := EvalAll().Evaluate(nil)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	vacuous := []Evaluator{
+		EvalAll(EvalAll()),
+		EvalAny(EvalAll()),
+		EvalAnyAdaptive(EvalAll()),
+		EvalAny(EvalPermission("reports:read"), EvalAll()),
+	}
+	for _, evaluator := range vacuous {
+		t.Run("should allow "+evaluator.String()+" like EvaluateWithStats", func(t *testing.T) {
+			ok, err := evaluator.Evaluate(map[string]map[string]struct{}{})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, _, err = EvaluateWithStats(evaluator, map[string]map[string]struct{}{})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	benchmarks := []struct {
+		desc   string
+		scope  string
+		target string
+	}{
+		{desc: "exact", scope: "datasources:id:1", target: "datasources:id:1"},
+		{desc: "wildcard", scope: "datasources:*", target: "datasources:id:1"},
+		{desc: "mismatch", scope: "dashboards:id:1", target: "datasources:id:1"},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.desc, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = match(bm.scope, bm.target)
+			}
+		})
+	}
+}
+
+// benchmarkAnyDatasources evaluates "any of 100 datasources" for users who mostly hold one of the last datasources
+func benchmarkAnyDatasources(b *testing.B, newEvaluator func(...Evaluator) Evaluator) {
+	var datasources []Evaluator
+	for i := 0; i < 100; i++ {
+		datasources = append(datasources, EvalPermission("datasources:query", Scope("datasources", "id", fmt.Sprint(i))))
+	}
+	evaluator := newEvaluator(datasources...)
+
+	hot := map[string]map[string]struct{}{"datasources:query": {Scope("datasources", "id", "95"): {}}}
+	cold := map[string]map[string]struct{}{"datasources:query": {Scope("datasources", "id", "10"): {}}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		permissions := hot
+		if i%10 == 0 {
+			permissions = cold
+		}
+		_, _ = evaluator.Evaluate(permissions)
+	}
+}
+
+func BenchmarkEvalAny_Skewed(b *testing.B) {
+	benchmarkAnyDatasources(b, EvalAny)
+}
+
+func BenchmarkEvalAnyAdaptive_Skewed(b *testing.B) {
+	benchmarkAnyDatasources(b, EvalAnyAdaptive)
+}
+
+func BenchmarkEvaluate_EmptyPermissions(b *testing.B) {
+	var datasources []Evaluator
+	for i := 0; i < 100; i++ {
+		datasources = append(datasources, EvalPermission("datasources:query", Scope("datasources", "id", fmt.Sprint(i))))
+	}
+	evaluator := EvalAny(
+		EvalAll(EvalPermission("datasources:explore"), EvalAny(datasources...)),
+		EvalAny(datasources...),
+	)
+	permissions := map[string]map[string]struct{}{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = evaluator.Evaluate(permissions)
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -26,6 +27,11 @@ func Middleware(ac accesscontrol.AccessControl) func(web.Handler, accesscontrol.
 			}
 
 			hasAccess, err := ac.Evaluate(c.Req.Context(), c.SignedInUser, injected)
+			if errors.Is(err, accesscontrol.ErrResolverFailed) {
+				// A failing resolver is a server side problem, unlike a resource that could not be found
+				c.JsonApiErr(http.StatusInternalServerError, "Internal server error", err)
+				return
+			}
 			if !hasAccess || err != nil {
 				Deny(c, injected, err)
 				return
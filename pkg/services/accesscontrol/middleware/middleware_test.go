@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,6 +20,7 @@ type middlewareTestCase struct {
 	desc           string
 	expectFallback bool
 	expectEndpoint bool
+	expectStatus   int
 	evaluator      accesscontrol.Evaluator
 	ac             accesscontrol.AccessControl
 }
@@ -48,6 +51,22 @@ func TestMiddleware(t *testing.T) {
 			expectFallback: false,
 			expectEndpoint: false,
 		},
+		{
+			desc:           "should deny access when a scope could not be resolved",
+			ac:             evaluateErr(fmt.Errorf("%w: no such data source", accesscontrol.ErrResolverNotFound)),
+			evaluator:      accesscontrol.EvalPermission("datasources:query", "datasources:name:unknown"),
+			expectFallback: false,
+			expectEndpoint: false,
+			expectStatus:   http.StatusForbidden,
+		},
+		{
+			desc:           "should return internal server error when a scope resolver fails",
+			ac:             evaluateErr(fmt.Errorf("%w: database is locked", accesscontrol.ErrResolverFailed)),
+			evaluator:      accesscontrol.EvalPermission("datasources:query", "datasources:name:test"),
+			expectFallback: false,
+			expectEndpoint: false,
+			expectStatus:   http.StatusInternalServerError,
+		},
 	}
 
 	for _, test := range tests {
@@ -64,11 +83,11 @@ func TestMiddleware(t *testing.T) {
 			server.Use(Middleware(test.ac)(fallback, test.evaluator))
 
 			endpointCalled := false
-			server.Get("/", func(c *models.ReqContext) {
+			server.Get("/api/test", func(c *models.ReqContext) {
 				endpointCalled = true
 			})
 
-			request, err := http.NewRequest(http.MethodGet, "/", nil)
+			request, err := http.NewRequest(http.MethodGet, "/api/test", nil)
 			assert.NoError(t, err)
 			recorder := httptest.NewRecorder()
 
@@ -76,10 +95,21 @@ func TestMiddleware(t *testing.T) {
 
 			assert.Equal(t, test.expectFallback, fallbackCalled)
 			assert.Equal(t, test.expectEndpoint, endpointCalled)
+			if test.expectStatus != 0 {
+				assert.Equal(t, test.expectStatus, recorder.Code)
+			}
 		})
 	}
 }
 
+func evaluateErr(err error) *mock.Mock {
+	m := mock.New()
+	m.EvaluateFunc = func(context.Context, *models.SignedInUser, accesscontrol.Evaluator) (bool, error) {
+		return false, err
+	}
+	return m
+}
+
 func contextProvider() web.Handler {
 	return func(c *web.Context) {
 		reqCtx := &models.ReqContext{
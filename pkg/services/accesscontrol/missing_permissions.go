@@ -0,0 +1,129 @@
+package accesscontrol
+
+import "fmt"
+
+// MissingPermissions returns the actions and scopes the permissions lack to satisfy the evaluator, e.g. to tell users
+// what they need on a 403 page. Nothing is missing when the evaluator grants access.
+//   - EvalAll is missing the permissions all its evaluators are missing
+//   - EvalAny is missing those of its closest alternative, the one missing the fewest permissions, first one on ties
+//   - EvalXor is missing those of its closest evaluator when both deny, and nothing when both grant,
+//     as it's denied by extra permissions then
+//   - EvalDuring, EvalFeature and EvalNotIn are missing those of the evaluator they wrap, a closed time window,
+//     a disabled feature flag or a blacklisted scope isn't reported
+//
+// A permission without scopes is reported with an empty scope.
+func MissingPermissions(evaluator Evaluator, permissions map[string]map[string]struct{}) ([]Permission, error) {
+	missing, err := missingPermissions(evaluator, permissions)
+	if err != nil {
+		return nil, err
+	}
+	return dedupePermissions(missing), nil
+}
+
+func missingPermissions(evaluator Evaluator, permissions map[string]map[string]struct{}) ([]Permission, error) {
+	switch e := evaluator.(type) {
+	case permissionEvaluator:
+		if len(e.Scopes) == 0 {
+			if _, ok := permissions[e.Action]; ok {
+				return nil, nil
+			}
+			return []Permission{{Action: e.Action}}, nil
+		}
+		var missing []Permission
+		for _, scope := range e.Scopes {
+			ok, err := EvalPermission(e.Action, scope).Evaluate(permissions)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				missing = append(missing, Permission{Action: e.Action, Scope: scope})
+			}
+		}
+		return missing, nil
+	case allEvaluator:
+		var missing []Permission
+		for _, sub := range e.allOf {
+			m, err := missingPermissions(sub, permissions)
+			if err != nil {
+				return nil, err
+			}
+			missing = append(missing, m...)
+		}
+		return missing, nil
+	case anyEvaluator:
+		return missingAnyPermissions(e.anyOf, permissions)
+	case adaptiveAnyEvaluator:
+		return missingAnyPermissions(e.anyOf, permissions)
+	case inheritanceEvaluator:
+		if len(e.inheritance) == 0 || len(permissions) == 0 {
+			return missingPermissions(e.wrapped, permissions)
+		}
+		expanded, err := e.inheritance.expand(permissions)
+		if err != nil {
+			return nil, err
+		}
+		return missingPermissions(e.wrapped, expanded)
+	case duringEvaluator:
+		return missingPermissions(e.inner, permissions)
+	case featureEvaluator:
+		return missingPermissions(e.inner, permissions)
+	case notInEvaluator:
+		return missingPermissions(e.inner, permissions)
+	case xorEvaluator:
+		a, err := e.a.Evaluate(permissions)
+		if err != nil || a {
+			return nil, err
+		}
+		b, err := e.b.Evaluate(permissions)
+		if err != nil || b {
+			return nil, err
+		}
+		return missingAnyPermissions([]Evaluator{e.a, e.b}, permissions)
+	case ownershipEvaluator:
+		ok, err := e.Evaluate(permissions)
+		if ok || err != nil {
+			return nil, err
+		}
+		return []Permission{{Action: e.action, Scope: e.scope}}, nil
+	case compiledPermissionEvaluator:
+		return missingPermissions(e.source(), permissions)
+	case cachingEvaluator:
+		return missingPermissions(e.inner, permissions)
+	default:
+		return nil, fmt.Errorf("cannot list missing permissions of evaluator %T", evaluator)
+	}
+}
+
+func missingAnyPermissions(anyOf []Evaluator, permissions map[string]map[string]struct{}) ([]Permission, error) {
+	var closest []Permission
+	for i, sub := range anyOf {
+		missing, err := missingPermissions(sub, permissions)
+		if err != nil {
+			return nil, err
+		}
+		missing = dedupePermissions(missing)
+		if len(missing) == 0 {
+			return nil, nil
+		}
+		if i == 0 || len(missing) < len(closest) {
+			closest = missing
+		}
+	}
+	return closest, nil
+}
+
+func dedupePermissions(permissions []Permission) []Permission {
+	if len(permissions) == 0 {
+		return nil
+	}
+	seen := make(map[Permission]struct{}, len(permissions))
+	deduped := make([]Permission, 0, len(permissions))
+	for _, p := range permissions {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		deduped = append(deduped, p)
+	}
+	return deduped
+}
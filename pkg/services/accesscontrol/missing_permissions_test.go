@@ -0,0 +1,145 @@
+package accesscontrol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingPermissions(t *testing.T) {
+	notOwner := func(string) (bool, error) { return false, nil }
+	owner := func(string) (bool, error) { return true, nil }
+
+	tests := []struct {
+		desc        string
+		evaluator   Evaluator
+		permissions map[string]map[string]struct{}
+		expected    []Permission
+	}{
+		{
+			desc:        "should return nothing when the permission is granted",
+			evaluator:   EvalPermission("reports:read", "reports:1"),
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:*": {}}},
+		},
+		{
+			desc:      "should return a permission without scopes with an empty scope",
+			evaluator: EvalPermission("reports:read"),
+			expected:  []Permission{{Action: "reports:read"}},
+		},
+		{
+			desc:        "should return only the scopes that are not matched",
+			evaluator:   EvalPermission("reports:read", "reports:1", "reports:2"),
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:1": {}}},
+			expected:    []Permission{{Action: "reports:read", Scope: "reports:2"}},
+		},
+		{
+			desc: "should return every unmet requirement of all",
+			evaluator: EvalAll(
+				EvalPermission("datasources:query", "datasources:id:1"),
+				EvalAll(EvalPermission("reports:read"), EvalPermission("datasources:query", "datasources:id:1", "datasources:id:2")),
+				EvalPermission("teams:read"),
+			),
+			permissions: map[string]map[string]struct{}{"teams:read": {}},
+			expected: []Permission{
+				{Action: "datasources:query", Scope: "datasources:id:1"},
+				{Action: "reports:read"},
+				{Action: "datasources:query", Scope: "datasources:id:2"},
+			},
+		},
+		{
+			desc: "should return nothing when one alternative of any is granted",
+			evaluator: EvalAny(
+				EvalPermission("datasources:query", "datasources:id:1"),
+				EvalPermission("teams:read"),
+			),
+			permissions: map[string]map[string]struct{}{"teams:read": {}},
+		},
+		{
+			desc: "should return the closest alternative of any",
+			evaluator: EvalAny(
+				EvalAll(EvalPermission("reports:read"), EvalPermission("reports:write")),
+				EvalPermission("datasources:query", "datasources:id:1", "datasources:id:2"),
+				EvalPermission("teams:read"),
+			),
+			permissions: map[string]map[string]struct{}{"datasources:query": {"datasources:id:1": {}}},
+			expected:    []Permission{{Action: "datasources:query", Scope: "datasources:id:2"}},
+		},
+		{
+			desc: "should return the first closest alternative of any on ties",
+			evaluator: EvalAnyAdaptive(
+				EvalPermission("reports:read"),
+				EvalPermission("teams:read"),
+			),
+			expected: []Permission{{Action: "reports:read"}},
+		},
+		{
+			desc: "should combine all and any in composite trees",
+			evaluator: EvalAll(
+				EvalPermission("dashboards:read", "dashboards:uid:1"),
+				EvalAny(
+					EvalPermission("dashboards:write", "dashboards:uid:1"),
+					EvalPermission("dashboards:write", "folders:uid:parent"),
+				),
+			),
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"dashboards:*": {}}},
+			expected:    []Permission{{Action: "dashboards:write", Scope: "dashboards:uid:1"}},
+		},
+		{
+			desc: "should take inherited scopes into account",
+			evaluator: EvalWithInheritance(ScopeInheritance{"folders:uid:parent": {"dashboards:uid:1"}}, EvalAll(
+				EvalPermission("dashboards:read", "dashboards:uid:1"),
+				EvalPermission("dashboards:write", "dashboards:uid:1"),
+			)),
+			permissions: map[string]map[string]struct{}{"dashboards:read": {"folders:uid:parent": {}}},
+			expected:    []Permission{{Action: "dashboards:write", Scope: "dashboards:uid:1"}},
+		},
+		{
+			desc:      "should return the scope of a resource the user doesn't own",
+			evaluator: EvalOwnership("reports:write", "reports:1", notOwner),
+			expected:  []Permission{{Action: "reports:write", Scope: "reports:1"}},
+		},
+		{
+			desc:        "should return nothing for the owner of the resource",
+			evaluator:   EvalOwnership("reports:write", "reports:1", owner),
+			permissions: map[string]map[string]struct{}{"reports:write": {}},
+		},
+		{
+			desc:        "should return the permissions of the closest evaluator of xor when neither passes",
+			evaluator:   EvalXor(EvalPermission("reports:read", "reports:1", "reports:2"), EvalPermission("reports:write", "reports:1")),
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:1": {}}},
+			expected:    []Permission{{Action: "reports:read", Scope: "reports:2"}},
+		},
+		{
+			desc:      "should return the permissions of compiled evaluators",
+			evaluator: Compile(EvalAll(EvalPermission("reports:read", "reports:1"), EvalPermission("reports:read", "reports:1"))),
+			expected:  []Permission{{Action: "reports:read", Scope: "reports:1"}},
+		},
+		{
+			desc:        "should return the permissions of cached evaluators",
+			evaluator:   CachingEvaluator(time.Minute, EvalPermission("reports:read", "reports:1", "reports:2")),
+			permissions: map[string]map[string]struct{}{"reports:read": {"reports:2": {}}},
+			expected:    []Permission{{Action: "reports:read", Scope: "reports:1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			missing, err := MissingPermissions(test.evaluator, test.permissions)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, missing)
+
+			granted, err := test.evaluator.Evaluate(test.permissions)
+			require.NoError(t, err)
+			assert.Equal(t, len(test.expected) == 0, granted)
+		})
+	}
+
+	t.Run("should return the errors of the evaluators", func(t *testing.T) {
+		failing := func(string) (bool, error) { return false, errors.New("lookup failed") }
+		_, err := MissingPermissions(EvalAll(EvalOwnership("reports:write", "reports:1", failing)), map[string]map[string]struct{}{"reports:write": {}})
+		require.Error(t, err)
+	})
+}
@@ -14,15 +14,16 @@ type fullAccessControl interface {
 }
 
 type Calls struct {
-	CloneUserToServiceAccount  []interface{}
-	Evaluate                   []interface{}
-	GetUserPermissions         []interface{}
-	GetUserRoles               []interface{}
-	IsDisabled                 []interface{}
-	DeclareFixedRoles          []interface{}
-	GetUserBuiltInRoles        []interface{}
-	RegisterFixedRoles         []interface{}
-	LinkAPIKeyToServiceAccount []interface{}
+	CloneUserToServiceAccount      []interface{}
+	Evaluate                       []interface{}
+	GetUserPermissions             []interface{}
+	GetUserRoles                   []interface{}
+	IsDisabled                     []interface{}
+	DeclareFixedRoles              []interface{}
+	GetUserBuiltInRoles            []interface{}
+	RegisterFixedRoles             []interface{}
+	LinkAPIKeyToServiceAccount     []interface{}
+	RegisterAttributeScopeResolver []interface{}
 }
 
 type Mock struct {
@@ -41,15 +42,16 @@ type Mock struct {
 	Calls Calls
 
 	// Override functions
-	CloneUserToServiceAccountFunc  func(context.Context, *models.SignedInUser) (*models.User, error)
-	LinkAPIKeyToServiceAccountFunc func(context.Context, *models.ApiKey, *models.User) error
-	EvaluateFunc                   func(context.Context, *models.SignedInUser, accesscontrol.Evaluator) (bool, error)
-	GetUserPermissionsFunc         func(context.Context, *models.SignedInUser) ([]*accesscontrol.Permission, error)
-	GetUserRolesFunc               func(context.Context, *models.SignedInUser) ([]*accesscontrol.RoleDTO, error)
-	IsDisabledFunc                 func() bool
-	DeclareFixedRolesFunc          func(...accesscontrol.RoleRegistration) error
-	GetUserBuiltInRolesFunc        func(user *models.SignedInUser) []string
-	RegisterFixedRolesFunc         func() error
+	CloneUserToServiceAccountFunc      func(context.Context, *models.SignedInUser) (*models.User, error)
+	LinkAPIKeyToServiceAccountFunc     func(context.Context, *models.ApiKey, *models.User) error
+	EvaluateFunc                       func(context.Context, *models.SignedInUser, accesscontrol.Evaluator) (bool, error)
+	GetUserPermissionsFunc             func(context.Context, *models.SignedInUser) ([]*accesscontrol.Permission, error)
+	GetUserRolesFunc                   func(context.Context, *models.SignedInUser) ([]*accesscontrol.RoleDTO, error)
+	IsDisabledFunc                     func() bool
+	DeclareFixedRolesFunc              func(...accesscontrol.RoleRegistration) error
+	GetUserBuiltInRolesFunc            func(user *models.SignedInUser) []string
+	RegisterFixedRolesFunc             func() error
+	RegisterAttributeScopeResolverFunc func(string, accesscontrol.AttributeScopeResolveFunc)
 }
 
 // Ensure the mock stays in line with the interface
@@ -188,3 +190,13 @@ func (m *Mock) RegisterFixedRoles() error {
 	}
 	return nil
 }
+
+// RegisterAttributeScopeResolver registers a resolver for the attribute scopes starting with scopePrefix
+// This mock does nothing unless an override is provided.
+func (m *Mock) RegisterAttributeScopeResolver(scopePrefix string, resolver accesscontrol.AttributeScopeResolveFunc) {
+	m.Calls.RegisterAttributeScopeResolver = append(m.Calls.RegisterAttributeScopeResolver, []interface{}{scopePrefix, resolver})
+	// Use override if provided
+	if m.RegisterAttributeScopeResolverFunc != nil {
+		m.RegisterAttributeScopeResolverFunc(scopePrefix, resolver)
+	}
+}
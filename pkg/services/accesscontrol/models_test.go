@@ -0,0 +1,46 @@
+package accesscontrol
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermission_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		desc       string
+		permission Permission
+		expected   map[string]interface{}
+	}{
+		{
+			desc:       "should marshal permission with scope",
+			permission: Permission{ID: 1, RoleID: 2, Action: "users:read", Scope: "users:*"},
+			expected:   map[string]interface{}{"action": "users:read", "scope": "users:*"},
+		},
+		{
+			desc:       "should marshal permission without scope",
+			permission: Permission{ID: 1, RoleID: 2, Action: "users:read"},
+			expected:   map[string]interface{}{"action": "users:read", "scope": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			data, err := json.Marshal(tt.permission)
+			require.NoError(t, err)
+
+			var fields map[string]interface{}
+			require.NoError(t, json.Unmarshal(data, &fields))
+			assert.Equal(t, tt.expected["action"], fields["action"])
+			assert.Equal(t, tt.expected["scope"], fields["scope"])
+			assert.NotContains(t, fields, "id", "database identifiers should not be exposed")
+			assert.NotContains(t, fields, "roleId", "database identifiers should not be exposed")
+
+			var decoded Permission
+			require.NoError(t, json.Unmarshal(data, &decoded))
+			assert.Equal(t, tt.permission.OSSPermission(), decoded)
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package accesscontrol
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
+	"github.com/grafana/grafana/pkg/models"
+)
+
+// ScopeModifier returns the scope to evaluate in place of scope, e.g. ScopeResolver.ResolveAttribute
+type ScopeModifier func(ctx context.Context, scope string) (string, error)
+
+// ModifyScopes returns a copy of the evaluator where every scope has been replaced by the result of modifier,
+// see Evaluator.MutateScopes
+func ModifyScopes(ctx context.Context, evaluator Evaluator, modifier ScopeModifier) (Evaluator, error) {
+	return evaluator.MutateScopes(ctx, modifier)
+}
+
+func mutateScopesList(ctx context.Context, evaluators []Evaluator, modifier ScopeModifier) ([]Evaluator, error) {
+	modified := make([]Evaluator, 0, len(evaluators))
+	for _, e := range evaluators {
+		m, err := e.MutateScopes(ctx, modifier)
+		if err != nil {
+			return nil, err
+		}
+		modified = append(modified, m)
+	}
+	return modified, nil
+}
+
+// EvaluatorSignatureFunc returns the key ModifiedScopesCache stores the modified evaluator under.
+// Two user and evaluator pairs with the same signature must lead to the same modified evaluator.
+type EvaluatorSignatureFunc func(user *models.SignedInUser, evaluator Evaluator) (string, error)
+
+// DefaultEvaluatorSignature identifies the evaluator by its canonical representation and the user by its org and ID
+func DefaultEvaluatorSignature(user *models.SignedInUser, evaluator Evaluator) (string, error) {
+	canonical, err := CanonicalString(evaluator)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%d:%s", user.OrgId, user.UserId, canonical), nil
+}
+
+// modifiedScopesCacheMaxEntries bounds the number of modified evaluators a ModifiedScopesCache holds, all orgs included
+const modifiedScopesCacheMaxEntries = 4096
+
+// ModifiedScopesCache caches the results of ModifyScopes per org, so hot endpoints don't rebuild the same evaluator tree
+// on every request. Entries of an org are invalidated when its data sources are updated or deleted, see ListenForChanges.
+// The cache holds at most modifiedScopesCacheMaxEntries evaluators, it is emptied when it is full.
+type ModifiedScopesCache struct {
+	signature EvaluatorSignatureFunc
+
+	mtx     sync.RWMutex
+	entries map[int64]map[string]Evaluator
+	// size is the number of cached evaluators, it is guarded by mtx
+	size int
+}
+
+// NewModifiedScopesCache returns an empty cache, DefaultEvaluatorSignature is used when signature is nil
+func NewModifiedScopesCache(signature EvaluatorSignatureFunc) *ModifiedScopesCache {
+	if signature == nil {
+		signature = DefaultEvaluatorSignature
+	}
+	return &ModifiedScopesCache{
+		signature: signature,
+		entries:   make(map[int64]map[string]Evaluator),
+	}
+}
+
+// ModifyScopes returns the cached modified evaluator matching the user and the evaluator, or calls ModifyScopes and caches its result.
+// Evaluators without signature, e.g. those without canonical representation, are modified without being cached.
+func (c *ModifiedScopesCache) ModifyScopes(ctx context.Context, user *models.SignedInUser, evaluator Evaluator, modifier ScopeModifier) (Evaluator, error) {
+	key, err := c.signature(user, evaluator)
+	if err != nil {
+		return evaluator.MutateScopes(ctx, modifier)
+	}
+
+	c.mtx.RLock()
+	cached, ok := c.entries[user.OrgId][key]
+	c.mtx.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	modified, err := evaluator.MutateScopes(ctx, modifier)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.size >= modifiedScopesCacheMaxEntries {
+		c.entries = make(map[int64]map[string]Evaluator)
+		c.size = 0
+	}
+	if _, ok := c.entries[user.OrgId]; !ok {
+		c.entries[user.OrgId] = make(map[string]Evaluator)
+	}
+	if _, ok := c.entries[user.OrgId][key]; !ok {
+		c.size++
+	}
+	c.entries[user.OrgId][key] = modified
+
+	return modified, nil
+}
+
+// InvalidateOrg drops the cached evaluators of the org
+func (c *ModifiedScopesCache) InvalidateOrg(orgID int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.size -= len(c.entries[orgID])
+	delete(c.entries, orgID)
+}
+
+// ListenForChanges invalidates the cached evaluators of an org whenever one of its data sources is renamed or deleted
+func (c *ModifiedScopesCache) ListenForChanges(b bus.Bus) {
+	b.AddEventListener(func(e *events.DataSourceUpdated) error {
+		c.InvalidateOrg(e.OrgID)
+		return nil
+	})
+	b.AddEventListener(func(e *events.DataSourceDeleted) error {
+		c.InvalidateOrg(e.OrgID)
+		return nil
+	})
+}
@@ -0,0 +1,186 @@
+package accesscontrol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModifyScopes(t *testing.T) {
+	modifier := func(_ context.Context, scope string) (string, error) {
+		return strings.Replace(scope, "datasources:name:test", "datasources:id:1", 1), nil
+	}
+
+	tests := []struct {
+		desc      string
+		evaluator Evaluator
+		expected  Evaluator
+	}{
+		{
+			desc:      "should modify permission scopes",
+			evaluator: EvalPermission("datasources:read", "datasources:name:test", "datasources:name:other"),
+			expected:  EvalPermission("datasources:read", "datasources:id:1", "datasources:name:other"),
+		},
+		{
+			desc:      "should keep permissions without scopes",
+			evaluator: EvalPermission("datasources:read"),
+			expected:  EvalPermission("datasources:read"),
+		},
+		{
+			desc: "should modify nested scopes",
+			evaluator: EvalAll(
+				EvalAny(EvalPermission("datasources:read", "datasources:name:test")),
+				EvalWithInheritance(ScopeInheritance{"folders:id:1": {"dashboards:id:1"}}, EvalPermission("datasources:query", "datasources:name:test")),
+			),
+			expected: EvalAll(
+				EvalAny(EvalPermission("datasources:read", "datasources:id:1")),
+				EvalWithInheritance(ScopeInheritance{"folders:id:1": {"dashboards:id:1"}}, EvalPermission("datasources:query", "datasources:id:1")),
+			),
+		},
+		{
+			desc:      "should modify scope hierarchies",
+			evaluator: EvalScopeHierarchy("datasources:read", "datasources:name:test", "datasources:name:other"),
+			expected:  EvalScopeHierarchy("datasources:read", "datasources:id:1", "datasources:name:other"),
+		},
+		{
+			desc:      "should modify inner and blacklisted scopes of notIn",
+			evaluator: EvalNotIn([]string{"datasources:name:test"}, EvalPermission("datasources:read", "datasources:name:test")),
+			expected:  EvalNotIn([]string{"datasources:id:1"}, EvalPermission("datasources:read", "datasources:id:1")),
+		},
+		{
+			desc:      "should modify both scopes of xor",
+			evaluator: EvalXor(EvalPermission("datasources:read", "datasources:name:test"), EvalPermission("datasources:write", "datasources:name:test")),
+			expected:  EvalXor(EvalPermission("datasources:read", "datasources:id:1"), EvalPermission("datasources:write", "datasources:id:1")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			modified, err := ModifyScopes(context.Background(), test.evaluator, modifier)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, modified)
+		})
+	}
+
+	t.Run("should modify the scopes of cached evaluators", func(t *testing.T) {
+		// caching evaluators hold a clock, which can't be compared, so compare their representations instead
+		modified, err := ModifyScopes(context.Background(), CachingEvaluator(time.Minute, EvalPermission("datasources:read", "datasources:name:test")), modifier)
+		require.NoError(t, err)
+		require.IsType(t, cachingEvaluator{}, modified)
+		assert.Equal(t, EvalPermission("datasources:read", "datasources:id:1").String(), modified.String())
+	})
+
+	t.Run("should return modifier errors", func(t *testing.T) {
+		_, err := ModifyScopes(context.Background(), EvalAny(EvalPermission("datasources:read", "datasources:name:test")),
+			func(_ context.Context, _ string) (string, error) {
+				return "", errors.New("not found")
+			})
+		require.Error(t, err)
+	})
+}
+
+func TestModifiedScopesCache(t *testing.T) {
+	calls := 0
+	modifier := func(_ context.Context, scope string) (string, error) {
+		calls++
+		return strings.Replace(scope, "datasources:name:test", "datasources:id:1", 1), nil
+	}
+	evaluator := EvalAny(EvalPermission("datasources:read", "datasources:name:test"))
+	user := &models.SignedInUser{OrgId: 1, UserId: 1}
+	ctx := context.Background()
+
+	b := bus.New()
+	cache := NewModifiedScopesCache(nil)
+	cache.ListenForChanges(b)
+
+	t.Run("should modify scopes once for the same user and evaluator", func(t *testing.T) {
+		first, err := cache.ModifyScopes(ctx, user, evaluator, modifier)
+		require.NoError(t, err)
+		second, err := cache.ModifyScopes(ctx, user, EvalAny(EvalPermission("datasources:read", "datasources:name:test")), modifier)
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, EvalAny(EvalPermission("datasources:read", "datasources:id:1")), first)
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("should modify scopes for another user or evaluator", func(t *testing.T) {
+		calls = 0
+		_, err := cache.ModifyScopes(ctx, &models.SignedInUser{OrgId: 1, UserId: 2}, evaluator, modifier)
+		require.NoError(t, err)
+		_, err = cache.ModifyScopes(ctx, user, EvalAny(EvalPermission("datasources:query", "datasources:name:test")), modifier)
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("should invalidate the org on data source update", func(t *testing.T) {
+		calls = 0
+		other := &models.SignedInUser{OrgId: 2, UserId: 1}
+		_, err := cache.ModifyScopes(ctx, other, evaluator, modifier)
+		require.NoError(t, err)
+
+		require.NoError(t, b.Publish(&events.DataSourceUpdated{OrgID: 1, Name: "renamed"}))
+		_, err = cache.ModifyScopes(ctx, user, evaluator, modifier)
+		require.NoError(t, err)
+		_, err = cache.ModifyScopes(ctx, other, evaluator, modifier)
+		require.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("should invalidate the org on data source deletion", func(t *testing.T) {
+		calls = 0
+		require.NoError(t, b.Publish(&events.DataSourceDeleted{OrgID: 1}))
+		_, err := cache.ModifyScopes(ctx, user, evaluator, modifier)
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("should modify scopes without caching when the evaluator has no signature", func(t *testing.T) {
+		calls = 0
+		uncached := EvalFeature("flag", EvalPermission("datasources:read", "datasources:name:test"), func(string) bool { return true })
+		for i := 0; i < 2; i++ {
+			modified, err := cache.ModifyScopes(ctx, user, uncached, modifier)
+			require.NoError(t, err)
+			assert.Equal(t, "feature(flag action:datasources:read scopes:datasources:id:1)", modified.String())
+		}
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("should empty the cache when it is full", func(t *testing.T) {
+		bounded := NewModifiedScopesCache(nil)
+		for i := 0; i < modifiedScopesCacheMaxEntries; i++ {
+			_, err := bounded.ModifyScopes(ctx, &models.SignedInUser{OrgId: int64(i % 3), UserId: int64(i)}, evaluator, modifier)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, modifiedScopesCacheMaxEntries, bounded.size)
+
+		bounded.InvalidateOrg(0)
+		assert.Equal(t, len(bounded.entries[1])+len(bounded.entries[2]), bounded.size)
+		for i := 0; i <= modifiedScopesCacheMaxEntries; i++ {
+			_, err := bounded.ModifyScopes(ctx, &models.SignedInUser{OrgId: 1, UserId: int64(modifiedScopesCacheMaxEntries + i)}, evaluator, modifier)
+			require.NoError(t, err)
+		}
+		assert.LessOrEqual(t, bounded.size, modifiedScopesCacheMaxEntries)
+		assert.Equal(t, bounded.size, len(bounded.entries[1])+len(bounded.entries[2]))
+	})
+
+	t.Run("should use the signature function", func(t *testing.T) {
+		calls = 0
+		orgWide := NewModifiedScopesCache(func(user *models.SignedInUser, evaluator Evaluator) (string, error) {
+			return evaluator.String(), nil
+		})
+		_, err := orgWide.ModifyScopes(ctx, user, evaluator, modifier)
+		require.NoError(t, err)
+		_, err = orgWide.ModifyScopes(ctx, &models.SignedInUser{OrgId: 1, UserId: 2}, evaluator, modifier)
+		require.NoError(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
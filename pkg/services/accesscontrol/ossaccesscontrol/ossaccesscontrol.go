@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 
+	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/metrics"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
@@ -13,13 +14,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func ProvideService(cfg *setting.Cfg, usageStats usagestats.Service) *OSSAccessControlService {
+// modifiedScopesCacheFeatureToggle enables caching the evaluators whose attribute scopes have been resolved,
+// see accesscontrol.ModifiedScopesCache
+const modifiedScopesCacheFeatureToggle = "accesscontrolModifiedScopesCache"
+
+func ProvideService(cfg *setting.Cfg, usageStats usagestats.Service, bus bus.Bus) *OSSAccessControlService {
 	s := &OSSAccessControlService{
 		Cfg:           cfg,
 		UsageStats:    usageStats,
 		Log:           log.New("accesscontrol"),
 		scopeResolver: accesscontrol.NewScopeResolver(),
 	}
+	if cfg != nil && cfg.FeatureToggles[modifiedScopesCacheFeatureToggle] {
+		s.modifiedScopesCache = accesscontrol.NewModifiedScopesCache(nil)
+		s.modifiedScopesCache.ListenForChanges(bus)
+	}
 	s.registerUsageMetrics()
 	return s
 }
@@ -31,6 +40,8 @@ type OSSAccessControlService struct {
 	Log           log.Logger
 	registrations accesscontrol.RegistrationList
 	scopeResolver accesscontrol.ScopeResolver
+	// modifiedScopesCache is nil unless enabled by modifiedScopesCacheFeatureToggle
+	modifiedScopesCache *accesscontrol.ModifiedScopesCache
 }
 
 func (ac *OSSAccessControlService) IsDisabled() bool {
@@ -58,7 +69,8 @@ func (ac *OSSAccessControlService) getUsageMetrics() interface{} {
 	return 1
 }
 
-// Evaluate evaluates access to the given resources
+// Evaluate evaluates access to the given resources, attribute scopes of the evaluator are resolved first,
+// see RegisterAttributeScopeResolver
 func (ac *OSSAccessControlService) Evaluate(ctx context.Context, user *models.SignedInUser, evaluator accesscontrol.Evaluator) (bool, error) {
 	timer := prometheus.NewTimer(metrics.MAccessEvaluationsSummary)
 	defer timer.ObserveDuration()
@@ -69,7 +81,24 @@ func (ac *OSSAccessControlService) Evaluate(ctx context.Context, user *models.Si
 		return false, err
 	}
 
-	return evaluator.Evaluate(accesscontrol.GroupScopesByAction(permissions))
+	modifier := ac.scopeResolver.AttributeScopeModifier(user.OrgId)
+	var resolved accesscontrol.Evaluator
+	if ac.modifiedScopesCache != nil {
+		resolved, err = ac.modifiedScopesCache.ModifyScopes(ctx, user, evaluator, modifier)
+	} else {
+		resolved, err = evaluator.MutateScopes(ctx, modifier)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return resolved.Evaluate(accesscontrol.GroupScopesByAction(permissions))
+}
+
+// RegisterAttributeScopeResolver registers a resolver for the attribute scopes starting with scopePrefix,
+// resolvers are expected to be registered when the services are provided, before any evaluation
+func (ac *OSSAccessControlService) RegisterAttributeScopeResolver(scopePrefix string, resolver accesscontrol.AttributeScopeResolveFunc) {
+	ac.scopeResolver.AddAttributeResolver(scopePrefix, resolver)
 }
 
 // GetUserRoles returns user permissions based on built-in roles
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/infra/usagestats"
 	"github.com/grafana/grafana/pkg/models"
@@ -19,7 +22,7 @@ func setupTestEnv(t testing.TB) *OSSAccessControlService {
 
 	cfg := setting.NewCfg()
 	cfg.FeatureToggles = map[string]bool{"accesscontrol": true}
-	ac := ProvideService(cfg, &usagestats.UsageStatsMock{T: t})
+	ac := ProvideService(cfg, &usagestats.UsageStatsMock{T: t}, bus.New())
 	return ac
 }
 
@@ -145,7 +148,7 @@ func TestUsageMetrics(t *testing.T) {
 				cfg.FeatureToggles = map[string]bool{"accesscontrol": true}
 			}
 
-			s := ProvideService(cfg, &usagestats.UsageStatsMock{T: t})
+			s := ProvideService(cfg, &usagestats.UsageStatsMock{T: t}, bus.New())
 			report, err := s.UsageStats.GetUsageReport(context.Background())
 			assert.Nil(t, err)
 
@@ -541,6 +544,20 @@ func TestOSSAccessControlService_GetUserPermissions(t *testing.T) {
 			wantPerm: accesscontrol.Permission{Action: "users:read", Scope: "users:id:2"},
 			wantErr:  false,
 		},
+		{
+			name:     "Translate serviceaccounts:self of a regular user to a scope matching nothing",
+			user:     testUser,
+			rawPerm:  accesscontrol.Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:self"},
+			wantPerm: accesscontrol.Permission{Action: "serviceaccounts:read", Scope: ""},
+			wantErr:  false,
+		},
+		{
+			name:     "Translate serviceaccounts:self of a service account",
+			user:     &models.SignedInUser{UserId: 5, OrgId: 3, OrgRole: models.ROLE_VIEWER, IsServiceAccount: true},
+			rawPerm:  accesscontrol.Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:self"},
+			wantPerm: accesscontrol.Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:id:5"},
+			wantErr:  false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -581,3 +598,191 @@ func TestOSSAccessControlService_GetUserPermissions(t *testing.T) {
 		})
 	}
 }
+
+func TestOSSAccessControlService_EvaluateResolvesAttributeScopes(t *testing.T) {
+	registration := accesscontrol.RoleRegistration{
+		Role: accesscontrol.RoleDTO{
+			Version:     1,
+			UID:         "fixed:test:datasources",
+			Name:        "fixed:test:datasources",
+			Description: "Test role",
+			Permissions: []accesscontrol.Permission{{Action: "datasources:query", Scope: "datasources:id:1"}},
+		},
+		Grants: []string{"Viewer"},
+	}
+	t.Cleanup(func() {
+		removeRoleHelper(registration.Role.Name)
+	})
+
+	ac := setupTestEnv(t)
+	ac.RegisterAttributeScopeResolver("datasources:name:", func(_ context.Context, orgID int64, scope string) (string, error) {
+		switch scope {
+		case "datasources:name:test":
+			return "datasources:id:1", nil
+		case "datasources:name:other":
+			return "datasources:id:2", nil
+		default:
+			return "", fmt.Errorf("%w: database is locked", accesscontrol.ErrResolverFailed)
+		}
+	})
+	require.NoError(t, ac.DeclareFixedRoles(registration))
+	require.NoError(t, ac.RegisterFixedRoles())
+	user := &models.SignedInUser{UserId: 1, OrgId: 1, OrgRole: models.ROLE_VIEWER}
+
+	t.Run("should evaluate the resolved scopes", func(t *testing.T) {
+		ok, err := ac.Evaluate(context.Background(), user, accesscontrol.EvalPermission("datasources:query", "datasources:name:test"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = ac.Evaluate(context.Background(), user, accesscontrol.EvalPermission("datasources:query", "datasources:name:other"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("should return the errors of the resolvers", func(t *testing.T) {
+		_, err := ac.Evaluate(context.Background(), user, accesscontrol.EvalPermission("datasources:query", "datasources:name:broken"))
+		require.ErrorIs(t, err, accesscontrol.ErrResolverFailed)
+	})
+}
+
+// externalEvaluator is an evaluator implemented outside of the accesscontrol package, granting access when
+// the user has its action and counting its resolutions and its evaluations
+type externalEvaluator struct {
+	action    string
+	scope     string
+	resolved  *int
+	evaluated *int
+}
+
+func (e externalEvaluator) Evaluate(permissions map[string]map[string]struct{}) (bool, error) {
+	if e.evaluated != nil {
+		*e.evaluated++
+	}
+	return accesscontrol.EvalPermission(e.action, e.scope).Evaluate(permissions)
+}
+
+func (e externalEvaluator) Inject(accesscontrol.ScopeParams) (accesscontrol.Evaluator, error) {
+	return e, nil
+}
+
+func (e externalEvaluator) MutateScopes(ctx context.Context, modifier accesscontrol.ScopeModifier) (accesscontrol.Evaluator, error) {
+	scope, err := modifier(ctx, e.scope)
+	if err != nil {
+		return nil, err
+	}
+	*e.resolved++
+	return externalEvaluator{action: e.action, scope: scope, resolved: e.resolved, evaluated: e.evaluated}, nil
+}
+
+func (e externalEvaluator) String() string {
+	return fmt.Sprintf("external(%s %s)", e.action, e.scope)
+}
+
+func TestOSSAccessControlService_EvaluateExternalEvaluator(t *testing.T) {
+	registration := accesscontrol.RoleRegistration{
+		Role: accesscontrol.RoleDTO{
+			Version:     1,
+			UID:         "fixed:test:external",
+			Name:        "fixed:test:external",
+			Description: "Test role",
+			Permissions: []accesscontrol.Permission{{Action: "datasources:query", Scope: "datasources:id:1"}},
+		},
+		Grants: []string{"Viewer"},
+	}
+	t.Cleanup(func() {
+		removeRoleHelper(registration.Role.Name)
+	})
+
+	ac := setupTestEnv(t)
+	ac.RegisterAttributeScopeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+		return "datasources:id:1", nil
+	})
+	require.NoError(t, ac.DeclareFixedRoles(registration))
+	require.NoError(t, ac.RegisterFixedRoles())
+	user := &models.SignedInUser{UserId: 1, OrgId: 1, OrgRole: models.ROLE_VIEWER}
+
+	resolved := 0
+	ok, err := ac.Evaluate(context.Background(), user, externalEvaluator{action: "datasources:query", scope: "datasources:name:test", resolved: &resolved})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, resolved)
+}
+
+func TestOSSAccessControlService_ModifiedScopesCache(t *testing.T) {
+	registration := accesscontrol.RoleRegistration{
+		Role: accesscontrol.RoleDTO{
+			Version:     1,
+			UID:         "fixed:test:cached",
+			Name:        "fixed:test:cached",
+			Description: "Test role",
+			Permissions: []accesscontrol.Permission{{Action: "datasources:query", Scope: "datasources:id:1"}},
+		},
+		Grants: []string{"Viewer"},
+	}
+	t.Cleanup(func() {
+		removeRoleHelper(registration.Role.Name)
+	})
+
+	cfg := setting.NewCfg()
+	cfg.FeatureToggles = map[string]bool{"accesscontrol": true, modifiedScopesCacheFeatureToggle: true}
+	b := bus.New()
+	ac := ProvideService(cfg, &usagestats.UsageStatsMock{T: t}, b)
+	resolutions := 0
+	ac.RegisterAttributeScopeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+		resolutions++
+		return "datasources:id:1", nil
+	})
+	require.NoError(t, ac.DeclareFixedRoles(registration))
+	require.NoError(t, ac.RegisterFixedRoles())
+	user := &models.SignedInUser{UserId: 1, OrgId: 1, OrgRole: models.ROLE_VIEWER}
+	evaluator := accesscontrol.EvalPermission("datasources:query", "datasources:name:test")
+
+	for i := 0; i < 2; i++ {
+		ok, err := ac.Evaluate(context.Background(), user, evaluator)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 1, resolutions)
+
+	require.NoError(t, b.Publish(&events.DataSourceDeleted{OrgID: 1}))
+	ok, err := ac.Evaluate(context.Background(), user, evaluator)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, resolutions)
+}
+
+func TestOSSAccessControlService_EvaluateCachingEvaluator(t *testing.T) {
+	registration := accesscontrol.RoleRegistration{
+		Role: accesscontrol.RoleDTO{
+			Version:     1,
+			UID:         "fixed:test:caching",
+			Name:        "fixed:test:caching",
+			Description: "Test role",
+			Permissions: []accesscontrol.Permission{{Action: "datasources:query", Scope: "datasources:id:1"}},
+		},
+		Grants: []string{"Viewer"},
+	}
+	t.Cleanup(func() {
+		removeRoleHelper(registration.Role.Name)
+	})
+
+	ac := setupTestEnv(t)
+	ac.RegisterAttributeScopeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+		return "datasources:id:1", nil
+	})
+	require.NoError(t, ac.DeclareFixedRoles(registration))
+	require.NoError(t, ac.RegisterFixedRoles())
+	user := &models.SignedInUser{UserId: 1, OrgId: 1, OrgRole: models.ROLE_VIEWER}
+
+	resolved, evaluated := 0, 0
+	evaluator := accesscontrol.CachingEvaluator(time.Minute, externalEvaluator{
+		action: "datasources:query", scope: "datasources:name:test", resolved: &resolved, evaluated: &evaluated,
+	})
+	for i := 0; i < 3; i++ {
+		ok, err := ac.Evaluate(context.Background(), user, evaluator)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 3, resolved)
+	assert.Equal(t, 1, evaluated, "the evaluations following the first one should hit the cache")
+}
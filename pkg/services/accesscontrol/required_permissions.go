@@ -0,0 +1,62 @@
+package accesscontrol
+
+// RequiredPermissions returns the actions and scopes the evaluators refer to, e.g. to show what a role needs.
+// The result is exact for permissions combined with EvalAll. It is an approximation otherwise:
+//   - the alternatives of EvalAny are all included even though a single one is enough, as are both evaluators of EvalXor
+//   - the scopes of EvalOwnership are included even though owners don't need them
+//   - EvalWithInheritance, EvalDuring, EvalFeature and EvalNotIn contribute the permissions of the evaluator they wrap,
+//     regardless of inherited scopes, time windows, feature flags and blacklisted scopes
+//
+// Permissions without scopes map their action to an empty set.
+func RequiredPermissions(evaluators ...Evaluator) map[string]map[string]struct{} {
+	required := make(map[string]map[string]struct{})
+	for _, evaluator := range evaluators {
+		addRequiredPermissions(required, evaluator)
+	}
+	return required
+}
+
+func addRequiredPermissions(required map[string]map[string]struct{}, evaluator Evaluator) {
+	switch e := evaluator.(type) {
+	case permissionEvaluator:
+		addRequiredScopes(required, e.Action, e.Scopes...)
+	case allEvaluator:
+		for _, sub := range e.allOf {
+			addRequiredPermissions(required, sub)
+		}
+	case anyEvaluator:
+		for _, sub := range e.anyOf {
+			addRequiredPermissions(required, sub)
+		}
+	case adaptiveAnyEvaluator:
+		for _, sub := range e.anyOf {
+			addRequiredPermissions(required, sub)
+		}
+	case inheritanceEvaluator:
+		addRequiredPermissions(required, e.wrapped)
+	case duringEvaluator:
+		addRequiredPermissions(required, e.inner)
+	case featureEvaluator:
+		addRequiredPermissions(required, e.inner)
+	case notInEvaluator:
+		addRequiredPermissions(required, e.inner)
+	case xorEvaluator:
+		addRequiredPermissions(required, e.a)
+		addRequiredPermissions(required, e.b)
+	case ownershipEvaluator:
+		addRequiredScopes(required, e.action, e.scope)
+	case compiledPermissionEvaluator:
+		addRequiredPermissions(required, e.source())
+	case cachingEvaluator:
+		addRequiredPermissions(required, e.inner)
+	}
+}
+
+func addRequiredScopes(required map[string]map[string]struct{}, action string, scopes ...string) {
+	if _, ok := required[action]; !ok {
+		required[action] = make(map[string]struct{})
+	}
+	for _, scope := range scopes {
+		required[action][scope] = struct{}{}
+	}
+}
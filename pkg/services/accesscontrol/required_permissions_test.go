@@ -0,0 +1,71 @@
+package accesscontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequiredPermissions(t *testing.T) {
+	isOwner := func(string) (bool, error) { return false, nil }
+
+	tests := []struct {
+		desc       string
+		evaluators []Evaluator
+		expected   map[string]map[string]struct{}
+	}{
+		{
+			desc:     "should return no permissions without evaluators",
+			expected: map[string]map[string]struct{}{},
+		},
+		{
+			desc:       "should map actions without scopes to an empty set",
+			evaluators: []Evaluator{EvalPermission("reports:read")},
+			expected:   map[string]map[string]struct{}{"reports:read": {}},
+		},
+		{
+			desc: "should aggregate nested trees",
+			evaluators: []Evaluator{
+				EvalAll(
+					EvalPermission("datasources:query", "datasources:id:1"),
+					EvalAny(
+						EvalPermission("datasources:query", "datasources:id:2"),
+						EvalAll(EvalPermission("reports:read", "reports:1"), EvalPermission("reports:write")),
+					),
+				),
+				EvalAny(EvalPermission("datasources:query", "datasources:id:1", "datasources:id:3")),
+			},
+			expected: map[string]map[string]struct{}{
+				"datasources:query": {"datasources:id:1": {}, "datasources:id:2": {}, "datasources:id:3": {}},
+				"reports:read":      {"reports:1": {}},
+				"reports:write":     {},
+			},
+		},
+		{
+			desc: "should look through wrapping evaluators",
+			evaluators: []Evaluator{
+				EvalWithInheritance(ScopeInheritance{"folders:uid:a": {"folders:uid:b"}}, EvalPermission("folders:read", "folders:uid:a")),
+				EvalDuring(time.Time{}, time.Time{}, EvalAnyAdaptive(EvalPermission("users:read", "users:id:1"))),
+				EvalFeature("flag", EvalPermission("teams:read"), func(string) bool { return false }),
+				EvalOwnership("dashboards:write", "dashboards:uid:a", isOwner),
+				Compile(EvalAny(EvalPermission("orgs:read", "orgs:id:1"), EvalPermission("orgs:read", "orgs:id:2"))),
+				CachingEvaluator(time.Minute, EvalPermission("alerts:read", "alerts:uid:a")),
+			},
+			expected: map[string]map[string]struct{}{
+				"folders:read":     {"folders:uid:a": {}},
+				"users:read":       {"users:id:1": {}},
+				"teams:read":       {},
+				"dashboards:write": {"dashboards:uid:a": {}},
+				"orgs:read":        {"orgs:id:1": {}, "orgs:id:2": {}},
+				"alerts:read":      {"alerts:uid:a": {}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expected, RequiredPermissions(test.evaluators...))
+		})
+	}
+}
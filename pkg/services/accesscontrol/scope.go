@@ -1,9 +1,15 @@
 package accesscontrol
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
+	"text/template"
+	"text/template/parse"
 
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 )
 
@@ -32,22 +38,179 @@ func Field(key string) string {
 	return fmt.Sprintf(`{{ .%s }}`, key)
 }
 
+// ValidateScopeTemplate parses an injectable scope, see Parameter and Field, and checks that the fields it references
+// exist on ScopeParams, e.g. it rejects "orgs:{{ .OrgId }}". The scope is not executed, so URL parameters are not checked.
+func ValidateScopeTemplate(scope string) error {
+	tmpl, err := template.New("scope").Parse(scope)
+	if err != nil {
+		return err
+	}
+	if tmpl.Tree == nil {
+		return nil
+	}
+	return validateScopeTemplateNode(scope, tmpl.Tree.Root)
+}
+
+// validateScopeTemplateNode walks the nodes of a parsed scope and checks their fields against ScopeParams
+func validateScopeTemplateNode(scope string, node parse.Node) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := validateScopeTemplateNode(scope, child); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return validateScopeTemplateNode(scope, n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				if err := validateScopeTemplateNode(scope, arg); err != nil {
+					return err
+				}
+			}
+		}
+	case *parse.IfNode:
+		return validateScopeTemplateBranch(scope, &n.BranchNode)
+	case *parse.RangeNode:
+		return validateScopeTemplateBranch(scope, &n.BranchNode)
+	case *parse.WithNode:
+		return validateScopeTemplateBranch(scope, &n.BranchNode)
+	case *parse.FieldNode:
+		return validateScopeField(scope, n.Ident)
+	case *parse.ChainNode:
+		if err := validateScopeTemplateNode(scope, n.Node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateScopeTemplateBranch(scope string, n *parse.BranchNode) error {
+	for _, node := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := validateScopeTemplateNode(scope, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateScopeField checks that a chain of fields, e.g. [URLParams] for .URLParams, exists on ScopeParams.
+// Fields of maps are keys, they are not checked.
+func validateScopeField(scope string, ident []string) error {
+	t := reflect.TypeOf(ScopeParams{})
+	for _, name := range ident {
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		field, ok := t.FieldByName(name)
+		if !ok {
+			return fmt.Errorf("scope %q references unknown field %q of %s", scope, name, t.Name())
+		}
+		t = field.Type
+	}
+	return nil
+}
+
 type KeywordScopeResolveFunc func(*models.SignedInUser) (string, error)
 
+// AttributeScopeResolveFunc resolves a scope using an attribute, such as `name` or `uid`, into an `id` based scope.
+// It returns ErrResolverDeclined when it can't handle the scope, to let the next registered resolver try.
+type AttributeScopeResolveFunc func(ctx context.Context, orgID int64, scope string) (string, error)
+
+var (
+	// ErrResolverDeclined is returned by attribute resolvers that won't resolve a scope matching their prefix
+	ErrResolverDeclined = errors.New("scope resolver declined the scope")
+	// ErrResolverNotFound is returned by attribute resolvers when the resource the scope refers to does not exist
+	ErrResolverNotFound = errors.New("could not find the resource the scope refers to")
+	// ErrResolverFailed is returned by attribute resolvers failing to look up the resource the scope refers to,
+	// e.g. because of a database error
+	ErrResolverFailed = errors.New("scope resolution failed")
+)
+
+// ScopeNormalizer rewrites a scope into its normal form before it is resolved
+type ScopeNormalizer func(scope string) string
+
+// NormalizeScopeKind lowercases the kind and the attribute of a scope, e.g. "Datasources:ID:1" becomes "datasources:id:1".
+// The rest of the scope is left as is since it can be case sensitive, such as a name.
+func NormalizeScopeKind(scope string) string {
+	parts := strings.SplitN(scope, ":", 3)
+	parts[0] = strings.ToLower(parts[0])
+	if len(parts) == 3 {
+		parts[1] = strings.ToLower(parts[1])
+	}
+	return strings.Join(parts, ":")
+}
+
+type attributeResolver struct {
+	prefix  string
+	resolve AttributeScopeResolveFunc
+}
+
 // ScopeResolver contains a map of functions to resolve scope keywords such as `self` or `current` into `id` based scopes
+// and the resolvers of attribute based scopes, such as `datasources:name:test`
 type ScopeResolver struct {
-	keywordResolvers map[string]KeywordScopeResolveFunc
+	keywordResolvers   map[string]KeywordScopeResolveFunc
+	attributeResolvers []attributeResolver
+	normalizers        []ScopeNormalizer
+	log                log.Logger
 }
 
 func NewScopeResolver() ScopeResolver {
 	return ScopeResolver{
+		log: log.New("accesscontrol.scoperesolver"),
 		keywordResolvers: map[string]KeywordScopeResolveFunc{
 			"orgs:current": resolveCurrentOrg,
 			"users:self":   resolveUserSelf,
+
+			"serviceaccounts:self": resolveServiceAccountSelf,
 		},
 	}
 }
 
+// AddScopeNormalizer registers a normalizer applied to scopes before they are resolved, after the ones already registered,
+// e.g. NormalizeScopeKind. Scopes are resolved as is until a normalizer is registered.
+func (s *ScopeResolver) AddScopeNormalizer(fn ScopeNormalizer) {
+	s.normalizers = append(s.normalizers, fn)
+}
+
+// SetLogger replaces the logger the resolution failures are logged with
+func (s *ScopeResolver) SetLogger(logger log.Logger) {
+	s.log = logger
+}
+
+// redactScope hides the attribute value of a scope in logs, e.g. "datasources:name:prod" becomes "datasources:name:[redacted]",
+// since names can be sensitive. IDs, UIDs and wildcards are kept.
+func redactScope(scope string) string {
+	parts := strings.SplitN(scope, ":", 3)
+	if len(parts) != 3 || parts[1] == "id" || parts[1] == "uid" || parts[2] == "*" {
+		return scope
+	}
+	return parts[0] + ":" + parts[1] + ":[redacted]"
+}
+
+// resolverErrorKind returns the sentinel err wraps, to log resolution failures without the details resolvers add
+// to their errors, which may name the resource the scope refers to
+func resolverErrorKind(err error) error {
+	if errors.Is(err, ErrResolverNotFound) {
+		return ErrResolverNotFound
+	}
+	return ErrResolverFailed
+}
+
+func (s *ScopeResolver) normalize(scope string) string {
+	for _, normalizer := range s.normalizers {
+		scope = normalizer(scope)
+	}
+	return scope
+}
+
 func resolveCurrentOrg(u *models.SignedInUser) (string, error) {
 	return Scope("orgs", "id", fmt.Sprintf("%v", u.OrgId)), nil
 }
@@ -56,14 +219,99 @@ func resolveUserSelf(u *models.SignedInUser) (string, error) {
 	return Scope("users", "id", fmt.Sprintf("%v", u.UserId)), nil
 }
 
+// resolveServiceAccountSelf resolves the service account of the requests authenticated with its API keys.
+// The account of a regular user is not a service account, so the scope is resolved to the empty scope,
+// which matches no scope, rather than failing the resolution of all the permissions of the user.
+func resolveServiceAccountSelf(u *models.SignedInUser) (string, error) {
+	if !u.IsServiceAccount {
+		return "", nil
+	}
+	return Scope("serviceaccounts", "id", fmt.Sprintf("%v", u.UserId)), nil
+}
+
 // ResolveKeyword resolves scope with keywords such as `self` or `current` into `id` based scopes
 func (s *ScopeResolver) ResolveKeyword(user *models.SignedInUser, permission Permission) (*Permission, error) {
-	if fn, ok := s.keywordResolvers[permission.Scope]; ok {
-		resolvedScope, err := fn(user)
+	resolvedScope, err := s.resolveKeywordScope(user, permission.Scope)
+	if err != nil {
+		return nil, err
+	}
+	permission.Scope = resolvedScope
+	return &permission, nil
+}
+
+func (s *ScopeResolver) resolveKeywordScope(user *models.SignedInUser, scope string) (string, error) {
+	scope = s.normalize(scope)
+	fn, ok := s.keywordResolvers[scope]
+	if !ok {
+		return scope, nil
+	}
+	resolvedScope, err := fn(user)
+	if err != nil {
+		s.log.Error("Failed to resolve keyword scope", "userId", user.UserId, "orgId", user.OrgId, "scope", scope, "resolver", scope, "err", err)
+		return "", fmt.Errorf("could not resolve %v: %v", scope, err)
+	}
+	s.log.Debug("Resolved keyword scope", "userId", user.UserId, "scope", scope, "resolved", resolvedScope)
+	return resolvedScope, nil
+}
+
+// KeywordScopeModifier returns a ScopeModifier resolving the keyword scopes of the user, see ResolveKeyword
+func (s *ScopeResolver) KeywordScopeModifier(user *models.SignedInUser) ScopeModifier {
+	return func(_ context.Context, scope string) (string, error) {
+		return s.resolveKeywordScope(user, scope)
+	}
+}
+
+// AttributeScopeModifier returns a ScopeModifier resolving the attribute scopes of the org, see ResolveAttribute
+func (s *ScopeResolver) AttributeScopeModifier(orgID int64) ScopeModifier {
+	return func(ctx context.Context, scope string) (string, error) {
+		return s.resolveAttribute(ctx, orgID, scope)
+	}
+}
+
+// KeywordAndAttributeScopeModifier returns a ScopeModifier resolving both the keyword and the attribute scopes of the user,
+// so ModifyScopes walks the evaluator once instead of once per kind of scope.
+// Keywords are resolved first since the resolved scope can be an attribute scope in turn.
+func (s *ScopeResolver) KeywordAndAttributeScopeModifier(user *models.SignedInUser) ScopeModifier {
+	return func(ctx context.Context, scope string) (string, error) {
+		resolved, err := s.resolveKeywordScope(user, scope)
 		if err != nil {
-			return nil, fmt.Errorf("could not resolve %v: %v", permission.Scope, err)
+			return "", err
 		}
-		permission.Scope = resolvedScope
+		return s.resolveAttribute(ctx, user.OrgId, resolved, "userId", user.UserId)
 	}
-	return &permission, nil
+}
+
+// AddAttributeResolver registers a resolver for the scopes starting with prefix, e.g. "datasources:name:".
+// When several resolvers match a scope, they are tried in registration order until one doesn't decline.
+func (s *ScopeResolver) AddAttributeResolver(prefix string, fn AttributeScopeResolveFunc) {
+	s.attributeResolvers = append(s.attributeResolvers, attributeResolver{prefix: prefix, resolve: fn})
+}
+
+// ResolveAttribute resolves an attribute based scope into an `id` based scope.
+// Scopes no resolver accepts are returned normalized, see AddScopeNormalizer.
+func (s *ScopeResolver) ResolveAttribute(ctx context.Context, orgID int64, scope string) (string, error) {
+	return s.resolveAttribute(ctx, orgID, scope)
+}
+
+// resolveAttribute resolves an attribute based scope, logCtx is added to the logs, e.g. the ID of the user
+// the scope is resolved for. Resolvers are identified by their prefix in the logs.
+func (s *ScopeResolver) resolveAttribute(ctx context.Context, orgID int64, scope string, logCtx ...interface{}) (string, error) {
+	scope = s.normalize(scope)
+	for _, resolver := range s.attributeResolvers {
+		if !strings.HasPrefix(scope, resolver.prefix) {
+			continue
+		}
+		resolved, err := resolver.resolve(ctx, orgID, scope)
+		if errors.Is(err, ErrResolverDeclined) {
+			s.log.Debug("Scope resolver declined the scope", append(logCtx, "orgId", orgID, "scope", redactScope(scope), "resolver", resolver.prefix)...)
+			continue
+		}
+		if err != nil {
+			s.log.Error("Failed to resolve attribute scope", append(logCtx, "orgId", orgID, "scope", redactScope(scope), "resolver", resolver.prefix, "err", resolverErrorKind(err))...)
+			return "", fmt.Errorf("could not resolve %v: %w", redactScope(scope), err)
+		}
+		s.log.Debug("Resolved attribute scope", append(logCtx, "orgId", orgID, "scope", redactScope(scope), "resolver", resolver.prefix, "resolved", resolved)...)
+		return resolved, nil
+	}
+	return scope, nil
 }
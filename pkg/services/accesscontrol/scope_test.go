@@ -1,10 +1,16 @@
 package accesscontrol
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testUser = &models.SignedInUser{
@@ -39,7 +45,41 @@ func TestResolveKeywordedScope(t *testing.T) {
 			want:       &Permission{Action: "users:read", Scope: "users:id:2"},
 			wantErr:    false,
 		},
+		{
+			name:       "service account self resolution",
+			user:       &models.SignedInUser{UserId: 4, OrgId: 3, IsServiceAccount: true},
+			permission: Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:self"},
+			want:       &Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:id:4"},
+			wantErr:    false,
+		},
+		{
+			name:       "service account self resolution of a regular user",
+			user:       testUser,
+			permission: Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:self"},
+			want:       &Permission{Action: "serviceaccounts:read", Scope: ""},
+			wantErr:    false,
+		},
+		{
+			name:       "user self resolution of a service account",
+			user:       &models.SignedInUser{UserId: 4, OrgId: 3, IsServiceAccount: true},
+			permission: Permission{Action: "users:read", Scope: "users:self"},
+			want:       &Permission{Action: "users:read", Scope: "users:id:4"},
+			wantErr:    false,
+		},
 	}
+	t.Run("service account self resolution of a regular user should match no scope", func(t *testing.T) {
+		resolver := NewScopeResolver()
+		resolved, err := resolver.ResolveKeyword(testUser, Permission{Action: "serviceaccounts:read", Scope: "serviceaccounts:self"})
+		require.NoError(t, err)
+
+		permissions := GroupScopesByAction([]*Permission{resolved})
+		for _, scope := range []string{"serviceaccounts:id:2", "serviceaccounts:*", "", "serviceaccounts:self"} {
+			ok, err := EvalPermission("serviceaccounts:read", scope).Evaluate(permissions)
+			require.NoError(t, err)
+			assert.False(t, ok, scope)
+		}
+	})
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			resolver := NewScopeResolver()
@@ -53,3 +93,338 @@ func TestResolveKeywordedScope(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveAttribute(t *testing.T) {
+	byName := func(_ context.Context, orgID int64, scope string) (string, error) {
+		if strings.HasPrefix(scope, "datasources:name:uid-") {
+			return "", ErrResolverDeclined
+		}
+		return Scope("datasources", "id", fmt.Sprintf("%d", orgID)), nil
+	}
+	byUIDLikeName := func(_ context.Context, _ int64, scope string) (string, error) {
+		return Scope("datasources", "id", "100"), nil
+	}
+	failing := func(context.Context, int64, string) (string, error) {
+		return "", errors.New("datasource not found")
+	}
+
+	tests := []struct {
+		name      string
+		resolvers []AttributeScopeResolveFunc
+		prefixes  []string
+		scope     string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:  "no resolver should leave scope unchanged",
+			scope: "datasources:name:test",
+			want:  "datasources:name:test",
+		},
+		{
+			name:      "resolver of another prefix should leave scope unchanged",
+			resolvers: []AttributeScopeResolveFunc{byName},
+			prefixes:  []string{"dashboards:uid:"},
+			scope:     "datasources:name:test",
+			want:      "datasources:name:test",
+		},
+		{
+			name:      "first registered resolver should win for overlapping prefixes",
+			resolvers: []AttributeScopeResolveFunc{byName, byUIDLikeName},
+			prefixes:  []string{"datasources:name:", "datasources:"},
+			scope:     "datasources:name:test",
+			want:      "datasources:id:1",
+		},
+		{
+			name:      "next resolver should try when first declines",
+			resolvers: []AttributeScopeResolveFunc{byName, byUIDLikeName},
+			prefixes:  []string{"datasources:name:", "datasources:"},
+			scope:     "datasources:name:uid-test",
+			want:      "datasources:id:100",
+		},
+		{
+			name:      "resolvers declining should leave scope unchanged",
+			resolvers: []AttributeScopeResolveFunc{byName},
+			prefixes:  []string{"datasources:name:"},
+			scope:     "datasources:name:uid-test",
+			want:      "datasources:name:uid-test",
+		},
+		{
+			name:      "failing resolver should stop the resolution",
+			resolvers: []AttributeScopeResolveFunc{failing, byUIDLikeName},
+			prefixes:  []string{"datasources:name:", "datasources:"},
+			scope:     "datasources:name:test",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := NewScopeResolver()
+			for i, fn := range tt.resolvers {
+				resolver.AddAttributeResolver(tt.prefixes[i], fn)
+			}
+			resolved, err := resolver.ResolveAttribute(context.Background(), 1, tt.scope)
+			if tt.wantErr {
+				assert.Error(t, err, "expected an error during the resolution of the scope")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, resolved)
+		})
+	}
+}
+
+func TestKeywordAndAttributeScopeModifier(t *testing.T) {
+	resolved := []string{}
+	resolver := NewScopeResolver()
+	resolver.AddAttributeResolver("datasources:name:", func(_ context.Context, orgID int64, scope string) (string, error) {
+		resolved = append(resolved, scope)
+		return Scope("datasources", "id", fmt.Sprintf("%d", orgID)), nil
+	})
+	// depends on the keyword resolution of users:self
+	resolver.AddAttributeResolver("users:id:", func(_ context.Context, _ int64, scope string) (string, error) {
+		resolved = append(resolved, scope)
+		return Scope("users", "login", "testUser"), nil
+	})
+
+	evaluator := EvalAll(
+		EvalPermission("datasources:query", "datasources:name:test"),
+		EvalAny(
+			EvalPermission("users:read", "users:self"),
+			EvalPermission("orgs:read", "orgs:current", "datasources:name:other"),
+		),
+	)
+
+	calls := 0
+	modifier := resolver.KeywordAndAttributeScopeModifier(testUser)
+	modified, err := ModifyScopes(context.Background(), evaluator, func(ctx context.Context, scope string) (string, error) {
+		calls++
+		return modifier(ctx, scope)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, calls, "every scope should be modified once")
+	assert.Equal(t, []string{"datasources:name:test", "users:id:2", "datasources:name:other"}, resolved)
+
+	canonical, err := CanonicalString(modified)
+	assert.NoError(t, err)
+	assert.Equal(t, `all(permission("datasources:query","datasources:id:3"),any(permission("users:read","users:login:testUser"),permission("orgs:read","orgs:id:3","datasources:id:3")))`, canonical)
+
+	// two separate passes should give the same evaluator
+	twoPasses, err := ModifyScopes(context.Background(), evaluator, resolver.KeywordScopeModifier(testUser))
+	assert.NoError(t, err)
+	twoPasses, err = ModifyScopes(context.Background(), twoPasses, resolver.AttributeScopeModifier(testUser.OrgId))
+	assert.NoError(t, err)
+	twoPassesCanonical, err := CanonicalString(twoPasses)
+	assert.NoError(t, err)
+	assert.Equal(t, canonical, twoPassesCanonical)
+}
+
+func TestKeywordAndAttributeScopeModifier_Error(t *testing.T) {
+	resolver := NewScopeResolver()
+	resolver.AddAttributeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+		return "", fmt.Errorf("%w: database is locked", ErrResolverFailed)
+	})
+
+	_, err := ModifyScopes(context.Background(), EvalAny(
+		EvalPermission("users:read", "users:self"),
+		EvalPermission("datasources:query", "datasources:name:test"),
+	), resolver.KeywordAndAttributeScopeModifier(testUser))
+	assert.ErrorIs(t, err, ErrResolverFailed)
+}
+
+type logEntry struct {
+	msg string
+	ctx map[string]interface{}
+}
+
+// recordingLogger records the error and debug entries logged
+type recordingLogger struct {
+	log.Logger
+	errors []logEntry
+	debugs []logEntry
+}
+
+func newLogEntry(msg string, ctx []interface{}) logEntry {
+	entry := logEntry{msg: msg, ctx: map[string]interface{}{}}
+	for i := 0; i+1 < len(ctx); i += 2 {
+		entry.ctx[fmt.Sprint(ctx[i])] = ctx[i+1]
+	}
+	return entry
+}
+
+func (l *recordingLogger) Error(msg string, ctx ...interface{}) {
+	l.errors = append(l.errors, newLogEntry(msg, ctx))
+}
+
+func (l *recordingLogger) Debug(msg string, ctx ...interface{}) {
+	l.debugs = append(l.debugs, newLogEntry(msg, ctx))
+}
+
+func TestScopeResolver_LogsFailures(t *testing.T) {
+	t.Run("should log the user, the scope and the resolver of a failed attribute resolution", func(t *testing.T) {
+		logger := &recordingLogger{}
+		resolver := NewScopeResolver()
+		resolver.SetLogger(logger)
+		resolver.AddAttributeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+			return "", fmt.Errorf("%w: database is locked", ErrResolverFailed)
+		})
+
+		_, err := ModifyScopes(context.Background(), EvalPermission("datasources:query", "datasources:name:prod-secret"),
+			resolver.KeywordAndAttributeScopeModifier(testUser))
+		require.ErrorIs(t, err, ErrResolverFailed)
+
+		require.Len(t, logger.errors, 1)
+		entry := logger.errors[0]
+		assert.Equal(t, testUser.UserId, entry.ctx["userId"])
+		assert.Equal(t, testUser.OrgId, entry.ctx["orgId"])
+		assert.Equal(t, "datasources:name:[redacted]", entry.ctx["scope"])
+		assert.Equal(t, "datasources:name:", entry.ctx["resolver"])
+		assert.Equal(t, ErrResolverFailed, entry.ctx["err"])
+		assert.NotContains(t, err.Error(), "prod-secret")
+	})
+
+	t.Run("should log only the kind of error of a failed attribute resolution", func(t *testing.T) {
+		logger := &recordingLogger{}
+		resolver := NewScopeResolver()
+		resolver.SetLogger(logger)
+		resolver.AddAttributeResolver("datasources:name:", func(context.Context, int64, string) (string, error) {
+			return "", fmt.Errorf("%w: data source \"prod-secret\"", ErrResolverNotFound)
+		})
+
+		_, err := resolver.ResolveAttribute(context.Background(), testUser.OrgId, "datasources:name:prod-secret")
+		require.ErrorIs(t, err, ErrResolverNotFound)
+
+		require.Len(t, logger.errors, 1)
+		assert.Equal(t, ErrResolverNotFound, logger.errors[0].ctx["err"])
+	})
+
+	t.Run("should log the user and the keyword of a failed keyword resolution", func(t *testing.T) {
+		logger := &recordingLogger{}
+		resolver := NewScopeResolver()
+		resolver.SetLogger(logger)
+		resolver.keywordResolvers["teams:mine"] = func(*models.SignedInUser) (string, error) {
+			return "", errors.New("the signed in user has no team")
+		}
+
+		_, err := ModifyScopes(context.Background(), EvalPermission("teams:read", "teams:mine"),
+			resolver.KeywordScopeModifier(testUser))
+		require.Error(t, err)
+
+		require.Len(t, logger.errors, 1)
+		assert.Equal(t, testUser.UserId, logger.errors[0].ctx["userId"])
+		assert.Equal(t, "teams:mine", logger.errors[0].ctx["scope"])
+	})
+
+	t.Run("should only log successful resolutions at debug level", func(t *testing.T) {
+		logger := &recordingLogger{}
+		resolver := NewScopeResolver()
+		resolver.SetLogger(logger)
+		resolver.AddAttributeResolver("datasources:uid:", func(context.Context, int64, string) (string, error) {
+			return "datasources:id:1", nil
+		})
+
+		_, err := resolver.ResolveAttribute(context.Background(), 1, "datasources:uid:abc")
+		require.NoError(t, err)
+		assert.Empty(t, logger.errors)
+		require.Len(t, logger.debugs, 1)
+		assert.Equal(t, "datasources:uid:abc", logger.debugs[0].ctx["scope"])
+	})
+}
+
+func TestRedactScope(t *testing.T) {
+	assert.Equal(t, "datasources:name:[redacted]", redactScope("datasources:name:prod"))
+	assert.Equal(t, "datasources:id:1", redactScope("datasources:id:1"))
+	assert.Equal(t, "datasources:uid:abc", redactScope("datasources:uid:abc"))
+	assert.Equal(t, "datasources:name:*", redactScope("datasources:name:*"))
+	assert.Equal(t, "orgs:current", redactScope("orgs:current"))
+}
+
+func TestNormalizeScopeKind(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  string
+	}{
+		{scope: "Datasources:ID:1", want: "datasources:id:1"},
+		{scope: "datasources:id:1", want: "datasources:id:1"},
+		{scope: "DATASOURCES:*", want: "datasources:*"},
+		{scope: "Datasources:Name:My Test DS", want: "datasources:name:My Test DS"},
+		{scope: "Folders:UID:aBc:extra", want: "folders:uid:aBc:extra"},
+		{scope: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			assert.Equal(t, tt.want, NormalizeScopeKind(tt.scope))
+		})
+	}
+}
+
+func TestScopeResolver_Normalizers(t *testing.T) {
+	t.Run("scopes should be left as is without normalizer", func(t *testing.T) {
+		resolver := NewScopeResolver()
+
+		resolved, err := resolver.ResolveAttribute(context.Background(), 1, "Datasources:ID:1")
+		assert.NoError(t, err)
+		assert.Equal(t, "Datasources:ID:1", resolved)
+	})
+
+	t.Run("mixed-case scopes should be resolved like lowercase ones", func(t *testing.T) {
+		resolver := NewScopeResolver()
+		resolver.AddScopeNormalizer(NormalizeScopeKind)
+		resolver.AddAttributeResolver("datasources:name:", func(_ context.Context, _ int64, scope string) (string, error) {
+			assert.Equal(t, "datasources:name:Prod", scope)
+			return Scope("datasources", "id", "7"), nil
+		})
+
+		resolved, err := resolver.ResolveAttribute(context.Background(), 1, "Datasources:Name:Prod")
+		assert.NoError(t, err)
+		assert.Equal(t, "datasources:id:7", resolved)
+
+		resolved, err = resolver.ResolveAttribute(context.Background(), 1, "Datasources:ID:1")
+		assert.NoError(t, err)
+		assert.Equal(t, "datasources:id:1", resolved)
+
+		permission, err := resolver.ResolveKeyword(testUser, Permission{Action: "users:read", Scope: "Users:self"})
+		assert.NoError(t, err)
+		assert.Equal(t, "users:id:2", permission.Scope)
+	})
+
+	t.Run("registered normalizers should apply in registration order", func(t *testing.T) {
+		resolver := NewScopeResolver()
+		resolver.AddScopeNormalizer(NormalizeScopeKind)
+		resolver.AddScopeNormalizer(func(scope string) string {
+			return strings.TrimSuffix(scope, ":")
+		})
+
+		modified, err := ModifyScopes(context.Background(), EvalPermission("datasources:read", "Datasources:ID:1:"), resolver.KeywordAndAttributeScopeModifier(testUser))
+		assert.NoError(t, err)
+		assert.Equal(t, EvalPermission("datasources:read", "datasources:id:1"), modified)
+	})
+}
+
+func TestValidateScopeTemplate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		scope   string
+		wantErr bool
+	}{
+		{desc: "should accept a scope without template", scope: "users:id:1"},
+		{desc: "should accept a parameter", scope: Scope("users", "id", Parameter(":id"))},
+		{desc: "should accept a field", scope: Scope("orgs", Field("OrgID"))},
+		{desc: "should accept fields in conditions", scope: `orgs:{{ if .OrgID }}{{ .OrgID }}{{ else }}*{{ end }}`},
+		{desc: "should reject a misspelled field", scope: "orgs:{{ .OrgId }}", wantErr: true},
+		{desc: "should reject a misspelled field in a parameter", scope: `users:id:{{ index .URLParam ":id" }}`, wantErr: true},
+		{desc: "should reject a misspelled field in conditions", scope: `orgs:{{ if .Org }}1{{ end }}`, wantErr: true},
+		{desc: "should reject an invalid template", scope: "orgs:{{ .OrgID", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := ValidateScopeTemplate(tt.scope)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -66,10 +66,13 @@ func (s *AlertNotificationService) CreateAlertNotificationCommand(ctx context.Co
 }
 
 func (s *AlertNotificationService) UpdateAlertNotification(ctx context.Context, cmd *models.UpdateAlertNotificationCommand) error {
-	var err error
-	cmd.EncryptedSecureSettings, err = s.EncryptionService.EncryptJsonData(ctx, cmd.SecureSettings, setting.SecretKey)
-	if err != nil {
-		return err
+	// the caller may have kept the stored secure settings, e.g. provisioning when they haven't changed
+	if cmd.EncryptedSecureSettings == nil {
+		var err error
+		cmd.EncryptedSecureSettings, err = s.EncryptionService.EncryptJsonData(ctx, cmd.SecureSettings, setting.SecretKey)
+		if err != nil {
+			return err
+		}
 	}
 
 	model := models.AlertNotification{
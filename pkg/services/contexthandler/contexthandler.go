@@ -245,6 +245,7 @@ func (h *ContextHandler) initContextWithAPIKey(reqContext *models.ReqContext) bo
 
 	reqContext.IsSignedIn = true
 	reqContext.SignedInUser = query.Result
+	reqContext.SignedInUser.IsServiceAccount = true
 	return true
 }
 
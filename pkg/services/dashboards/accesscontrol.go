@@ -0,0 +1,45 @@
+package dashboards
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/accesscontrol"
+)
+
+const uidScopePrefix = "dashboards:uid:"
+
+// DashboardRetriever looks up dashboards, it is implemented by sqlstore.SQLStore
+type DashboardRetriever interface {
+	GetDashboard(id, orgID int64, uid, slug string) (*models.Dashboard, error)
+}
+
+// NewDashboardUIDScopeResolver returns the prefix and the resolver translating dashboard uid scopes into id scopes,
+// e.g. "dashboards:uid:abc" into "dashboards:id:99", within the org of the user.
+// Unknown dashboards, folders included, fail with accesscontrol.ErrResolverNotFound, lookup errors with
+// accesscontrol.ErrResolverFailed.
+func NewDashboardUIDScopeResolver(db DashboardRetriever) (string, accesscontrol.AttributeScopeResolveFunc) {
+	return uidScopePrefix, func(ctx context.Context, orgID int64, scope string) (string, error) {
+		uid := strings.TrimPrefix(scope, uidScopePrefix)
+		if uid == "" || uid == "*" {
+			return "", accesscontrol.ErrResolverDeclined
+		}
+
+		dashboard, err := db.GetDashboard(0, orgID, uid, "")
+		if err != nil {
+			if errors.Is(err, models.ErrDashboardNotFound) {
+				// the uid is left out, like data source names in datasources.NewNameScopeResolver
+				return "", fmt.Errorf("%w: no such dashboard", accesscontrol.ErrResolverNotFound)
+			}
+			return "", fmt.Errorf("%w: %v", accesscontrol.ErrResolverFailed, err)
+		}
+		if dashboard.IsFolder {
+			return "", fmt.Errorf("%w: the uid refers to a folder", accesscontrol.ErrResolverNotFound)
+		}
+
+		return accesscontrol.Scope("dashboards", "id", fmt.Sprint(dashboard.Id)), nil
+	}
+}
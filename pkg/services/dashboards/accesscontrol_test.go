@@ -0,0 +1,82 @@
+package dashboards
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/accesscontrol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDashboardRetriever struct {
+	dashboards []*models.Dashboard
+	err        error
+}
+
+func (f *fakeDashboardRetriever) GetDashboard(_, orgID int64, uid, _ string) (*models.Dashboard, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	for _, dashboard := range f.dashboards {
+		if dashboard.Uid == uid && dashboard.OrgId == orgID {
+			return dashboard, nil
+		}
+	}
+	return nil, models.ErrDashboardNotFound
+}
+
+func TestDashboardUIDScopeResolver(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDashboardRetriever{dashboards: []*models.Dashboard{
+		{Id: 99, OrgId: 1, Uid: "abc"},
+		{Id: 100, OrgId: 1, Uid: "folder", IsFolder: true},
+	}}
+
+	resolver := accesscontrol.NewScopeResolver()
+	resolver.AddAttributeResolver(NewDashboardUIDScopeResolver(db))
+
+	t.Run("should resolve the uid of an existing dashboard", func(t *testing.T) {
+		resolved, err := resolver.ResolveAttribute(ctx, 1, "dashboards:uid:abc")
+		require.NoError(t, err)
+		assert.Equal(t, "dashboards:id:99", resolved)
+	})
+
+	t.Run("should leave wildcard scopes unchanged", func(t *testing.T) {
+		resolved, err := resolver.ResolveAttribute(ctx, 1, "dashboards:uid:*")
+		require.NoError(t, err)
+		assert.Equal(t, "dashboards:uid:*", resolved)
+	})
+
+	t.Run("should return a not found error for dashboards of other orgs", func(t *testing.T) {
+		_, err := resolver.ResolveAttribute(ctx, 2, "dashboards:uid:abc")
+		require.ErrorIs(t, err, accesscontrol.ErrResolverNotFound)
+		assert.False(t, errors.Is(err, accesscontrol.ErrResolverFailed))
+	})
+
+	t.Run("should return a not found error for folders", func(t *testing.T) {
+		_, err := resolver.ResolveAttribute(ctx, 1, "dashboards:uid:folder")
+		require.ErrorIs(t, err, accesscontrol.ErrResolverNotFound)
+	})
+
+	t.Run("should return a failure error when the lookup fails", func(t *testing.T) {
+		failing := accesscontrol.NewScopeResolver()
+		failing.AddAttributeResolver(NewDashboardUIDScopeResolver(&fakeDashboardRetriever{err: errors.New("database is locked")}))
+
+		_, err := failing.ResolveAttribute(ctx, 1, "dashboards:uid:abc")
+		require.ErrorIs(t, err, accesscontrol.ErrResolverFailed)
+		assert.False(t, errors.Is(err, accesscontrol.ErrResolverNotFound))
+	})
+
+	t.Run("should preserve the error when modifying scopes", func(t *testing.T) {
+		modifier := func(ctx context.Context, scope string) (string, error) {
+			return resolver.ResolveAttribute(ctx, 2, scope)
+		}
+		_, err := accesscontrol.ModifyScopes(ctx, accesscontrol.EvalAny(
+			accesscontrol.EvalPermission("dashboards:read", "dashboards:uid:abc"),
+		), modifier)
+		require.ErrorIs(t, err, accesscontrol.ErrResolverNotFound)
+	})
+}
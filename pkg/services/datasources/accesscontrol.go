@@ -0,0 +1,41 @@
+package datasources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/accesscontrol"
+)
+
+const nameScopePrefix = "datasources:name:"
+
+// DataSourceRetriever looks up data sources, it is implemented by Service and sqlstore.SQLStore
+type DataSourceRetriever interface {
+	GetDataSource(ctx context.Context, query *models.GetDataSourceQuery) error
+}
+
+// NewNameScopeResolver returns the prefix and the resolver translating data source name scopes into id scopes,
+// e.g. "datasources:name:test" into "datasources:id:1".
+// Unknown data sources fail with accesscontrol.ErrResolverNotFound, lookup errors with accesscontrol.ErrResolverFailed.
+func NewNameScopeResolver(db DataSourceRetriever) (string, accesscontrol.AttributeScopeResolveFunc) {
+	return nameScopePrefix, func(ctx context.Context, orgID int64, scope string) (string, error) {
+		name := strings.TrimPrefix(scope, nameScopePrefix)
+		if name == "" || name == "*" {
+			return "", accesscontrol.ErrResolverDeclined
+		}
+
+		query := models.GetDataSourceQuery{Name: name, OrgId: orgID}
+		if err := db.GetDataSource(ctx, &query); err != nil {
+			if errors.Is(err, models.ErrDataSourceNotFound) {
+				// the name is left out, the error may be logged and names can be sensitive
+				return "", fmt.Errorf("%w: no such data source", accesscontrol.ErrResolverNotFound)
+			}
+			return "", fmt.Errorf("%w: %v", accesscontrol.ErrResolverFailed, err)
+		}
+
+		return accesscontrol.Scope("datasources", "id", fmt.Sprint(query.Result.Id)), nil
+	}
+}
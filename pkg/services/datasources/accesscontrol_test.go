@@ -0,0 +1,87 @@
+package datasources
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/accesscontrol"
+	acmock "github.com/grafana/grafana/pkg/services/accesscontrol/mock"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDataSourceRetriever struct {
+	dataSources []*models.DataSource
+	err         error
+}
+
+func (f *fakeDataSourceRetriever) GetDataSource(_ context.Context, query *models.GetDataSourceQuery) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, ds := range f.dataSources {
+		if ds.Name == query.Name && ds.OrgId == query.OrgId {
+			query.Result = ds
+			return nil
+		}
+	}
+	return models.ErrDataSourceNotFound
+}
+
+func TestNameScopeResolver(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDataSourceRetriever{dataSources: []*models.DataSource{{Id: 1, OrgId: 1, Name: "test"}}}
+
+	resolver := accesscontrol.NewScopeResolver()
+	resolver.AddAttributeResolver(NewNameScopeResolver(db))
+
+	t.Run("should resolve the name of an existing data source", func(t *testing.T) {
+		resolved, err := resolver.ResolveAttribute(ctx, 1, "datasources:name:test")
+		require.NoError(t, err)
+		assert.Equal(t, "datasources:id:1", resolved)
+	})
+
+	t.Run("should leave wildcard scopes unchanged", func(t *testing.T) {
+		resolved, err := resolver.ResolveAttribute(ctx, 1, "datasources:name:*")
+		require.NoError(t, err)
+		assert.Equal(t, "datasources:name:*", resolved)
+	})
+
+	t.Run("should return a not found error for unknown data sources", func(t *testing.T) {
+		_, err := resolver.ResolveAttribute(ctx, 2, "datasources:name:test")
+		require.ErrorIs(t, err, accesscontrol.ErrResolverNotFound)
+		assert.False(t, errors.Is(err, accesscontrol.ErrResolverFailed))
+		assert.NotContains(t, err.Error(), "test", "the name should not be part of the error")
+	})
+
+	t.Run("should return a failure error when the lookup fails", func(t *testing.T) {
+		failing := accesscontrol.NewScopeResolver()
+		failing.AddAttributeResolver(NewNameScopeResolver(&fakeDataSourceRetriever{err: errors.New("database is locked")}))
+
+		_, err := failing.ResolveAttribute(ctx, 1, "datasources:name:test")
+		require.ErrorIs(t, err, accesscontrol.ErrResolverFailed)
+		assert.False(t, errors.Is(err, accesscontrol.ErrResolverNotFound))
+	})
+
+	t.Run("should preserve the error when modifying scopes", func(t *testing.T) {
+		modifier := func(ctx context.Context, scope string) (string, error) {
+			return resolver.ResolveAttribute(ctx, 2, scope)
+		}
+		_, err := accesscontrol.ModifyScopes(ctx, accesscontrol.EvalAny(
+			accesscontrol.EvalPermission("datasources:read", "datasources:name:test"),
+		), modifier)
+		require.ErrorIs(t, err, accesscontrol.ErrResolverNotFound)
+	})
+}
+
+func TestProvideService_RegistersNameScopeResolver(t *testing.T) {
+	ac := acmock.New()
+	ProvideService(bus.New(), nil, fakes.NewFakeSecretsService(), ac)
+
+	require.Len(t, ac.Calls.RegisterAttributeScopeResolver, 1)
+	assert.Equal(t, nameScopePrefix, ac.Calls.RegisterAttributeScopeResolver[0].([]interface{})[0])
+}
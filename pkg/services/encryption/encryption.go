@@ -1,6 +1,12 @@
 package encryption
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrSecureSettingNotFound is returned by Service.DecryptValue when the secure settings have no value for the key
+var ErrSecureSettingNotFound = errors.New("secure setting not found")
 
 // Service must not be used for encryption,
 // use secrets.Service implementing envelope encryption instead.
@@ -12,4 +18,7 @@ type Service interface {
 	DecryptJsonData(ctx context.Context, sjd map[string][]byte, secret string) (map[string]string, error)
 
 	GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key string, fallback string, secret string) string
+	// DecryptValue returns the decrypted value of key, unlike GetDecryptedValue it doesn't fall back silently:
+	// it returns ErrSecureSettingNotFound when sjd has no value for key, and the error of decryption otherwise.
+	DecryptValue(ctx context.Context, sjd map[string][]byte, key string, secret string) (string, error)
 }
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/util"
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -41,7 +42,7 @@ func (s *Service) Decrypt(_ context.Context, payload []byte, secret string) ([]b
 
 	// The IV needs to be unique, but not secure. Therefore it's common to
 	// include it at the beginning of the ciphertext.
-	if len(payload) < aes.BlockSize {
+	if len(payload) < saltLength+aes.BlockSize {
 		return nil, errors.New("payload too short")
 	}
 	iv := payload[saltLength : saltLength+aes.BlockSize]
@@ -124,6 +125,19 @@ func (s *Service) GetDecryptedValue(ctx context.Context, sjd map[string][]byte,
 	return fallback
 }
 
+func (s *Service) DecryptValue(ctx context.Context, sjd map[string][]byte, key, secret string) (string, error) {
+	value, ok := sjd[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", encryption.ErrSecureSettingNotFound, key)
+	}
+
+	decryptedData, err := s.Decrypt(ctx, value, secret)
+	if err != nil {
+		return "", err
+	}
+	return string(decryptedData), nil
+}
+
 // Key needs to be 32bytes
 func encryptionKeyToBytes(secret, salt string) ([]byte, error) {
 	return pbkdf2.Key([]byte(secret), []byte(salt), 10000, 32, sha256.New), nil
@@ -2,8 +2,10 @@ package ossencryption
 
 import (
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -39,4 +41,46 @@ func TestEncryption(t *testing.T) {
 
 		assert.Equal(t, "unable to compute salt", err.Error())
 	})
+
+	t.Run("decrypting payload shorter than salt and iv should return error", func(t *testing.T) {
+		_, err := svc.Decrypt(context.Background(), make([]byte, saltLength+4), "1234")
+		require.Error(t, err)
+
+		assert.Equal(t, "payload too short", err.Error())
+	})
+}
+
+func TestDecryptValue(t *testing.T) {
+	svc := Service{}
+	ctx := context.Background()
+
+	sjd, err := svc.EncryptJsonData(ctx, map[string]string{"token": "secret-token", "empty": ""}, "1234")
+	require.NoError(t, err)
+
+	t.Run("decrypting a present key should return its value", func(t *testing.T) {
+		value, err := svc.DecryptValue(ctx, sjd, "token", "1234")
+		require.NoError(t, err)
+		assert.Equal(t, "secret-token", value)
+
+		value, err = svc.DecryptValue(ctx, sjd, "empty", "1234")
+		require.NoError(t, err)
+		assert.Equal(t, "", value)
+	})
+
+	t.Run("decrypting a missing key should return ErrSecureSettingNotFound", func(t *testing.T) {
+		_, err := svc.DecryptValue(ctx, sjd, "url", "1234")
+		require.ErrorIs(t, err, encryption.ErrSecureSettingNotFound)
+
+		_, err = svc.DecryptValue(ctx, nil, "url", "1234")
+		require.ErrorIs(t, err, encryption.ErrSecureSettingNotFound)
+
+		// the fallback behavior is unchanged
+		assert.Equal(t, "fallback", svc.GetDecryptedValue(ctx, sjd, "url", "fallback", "1234"))
+	})
+
+	t.Run("decrypting an invalid value should return the decryption error", func(t *testing.T) {
+		_, err := svc.DecryptValue(ctx, map[string][]byte{"token": []byte("x")}, "token", "1234")
+		require.Error(t, err)
+		require.False(t, errors.Is(err, encryption.ErrSecureSettingNotFound))
+	})
 }
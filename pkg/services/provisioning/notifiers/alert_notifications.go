@@ -1,28 +1,50 @@
 package notifiers
 
 import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
 	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
 	"golang.org/x/net/context"
 )
 
-// Provision alert notifiers
-func Provision(ctx context.Context, configDirectory string, encryptionService encryption.Service) error {
+// Provision alert notifiers from the provisioning files of the paths of the options
+func Provision(ctx context.Context, opts Options, encryptionService encryption.Service) error {
+	dc := newNotificationProvisioner(encryptionService, log.New("provisioning.notifiers"))
+	dc.cfgProvider.opts = opts
+	return dc.applyChanges(ctx, opts.Paths...)
+}
+
+// Reload reads the alert notifier provisioning files again and applies them, e.g. once they were edited after startup.
+// The files go through the same validation as when they are provisioned at startup and provisioned notifiers are
+// updated in place by uid. Reloads are serialized with each other and with the other provisioning functions.
+func Reload(ctx context.Context, opts Options, encryptionService encryption.Service) error {
 	dc := newNotificationProvisioner(encryptionService, log.New("provisioning.notifiers"))
-	return dc.applyChanges(ctx, configDirectory)
+	dc.cfgProvider.opts = opts
+	dc.log.Info("Reloading alert notifications", "paths", opts.Paths)
+	return dc.applyChanges(ctx, opts.Paths...)
 }
 
+// applyMutex serializes applying provisioning files, so that concurrent reloads don't interleave their changes
+var applyMutex sync.Mutex
+
 // NotificationProvisioner is responsible for provsioning alert notifiers
 type NotificationProvisioner struct {
-	log         log.Logger
-	cfgProvider *configReader
+	log               log.Logger
+	cfgProvider       *configReader
+	encryptionService encryption.Service
 }
 
 func newNotificationProvisioner(encryptionService encryption.Service, log log.Logger) NotificationProvisioner {
 	return NotificationProvisioner{
-		log: log,
+		log:               log,
+		encryptionService: encryptionService,
 		cfgProvider: &configReader{
 			encryptionService: encryptionService,
 			log:               log,
@@ -35,7 +57,7 @@ func (dc *NotificationProvisioner) apply(ctx context.Context, cfg *notifications
 		return err
 	}
 
-	if err := dc.mergeNotifications(cfg.Notifications); err != nil {
+	if err := dc.mergeNotifications(ctx, cfg.Notifications); err != nil {
 		return err
 	}
 
@@ -44,7 +66,11 @@ func (dc *NotificationProvisioner) apply(ctx context.Context, cfg *notifications
 
 func (dc *NotificationProvisioner) deleteNotifications(ctx context.Context, notificationToDelete []*deleteNotificationConfig) error {
 	for _, notification := range notificationToDelete {
-		dc.log.Info("Deleting alert notification", "name", notification.Name, "uid", notification.UID)
+		if notification.isTypeFilter() {
+			dc.log.Info("Deleting alert notifications of type", "type", notification.Type)
+		} else {
+			dc.log.Info("Deleting alert notification", "name", notification.Name, "uid", notification.UID)
+		}
 
 		if notification.OrgID == 0 && notification.OrgName != "" {
 			getOrg := &models.GetOrgByNameQuery{Name: notification.OrgName}
@@ -56,13 +82,20 @@ func (dc *NotificationProvisioner) deleteNotifications(ctx context.Context, noti
 			notification.OrgID = 1
 		}
 
+		if notification.isTypeFilter() {
+			if err := dc.deleteNotificationsOfType(ctx, notification); err != nil {
+				return err
+			}
+			continue
+		}
+
 		getNotification := &models.GetAlertNotificationsWithUidQuery{Uid: notification.UID, OrgId: notification.OrgID}
 
 		if err := bus.DispatchCtx(ctx, getNotification); err != nil {
 			return err
 		}
 
-		if getNotification.Result != nil {
+		if getNotification.Result != nil && (notification.Type == "" || getNotification.Result.Type == notification.Type) {
 			cmd := &models.DeleteAlertNotificationWithUidCommand{Uid: getNotification.Result.Uid, OrgId: getNotification.OrgId}
 			if err := bus.DispatchCtx(ctx, cmd); err != nil {
 				return err
@@ -73,7 +106,32 @@ func (dc *NotificationProvisioner) deleteNotifications(ctx context.Context, noti
 	return nil
 }
 
-func (dc *NotificationProvisioner) mergeNotifications(notificationToMerge []*notificationFromConfig) error {
+// deleteNotificationsOfType deletes every notifier of the type of a filter entry in its org
+func (dc *NotificationProvisioner) deleteNotificationsOfType(ctx context.Context, notification *deleteNotificationConfig) error {
+	if !notification.DeleteAllOfType {
+		return fmt.Errorf("deleting every alert notification of type %s requires delete_all_of_type", notification.Type)
+	}
+
+	getNotifications := &models.GetAllAlertNotificationsQuery{OrgId: notification.OrgID}
+	if err := bus.DispatchCtx(ctx, getNotifications); err != nil {
+		return err
+	}
+
+	for _, existing := range getNotifications.Result {
+		if existing.Type != notification.Type {
+			continue
+		}
+
+		dc.log.Info("Deleting alert notification", "name", existing.Name, "uid", existing.Uid, "type", existing.Type)
+		cmd := &models.DeleteAlertNotificationWithUidCommand{Uid: existing.Uid, OrgId: notification.OrgID}
+		if err := bus.DispatchCtx(ctx, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dc *NotificationProvisioner) mergeNotifications(ctx context.Context, notificationToMerge []*notificationFromConfig) error {
 	for _, notification := range notificationToMerge {
 		if notification.OrgID == 0 && notification.OrgName != "" {
 			getOrg := &models.GetOrgByNameQuery{Name: notification.OrgName}
@@ -111,6 +169,10 @@ func (dc *NotificationProvisioner) mergeNotifications(notificationToMerge []*not
 			}
 		} else {
 			dc.log.Debug("updating alert notification from configuration", "name", notification.Name)
+			encryptedSecureSettings, err := dc.secureSettingsToStore(ctx, cmd.Result, notification.SecureSettings)
+			if err != nil {
+				return err
+			}
 			updateCmd := &models.UpdateAlertNotificationWithUidCommand{
 				Uid:                   notification.UID,
 				Name:                  notification.Name,
@@ -122,6 +184,8 @@ func (dc *NotificationProvisioner) mergeNotifications(notificationToMerge []*not
 				DisableResolveMessage: notification.DisableResolveMessage,
 				Frequency:             notification.Frequency,
 				SendReminder:          notification.SendReminder,
+
+				EncryptedSecureSettings: encryptedSecureSettings,
 			}
 
 			if err := bus.Dispatch(updateCmd); err != nil {
@@ -133,8 +197,50 @@ func (dc *NotificationProvisioner) mergeNotifications(notificationToMerge []*not
 	return nil
 }
 
-func (dc *NotificationProvisioner) applyChanges(ctx context.Context, configPath string) error {
-	configs, err := dc.cfgProvider.readConfig(ctx, configPath)
+// secureSettingsToStore returns the encrypted secure settings of a provisioned notification already stored as current.
+// The stored ones are kept when their plaintext is the same as the provisioned one, so re-provisioning doesn't encrypt
+// them again on every run, otherwise the provisioned ones are encrypted to replace them, e.g. after a token rotation.
+func (dc *NotificationProvisioner) secureSettingsToStore(ctx context.Context, current *models.AlertNotification, secureSettings map[string]string) (map[string][]byte, error) {
+	// empty values are not stored
+	provisioned := make(map[string]string, len(secureSettings))
+	for k, v := range secureSettings {
+		if v != "" {
+			provisioned[k] = v
+		}
+	}
+
+	stored, err := dc.encryptionService.DecryptJsonData(ctx, current.SecureSettings, setting.SecretKey)
+	if err != nil {
+		dc.log.Warn("failed to decrypt stored secure settings, replacing them", "uid", current.Uid, "error", err)
+	} else if reflect.DeepEqual(stored, provisioned) {
+		if current.SecureSettings == nil {
+			return map[string][]byte{}, nil
+		}
+		return current.SecureSettings, nil
+	}
+
+	changed := make([]string, 0)
+	for k, v := range provisioned {
+		if old, ok := stored[k]; !ok || old != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range stored {
+		if _, ok := provisioned[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	dc.log.Debug("updating secure settings of alert notification from configuration", "uid", current.Uid, "changed", changed)
+
+	return dc.encryptionService.EncryptJsonData(ctx, provisioned, setting.SecretKey)
+}
+
+func (dc *NotificationProvisioner) applyChanges(ctx context.Context, configPaths ...string) error {
+	applyMutex.Lock()
+	defer applyMutex.Unlock()
+
+	configs, err := dc.cfgProvider.readConfigs(ctx, configPaths...)
 	if err != nil {
 		return err
 	}
@@ -2,11 +2,16 @@ package notifiers
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/models"
@@ -14,40 +19,135 @@ import (
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/services/provisioning/utils"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
 	"gopkg.in/yaml.v2"
 )
 
+// ErrRemoteConfig is returned when the alert notification provisioning file can't be fetched from a remote URL
+var ErrRemoteConfig = errors.New("failed to fetch remote alert notification provisioning file")
+
+// ErrIncludeCycle is returned when alert notification provisioning files include each other
+var ErrIncludeCycle = errors.New("alert notification provisioning files include each other")
+
+// RemoteOptions configure how alert notification provisioning files are fetched from HTTP(S) URLs
+type RemoteOptions struct {
+	TLSSkipVerify bool
+	// TLSCACert is a PEM encoded certificate authority used to verify the server certificate
+	TLSCACert         string
+	BasicAuthUser     string
+	BasicAuthPassword string
+	BearerToken       string
+	Timeout           time.Duration
+}
+
+func (o RemoteOptions) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		// nolint:gosec
+		// Skipping TLS verification is an explicit opt-in of the operator
+		InsecureSkipVerify: o.TLSSkipVerify,
+	}
+	if o.TLSCACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(o.TLSCACert)) {
+			return nil, fmt.Errorf("%w: invalid TLS CA certificate", ErrRemoteConfig)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// Options configure how alert notifiers are provisioned, see OptionsFromCfg
+type Options struct {
+	// Paths are the directories or HTTP(S) URLs of the provisioning files, read in order, e.g. a base directory then
+	// a directory of overrides. A notifier with the uid and the org of a notifier of an earlier path overrides it.
+	Paths []string
+	// Remote configures TLS and authentication used to fetch the provisioning files of HTTP(S) URLs
+	Remote RemoteOptions
+	// Strict rejects provisioning files with unknown fields, e.g. a misspelled secure_settings,
+	// instead of having these fields ignored
+	Strict bool
+	// SecretStore resolves the secure settings pulling a value out of a JSON secret,
+	// e.g. ${secretjson:creds#/slack/token}
+	SecretStore SecretStore
+}
+
+// OptionsFromCfg returns the options of the [provisioning.notifiers] section, the provisioning files are read from
+// the notifiers directory of the provisioning path unless paths are configured
+func OptionsFromCfg(cfg *setting.Cfg) (Options, error) {
+	section := cfg.Raw.Section("provisioning.notifiers")
+
+	opts := Options{
+		Paths:  util.SplitString(section.Key("paths").String()),
+		Strict: section.Key("strict").MustBool(false),
+		Remote: RemoteOptions{
+			TLSSkipVerify:     section.Key("tls_skip_verify").MustBool(false),
+			BasicAuthUser:     section.Key("basic_auth_user").String(),
+			BasicAuthPassword: section.Key("basic_auth_password").String(),
+			BearerToken:       section.Key("bearer_token").String(),
+			Timeout:           section.Key("timeout").MustDuration(0),
+		},
+	}
+	if len(opts.Paths) == 0 {
+		opts.Paths = []string{filepath.Join(cfg.ProvisioningPath, "notifiers")}
+	}
+
+	if caCertPath := section.Key("tls_ca_cert_path").String(); caCertPath != "" {
+		// nolint:gosec
+		// The path comes from the configuration
+		caCert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return Options{}, fmt.Errorf("failed to read the TLS CA certificate of the alert notification provisioning: %w", err)
+		}
+		opts.Remote.TLSCACert = string(caCert)
+	}
+
+	if secretsPath := section.Key("secrets_path").String(); secretsPath != "" {
+		opts.SecretStore = FileSecretStore(secretsPath)
+	}
+
+	return opts, nil
+}
+
 type configReader struct {
 	encryptionService encryption.Service
 	log               log.Logger
+	opts              Options
 }
 
-func (cr *configReader) readConfig(ctx context.Context, path string) ([]*notificationsAsConfig, error) {
-	var notifications []*notificationsAsConfig
-	cr.log.Debug("Looking for alert notification provisioning files", "path", path)
-
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		cr.log.Error("Can't read alert notification provisioning files from directory", "path", path, "error", err)
-		return notifications, nil
-	}
+func isRemotePath(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
 
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml") {
-			cr.log.Debug("Parsing alert notifications provisioning file", "path", path, "file.Name", file.Name())
-			notifs, err := cr.parseNotificationConfig(path, file)
-			if err != nil {
-				return nil, err
-			}
+func (cr *configReader) readConfig(ctx context.Context, path string) ([]*notificationsAsConfig, error) {
+	return cr.readConfigs(ctx, path)
+}
 
-			if notifs != nil {
-				notifications = append(notifications, notifs)
-			}
+// readConfigs reads the provisioning files of every path, in order, e.g. a base directory then a directory of
+// overrides. A notifier with the uid and the org of a notifier read from an earlier path replaces it, the orgs
+// being defaulted beforehand so that a notifier without org overrides one of the main org and vice versa.
+// Validation runs once the files of all the paths are merged.
+func (cr *configReader) readConfigs(ctx context.Context, paths ...string) ([]*notificationsAsConfig, error) {
+	var notifications []*notificationsAsConfig
+	for _, path := range paths {
+		notifs, err := cr.loadConfig(ctx, path)
+		if err != nil {
+			return nil, err
 		}
+		defaultOrgIDs(notifs)
+		notifications = append(overrideNotifications(notifications, notifs), notifs...)
 	}
 
 	cr.log.Debug("Validating alert notifications")
-	if err = cr.validateRequiredField(notifications); err != nil {
+	if err := cr.validateRequiredField(notifications); err != nil {
 		return nil, err
 	}
 
@@ -55,6 +155,10 @@ func (cr *configReader) readConfig(ctx context.Context, path string) ([]*notific
 		return nil, err
 	}
 
+	if err := cr.resolveSecrets(ctx, notifications); err != nil {
+		return nil, err
+	}
+
 	if err := cr.validateNotifications(notifications); err != nil {
 		return nil, err
 	}
@@ -62,48 +166,222 @@ func (cr *configReader) readConfig(ctx context.Context, path string) ([]*notific
 	return notifications, nil
 }
 
+// notificationOverrideKey identifies a notifier across provisioning paths, by uid in the org it is configured for
+type notificationOverrideKey struct {
+	uid     string
+	orgID   int64
+	orgName string
+}
+
+// overrideNotifications removes from configs the notifiers that overrides provision again, notifiers without uid
+// are never overridden
+func overrideNotifications(configs []*notificationsAsConfig, overrides []*notificationsAsConfig) []*notificationsAsConfig {
+	overridden := make(map[notificationOverrideKey]struct{})
+	for _, cfg := range overrides {
+		for _, notification := range cfg.Notifications {
+			if notification.UID != "" {
+				overridden[notificationOverrideKey{notification.UID, notification.OrgID, notification.OrgName}] = struct{}{}
+			}
+		}
+	}
+	if len(overridden) == 0 {
+		return configs
+	}
+
+	for _, cfg := range configs {
+		kept := cfg.Notifications[:0]
+		for _, notification := range cfg.Notifications {
+			if _, ok := overridden[notificationOverrideKey{notification.UID, notification.OrgID, notification.OrgName}]; ok {
+				continue
+			}
+			kept = append(kept, notification)
+		}
+		cfg.Notifications = kept
+	}
+	return configs
+}
+
+// loadConfig reads the provisioning files of a directory, or the remote one of an HTTP(S) URL, without validating them
+func (cr *configReader) loadConfig(ctx context.Context, path string) ([]*notificationsAsConfig, error) {
+	var notifications []*notificationsAsConfig
+
+	if isRemotePath(path) {
+		cr.log.Debug("Fetching alert notification provisioning file", "url", path)
+		notifs, err := cr.readRemoteConfig(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if notifs != nil {
+			notifications = append(notifications, notifs)
+		}
+	} else {
+		cr.log.Debug("Looking for alert notification provisioning files", "path", path)
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			cr.log.Error("Can't read alert notification provisioning files from directory", "path", path, "error", err)
+			return notifications, nil
+		}
+
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), ".yaml") || strings.HasSuffix(file.Name(), ".yml") {
+				cr.log.Debug("Parsing alert notifications provisioning file", "path", path, "file.Name", file.Name())
+				notifs, err := cr.parseNotificationConfig(path, file)
+				if err != nil {
+					return nil, err
+				}
+
+				if notifs != nil {
+					notifications = append(notifications, notifs)
+				}
+			}
+		}
+	}
+
+	return notifications, nil
+}
+
 func (cr *configReader) parseNotificationConfig(path string, file os.FileInfo) (*notificationsAsConfig, error) {
 	filename, _ := filepath.Abs(filepath.Join(path, file.Name()))
+	return cr.parseNotificationConfigFile(filename, nil)
+}
+
+// parseNotificationConfigFile parses filename and merges the files listed in its include directive into it.
+// Relative includes are resolved from the directory of filename, including lists the files that led to filename.
+func (cr *configReader) parseNotificationConfigFile(filename string, including []string) (*notificationsAsConfig, error) {
+	for _, f := range including {
+		if f == filename {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrIncludeCycle, strings.Join(including, " -> "), filename)
+		}
+	}
 
 	// nolint:gosec
 	// We can ignore the gosec G304 warning on this one because `filename` comes from ps.Cfg.ProvisioningPath
+	// or from files included by it
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
+	cfg, err := parseNotificationConfigBytes(yamlFile, cr.opts.Strict)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	including = append(append([]string{}, including...), filename)
+	for _, include := range cfg.Includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+
+		cr.log.Debug("Parsing included alert notifications provisioning file", "file", filename, "include", include)
+		included, err := cr.parseNotificationConfigFile(include, including)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Notifications = append(cfg.Notifications, included.Notifications...)
+		cfg.DeleteNotifications = append(cfg.DeleteNotifications, included.DeleteNotifications...)
+	}
+	cfg.Includes = nil
+
+	return cfg, nil
+}
+
+func (cr *configReader) readRemoteConfig(ctx context.Context, url string) (*notificationsAsConfig, error) {
+	client, err := cr.opts.Remote.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteConfig, err)
+	}
+	if cr.opts.Remote.BasicAuthUser != "" {
+		req.SetBasicAuth(cr.opts.Remote.BasicAuthUser, cr.opts.Remote.BasicAuthPassword)
+	} else if cr.opts.Remote.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cr.opts.Remote.BearerToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteConfig, err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			cr.log.Warn("Failed to close response body", "url", url, "error", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded with status %d", ErrRemoteConfig, url, resp.StatusCode)
+	}
+
+	yamlFile, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemoteConfig, err)
+	}
+
+	cfg, err := parseNotificationConfigBytes(yamlFile, cr.opts.Strict)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	if len(cfg.Includes) > 0 {
+		return nil, fmt.Errorf("%w: %s uses include, which is only supported by local files", ErrRemoteConfig, url)
+	}
+
+	return cfg, nil
+}
+
+func parseNotificationConfigBytes(yamlFile []byte, strict bool) (*notificationsAsConfig, error) {
+	unmarshal := yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+
 	var cfg *notificationsAsConfigV0
-	err = yaml.Unmarshal(yamlFile, &cfg)
+	err := unmarshal(yamlFile, &cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return cfg.mapToNotificationFromConfig(), nil
+	return cfg.mapToNotificationFromConfig()
 }
 
-func (cr *configReader) checkOrgIDAndOrgName(ctx context.Context, notifications []*notificationsAsConfig) error {
+// defaultOrgIDs sets the org id of the notifiers without org id nor org name to the main org,
+// and the org id of those with an org name to 0 so that the org is looked up by name
+func defaultOrgIDs(notifications []*notificationsAsConfig) {
 	for i := range notifications {
 		for _, notification := range notifications[i].Notifications {
 			if notification.OrgID < 1 {
-				if notification.OrgName == "" {
-					notification.OrgID = 1
-				} else {
-					notification.OrgID = 0
-				}
-			} else {
-				if err := utils.CheckOrgExists(ctx, notification.OrgID); err != nil {
-					return fmt.Errorf("failed to provision %q notification: %w", notification.Name, err)
-				}
+				notification.OrgID = defaultOrgID(notification.OrgName)
 			}
 		}
 
 		for _, notification := range notifications[i].DeleteNotifications {
 			if notification.OrgID < 1 {
-				if notification.OrgName == "" {
-					notification.OrgID = 1
-				} else {
-					notification.OrgID = 0
-				}
+				notification.OrgID = defaultOrgID(notification.OrgName)
+			}
+		}
+	}
+}
+
+func defaultOrgID(orgName string) int64 {
+	if orgName == "" {
+		return 1
+	}
+	return 0
+}
+
+// checkOrgIDAndOrgName checks that the orgs given by id exist, the org ids having been defaulted by defaultOrgIDs
+func (cr *configReader) checkOrgIDAndOrgName(ctx context.Context, notifications []*notificationsAsConfig) error {
+	for i := range notifications {
+		for _, notification := range notifications[i].Notifications {
+			if notification.OrgID < 1 {
+				continue
+			}
+			if err := utils.CheckOrgExists(ctx, notification.OrgID); err != nil {
+				return fmt.Errorf("failed to provision %q notification: %w", notification.Name, err)
 			}
 		}
 	}
@@ -130,6 +408,16 @@ func (cr *configReader) validateRequiredField(notifications []*notificationsAsCo
 		}
 
 		for index, notification := range notifications[i].DeleteNotifications {
+			if notification.isTypeFilter() {
+				if !notification.DeleteAllOfType {
+					errStrings = append(
+						errStrings,
+						fmt.Sprintf("Deleted alert notification item %d in configuration deletes every notifier of type %s without delete_all_of_type", index+1, notification.Type),
+					)
+				}
+				continue
+			}
+
 			if notification.Name == "" {
 				errStrings = append(
 					errStrings,
@@ -153,6 +441,24 @@ func (cr *configReader) validateRequiredField(notifications []*notificationsAsCo
 	return nil
 }
 
+// decryptedValueWarningMissing returns an alerting.GetDecryptedValueFn warning when a secure setting the notifier
+// looks up is neither provisioned in secure_settings nor in settings, e.g. a misnamed secure setting key
+func (cr *configReader) decryptedValueWarningMissing(notification *notificationFromConfig) alerting.GetDecryptedValueFn {
+	return func(ctx context.Context, sjd map[string][]byte, key string, fallback string, secret string) string {
+		value, err := cr.encryptionService.DecryptValue(ctx, sjd, key, secret)
+		if errors.Is(err, encryption.ErrSecureSettingNotFound) {
+			if fallback == "" {
+				cr.log.Warn("Secure setting of provisioned notifier is missing", "notifier", notification.Name, "uid", notification.UID, "key", key)
+			}
+			return fallback
+		}
+		if err != nil {
+			return fallback
+		}
+		return value
+	}
+}
+
 func (cr *configReader) validateNotifications(notifications []*notificationsAsConfig) error {
 	for i := range notifications {
 		if notifications[i].Notifications == nil {
@@ -160,6 +466,16 @@ func (cr *configReader) validateNotifications(notifications []*notificationsAsCo
 		}
 
 		for _, notification := range notifications[i].Notifications {
+			// legacy setting keys are upgraded before validation, so the upgraded settings are the ones provisioned
+			notification.Settings = migrateSettings(notification.Type, notification.Settings)
+
+			// provisioning a redacted export as is would overwrite the stored secure settings with the placeholder
+			for key, value := range notification.SecureSettings {
+				if value == RedactedSecureSetting {
+					return fmt.Errorf("secure setting %q of alert notification %q is redacted, its value must be filled in before provisioning", key, notification.Name)
+				}
+			}
+
 			encryptedSecureSettings, err := cr.encryptionService.EncryptJsonData(
 				context.Background(),
 				notification.SecureSettings,
@@ -175,7 +491,7 @@ func (cr *configReader) validateNotifications(notifications []*notificationsAsCo
 				Settings:       notification.SettingsToJSON(),
 				SecureSettings: encryptedSecureSettings,
 				Type:           notification.Type,
-			}, cr.encryptionService.GetDecryptedValue)
+			}, cr.decryptedValueWarningMissing(notification))
 
 			if err != nil {
 				return err
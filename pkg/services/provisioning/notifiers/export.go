@@ -0,0 +1,98 @@
+package notifiers
+
+import (
+	"context"
+
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// RedactedSecureSetting replaces the secure settings of notifiers exported with SecureSettingsRedact
+const RedactedSecureSetting = "[REDACTED]"
+
+// SecureSettingsExport tells ExportNotifications how to export the secure settings of notifiers
+type SecureSettingsExport int
+
+const (
+	// SecureSettingsRedact keeps the secure setting keys and replaces their values with RedactedSecureSetting,
+	// the values must be filled in before provisioning the exported file, which is rejected otherwise
+	SecureSettingsRedact SecureSettingsExport = iota
+	// SecureSettingsDecrypt exports the secure settings in plain text, provisioning encrypts them again
+	SecureSettingsDecrypt
+)
+
+// NotificationsExport is a provisioning file of exported notifiers, it is read back like any version 0 file,
+// see notificationsAsConfigV0
+type NotificationsExport struct {
+	Notifications []*NotificationExport `json:"notifiers" yaml:"notifiers"`
+}
+
+// NotificationExport is an exported notifier, see notificationFromConfigV0
+type NotificationExport struct {
+	UID                   string                 `json:"uid" yaml:"uid"`
+	OrgID                 int64                  `json:"org_id" yaml:"org_id"`
+	Name                  string                 `json:"name" yaml:"name"`
+	Type                  string                 `json:"type" yaml:"type"`
+	SendReminder          bool                   `json:"send_reminder" yaml:"send_reminder"`
+	DisableResolveMessage bool                   `json:"disable_resolve_message" yaml:"disable_resolve_message"`
+	Frequency             string                 `json:"frequency,omitempty" yaml:"frequency,omitempty"`
+	IsDefault             bool                   `json:"is_default" yaml:"is_default"`
+	Settings              map[string]interface{} `json:"settings,omitempty" yaml:"settings,omitempty"`
+	SecureSettings        map[string]string      `json:"secure_settings,omitempty" yaml:"secure_settings,omitempty"`
+}
+
+// ExportNotifications returns the notifiers of an org in the provisioning file format,
+// secureSettings tells whether their secure settings are redacted or decrypted
+func ExportNotifications(ctx context.Context, orgID int64, encryptionService encryption.Service, secureSettings SecureSettingsExport) (*NotificationsExport, error) {
+	query := &models.GetAllAlertNotificationsQuery{OrgId: orgID}
+	if err := bus.DispatchCtx(ctx, query); err != nil {
+		return nil, err
+	}
+
+	export := &NotificationsExport{Notifications: make([]*NotificationExport, 0, len(query.Result))}
+	for _, notification := range query.Result {
+		exported := &NotificationExport{
+			UID:                   notification.Uid,
+			OrgID:                 notification.OrgId,
+			Name:                  notification.Name,
+			Type:                  notification.Type,
+			SendReminder:          notification.SendReminder,
+			DisableResolveMessage: notification.DisableResolveMessage,
+			IsDefault:             notification.IsDefault,
+		}
+		if notification.Frequency != 0 {
+			exported.Frequency = notification.Frequency.String()
+		}
+		if notification.Settings != nil {
+			settings, err := notification.Settings.Map()
+			if err != nil {
+				return nil, err
+			}
+			if len(settings) > 0 {
+				exported.Settings = settings
+			}
+		}
+
+		if len(notification.SecureSettings) > 0 {
+			switch secureSettings {
+			case SecureSettingsDecrypt:
+				decrypted, err := encryptionService.DecryptJsonData(ctx, notification.SecureSettings, setting.SecretKey)
+				if err != nil {
+					return nil, err
+				}
+				exported.SecureSettings = decrypted
+			default:
+				exported.SecureSettings = make(map[string]string, len(notification.SecureSettings))
+				for key := range notification.SecureSettings {
+					exported.SecureSettings[key] = RedactedSecureSetting
+				}
+			}
+		}
+
+		export.Notifications = append(export.Notifications, exported)
+	}
+
+	return export, nil
+}
@@ -0,0 +1,151 @@
+package notifiers
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/components/simplejson"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/alerting"
+	"github.com/grafana/grafana/pkg/services/alerting/notifiers"
+	"github.com/grafana/grafana/pkg/services/encryption/ossencryption"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestExportNotifications(t *testing.T) {
+	encryptionService := ossencryption.ProvideService()
+	logger := log.New("fake.log")
+
+	alerting.RegisterNotifier(&alerting.NotifierPlugin{
+		Type:    "slack",
+		Name:    "slack",
+		Factory: notifiers.NewSlackNotifier,
+	})
+	alerting.RegisterNotifier(&alerting.NotifierPlugin{
+		Type:    "email",
+		Name:    "email",
+		Factory: notifiers.NewEmailNotifier,
+	})
+
+	initDB := func(t *testing.T) *sqlstore.SQLStore {
+		sqlStore := sqlstore.InitTestDB(t)
+		setupBusHandlers(sqlStore)
+		require.NoError(t, sqlstore.CreateOrg(context.Background(), &models.CreateOrgCommand{Name: "Main Org."}))
+		return sqlStore
+	}
+
+	setup := func(t *testing.T) *sqlstore.SQLStore {
+		sqlStore := initDB(t)
+
+		secureSettings, err := encryptionService.EncryptJsonData(context.Background(), map[string]string{"url": "https://hooks.slack.com/secret"}, setting.SecretKey)
+		require.NoError(t, err)
+		for _, cmd := range []*models.CreateAlertNotificationCommand{
+			{
+				Uid:                     "slack-notifier",
+				OrgId:                   1,
+				Name:                    "slack",
+				Type:                    "slack",
+				IsDefault:               true,
+				Settings:                simplejson.NewFromAny(map[string]interface{}{"recipient": "#alerts"}),
+				EncryptedSecureSettings: secureSettings,
+			},
+			{
+				Uid:                   "email-notifier",
+				OrgId:                 1,
+				Name:                  "email",
+				Type:                  "email",
+				SendReminder:          true,
+				Frequency:             "1h",
+				DisableResolveMessage: true,
+				Settings:              simplejson.NewFromAny(map[string]interface{}{"addresses": "ops@example.com"}),
+			},
+		} {
+			require.NoError(t, sqlStore.CreateAlertNotificationCommand(context.Background(), cmd))
+		}
+		return sqlStore
+	}
+
+	t.Run("should export notifiers which are provisioned back identically", func(t *testing.T) {
+		sqlStore := setup(t)
+
+		export, err := ExportNotifications(context.Background(), 1, encryptionService, SecureSettingsDecrypt)
+		require.NoError(t, err)
+		require.Len(t, export.Notifications, 2)
+		require.Equal(t, map[string]string{"url": "https://hooks.slack.com/secret"}, export.Notifications[1].SecureSettings)
+
+		exported, err := yaml.Marshal(export)
+		require.NoError(t, err)
+		dir := t.TempDir()
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notifiers.yaml"), exported, 0600))
+
+		original := models.GetAllAlertNotificationsQuery{OrgId: 1}
+		require.NoError(t, sqlStore.GetAllAlertNotifications(context.Background(), &original))
+
+		cfgProvider := &configReader{encryptionService: encryptionService, log: logger}
+		cfg, err := cfgProvider.readConfig(context.Background(), dir)
+		require.NoError(t, err)
+		require.Len(t, cfg, 1)
+		require.Len(t, cfg[0].Notifications, 2)
+		require.Equal(t, export.Notifications[1].SecureSettings, cfg[0].Notifications[1].SecureSettings)
+
+		// provision the export into an empty database
+		sqlStore = initDB(t)
+		dc := newNotificationProvisioner(encryptionService, logger)
+		require.NoError(t, dc.applyChanges(context.Background(), dir))
+
+		reimported := models.GetAllAlertNotificationsQuery{OrgId: 1}
+		require.NoError(t, sqlStore.GetAllAlertNotifications(context.Background(), &reimported))
+		require.Len(t, reimported.Result, len(original.Result))
+		for i, nt := range reimported.Result {
+			expected := original.Result[i]
+			require.Equal(t, expected.Uid, nt.Uid)
+			require.Equal(t, expected.Name, nt.Name)
+			require.Equal(t, expected.Type, nt.Type)
+			require.Equal(t, expected.IsDefault, nt.IsDefault)
+			require.Equal(t, expected.SendReminder, nt.SendReminder)
+			require.Equal(t, expected.DisableResolveMessage, nt.DisableResolveMessage)
+			require.Equal(t, expected.Frequency, nt.Frequency)
+			require.Equal(t, expected.Settings, nt.Settings)
+		}
+		require.Equal(t, time.Hour, reimported.Result[0].Frequency)
+	})
+
+	t.Run("should redact secure settings", func(t *testing.T) {
+		setup(t)
+
+		export, err := ExportNotifications(context.Background(), 1, encryptionService, SecureSettingsRedact)
+		require.NoError(t, err)
+		require.Len(t, export.Notifications, 2)
+		require.Empty(t, export.Notifications[0].SecureSettings)
+		require.Equal(t, map[string]string{"url": RedactedSecureSetting}, export.Notifications[1].SecureSettings)
+	})
+
+	t.Run("should reject provisioning a redacted export back and keep the stored secure settings", func(t *testing.T) {
+		sqlStore := setup(t)
+
+		export, err := ExportNotifications(context.Background(), 1, encryptionService, SecureSettingsRedact)
+		require.NoError(t, err)
+		exported, err := yaml.Marshal(export)
+		require.NoError(t, err)
+		dir := t.TempDir()
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notifiers.yaml"), exported, 0600))
+
+		dc := newNotificationProvisioner(encryptionService, logger)
+		err = dc.applyChanges(context.Background(), dir)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "is redacted")
+
+		stored := models.GetAlertNotificationsWithUidQuery{OrgId: 1, Uid: "slack-notifier"}
+		require.NoError(t, sqlStore.GetAlertNotificationsWithUid(context.Background(), &stored))
+		decrypted, err := encryptionService.DecryptJsonData(context.Background(), stored.Result.SecureSettings, setting.SecretKey)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"url": "https://hooks.slack.com/secret"}, decrypted)
+	})
+}
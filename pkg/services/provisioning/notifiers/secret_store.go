@@ -0,0 +1,127 @@
+package notifiers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrSecretNotFound is returned when a secretjson directive refers to a secret or a JSON path which does not exist
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore returns the JSON bundles of secrets referenced by the secure settings of notifiers,
+// see Options
+type SecretStore interface {
+	// GetSecret returns the JSON document of the named secret, or an error wrapping ErrSecretNotFound
+	GetSecret(ctx context.Context, name string) ([]byte, error)
+}
+
+// FileSecretStore is a SecretStore reading the secret <name> from the file <name>.json of the directory
+type FileSecretStore string
+
+func (dir FileSecretStore) GetSecret(_ context.Context, name string) ([]byte, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+
+	// nolint:gosec
+	// The secret name can't escape the directory of the store, which comes from the configuration
+	secret, err := ioutil.ReadFile(filepath.Join(string(dir), name+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return secret, err
+}
+
+// secretJSONDirective matches a secure setting pulling a value out of a JSON secret, e.g. ${secretjson:creds#/slack/token}
+// pulls the token of the slack object of the creds secret. The path is a JSON pointer, see RFC 6901.
+var secretJSONDirective = regexp.MustCompile(`^\$\{secretjson:([^#}]+)#([^}]*)\}$`)
+
+func isSecretJSONDirective(value string) bool {
+	return secretJSONDirective.MatchString(value)
+}
+
+// resolveSecrets replaces the secure settings made of a secretjson directive with the value they point to
+func (cr *configReader) resolveSecrets(ctx context.Context, notifications []*notificationsAsConfig) error {
+	bundles := make(map[string]interface{})
+	for _, cfg := range notifications {
+		for _, notification := range cfg.Notifications {
+			for key, value := range notification.SecureSettings {
+				match := secretJSONDirective.FindStringSubmatch(value)
+				if match == nil {
+					continue
+				}
+				if cr.opts.SecretStore == nil {
+					return fmt.Errorf("notifier %q: secure setting %q requires a secret store", notification.Name, key)
+				}
+
+				name, path := match[1], match[2]
+				secret, ok := bundles[name]
+				if !ok {
+					raw, err := cr.opts.SecretStore.GetSecret(ctx, name)
+					if err != nil {
+						return fmt.Errorf("notifier %q: secure setting %q: %w", notification.Name, key, err)
+					}
+					if err := json.Unmarshal(raw, &secret); err != nil {
+						return fmt.Errorf("notifier %q: secure setting %q: secret %s is not valid JSON: %w", notification.Name, key, name, err)
+					}
+					bundles[name] = secret
+				}
+
+				resolved, err := lookupJSONPointer(secret, path)
+				if err != nil {
+					return fmt.Errorf("notifier %q: secure setting %q: secret %s: %w", notification.Name, key, name, err)
+				}
+				notification.SecureSettings[key] = resolved
+			}
+		}
+	}
+	return nil
+}
+
+// lookupJSONPointer returns the string, number or boolean the JSON pointer points to in document
+func lookupJSONPointer(document interface{}, pointer string) (string, error) {
+	if pointer != "" && !strings.HasPrefix(pointer, "/") {
+		return "", fmt.Errorf("invalid JSON path %q, expected a JSON pointer such as /slack/token", pointer)
+	}
+
+	value := document
+	if pointer != "" {
+		for _, token := range strings.Split(pointer[1:], "/") {
+			token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+
+			switch v := value.(type) {
+			case map[string]interface{}:
+				child, ok := v[token]
+				if !ok {
+					return "", fmt.Errorf("%w: no value at JSON path %s", ErrSecretNotFound, pointer)
+				}
+				value = child
+			case []interface{}:
+				index, err := strconv.Atoi(token)
+				if err != nil || index < 0 || index >= len(v) {
+					return "", fmt.Errorf("%w: no value at JSON path %s", ErrSecretNotFound, pointer)
+				}
+				value = v[index]
+			default:
+				return "", fmt.Errorf("%w: no value at JSON path %s", ErrSecretNotFound, pointer)
+			}
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("JSON path %s does not point to a string, a number or a boolean", pointer)
+	}
+}
@@ -0,0 +1,52 @@
+package notifiers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupJSONPointer(t *testing.T) {
+	var document interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"slack": {"token": "xoxb", "port": 443, "enabled": true},
+		"emails": ["ops@example.com", "dev@example.com"],
+		"a/b": {"c~d": "escaped"}
+	}`), &document))
+
+	tests := []struct {
+		desc     string
+		pointer  string
+		expected string
+		notFound bool
+		err      bool
+	}{
+		{desc: "should resolve a nested string", pointer: "/slack/token", expected: "xoxb"},
+		{desc: "should resolve a number", pointer: "/slack/port", expected: "443"},
+		{desc: "should resolve a boolean", pointer: "/slack/enabled", expected: "true"},
+		{desc: "should resolve an array index", pointer: "/emails/1", expected: "dev@example.com"},
+		{desc: "should resolve escaped tokens", pointer: "/a~1b/c~0d", expected: "escaped"},
+		{desc: "should not find a missing key", pointer: "/slack/url", notFound: true},
+		{desc: "should not find an index out of range", pointer: "/emails/2", notFound: true},
+		{desc: "should not find a child of a string", pointer: "/slack/token/value", notFound: true},
+		{desc: "should reject a path to an object", pointer: "/slack", err: true},
+		{desc: "should reject a path which is not a JSON pointer", pointer: "slack.token", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			value, err := lookupJSONPointer(document, tt.pointer)
+			switch {
+			case tt.notFound:
+				require.ErrorIs(t, err, ErrSecretNotFound)
+			case tt.err:
+				require.Error(t, err)
+				require.NotErrorIs(t, err, ErrSecretNotFound)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, tt.expected, value)
+			}
+		})
+	}
+}
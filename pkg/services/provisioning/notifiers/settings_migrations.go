@@ -0,0 +1,49 @@
+package notifiers
+
+import "sync"
+
+// SettingsMigration upgrades the settings of a notifier provisioned with a previous settings schema of its type
+// to the current one, e.g. by renaming a legacy key. It must leave settings already in the current schema unchanged.
+type SettingsMigration func(settings map[string]interface{}) map[string]interface{}
+
+var (
+	settingsMigrationsMtx sync.RWMutex
+	settingsMigrations    = map[string][]SettingsMigration{}
+)
+
+// RegisterSettingsMigration registers a migration of the settings of the notifiers of type notifierType,
+// the migrations of a type run in the order they are registered
+func RegisterSettingsMigration(notifierType string, migration SettingsMigration) {
+	settingsMigrationsMtx.Lock()
+	defer settingsMigrationsMtx.Unlock()
+	settingsMigrations[notifierType] = append(settingsMigrations[notifierType], migration)
+}
+
+// RenameSettingMigration returns a migration moving the value of the setting oldKey to newKey,
+// unless newKey is already set
+func RenameSettingMigration(oldKey, newKey string) SettingsMigration {
+	return func(settings map[string]interface{}) map[string]interface{} {
+		value, ok := settings[oldKey]
+		if !ok {
+			return settings
+		}
+		delete(settings, oldKey)
+		if _, exists := settings[newKey]; !exists {
+			settings[newKey] = value
+		}
+		return settings
+	}
+}
+
+// migrateSettings runs the registered migrations of the notifier type on its settings
+func migrateSettings(notifierType string, settings map[string]interface{}) map[string]interface{} {
+	settingsMigrationsMtx.RLock()
+	defer settingsMigrationsMtx.RUnlock()
+	for _, migration := range settingsMigrations[notifierType] {
+		if settings == nil {
+			settings = map[string]interface{}{}
+		}
+		settings = migration(settings)
+	}
+	return settings
+}
@@ -1,6 +1,10 @@
 package notifiers
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/services/provisioning/values"
 )
@@ -10,6 +14,7 @@ import (
 type notificationsAsConfig struct {
 	Notifications       []*notificationFromConfig
 	DeleteNotifications []*deleteNotificationConfig
+	Includes            []string
 }
 
 type deleteNotificationConfig struct {
@@ -17,6 +22,15 @@ type deleteNotificationConfig struct {
 	Name    string
 	OrgID   int64
 	OrgName string
+	// Type restricts the deletion to notifiers of the type. Without name and uid, every notifier of the type in the org
+	// is deleted, which DeleteAllOfType must acknowledge.
+	Type            string
+	DeleteAllOfType bool
+}
+
+// isTypeFilter tells whether the entry deletes every notifier of its type in its org rather than a single notifier
+func (notification *deleteNotificationConfig) isTypeFilter() bool {
+	return notification.Type != "" && notification.Name == "" && notification.UID == ""
 }
 
 type notificationFromConfig struct {
@@ -37,19 +51,34 @@ type notificationFromConfig struct {
 type notificationsAsConfigV0 struct {
 	Notifications       []*notificationFromConfigV0   `json:"notifiers" yaml:"notifiers"`
 	DeleteNotifications []*deleteNotificationConfigV0 `json:"delete_notifiers" yaml:"delete_notifiers"`
+	Includes            []values.StringValue          `json:"include" yaml:"include"`
+	// EnvPrefix makes the environment variables referenced by the settings of the notifiers of the file resolve
+	// against <env_prefix>_<name>, e.g. to scope them per org
+	EnvPrefix values.StringValue `json:"env_prefix" yaml:"env_prefix"`
+	// Defaults apply to every notifier of the file, unless the notifier overrides them
+	Defaults *notificationDefaultsV0 `json:"defaults" yaml:"defaults"`
+}
+
+// notificationDefaultsV0 is the defaults block of a config file, e.g. to set uploadImage once for all its notifiers
+type notificationDefaultsV0 struct {
+	Settings values.JSONValue `json:"settings" yaml:"settings"`
 }
 
 type deleteNotificationConfigV0 struct {
-	UID     values.StringValue `json:"uid" yaml:"uid"`
-	Name    values.StringValue `json:"name" yaml:"name"`
-	OrgID   values.Int64Value  `json:"org_id" yaml:"org_id"`
-	OrgName values.StringValue `json:"org_name" yaml:"org_name"`
+	UID             values.StringValue  `json:"uid" yaml:"uid"`
+	Name            values.StringValue  `json:"name" yaml:"name"`
+	OrgID           values.Int64Value   `json:"org_id" yaml:"org_id"`
+	OrgName         values.StringValue  `json:"org_name" yaml:"org_name"`
+	OrgIDs          []values.Int64Value `json:"orgs" yaml:"orgs"`
+	Type            values.StringValue  `json:"type" yaml:"type"`
+	DeleteAllOfType values.BoolValue    `json:"delete_all_of_type" yaml:"delete_all_of_type"`
 }
 
 type notificationFromConfigV0 struct {
 	UID                   values.StringValue    `json:"uid" yaml:"uid"`
 	OrgID                 values.Int64Value     `json:"org_id" yaml:"org_id"`
 	OrgName               values.StringValue    `json:"org_name" yaml:"org_name"`
+	OrgIDs                []values.Int64Value   `json:"orgs" yaml:"orgs"`
 	Name                  values.StringValue    `json:"name" yaml:"name"`
 	Type                  values.StringValue    `json:"type" yaml:"type"`
 	SendReminder          values.BoolValue      `json:"send_reminder" yaml:"send_reminder"`
@@ -58,6 +87,8 @@ type notificationFromConfigV0 struct {
 	IsDefault             values.BoolValue      `json:"is_default" yaml:"is_default"`
 	Settings              values.JSONValue      `json:"settings" yaml:"settings"`
 	SecureSettings        values.StringMapValue `json:"secure_settings" yaml:"secure_settings"`
+	// EnableWhen skips the notifier when it is falsey once interpolated, e.g. ${PAGERDUTY_ENABLED}
+	EnableWhen values.StringValue `json:"enable_when" yaml:"enable_when"`
 }
 
 func (notification notificationFromConfig) SettingsToJSON() *simplejson.Json {
@@ -72,36 +103,186 @@ func (notification notificationFromConfig) SettingsToJSON() *simplejson.Json {
 
 // mapToNotificationFromConfig maps config syntax to normalized notificationsAsConfig object. Every version
 // of the config syntax should have this function.
-func (cfg *notificationsAsConfigV0) mapToNotificationFromConfig() *notificationsAsConfig {
+func (cfg *notificationsAsConfigV0) mapToNotificationFromConfig() (*notificationsAsConfig, error) {
 	r := &notificationsAsConfig{}
 	if cfg == nil {
-		return r
+		return r, nil
+	}
+
+	defaultSettings, err := cfg.interpolateDefaultSettings()
+	if err != nil {
+		return nil, fmt.Errorf("defaults: %w", err)
 	}
 
 	for _, notification := range cfg.Notifications {
-		r.Notifications = append(r.Notifications, &notificationFromConfig{
+		enabled, err := cfg.isEnabled(notification)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %q: %w", notification.Name.Value(), err)
+		}
+		if !enabled {
+			continue
+		}
+
+		settings, secureSettings, err := cfg.interpolateSettings(notification)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %q: %w", notification.Name.Value(), err)
+		}
+		settings = mergeDefaultSettings(defaultSettings, settings)
+
+		r.Notifications = append(r.Notifications, expandNotificationOrgs(&notificationFromConfig{
 			UID:                   notification.UID.Value(),
 			OrgID:                 notification.OrgID.Value(),
 			OrgName:               notification.OrgName.Value(),
 			Name:                  notification.Name.Value(),
 			Type:                  notification.Type.Value(),
 			IsDefault:             notification.IsDefault.Value(),
-			Settings:              notification.Settings.Value(),
+			Settings:              settings,
 			DisableResolveMessage: notification.DisableResolveMessage.Value(),
 			Frequency:             notification.Frequency.Value(),
 			SendReminder:          notification.SendReminder.Value(),
-			SecureSettings:        notification.SecureSettings.Value(),
-		})
+			SecureSettings:        secureSettings,
+		}, notification.OrgIDs)...)
 	}
 
 	for _, notification := range cfg.DeleteNotifications {
-		r.DeleteNotifications = append(r.DeleteNotifications, &deleteNotificationConfig{
-			UID:     notification.UID.Value(),
-			OrgID:   notification.OrgID.Value(),
-			OrgName: notification.OrgName.Value(),
-			Name:    notification.Name.Value(),
-		})
+		r.DeleteNotifications = append(r.DeleteNotifications, expandDeleteNotificationOrgs(&deleteNotificationConfig{
+			UID:             notification.UID.Value(),
+			OrgID:           notification.OrgID.Value(),
+			OrgName:         notification.OrgName.Value(),
+			Name:            notification.Name.Value(),
+			Type:            notification.Type.Value(),
+			DeleteAllOfType: notification.DeleteAllOfType.Value(),
+		}, notification.OrgIDs)...)
+	}
+
+	for _, include := range cfg.Includes {
+		r.Includes = append(r.Includes, include.Value())
+	}
+
+	return r, nil
+}
+
+// isEnabled evaluates the enable_when condition of the notification. Notifications without condition are enabled,
+// the others are skipped, but not deleted, when the interpolated condition is falsey: empty, "false", "0", "no" or "off".
+// A missing environment variable is empty.
+func (cfg *notificationsAsConfigV0) isEnabled(notification *notificationFromConfigV0) (bool, error) {
+	if notification.EnableWhen.Raw == "" {
+		return true, nil
+	}
+
+	condition := notification.EnableWhen.Value()
+	if prefix := cfg.EnvPrefix.Value(); prefix != "" {
+		var err error
+		condition, err = values.InterpolateWithEnvPrefix(notification.EnableWhen.Raw, prefix)
+		if errors.Is(err, values.ErrMissingEnvVar) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(condition)) {
+	case "", "false", "0", "no", "off":
+		return false, nil
+	}
+	return true, nil
+}
+
+// interpolateSettings returns the settings and secure settings of the notification, interpolated against the
+// environment variables prefixed by the env prefix of the file when it has one.
+// Secure settings made of a secretjson directive are kept as is, they are resolved against the secret store.
+func (cfg *notificationsAsConfigV0) interpolateSettings(notification *notificationFromConfigV0) (map[string]interface{}, map[string]string, error) {
+	prefix := cfg.EnvPrefix.Value()
+	if prefix == "" {
+		secureSettings := notification.SecureSettings.Value()
+		for key, raw := range notification.SecureSettings.Raw {
+			if isSecretJSONDirective(raw) {
+				secureSettings[key] = raw
+			}
+		}
+		return notification.Settings.Value(), secureSettings, nil
+	}
+
+	settings, err := values.InterpolateMapWithEnvPrefix(notification.Settings.Raw, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var secureSettings map[string]string
+	if notification.SecureSettings.Raw != nil {
+		secureSettings = make(map[string]string, len(notification.SecureSettings.Raw))
+		for key, raw := range notification.SecureSettings.Raw {
+			if isSecretJSONDirective(raw) {
+				secureSettings[key] = raw
+				continue
+			}
+			if secureSettings[key], err = values.InterpolateWithEnvPrefix(raw, prefix); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return settings, secureSettings, nil
+}
+
+// interpolateDefaultSettings returns the settings of the defaults block of the file, interpolated like the settings
+// of its notifiers
+func (cfg *notificationsAsConfigV0) interpolateDefaultSettings() (map[string]interface{}, error) {
+	if cfg.Defaults == nil {
+		return nil, nil
+	}
+	if prefix := cfg.EnvPrefix.Value(); prefix != "" {
+		return values.InterpolateMapWithEnvPrefix(cfg.Defaults.Settings.Raw, prefix)
+	}
+	return cfg.Defaults.Settings.Value(), nil
+}
+
+// mergeDefaultSettings returns the settings of a notifier complemented with the default settings it doesn't set.
+// Settings are merged by top-level key, a notifier setting an object overrides the whole default object.
+func mergeDefaultSettings(defaults, settings map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return settings
+	}
+
+	merged := make(map[string]interface{}, len(defaults)+len(settings))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range settings {
+		merged[key] = value
+	}
+	return merged
+}
+
+// expandNotificationOrgs returns one notification per org listed in orgs, the notification itself when there are none.
+// UIDs are unique per org, so every org keeps the declared UID.
+func expandNotificationOrgs(notification *notificationFromConfig, orgs []values.Int64Value) []*notificationFromConfig {
+	if len(orgs) == 0 {
+		return []*notificationFromConfig{notification}
 	}
 
-	return r
+	expanded := make([]*notificationFromConfig, 0, len(orgs))
+	for _, org := range orgs {
+		orgNotification := *notification
+		orgNotification.OrgID = org.Value()
+		orgNotification.OrgName = ""
+		expanded = append(expanded, &orgNotification)
+	}
+	return expanded
+}
+
+// expandDeleteNotificationOrgs returns one deleted notification per org listed in orgs, the notification itself when there are none
+func expandDeleteNotificationOrgs(notification *deleteNotificationConfig, orgs []values.Int64Value) []*deleteNotificationConfig {
+	if len(orgs) == 0 {
+		return []*deleteNotificationConfig{notification}
+	}
+
+	expanded := make([]*deleteNotificationConfig, 0, len(orgs))
+	for _, org := range orgs {
+		orgNotification := *notification
+		orgNotification.OrgID = org.Value()
+		orgNotification.OrgName = ""
+		expanded = append(expanded, &orgNotification)
+	}
+	return expanded
 }
@@ -59,7 +59,7 @@ func NewProvisioningServiceImpl() *ProvisioningServiceImpl {
 // Used for testing purposes
 func newProvisioningServiceImpl(
 	newDashboardProvisioner dashboards.DashboardProvisionerFactory,
-	provisionNotifiers func(context.Context, string, encryption.Service) error,
+	provisionNotifiers func(context.Context, notifiers.Options, encryption.Service) error,
 	provisionDatasources func(context.Context, string) error,
 	provisionPlugins func(string, plugifaces.Store) error,
 ) *ProvisioningServiceImpl {
@@ -81,7 +81,7 @@ type ProvisioningServiceImpl struct {
 	pollingCtxCancel        context.CancelFunc
 	newDashboardProvisioner dashboards.DashboardProvisionerFactory
 	dashboardProvisioner    dashboards.DashboardProvisioner
-	provisionNotifiers      func(context.Context, string, encryption.Service) error
+	provisionNotifiers      func(context.Context, notifiers.Options, encryption.Service) error
 	provisionDatasources    func(context.Context, string) error
 	provisionPlugins        func(string, plugifaces.Store) error
 	mutex                   sync.Mutex
@@ -148,8 +148,11 @@ func (ps *ProvisioningServiceImpl) ProvisionPlugins() error {
 }
 
 func (ps *ProvisioningServiceImpl) ProvisionNotifications(ctx context.Context) error {
-	alertNotificationsPath := filepath.Join(ps.Cfg.ProvisioningPath, "notifiers")
-	err := ps.provisionNotifiers(ctx, alertNotificationsPath, ps.EncryptionService)
+	opts, err := notifiers.OptionsFromCfg(ps.Cfg)
+	if err != nil {
+		return errutil.Wrap("Alert notification provisioning error", err)
+	}
+	err = ps.provisionNotifiers(ctx, opts, ps.EncryptionService)
 	return errutil.Wrap("Alert notification provisioning error", err)
 }
 
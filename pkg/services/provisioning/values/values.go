@@ -11,6 +11,7 @@
 package values
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
@@ -279,3 +280,80 @@ func getInterpolated(unmarshal func(interface{}) error) (*interpolated, error) {
 	}
 	return &interpolated{raw: raw, value: value}, nil
 }
+
+// ErrMissingEnvVar is returned when a value interpolated with an env prefix references a variable which is not set
+var ErrMissingEnvVar = errors.New("environment variable is not set")
+
+// InterpolateWithEnvPrefix interpolates a raw value like the value types do, except that each environment variable
+// resolves against <prefix>_<name>, e.g. ${SLACK_TOKEN} resolves to the value of ORG1_SLACK_TOKEN with the prefix ORG1.
+// Unlike os.ExpandEnv, it fails with ErrMissingEnvVar when a prefixed variable is not set.
+func InterpolateWithEnvPrefix(val, prefix string) (string, error) {
+	parts := strings.Split(val, "$$")
+	interpolated := make([]string, len(parts))
+	for i, v := range parts {
+		// environment variables are resolved before the expanders, which would resolve them without the prefix
+		var missing []string
+		v = os.Expand(v, func(name string) string {
+			// leave the expanders, e.g. $__file{path}, to setting.ExpandVar
+			if strings.HasPrefix(name, "__") {
+				return "$" + name
+			}
+			value, ok := os.LookupEnv(prefix + "_" + name)
+			if !ok {
+				missing = append(missing, prefix+"_"+name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return val, fmt.Errorf("failed to interpolate value '%s': %w: %s", val, ErrMissingEnvVar, strings.Join(missing, ", "))
+		}
+
+		expanded, err := setting.ExpandVar(v)
+		if err != nil {
+			return val, fmt.Errorf("failed to interpolate value '%s': %w", val, err)
+		}
+		interpolated[i] = expanded
+	}
+	return strings.Join(interpolated, "$"), nil
+}
+
+// InterpolateMapWithEnvPrefix interpolates the string values of the Raw value of a JSONValue, traversing nested maps
+// and slices, see InterpolateWithEnvPrefix
+func InterpolateMapWithEnvPrefix(raw map[string]interface{}, prefix string) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	interpolated, err := interpolateRawWithEnvPrefix(raw, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return interpolated.(map[string]interface{}), nil
+}
+
+func interpolateRawWithEnvPrefix(i interface{}, prefix string) (interface{}, error) {
+	switch v := i.(type) {
+	case map[string]interface{}:
+		interpolated := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			var err error
+			if interpolated[key], err = interpolateRawWithEnvPrefix(val, prefix); err != nil {
+				return nil, err
+			}
+		}
+		return interpolated, nil
+	case []interface{}:
+		interpolated := make([]interface{}, 0, len(v))
+		for _, val := range v {
+			transformed, err := interpolateRawWithEnvPrefix(val, prefix)
+			if err != nil {
+				return nil, err
+			}
+			interpolated = append(interpolated, transformed)
+		}
+		return interpolated, nil
+	case string:
+		return InterpolateWithEnvPrefix(v, prefix)
+	default:
+		return i, nil
+	}
+}
@@ -258,6 +258,55 @@ func unmarshalingTest(t *testing.T, document string, out interface{}) {
 	require.NoError(t, err)
 }
 
+func TestInterpolateWithEnvPrefix(t *testing.T) {
+	t.Setenv("ORG1_SLACK_TOKEN", "token1")
+	t.Setenv("ORG2_SLACK_TOKEN", "token2")
+	t.Setenv("SLACK_TOKEN", "unprefixed")
+
+	t.Run("should resolve against the prefixed variable", func(t *testing.T) {
+		for prefix, expected := range map[string]string{"ORG1": "Bearer token1", "ORG2": "Bearer token2"} {
+			interpolated, err := InterpolateWithEnvPrefix("Bearer ${SLACK_TOKEN}", prefix)
+			require.NoError(t, err)
+			assert.Equal(t, expected, interpolated)
+		}
+	})
+
+	t.Run("$$ should be a literal $", func(t *testing.T) {
+		interpolated, err := InterpolateWithEnvPrefix("$$SLACK_TOKEN $SLACK_TOKEN", "ORG1")
+		require.NoError(t, err)
+		assert.Equal(t, "$SLACK_TOKEN token1", interpolated)
+	})
+
+	t.Run("should leave the expanders unprefixed", func(t *testing.T) {
+		interpolated, err := InterpolateWithEnvPrefix("$__env{SLACK_TOKEN} $SLACK_TOKEN", "ORG1")
+		require.NoError(t, err)
+		assert.Equal(t, "unprefixed token1", interpolated)
+	})
+
+	t.Run("should fail when the prefixed variable is not set", func(t *testing.T) {
+		_, err := InterpolateWithEnvPrefix("${SLACK_TOKEN}", "ORG3")
+		require.ErrorIs(t, err, ErrMissingEnvVar)
+		assert.Contains(t, err.Error(), "ORG3_SLACK_TOKEN")
+	})
+
+	t.Run("should interpolate nested values", func(t *testing.T) {
+		interpolated, err := InterpolateMapWithEnvPrefix(map[string]interface{}{
+			"token":   "$SLACK_TOKEN",
+			"retries": 3,
+			"nested":  map[string]interface{}{"tokens": []interface{}{"$SLACK_TOKEN", "static"}},
+		}, "ORG2")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"token":   "token2",
+			"retries": 3,
+			"nested":  map[string]interface{}{"tokens": []interface{}{"token2", "static"}},
+		}, interpolated)
+
+		_, err = InterpolateMapWithEnvPrefix(map[string]interface{}{"nested": []interface{}{"$MISSING"}}, "ORG2")
+		require.ErrorIs(t, err, ErrMissingEnvVar)
+	})
+}
+
 func TestValues_readFile(t *testing.T) {
 	type Data struct {
 		Val StringValue `yaml:"val"`
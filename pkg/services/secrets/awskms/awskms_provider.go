@@ -0,0 +1,90 @@
+package awskms
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+const providerPrefix = "awskms"
+
+// ProviderID returns the ID the provider configured under name must be registered with.
+// It only depends on the name and not on the key, so that DEKs remain bound to the provider
+// when the key behind an alias is rotated.
+func ProviderID(name string) string {
+	return providerPrefix + "." + name
+}
+
+type awsKMSProvider struct {
+	client kmsiface.KMSAPI
+	keyID  string
+}
+
+// New returns a provider wrapping DEKs with the given AWS KMS key.
+// keyID may be a key ID, a key ARN, an alias name ("alias/grafana") or an alias ARN.
+// Using an alias makes key rotation transparent: DEKs are wrapped with the key the alias currently points to,
+// and unwrapped with whichever key they have been wrapped with.
+func New(client kmsiface.KMSAPI, keyID string) (secrets.Provider, error) {
+	if err := validateKeyID(keyID); err != nil {
+		return nil, err
+	}
+
+	return awsKMSProvider{
+		client: client,
+		keyID:  keyID,
+	}, nil
+}
+
+func validateKeyID(keyID string) error {
+	if keyID == "" {
+		return fmt.Errorf("AWS KMS key ID is missing")
+	}
+
+	if !arn.IsARN(keyID) {
+		return nil
+	}
+
+	parsed, err := arn.Parse(keyID)
+	if err != nil {
+		return fmt.Errorf("invalid AWS KMS key ARN '%s': %w", keyID, err)
+	}
+	if parsed.Service != kms.ServiceName {
+		return fmt.Errorf("invalid AWS KMS key ARN '%s': not a KMS resource", keyID)
+	}
+	if !strings.HasPrefix(parsed.Resource, "key/") && !strings.HasPrefix(parsed.Resource, "alias/") {
+		return fmt.Errorf("invalid AWS KMS key ARN '%s': resource must be a key or an alias", keyID)
+	}
+
+	return nil
+}
+
+func (p awsKMSProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	out, err := p.client.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(p.keyID),
+		Plaintext: blob,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.CiphertextBlob, nil
+}
+
+func (p awsKMSProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	// The ciphertext identifies the key it has been encrypted with. The key ID is on purpose
+	// not given here, as the alias may point to a newer key since the DEK has been wrapped.
+	out, err := p.client.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: blob,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Plaintext, nil
+}
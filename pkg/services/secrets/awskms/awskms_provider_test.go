@@ -0,0 +1,130 @@
+package awskms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKMS simulates keys behind aliases, ciphertexts are prefixed with the ID of the key encrypting them
+type fakeKMS struct {
+	kmsiface.KMSAPI
+
+	aliases map[string]string
+	keys    map[string]bool
+}
+
+func (f *fakeKMS) EncryptWithContext(_ aws.Context, input *kms.EncryptInput, _ ...request.Option) (*kms.EncryptOutput, error) {
+	keyID := aws.StringValue(input.KeyId)
+	if target, ok := f.aliases[keyID]; ok {
+		keyID = target
+	}
+	if !f.keys[keyID] {
+		return nil, errors.New("key not found")
+	}
+
+	return &kms.EncryptOutput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: append([]byte(keyID+"|"), input.Plaintext...),
+	}, nil
+}
+
+func (f *fakeKMS) DecryptWithContext(_ aws.Context, input *kms.DecryptInput, _ ...request.Option) (*kms.DecryptOutput, error) {
+	if input.KeyId != nil {
+		return nil, errors.New("key ID must not be given, it breaks decryption after rotation")
+	}
+
+	sep := bytes.IndexByte(input.CiphertextBlob, '|')
+	if sep == -1 {
+		return nil, errors.New("invalid ciphertext")
+	}
+	keyID := string(input.CiphertextBlob[:sep])
+	if !f.keys[keyID] {
+		return nil, errors.New("key not found")
+	}
+
+	return &kms.DecryptOutput{
+		KeyId:     aws.String(keyID),
+		Plaintext: input.CiphertextBlob[sep+1:],
+	}, nil
+}
+
+func (f *fakeKMS) rotate(alias, keyID string) {
+	f.keys[keyID] = true
+	f.aliases[alias] = keyID
+}
+
+func TestAWSKMSProvider(t *testing.T) {
+	const alias = "arn:aws:kms:us-east-1:123456789012:alias/grafana"
+	ctx := context.Background()
+
+	client := &fakeKMS{aliases: map[string]string{}, keys: map[string]bool{}}
+	client.rotate(alias, "key-v1")
+
+	provider, err := New(client, alias)
+	require.NoError(t, err)
+
+	dataKey := []byte("data key")
+
+	wrappedV1, err := provider.Encrypt(ctx, dataKey)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(wrappedV1), "key-v1|"))
+
+	client.rotate(alias, "key-v2")
+
+	t.Run("wrapping after rotation should use the new key version", func(t *testing.T) {
+		wrappedV2, err := provider.Encrypt(ctx, dataKey)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(wrappedV2), "key-v2|"))
+
+		unwrapped, err := provider.Decrypt(ctx, wrappedV2)
+		require.NoError(t, err)
+		assert.Equal(t, dataKey, unwrapped)
+	})
+
+	t.Run("unwrapping a data key wrapped before rotation should succeed", func(t *testing.T) {
+		unwrapped, err := provider.Decrypt(ctx, wrappedV1)
+		require.NoError(t, err)
+		assert.Equal(t, dataKey, unwrapped)
+	})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		desc    string
+		keyID   string
+		wantErr bool
+	}{
+		{desc: "key ID", keyID: "1234abcd-12ab-34cd-56ef-1234567890ab"},
+		{desc: "key ARN", keyID: "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"},
+		{desc: "alias name", keyID: "alias/grafana"},
+		{desc: "alias ARN", keyID: "arn:aws:kms:us-east-1:123456789012:alias/grafana"},
+		{desc: "empty key ID", keyID: "", wantErr: true},
+		{desc: "ARN of another service", keyID: "arn:aws:s3:::bucket/grafana", wantErr: true},
+		{desc: "ARN of another KMS resource", keyID: "arn:aws:kms:us-east-1:123456789012:grant/grafana", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := New(&fakeKMS{}, tt.keyID)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestProviderID(t *testing.T) {
+	assert.Equal(t, "awskms.v1", ProviderID("v1"))
+}
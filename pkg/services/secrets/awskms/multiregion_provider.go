@@ -0,0 +1,189 @@
+package awskms
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// regionHeader prefixes the blobs wrapped by a multi-region provider, it is followed by the region and regionDelimiter.
+// KMS ciphertext blobs are binary and never start with it.
+const (
+	regionHeader    = "region:"
+	regionDelimiter = '|'
+)
+
+// RegionKey is one of the keys of a multi-region provider
+type RegionKey struct {
+	// Region identifies the key in the wrapped blobs, it must be unique and must not contain '|'
+	Region string
+	// Client must be configured for the region
+	Client kmsiface.KMSAPI
+	// KeyID is a key ID, a key ARN, an alias name or an alias ARN, see New
+	KeyID string
+	// Weight is the share of the new wraps made with the key. A key with a weight of 0 only unwraps,
+	// e.g. while a region is being drained.
+	Weight int
+	// Default makes the key unwrap the blobs that don't record their region, e.g. those wrapped by the single
+	// region provider before switching to the multi-region one. At most one key can be the default.
+	Default bool
+}
+
+type regionKey struct {
+	RegionKey
+	current int
+}
+
+type multiRegionProvider struct {
+	mtx  sync.Mutex
+	keys []*regionKey
+	// defaultKey unwraps the blobs without region, it is nil when no key is the default
+	defaultKey *regionKey
+}
+
+// NewMultiRegion returns a provider wrapping DEKs with AWS KMS keys in several regions, so DEKs can still be wrapped
+// when a region is unavailable. New wraps are spread across the keys by smooth weighted round-robin, a wrap failing
+// in a region is retried with the other keys with a positive weight. Each wrapped blob records its region so that
+// it is unwrapped by the key of that region, unwrapping doesn't fail over since no other key can unwrap it.
+func NewMultiRegion(keys []RegionKey) (secrets.Provider, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("AWS KMS region keys are missing")
+	}
+
+	p := &multiRegionProvider{}
+	regions := make(map[string]bool, len(keys))
+	totalWeight := 0
+	for _, key := range keys {
+		if key.Region == "" || strings.IndexByte(key.Region, regionDelimiter) != -1 {
+			return nil, fmt.Errorf("invalid AWS KMS region '%s'", key.Region)
+		}
+		if regions[key.Region] {
+			return nil, fmt.Errorf("AWS KMS region '%s' is configured more than once", key.Region)
+		}
+		regions[key.Region] = true
+		if err := validateKeyID(key.KeyID); err != nil {
+			return nil, fmt.Errorf("region '%s': %w", key.Region, err)
+		}
+		if key.Weight < 0 {
+			return nil, fmt.Errorf("region '%s': weight must not be negative", key.Region)
+		}
+		totalWeight += key.Weight
+		p.keys = append(p.keys, &regionKey{RegionKey: key})
+		if key.Default {
+			if p.defaultKey != nil {
+				return nil, fmt.Errorf("AWS KMS regions '%s' and '%s' are both the default", p.defaultKey.Region, key.Region)
+			}
+			p.defaultKey = p.keys[len(p.keys)-1]
+		}
+	}
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("at least one AWS KMS region key must have a positive weight")
+	}
+
+	return p, nil
+}
+
+// next picks the key of the next wrap, the keys with the highest weights are picked the most
+// but never several times in a row when another key is due
+func (p *multiRegionProvider) next() *regionKey {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var selected *regionKey
+	total := 0
+	for _, key := range p.keys {
+		key.current += key.Weight
+		total += key.Weight
+		if selected == nil || key.current > selected.current {
+			selected = key
+		}
+	}
+	selected.current -= total
+	return selected
+}
+
+func (p *multiRegionProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	selected := p.next()
+	wrapped, err := encryptInRegion(ctx, selected, blob)
+	if err == nil {
+		return wrapped, nil
+	}
+
+	failures := []string{err.Error()}
+	for _, key := range p.keys {
+		if key == selected || key.Weight == 0 {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if wrapped, err = encryptInRegion(ctx, key, blob); err == nil {
+			return wrapped, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, fmt.Errorf("failed to wrap data key in any AWS KMS region: %s", strings.Join(failures, "; "))
+}
+
+func encryptInRegion(ctx context.Context, key *regionKey, blob []byte) ([]byte, error) {
+	out, err := key.Client.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(key.KeyID),
+		Plaintext: blob,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("region '%s': %w", key.Region, err)
+	}
+
+	wrapped := make([]byte, 0, len(regionHeader)+len(key.Region)+1+len(out.CiphertextBlob))
+	wrapped = append(wrapped, regionHeader...)
+	wrapped = append(wrapped, key.Region...)
+	wrapped = append(wrapped, regionDelimiter)
+	return append(wrapped, out.CiphertextBlob...), nil
+}
+
+func (p *multiRegionProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, []byte(regionHeader)) {
+		if p.defaultKey == nil {
+			return nil, fmt.Errorf("wrapped data key doesn't record its AWS KMS region and no region is the default")
+		}
+		return decryptInRegion(ctx, p.defaultKey, blob)
+	}
+	blob = blob[len(regionHeader):]
+	end := bytes.IndexByte(blob, regionDelimiter)
+	if end == -1 {
+		return nil, fmt.Errorf("wrapped data key doesn't record its AWS KMS region")
+	}
+	region := string(blob[:end])
+
+	var key *regionKey
+	for _, k := range p.keys {
+		if k.Region == region {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("AWS KMS region '%s' of the wrapped data key is not configured", region)
+	}
+
+	return decryptInRegion(ctx, key, blob[end+1:])
+}
+
+func decryptInRegion(ctx context.Context, key *regionKey, blob []byte) ([]byte, error) {
+	// As for the single region provider, the key ID is not given so that rotated aliases still unwrap
+	out, err := key.Client.DecryptWithContext(ctx, &kms.DecryptInput{
+		CiphertextBlob: blob,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("region '%s': %w", key.Region, err)
+	}
+
+	return out.Plaintext, nil
+}
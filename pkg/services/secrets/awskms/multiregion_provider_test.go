@@ -0,0 +1,204 @@
+package awskms
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRegionKMS(keyID string) *fakeKMS {
+	client := &fakeKMS{aliases: map[string]string{}, keys: map[string]bool{}}
+	client.rotate("alias/grafana", keyID)
+	return client
+}
+
+// unavailableKMS fails to wrap, as during an outage of its region
+type unavailableKMS struct {
+	*fakeKMS
+}
+
+func (unavailableKMS) EncryptWithContext(aws.Context, *kms.EncryptInput, ...request.Option) (*kms.EncryptOutput, error) {
+	return nil, errors.New("service unavailable")
+}
+
+func TestMultiRegionProvider(t *testing.T) {
+	ctx := context.Background()
+	east := newRegionKMS("key-east")
+	west := newRegionKMS("key-west")
+	drained := newRegionKMS("key-drained")
+
+	provider, err := NewMultiRegion([]RegionKey{
+		{Region: "us-east-1", Client: east, KeyID: "alias/grafana", Weight: 3},
+		{Region: "us-west-2", Client: west, KeyID: "alias/grafana", Weight: 1},
+		{Region: "eu-west-1", Client: drained, KeyID: "alias/grafana", Weight: 0},
+	})
+	require.NoError(t, err)
+
+	dataKey := []byte("data key")
+
+	t.Run("wraps should be distributed according to the weights", func(t *testing.T) {
+		counts := map[string]int{}
+		var previous string
+		for i := 0; i < 8; i++ {
+			wrapped, err := provider.Encrypt(ctx, dataKey)
+			require.NoError(t, err)
+			region := strings.SplitN(strings.TrimPrefix(string(wrapped), regionHeader), "|", 2)[0]
+			counts[region]++
+			if region == "us-west-2" {
+				assert.NotEqual(t, previous, region, "smooth round-robin should not pick the lighter region twice in a row")
+			}
+			previous = region
+		}
+		assert.Equal(t, map[string]int{"us-east-1": 6, "us-west-2": 2}, counts)
+	})
+
+	t.Run("unwrap should use the region recorded in the wrapped blob", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			wrapped, err := provider.Encrypt(ctx, dataKey)
+			require.NoError(t, err)
+			unwrapped, err := provider.Decrypt(ctx, wrapped)
+			require.NoError(t, err)
+			assert.Equal(t, dataKey, unwrapped)
+		}
+
+		// a DEK wrapped in the drained region, e.g. before its weight was lowered, still unwraps
+		single, err := New(drained, "alias/grafana")
+		require.NoError(t, err)
+		blob, err := single.Encrypt(ctx, dataKey)
+		require.NoError(t, err)
+		unwrapped, err := provider.Decrypt(ctx, append([]byte(regionHeader+"eu-west-1|"), blob...))
+		require.NoError(t, err)
+		assert.Equal(t, dataKey, unwrapped)
+	})
+
+	t.Run("unwrap should not fall back to another region", func(t *testing.T) {
+		wrapped, err := provider.Encrypt(ctx, dataKey)
+		require.NoError(t, err)
+		region := strings.SplitN(strings.TrimPrefix(string(wrapped), regionHeader), "|", 2)[0]
+		other := "us-east-1"
+		if region == other {
+			other = "us-west-2"
+		}
+
+		_, err = provider.Decrypt(ctx, []byte(strings.Replace(string(wrapped), region, other, 1)))
+		require.Error(t, err)
+	})
+
+	t.Run("unwrapping a blob without a known region should fail", func(t *testing.T) {
+		_, err := provider.Decrypt(ctx, []byte("key-east|data key"))
+		require.Error(t, err)
+		_, err = provider.Decrypt(ctx, []byte(regionHeader+"ap-south-1|key-east|data key"))
+		require.Error(t, err)
+	})
+}
+
+func TestMultiRegionProvider_Outage(t *testing.T) {
+	ctx := context.Background()
+	dataKey := []byte("data key")
+
+	t.Run("wraps should fail over to the other regions with a positive weight", func(t *testing.T) {
+		provider, err := NewMultiRegion([]RegionKey{
+			{Region: "us-east-1", Client: unavailableKMS{newRegionKMS("key-east")}, KeyID: "alias/grafana", Weight: 3},
+			{Region: "eu-west-1", Client: newRegionKMS("key-drained"), KeyID: "alias/grafana", Weight: 0},
+			{Region: "us-west-2", Client: newRegionKMS("key-west"), KeyID: "alias/grafana", Weight: 1},
+		})
+		require.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			wrapped, err := provider.Encrypt(ctx, dataKey)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(string(wrapped), regionHeader+"us-west-2|"), string(wrapped))
+
+			unwrapped, err := provider.Decrypt(ctx, wrapped)
+			require.NoError(t, err)
+			assert.Equal(t, dataKey, unwrapped)
+		}
+	})
+
+	t.Run("wraps should fail when every region is unavailable", func(t *testing.T) {
+		provider, err := NewMultiRegion([]RegionKey{
+			{Region: "us-east-1", Client: unavailableKMS{newRegionKMS("key-east")}, KeyID: "alias/grafana", Weight: 1},
+			{Region: "us-west-2", Client: unavailableKMS{newRegionKMS("key-west")}, KeyID: "alias/grafana", Weight: 1},
+			{Region: "eu-west-1", Client: newRegionKMS("key-drained"), KeyID: "alias/grafana", Weight: 0},
+		})
+		require.NoError(t, err)
+
+		_, err = provider.Encrypt(ctx, dataKey)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "us-east-1")
+		assert.Contains(t, err.Error(), "us-west-2")
+	})
+}
+
+func TestMultiRegionProvider_DefaultRegion(t *testing.T) {
+	ctx := context.Background()
+	dataKey := []byte("data key")
+	east := newRegionKMS("key-east")
+
+	// blobs wrapped by the single region provider don't record their region
+	single, err := New(east, "alias/grafana")
+	require.NoError(t, err)
+	blob, err := single.Encrypt(ctx, dataKey)
+	require.NoError(t, err)
+
+	provider, err := NewMultiRegion([]RegionKey{
+		{Region: "us-west-2", Client: newRegionKMS("key-west"), KeyID: "alias/grafana", Weight: 1},
+		{Region: "us-east-1", Client: east, KeyID: "alias/grafana", Weight: 1, Default: true},
+	})
+	require.NoError(t, err)
+
+	unwrapped, err := provider.Decrypt(ctx, blob)
+	require.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+}
+
+func TestNewMultiRegion(t *testing.T) {
+	client := newRegionKMS("key")
+	tests := []struct {
+		desc    string
+		keys    []RegionKey
+		wantErr bool
+	}{
+		{desc: "single region", keys: []RegionKey{{Region: "us-east-1", Client: client, KeyID: "alias/grafana", Weight: 1}}},
+		{desc: "no region", wantErr: true},
+		{desc: "missing region name", keys: []RegionKey{{Client: client, KeyID: "alias/grafana", Weight: 1}}, wantErr: true},
+		{desc: "invalid region name", keys: []RegionKey{{Region: "us|east", Client: client, KeyID: "alias/grafana", Weight: 1}}, wantErr: true},
+		{desc: "missing key ID", keys: []RegionKey{{Region: "us-east-1", Client: client, Weight: 1}}, wantErr: true},
+		{desc: "negative weight", keys: []RegionKey{{Region: "us-east-1", Client: client, KeyID: "alias/grafana", Weight: -1}}, wantErr: true},
+		{desc: "only zero weights", keys: []RegionKey{{Region: "us-east-1", Client: client, KeyID: "alias/grafana"}}, wantErr: true},
+		{
+			desc: "several default regions",
+			keys: []RegionKey{
+				{Region: "us-east-1", Client: client, KeyID: "alias/grafana", Weight: 1, Default: true},
+				{Region: "us-west-2", Client: client, KeyID: "alias/grafana", Weight: 1, Default: true},
+			},
+			wantErr: true,
+		},
+		{
+			desc: "duplicate region",
+			keys: []RegionKey{
+				{Region: "us-east-1", Client: client, KeyID: "alias/grafana", Weight: 1},
+				{Region: "us-east-1", Client: client, KeyID: "alias/other", Weight: 1},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, err := NewMultiRegion(test.keys)
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
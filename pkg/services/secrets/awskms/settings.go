@@ -0,0 +1,95 @@
+package awskms
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+// settingsSectionPrefix prefixes the settings sections configuring the providers,
+// e.g. [security.encryption.awskms.primary] configures the provider awskms.primary
+const settingsSectionPrefix = "security.encryption." + providerPrefix + "."
+
+// newClient returns a KMS client for region, using the default AWS credential chain
+var newClient = func(region string) (kmsiface.KMSAPI, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(sess), nil
+}
+
+// ProviderFactories returns the factories of the providers configured in the settings, by provider ID.
+// A section configures a single region provider with region and key_id, or a multi-region provider with
+// regions and key_id, the key of region, if given, then unwrapping the blobs without region, see NewMultiRegion.
+// Invalid settings are reported when the provider is first used.
+func ProviderFactories(settings setting.Provider) map[string]secrets.ProviderFactory {
+	factories := make(map[string]secrets.ProviderFactory)
+	// Current only provides the section names here, its values may be redacted
+	for section := range settings.Current() {
+		name := strings.TrimPrefix(section, settingsSectionPrefix)
+		if name == section || name == "" {
+			continue
+		}
+		section := settings.Section(section)
+		factories[ProviderID(name)] = func(context.Context) (secrets.Provider, error) {
+			provider, err := newFromSettings(section)
+			if err != nil {
+				return nil, fmt.Errorf("AWS KMS provider '%s': %w", name, err)
+			}
+			return provider, nil
+		}
+	}
+	return factories
+}
+
+func newFromSettings(section setting.Section) (secrets.Provider, error) {
+	keyID := section.KeyValue("key_id").Value()
+	region := section.KeyValue("region").Value()
+	regions := util.SplitString(section.KeyValue("regions").Value())
+
+	if len(regions) == 0 {
+		if region == "" {
+			return nil, fmt.Errorf("region is missing")
+		}
+		client, err := newClient(region)
+		if err != nil {
+			return nil, err
+		}
+		return New(client, keyID)
+	}
+
+	keys := make([]RegionKey, 0, len(regions))
+	found := false
+	for _, entry := range regions {
+		key := RegionKey{Region: entry, KeyID: keyID, Weight: 1}
+		if i := strings.LastIndexByte(entry, ':'); i != -1 {
+			weight, err := strconv.Atoi(entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight of region '%s': %w", entry, err)
+			}
+			key.Region, key.Weight = entry[:i], weight
+		}
+		key.Default = key.Region == region
+		client, err := newClient(key.Region)
+		if err != nil {
+			return nil, err
+		}
+		key.Client = client
+		keys = append(keys, key)
+		found = found || key.Default
+	}
+	if region != "" && !found {
+		return nil, fmt.Errorf("region '%s' is not one of the regions", region)
+	}
+	return NewMultiRegion(keys)
+}
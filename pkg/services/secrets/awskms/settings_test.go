@@ -0,0 +1,96 @@
+package awskms
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
+)
+
+func TestProviderFactories(t *testing.T) {
+	ctx := context.Background()
+	clients := map[string]*fakeKMS{
+		"us-east-1": newRegionKMS("key-east"),
+		"us-west-2": newRegionKMS("key-west"),
+	}
+	previous := newClient
+	t.Cleanup(func() { newClient = previous })
+	newClient = func(region string) (kmsiface.KMSAPI, error) {
+		return clients[region], nil
+	}
+
+	raw, err := ini.Load([]byte(`
+		[security]
+		encryption_provider = awskms.primary
+
+		[security.encryption.awskms.primary]
+		key_id = alias/grafana
+		region = us-east-1
+
+		[security.encryption.awskms.global]
+		key_id = alias/grafana
+		region = us-east-1
+		regions = us-east-1:3, us-west-2
+
+		[security.encryption.awskms.no_region]
+		key_id = alias/grafana
+
+		[security.encryption.awskms.bad_weight]
+		key_id = alias/grafana
+		regions = us-east-1:many
+
+		[security.encryption.awskms.bad_default]
+		key_id = alias/grafana
+		region = eu-west-1
+		regions = us-east-1 us-west-2`))
+	require.NoError(t, err)
+	factories := ProviderFactories(&setting.OSSImpl{Cfg: &setting.Cfg{Raw: raw}})
+
+	require.Len(t, factories, 5)
+
+	t.Run("a section with region should configure a single region provider", func(t *testing.T) {
+		provider, err := factories["awskms.primary"](ctx)
+		require.NoError(t, err)
+
+		wrapped, err := provider.Encrypt(ctx, []byte("data key"))
+		require.NoError(t, err)
+		assert.Equal(t, "key-east|data key", string(wrapped))
+	})
+
+	t.Run("a section with regions should configure a multi-region provider", func(t *testing.T) {
+		provider, err := factories["awskms.global"](ctx)
+		require.NoError(t, err)
+
+		seen := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			wrapped, err := provider.Encrypt(ctx, []byte("data key"))
+			require.NoError(t, err)
+			seen[string(wrapped)] = true
+		}
+		assert.Equal(t, map[string]bool{
+			"region:us-east-1|key-east|data key": true,
+			"region:us-west-2|key-west|data key": true,
+		}, seen)
+
+		// region is the default, unwrapping the blobs of the single region provider
+		decrypted, err := provider.Decrypt(ctx, []byte("key-east|data key"))
+		require.NoError(t, err)
+		assert.Equal(t, "data key", string(decrypted))
+	})
+
+	t.Run("invalid sections should fail when the provider is first used", func(t *testing.T) {
+		for providerID, message := range map[string]string{
+			"awskms.no_region":   "AWS KMS provider 'no_region': region is missing",
+			"awskms.bad_weight":  "AWS KMS provider 'bad_weight': invalid weight of region 'us-east-1:many'",
+			"awskms.bad_default": "AWS KMS provider 'bad_default': region 'eu-west-1' is not one of the regions",
+		} {
+			_, err := factories[providerID](ctx)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), message)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/grafana/grafana/pkg/services/secrets"
@@ -11,30 +12,76 @@ import (
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrations"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+	"github.com/grafana/grafana/pkg/setting"
 )
 
-const dataKeysTable = "data_keys"
+const (
+	dataKeysTable     = "data_keys"
+	dataKeyUsageTable = "data_key_usage"
+)
+
+// dataKeyUsage is a row of the data_key_usage table
+type dataKeyUsage struct {
+	SecretRef   string `xorm:"secret_ref"`
+	DataKeyName string `xorm:"data_key_name"`
+	Created     time.Time
+	Updated     time.Time
+}
 
 var logger = log.New("secrets-store")
 
+// withSessionFunc runs callback with a session of the database the data keys are stored in
+type withSessionFunc func(ctx context.Context, callback func(sess *xorm.Session) error) error
+
 type SecretsStoreImpl struct {
-	sqlStore *sqlstore.SQLStore
+	withSession withSessionFunc
+	dialect     migrator.Dialect
+	// external is set when the data keys aren't stored in the Grafana database, see NewExternalSecretsStore
+	external bool
 }
 
+// ProvideSecretsStore returns a store keeping the data keys in the data_keys table of the Grafana database
 func ProvideSecretsStore(sqlStore *sqlstore.SQLStore) *SecretsStoreImpl {
 	return &SecretsStoreImpl{
-		sqlStore: sqlStore,
+		withSession: func(ctx context.Context, callback func(sess *xorm.Session) error) error {
+			return sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+				return callback(sess.Session)
+			})
+		},
+		dialect: sqlStore.Dialect,
+	}
+}
+
+// NewExternalSecretsStore returns a store keeping the data keys in the data_keys table of a database other than
+// the Grafana one, e.g. a more tightly controlled one, the table is created or migrated on the engine if necessary.
+func NewExternalSecretsStore(engine *xorm.Engine, cfg *setting.Cfg) (*SecretsStoreImpl, error) {
+	mg := migrator.NewMigrator(engine, cfg)
+	migrations.AddExternalDataKeysMigrations(mg)
+	if err := mg.Start(); err != nil {
+		return nil, fmt.Errorf("failed to migrate the data keys table: %w", err)
 	}
+
+	return &SecretsStoreImpl{
+		withSession: func(ctx context.Context, callback func(sess *xorm.Session) error) error {
+			sess := engine.NewSession().Context(ctx)
+			defer sess.Close()
+			return callback(sess)
+		},
+		dialect:  mg.Dialect,
+		external: true,
+	}, nil
 }
 
 func (ss *SecretsStoreImpl) GetDataKey(ctx context.Context, name string) (*secrets.DataKey, error) {
 	dataKey := &secrets.DataKey{}
 	var exists bool
 
-	err := ss.sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
 		var err error
 		exists, err = sess.Table(dataKeysTable).
-			Where("name = ? AND active = ?", name, ss.sqlStore.Dialect.BooleanStr(true)).
+			Where("name = ? AND active = ?", name, ss.dialect.BooleanStr(true)).
 			Get(dataKey)
 		return err
 	})
@@ -48,25 +95,128 @@ func (ss *SecretsStoreImpl) GetDataKey(ctx context.Context, name string) (*secre
 		return nil, fmt.Errorf("failed getting data key: %w", err)
 	}
 
+	if err := validateDataKey(dataKey); err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+func (ss *SecretsStoreImpl) GetDeletedDataKey(ctx context.Context, name string) (*secrets.DataKey, error) {
+	dataKey := &secrets.DataKey{}
+	var exists bool
+
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
+		var err error
+		exists, err = sess.Table(dataKeysTable).
+			Where("name = ? AND active = ?", name, ss.dialect.BooleanStr(false)).
+			Get(dataKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting deleted data key: %w", err)
+	}
+	if !exists {
+		return nil, secrets.ErrDataKeyNotFound
+	}
+
+	if err := validateDataKey(dataKey); err != nil {
+		return nil, err
+	}
 	return dataKey, nil
 }
 
+// validateDataKey checks that a loaded data key has encrypted material and a provider to decrypt it with.
+// The format of the material depends on the provider, which validates it when decrypting.
+func validateDataKey(dataKey *secrets.DataKey) error {
+	if len(dataKey.EncryptedData) == 0 {
+		logger.Error("Data key has no encrypted data", "name", dataKey.Name)
+		return fmt.Errorf("%w: '%s' has no encrypted data", secrets.ErrDataKeyCorrupt, dataKey.Name)
+	}
+	if dataKey.Provider == "" {
+		logger.Error("Data key has no provider", "name", dataKey.Name)
+		return fmt.Errorf("%w: '%s' has no provider", secrets.ErrDataKeyCorrupt, dataKey.Name)
+	}
+	return nil
+}
+
 func (ss *SecretsStoreImpl) GetAllDataKeys(ctx context.Context) ([]*secrets.DataKey, error) {
 	result := make([]*secrets.DataKey, 0)
-	err := ss.sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
 		err := sess.Table(dataKeysTable).Find(&result)
 		return err
 	})
 	return result, err
 }
 
+func (ss *SecretsStoreImpl) GetDataKeysPage(ctx context.Context, offset, limit int) ([]*secrets.DataKey, int64, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid page offset %d and limit %d", offset, limit)
+	}
+
+	result := make([]*secrets.DataKey, 0, limit)
+	var total int64
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
+		var err error
+		total, err = sess.Table(dataKeysTable).Count()
+		if err != nil {
+			return err
+		}
+		return sess.Table(dataKeysTable).OrderBy("name ASC").Limit(limit, offset).Find(&result)
+	})
+	return result, total, err
+}
+
+func (ss *SecretsStoreImpl) GetDataKeysByProvider(ctx context.Context, provider string) ([]*secrets.DataKey, error) {
+	result := make([]*secrets.DataKey, 0)
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
+		err := sess.Table(dataKeysTable).Where("provider = ?", provider).Find(&result)
+		return err
+	})
+	return result, err
+}
+
+func (ss *SecretsStoreImpl) GetDataKeysByNameAffixes(ctx context.Context, prefix, suffix string) ([]*secrets.DataKey, error) {
+	found := make([]*secrets.DataKey, 0)
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
+		return sess.Table(dataKeysTable).
+			Where("name "+ss.dialect.LikeStr()+" ? ESCAPE '!'", escapeLike(prefix)+"%"+escapeLike(suffix)).
+			Find(&found)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting data keys: %w", err)
+	}
+
+	// LIKE ignores the case with some databases, and the prefix and the suffix of a name may overlap
+	result := found[:0]
+	for _, dataKey := range found {
+		if len(dataKey.Name) >= len(prefix)+len(suffix) && strings.HasPrefix(dataKey.Name, prefix) && strings.HasSuffix(dataKey.Name, suffix) {
+			result = append(result, dataKey)
+		}
+	}
+	return result, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, using ! as escape character
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
 func (ss *SecretsStoreImpl) CreateDataKey(ctx context.Context, dataKey secrets.DataKey) error {
-	return ss.sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
-		return ss.CreateDataKeyWithDBSession(ctx, dataKey, sess.Session)
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
+		return ss.createDataKey(dataKey, sess)
 	})
 }
 
-func (ss *SecretsStoreImpl) CreateDataKeyWithDBSession(_ context.Context, dataKey secrets.DataKey, sess *xorm.Session) error {
+// CreateDataKeyWithDBSession inserts the data key within the given session of the Grafana database,
+// unless the data keys are stored in an external database, then it's inserted within a session of its own.
+func (ss *SecretsStoreImpl) CreateDataKeyWithDBSession(ctx context.Context, dataKey secrets.DataKey, sess *xorm.Session) error {
+	if ss.external {
+		return ss.CreateDataKey(ctx, dataKey)
+	}
+	return ss.createDataKey(dataKey, sess)
+}
+
+func (ss *SecretsStoreImpl) createDataKey(dataKey secrets.DataKey, sess *xorm.Session) error {
 	if !dataKey.Active {
 		return fmt.Errorf("cannot insert deactivated data keys")
 	}
@@ -75,17 +225,129 @@ func (ss *SecretsStoreImpl) CreateDataKeyWithDBSession(_ context.Context, dataKe
 	dataKey.Updated = dataKey.Created
 
 	_, err := sess.Table(dataKeysTable).Insert(&dataKey)
+	if err != nil && ss.dialect.IsUniqueConstraintViolation(err) {
+		return fmt.Errorf("%w: %s", secrets.ErrDataKeyExists, dataKey.Name)
+	}
 	return err
 }
 
+// UpdateDataKey updates the provider and the encrypted data of an existing data key
+func (ss *SecretsStoreImpl) UpdateDataKey(ctx context.Context, dataKey secrets.DataKey) error {
+	if len(dataKey.Name) == 0 {
+		return fmt.Errorf("data key name is missing")
+	}
+
+	dataKey.Updated = time.Now()
+
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
+		affected, err := sess.Table(dataKeysTable).
+			Where("name = ?", dataKey.Name).
+			Cols("provider", "encrypted_data", "updated").
+			Update(&dataKey)
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return secrets.ErrDataKeyNotFound
+		}
+		return nil
+	})
+}
+
+func (ss *SecretsStoreImpl) RestoreDataKey(ctx context.Context, dataKey secrets.DataKey) error {
+	if len(dataKey.Name) == 0 {
+		return fmt.Errorf("data key name is missing")
+	}
+
+	dataKey.Updated = time.Now()
+	if dataKey.Created.IsZero() {
+		dataKey.Created = dataKey.Updated
+	}
+
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
+		_, err := sess.Table(dataKeysTable).Insert(&dataKey)
+		if err != nil && ss.dialect.IsUniqueConstraintViolation(err) {
+			return fmt.Errorf("%w: %s", secrets.ErrDataKeyExists, dataKey.Name)
+		}
+		return err
+	})
+}
+
+func (ss *SecretsStoreImpl) DeactivateDataKey(ctx context.Context, name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("data key name is missing")
+	}
+
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
+		affected, err := sess.Table(dataKeysTable).
+			Where("name = ?", name).
+			Cols("active", "updated").
+			Update(&secrets.DataKey{Active: false, Updated: time.Now()})
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return secrets.ErrDataKeyNotFound
+		}
+		return nil
+	})
+}
+
 func (ss *SecretsStoreImpl) DeleteDataKey(ctx context.Context, name string) error {
 	if len(name) == 0 {
 		return fmt.Errorf("data key name is missing")
 	}
 
-	return ss.sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
 		_, err := sess.Table(dataKeysTable).Delete(&secrets.DataKey{Name: name})
 
 		return err
 	})
 }
+
+func (ss *SecretsStoreImpl) RegisterSecretUsage(ctx context.Context, secretRef string, dataKeyName string) error {
+	if len(secretRef) == 0 {
+		return fmt.Errorf("secret reference is missing")
+	}
+	if len(dataKeyName) == 0 {
+		return fmt.Errorf("data key name is missing")
+	}
+
+	return ss.withSession(ctx, func(sess *xorm.Session) error {
+		now := time.Now()
+		updated, err := sess.Table(dataKeyUsageTable).
+			Where("secret_ref = ?", secretRef).
+			Cols("data_key_name", "updated").
+			Update(&dataKeyUsage{DataKeyName: dataKeyName, Updated: now})
+		if err != nil || updated > 0 {
+			return err
+		}
+
+		_, err = sess.Table(dataKeyUsageTable).Insert(&dataKeyUsage{
+			SecretRef:   secretRef,
+			DataKeyName: dataKeyName,
+			Created:     now,
+			Updated:     now,
+		})
+		return err
+	})
+}
+
+func (ss *SecretsStoreImpl) GetSecretsForDataKey(ctx context.Context, dataKeyName string) ([]string, error) {
+	usages := make([]*dataKeyUsage, 0)
+	err := ss.withSession(ctx, func(sess *xorm.Session) error {
+		return sess.Table(dataKeyUsageTable).
+			Where("data_key_name = ?", dataKeyName).
+			Asc("secret_ref").
+			Find(&usages)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting secrets for data key: %w", err)
+	}
+
+	secretRefs := make([]string, 0, len(usages))
+	for _, usage := range usages {
+		secretRefs = append(secretRefs, usage.SecretRef)
+	}
+	return secretRefs, nil
+}
@@ -0,0 +1,76 @@
+package fakekms
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeKMSProvider(t *testing.T) {
+	ctx := context.Background()
+	blob := []byte("data key")
+
+	t.Run("should encrypt deterministically", func(t *testing.T) {
+		provider := New("key")
+		encrypted, err := provider.Encrypt(ctx, blob)
+		require.NoError(t, err)
+		assert.NotContains(t, string(encrypted), string(blob))
+
+		again, err := New("key").Encrypt(ctx, blob)
+		require.NoError(t, err)
+		assert.Equal(t, encrypted, again)
+
+		decrypted, err := provider.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, blob, decrypted)
+		assert.Equal(t, 1, provider.EncryptCalls())
+		assert.Equal(t, 1, provider.DecryptCalls())
+	})
+
+	t.Run("should not decrypt blobs of another key", func(t *testing.T) {
+		encrypted, err := New("key").Encrypt(ctx, blob)
+		require.NoError(t, err)
+
+		_, err = New("other").Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, ErrWrongKey)
+	})
+
+	t.Run("should fail the next calls", func(t *testing.T) {
+		provider := New("key")
+		provider.FailNext = 2
+
+		for i := 0; i < 2; i++ {
+			_, err := provider.Encrypt(ctx, blob)
+			require.ErrorIs(t, err, ErrInjectedFailure)
+		}
+		_, err := provider.Encrypt(ctx, blob)
+		require.NoError(t, err)
+		assert.Equal(t, 3, provider.EncryptCalls())
+	})
+
+	t.Run("should fail every call with the injected error", func(t *testing.T) {
+		injected := errors.New("throttled")
+		provider := New("key")
+		provider.FailDecrypt = true
+		provider.Err = injected
+
+		encrypted, err := provider.Encrypt(ctx, blob)
+		require.NoError(t, err)
+		_, err = provider.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, injected)
+	})
+
+	t.Run("should time out when the latency exceeds the deadline", func(t *testing.T) {
+		provider := New("key")
+		provider.Latency = time.Second
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := provider.Encrypt(ctx, blob)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
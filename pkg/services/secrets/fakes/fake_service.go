@@ -12,13 +12,22 @@ func NewFakeSecretsService() FakeSecretsService {
 	return FakeSecretsService{}
 }
 
-func (f FakeSecretsService) Encrypt(_ context.Context, payload []byte, _ secrets.EncryptionOptions) ([]byte, error) {
+func (f FakeSecretsService) Encrypt(_ context.Context, payload []byte, _ ...secrets.EncryptionOptions) ([]byte, error) {
 	return payload, nil
 }
-func (f FakeSecretsService) Decrypt(_ context.Context, payload []byte) ([]byte, error) {
+func (f FakeSecretsService) Decrypt(_ context.Context, payload []byte, _ ...secrets.DecryptionOptions) ([]byte, error) {
 	return payload, nil
 }
-func (f FakeSecretsService) EncryptJsonData(_ context.Context, kv map[string]string, _ secrets.EncryptionOptions) (map[string][]byte, error) {
+func (f FakeSecretsService) DecryptInto(_ context.Context, payload []byte, fn func(plaintext []byte) error, _ ...secrets.DecryptionOptions) error {
+	plaintext := make([]byte, len(payload))
+	copy(plaintext, payload)
+	defer secrets.Wipe(plaintext)
+	return fn(plaintext)
+}
+func (f FakeSecretsService) IsLegacyEncrypted(_ []byte) bool {
+	return false
+}
+func (f FakeSecretsService) EncryptJsonData(_ context.Context, kv map[string]string, _ ...secrets.EncryptionOptions) (map[string][]byte, error) {
 	result := make(map[string][]byte, len(kv))
 	for key, value := range kv {
 		result[key] = []byte(value)
@@ -40,6 +49,24 @@ func (f FakeSecretsService) GetDecryptedValue(_ context.Context, sjd map[string]
 	return fallback
 }
 
+func (f FakeSecretsService) RegisterUsageCounter(_ secrets.UsageCounter) {}
+
+func (f FakeSecretsService) CountSecretsForDataKey(_ context.Context, _ string) (int64, error) {
+	return 0, nil
+}
+
+func (f FakeSecretsService) RegisterSecretUsage(_ context.Context, _ string, _ []byte) error {
+	return nil
+}
+
+func (f FakeSecretsService) SecretsForDataKey(_ context.Context, _ string) ([]string, error) {
+	return nil, nil
+}
+
+func (f FakeSecretsService) Close(_ context.Context) error {
+	return nil
+}
+
 func (f FakeSecretsService) CurrentProviderID() string {
 	return "fakeProvider"
 }
@@ -49,3 +76,9 @@ func (f FakeSecretsService) GetProviders() map[string]secrets.Provider {
 }
 
 func (f FakeSecretsService) RegisterProvider(_ string, _ secrets.Provider) {}
+
+func (f FakeSecretsService) RegisterProviderFactory(_ string, _ secrets.ProviderFactory) {}
+
+func (f FakeSecretsService) InitProviders() error {
+	return nil
+}
@@ -2,22 +2,34 @@ package fakes
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/grafana/grafana/pkg/services/secrets"
 	"xorm.io/xorm"
 )
 
 type FakeSecretsStore struct {
-	store map[string]*secrets.DataKey
+	store  map[string]*secrets.DataKey
+	usages map[string]string
 }
 
 func NewFakeSecretsStore() FakeSecretsStore {
-	return FakeSecretsStore{store: make(map[string]*secrets.DataKey)}
+	return FakeSecretsStore{store: make(map[string]*secrets.DataKey), usages: make(map[string]string)}
 }
 
 func (f FakeSecretsStore) GetDataKey(_ context.Context, name string) (*secrets.DataKey, error) {
 	key, ok := f.store[name]
-	if !ok {
+	if !ok || !key.Active {
+		return nil, secrets.ErrDataKeyNotFound
+	}
+	return key, nil
+}
+
+func (f FakeSecretsStore) GetDeletedDataKey(_ context.Context, name string) (*secrets.DataKey, error) {
+	key, ok := f.store[name]
+	if !ok || key.Active {
 		return nil, secrets.ErrDataKeyNotFound
 	}
 	return key, nil
@@ -31,6 +43,44 @@ func (f FakeSecretsStore) GetAllDataKeys(_ context.Context) ([]*secrets.DataKey,
 	return result, nil
 }
 
+func (f FakeSecretsStore) GetDataKeysPage(_ context.Context, offset, limit int) ([]*secrets.DataKey, int64, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("invalid page offset %d and limit %d", offset, limit)
+	}
+
+	names := make([]string, 0, len(f.store))
+	for name := range f.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*secrets.DataKey, 0, limit)
+	for i := offset; i < len(names) && len(result) < limit; i++ {
+		result = append(result, f.store[names[i]])
+	}
+	return result, int64(len(names)), nil
+}
+
+func (f FakeSecretsStore) GetDataKeysByProvider(_ context.Context, provider string) ([]*secrets.DataKey, error) {
+	result := make([]*secrets.DataKey, 0)
+	for _, key := range f.store {
+		if key.Provider == provider {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+func (f FakeSecretsStore) GetDataKeysByNameAffixes(_ context.Context, prefix, suffix string) ([]*secrets.DataKey, error) {
+	result := make([]*secrets.DataKey, 0)
+	for name, key := range f.store {
+		if len(name) >= len(prefix)+len(suffix) && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
 func (f FakeSecretsStore) CreateDataKey(_ context.Context, dataKey secrets.DataKey) error {
 	f.store[dataKey.Name] = &dataKey
 	return nil
@@ -41,7 +91,50 @@ func (f FakeSecretsStore) CreateDataKeyWithDBSession(ctx context.Context, dataKe
 	return nil
 }
 
+func (f FakeSecretsStore) UpdateDataKey(_ context.Context, dataKey secrets.DataKey) error {
+	key, ok := f.store[dataKey.Name]
+	if !ok {
+		return secrets.ErrDataKeyNotFound
+	}
+	key.Provider = dataKey.Provider
+	key.EncryptedData = dataKey.EncryptedData
+	return nil
+}
+
+func (f FakeSecretsStore) RestoreDataKey(_ context.Context, dataKey secrets.DataKey) error {
+	if _, ok := f.store[dataKey.Name]; ok {
+		return fmt.Errorf("%w: %s", secrets.ErrDataKeyExists, dataKey.Name)
+	}
+	f.store[dataKey.Name] = &dataKey
+	return nil
+}
+
+func (f FakeSecretsStore) DeactivateDataKey(_ context.Context, name string) error {
+	key, ok := f.store[name]
+	if !ok {
+		return secrets.ErrDataKeyNotFound
+	}
+	key.Active = false
+	return nil
+}
+
 func (f FakeSecretsStore) DeleteDataKey(_ context.Context, name string) error {
 	delete(f.store, name)
 	return nil
 }
+
+func (f FakeSecretsStore) RegisterSecretUsage(_ context.Context, secretRef string, dataKeyName string) error {
+	f.usages[secretRef] = dataKeyName
+	return nil
+}
+
+func (f FakeSecretsStore) GetSecretsForDataKey(_ context.Context, dataKeyName string) ([]string, error) {
+	result := make([]string, 0)
+	for secretRef, name := range f.usages {
+		if name == dataKeyName {
+			result = append(result, secretRef)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/util"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	saltLength                   = 8
+	encryptionAlgorithmDelimiter = '*'
+)
+
+// aesGcmPrefix marks payloads encrypted with AES-GCM, same as "*<b64 alg>*" used by util.Encrypt
+var aesGcmPrefix = []byte("*" + b64.EncodeToString([]byte(secrets.CipherAESGCM)) + "*")
+
+// isAEADPayload tells whether the payload has been encrypted with AES-GCM.
+// Payloads encrypted with AES-CFB start with an alphanumeric salt, so they never match.
+func isAEADPayload(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == encryptionAlgorithmDelimiter && bytes.HasPrefix(payload, aesGcmPrefix)
+}
+
+// recentNoncesSize is the number of nonces a nonceGenerator remembers to detect duplicates
+const recentNoncesSize = 4096
+
+// nonceGenerator reads AES-GCM nonces from its source, crypto/rand by default. Reusing a nonce with the same key
+// breaks GCM, so it rejects all-zero nonces and the nonces it has recently generated, which only a broken source produces.
+type nonceGenerator struct {
+	source io.Reader
+
+	mtx    sync.Mutex
+	recent map[string]struct{}
+	order  []string
+}
+
+func newNonceGenerator(source io.Reader) *nonceGenerator {
+	return &nonceGenerator{
+		source: source,
+		recent: make(map[string]struct{}, recentNoncesSize),
+		order:  make([]string, 0, recentNoncesSize),
+	}
+}
+
+func (g *nonceGenerator) next(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := io.ReadFull(g.source, nonce); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(nonce, make([]byte, size)) {
+		return nil, fmt.Errorf("%w: all-zero nonce", secrets.ErrInvalidNonce)
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	key := string(nonce)
+	if _, exists := g.recent[key]; exists {
+		return nil, fmt.Errorf("%w: duplicate nonce", secrets.ErrInvalidNonce)
+	}
+	if len(g.order) == recentNoncesSize {
+		delete(g.recent, g.order[0])
+		g.order = g.order[1:]
+	}
+	g.recent[key] = struct{}{}
+	g.order = append(g.order, key)
+
+	return nonce, nil
+}
+
+// encryptAEAD encrypts the payload with AES-GCM, authenticating additionalData along with it
+func encryptAEAD(nonces *nonceGenerator, payload []byte, secret string, additionalData []byte) ([]byte, error) {
+	salt, err := util.GetRandomString(saltLength)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := nonces.next(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, 0, len(aesGcmPrefix)+saltLength+len(nonce)+len(payload)+gcm.Overhead())
+	ciphertext = append(ciphertext, aesGcmPrefix...)
+	ciphertext = append(ciphertext, salt...)
+	ciphertext = append(ciphertext, nonce...)
+	return gcm.Seal(ciphertext, nonce, payload, additionalData), nil
+}
+
+// decryptAEAD decrypts a payload encrypted by encryptAEAD, it fails with secrets.ErrAuthenticationFailed
+// when the payload has been tampered with or when secret or additionalData are not the ones it has been encrypted with.
+func decryptAEAD(payload []byte, secret string, additionalData []byte) ([]byte, error) {
+	payload = payload[len(aesGcmPrefix):]
+	if len(payload) < saltLength {
+		return nil, fmt.Errorf("unable to compute salt")
+	}
+
+	gcm, err := newGCM(secret, string(payload[:saltLength]))
+	if err != nil {
+		return nil, err
+	}
+
+	payload = payload[saltLength:]
+	if len(payload) < gcm.NonceSize() {
+		return nil, fmt.Errorf("payload too short")
+	}
+
+	decrypted, err := gcm.Open(nil, payload[:gcm.NonceSize()], payload[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, secrets.ErrAuthenticationFailed
+	}
+	return decrypted, nil
+}
+
+func newGCM(secret, salt string) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(secret), []byte(salt), 10000, 32, sha256.New)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
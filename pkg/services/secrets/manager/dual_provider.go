@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+const dualProviderPrefix = "dual."
+
+// DualProviderID returns the ID of the dual-control provider wrapping DEKs with both providers,
+// e.g. "dual.awskms.primary.awskms.secondary" to select it with encryption_provider. The ID is also
+// the provider stored with the DEKs, so that both providers are required to decrypt them.
+func DualProviderID(first, second string) string {
+	return dualProviderPrefix + first + "." + second
+}
+
+// dualProvider wraps DEKs with first, then wraps the result with second. Unwrapping needs both providers,
+// so that no single KMS, nor whoever controls it, can decrypt the DEKs.
+type dualProvider struct {
+	firstID  string
+	first    secrets.Provider
+	secondID string
+	second   secrets.Provider
+}
+
+func (p dualProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	inner, err := p.first.Encrypt(ctx, blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap with encryption provider '%s': %w", p.firstID, err)
+	}
+	outer, err := p.second.Encrypt(ctx, inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap with encryption provider '%s': %w", p.secondID, err)
+	}
+	return outer, nil
+}
+
+func (p dualProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	inner, err := p.second.Decrypt(ctx, blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap with encryption provider '%s': %w", p.secondID, err)
+	}
+	decrypted, err := p.first.Decrypt(ctx, inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap with encryption provider '%s': %w", p.firstID, err)
+	}
+	return decrypted, nil
+}
+
+// lookupProvider returns the provider registered with providerID, or the dual-control provider of the
+// registered providers providerID names, see DualProviderID
+func (s *SecretsService) lookupProvider(providerID string) (secrets.Provider, bool) {
+	if provider, exists := s.providers[providerID]; exists {
+		return provider, true
+	}
+	if !strings.HasPrefix(providerID, dualProviderPrefix) {
+		return nil, false
+	}
+
+	// provider IDs may contain dots themselves, so every split of the pair is tried
+	// and the ID must name exactly one pair of registered providers
+	pair := strings.TrimPrefix(providerID, dualProviderPrefix)
+	var found *dualProvider
+	for i := 0; i < len(pair); i++ {
+		if pair[i] != '.' {
+			continue
+		}
+		firstID, secondID := pair[:i], pair[i+1:]
+		first, firstExists := s.providers[firstID]
+		second, secondExists := s.providers[secondID]
+		if firstExists && secondExists {
+			if found != nil {
+				logger.Warn("Dual encryption provider is ambiguous", "provider", providerID)
+				return nil, false
+			}
+			found = &dualProvider{firstID: firstID, first: first, secondID: secondID, second: second}
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return *found, true
+}
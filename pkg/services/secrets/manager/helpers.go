@@ -13,7 +13,7 @@ import (
 	"gopkg.in/ini.v1"
 )
 
-func SetupTestService(tb testing.TB, store secrets.Store) *SecretsService {
+func SetupTestService(tb testing.TB, store secrets.Store, opts ...Option) *SecretsService {
 	tb.Helper()
 	defaultKey := "SdlklWklckeLS"
 	if len(setting.SecretKey) > 0 {
@@ -29,10 +29,11 @@ func SetupTestService(tb testing.TB, store secrets.Store) *SecretsService {
 	settings := &setting.OSSImpl{Cfg: cfg}
 	assert.True(tb, settings.IsFeatureToggleEnabled(envelopeEncryptionFeatureToggle))
 
-	return ProvideSecretsService(
+	return NewSecretsService(
 		store,
 		bus.New(),
 		ossencryption.ProvideService(),
 		settings,
+		opts...,
 	)
 }
@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/grafana/grafana/pkg/services/secrets"
+)
+
+// lazyProvider constructs its provider on the first call and reuses it for the following ones,
+// so that clients such as KMS SDK clients are not rebuilt for every DEK. A failed construction
+// isn't cached, the next call tries again.
+type lazyProvider struct {
+	factory secrets.ProviderFactory
+
+	mtx      sync.Mutex
+	provider secrets.Provider
+}
+
+func newLazyProvider(factory secrets.ProviderFactory) *lazyProvider {
+	return &lazyProvider{factory: factory}
+}
+
+func (p *lazyProvider) get(ctx context.Context) (secrets.Provider, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+
+	provider, err := p.factory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.provider = provider
+	return provider, nil
+}
+
+func (p *lazyProvider) Encrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	provider, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Encrypt(ctx, blob)
+}
+
+func (p *lazyProvider) Decrypt(ctx context.Context, blob []byte) ([]byte, error) {
+	provider, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Decrypt(ctx, blob)
+}
+
+// Close releases the constructed provider, if any and if it is a secrets.ClosableProvider.
+// A call made afterwards constructs a new one.
+func (p *lazyProvider) Close(ctx context.Context) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	provider := p.provider
+	p.provider = nil
+	if closable, ok := provider.(secrets.ClosableProvider); ok {
+		return closable.Close(ctx)
+	}
+	return nil
+}
@@ -5,20 +5,41 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/awskms"
 	grafana "github.com/grafana/grafana/pkg/services/secrets/defaultprovider"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
 )
 
+var logger = log.New("secrets")
+
 const (
+	// defaultMaxPayloadSize is the default max_encryption_payload_size, secrets are much smaller
+	defaultMaxPayloadSize = 64 << 20
+
 	defaultProvider                 = "secretKey"
 	envelopeEncryptionFeatureToggle = "envelopeEncryption"
+
+	// maxProviderIDLength is the length of the data_keys.provider column the provider of each DEK is stored in
+	maxProviderIDLength = 255
+
+	// maxDataKeyRenewals bounds the DEKs that replace the deactivated DEKs of a scope in a day, see activeDataKey
+	maxDataKeyRenewals = 100
 )
 
 type SecretsService struct {
@@ -28,11 +49,118 @@ type SecretsService struct {
 	settings setting.Provider
 
 	currentProvider string
+	// scopeProviders overrides currentProvider for the scopes matching one of their prefixes, longest prefix first
+	scopeProviders []scopeProvider
+	// providerAliases maps former provider names, still referenced by stored DEKs, to the providers decrypting them
+	providerAliases map[string]string
+	// previousSecretKeys are the former secret keys legacy payloads are decrypted with, see decryptLegacy
+	previousSecretKeys []string
+	// decryptWithDeletedDataKeys lets Decrypt use soft-deleted DEKs, see decrypt_with_deleted_data_keys
+	decryptWithDeletedDataKeys bool
+	// allowedScopes are the prefixes of the scopes allowed to create DEKs, every scope is allowed when it is empty
+	allowedScopes   []string
 	providers       map[string]secrets.Provider
 	dataKeyCache    map[string]dataKeyCacheItem
+	dataKeyCacheMtx sync.Mutex
+	// dataKeyCacheStats counts the lookups and evictions of dataKeyCache, it is guarded by dataKeyCacheMtx
+	dataKeyCacheStats DataKeyCacheStats
+	// dataKeyRenewals are the names of the DEKs renewing deactivated DEKs by name of the deactivated DEK,
+	// so that activeDataKey finds them in dataKeyCache, it is guarded by dataKeyCacheMtx
+	dataKeyRenewals map[string]string
+	usageCounters   []secrets.UsageCounter
+	dataKeyName     DataKeyNameGenerator
+	// nonces generates the nonces of payloads encrypted with additional data
+	nonces *nonceGenerator
+	// maxPayloadSize is the size in bytes of the largest payload Encrypt accepts
+	maxPayloadSize int
+	// providerCalls limits the concurrent calls to the providers when it isn't nil
+	providerCalls chan struct{}
+
+	closedMtx sync.RWMutex
+	closed    bool
+}
+
+// scopeProvider maps the scopes starting with prefix to a provider, see encryption_provider_by_scope
+type scopeProvider struct {
+	prefix   string
+	provider string
+}
+
+// parseScopeProviders parses a list of "<scope prefix>=<provider>" entries, e.g. "user:=awskms.users datasource:=awskms.datasources"
+func parseScopeProviders(value string) []scopeProvider {
+	var mapping []scopeProvider
+	for _, entry := range util.SplitString(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			logger.Warn("Ignoring invalid encryption_provider_by_scope entry, expected <scope prefix>=<provider>", "entry", entry)
+			continue
+		}
+		mapping = append(mapping, scopeProvider{prefix: parts[0], provider: parts[1]})
+	}
+
+	sort.SliceStable(mapping, func(i, j int) bool {
+		return len(mapping[i].prefix) > len(mapping[j].prefix)
+	})
+	return mapping
+}
+
+// parseProviderAliases parses a list of "<former provider>=<provider>" entries, e.g. "awskms.first_key=awskms.primary"
+func parseProviderAliases(value string) map[string]string {
+	aliases := make(map[string]string)
+	for _, entry := range util.SplitString(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || parts[0] == parts[1] {
+			logger.Warn("Ignoring invalid encryption_provider_aliases entry, expected <former provider>=<provider>", "entry", entry)
+			continue
+		}
+		aliases[parts[0]] = parts[1]
+	}
+	return aliases
+}
+
+// DataKeyNameGenerator returns the name of the DEK used to encrypt secrets bound to scope with the given provider.
+// Secrets encrypted with the same scope and provider share a DEK as long as the generated name is the same.
+type DataKeyNameGenerator func(scope, providerID string) string
+
+// defaultDataKeyName generates names like "2021-10-28/user:10@secretKey", so DEKs are renewed every day
+func defaultDataKeyName(scope, providerID string) string {
+	return fmt.Sprintf("%s/%s@%s", time.Now().Format("2006-01-02"), scope, providerID)
+}
+
+// Option customizes the SecretsService built by NewSecretsService
+type Option func(*SecretsService)
+
+// WithDataKeyNameGenerator replaces the default DEK name generation, e.g. to get deterministic names in tests
+// or to enforce a naming convention. InspectEnvelope expects names ending with "/<scope>@<provider>".
+func WithDataKeyNameGenerator(generator DataKeyNameGenerator) Option {
+	return func(s *SecretsService) {
+		s.dataKeyName = generator
+	}
+}
+
+// WithAllowedScopes restricts the creation of DEKs to the scopes starting with one of the prefixes, replacing the
+// encryption_allowed_scopes setting. Encrypting for another scope fails with secrets.ErrScopeNotAllowed
+// instead of creating a DEK. Without prefixes, every scope is allowed.
+func WithAllowedScopes(prefixes ...string) Option {
+	return func(s *SecretsService) {
+		s.allowedScopes = prefixes
+	}
+}
+
+// WithNonceSource replaces crypto/rand as the source of the AES-GCM nonces, e.g. to get deterministic payloads in tests.
+// Encryption fails when the source returns an all-zero or a recently returned nonce.
+func WithNonceSource(source io.Reader) Option {
+	return func(s *SecretsService) {
+		s.nonces = newNonceGenerator(source)
+	}
 }
 
 func ProvideSecretsService(store secrets.Store, bus bus.Bus, enc encryption.Service, settings setting.Provider) *SecretsService {
+	return NewSecretsService(store, bus, enc, settings)
+}
+
+// NewSecretsService returns a SecretsService customized with opts
+func NewSecretsService(store secrets.Store, bus bus.Bus, enc encryption.Service, settings setting.Provider, opts ...Option) *SecretsService {
 	providers := map[string]secrets.Provider{
 		defaultProvider: grafana.New(settings, enc),
 	}
@@ -45,7 +173,31 @@ func ProvideSecretsService(store secrets.Store, bus bus.Bus, enc encryption.Serv
 		settings:        settings,
 		providers:       providers,
 		currentProvider: currentProvider,
+		scopeProviders:  parseScopeProviders(settings.KeyValue("security", "encryption_provider_by_scope").Value()),
+		providerAliases: parseProviderAliases(settings.KeyValue("security", "encryption_provider_aliases").Value()),
+		allowedScopes:   util.SplitString(settings.KeyValue("security", "encryption_allowed_scopes").Value()),
 		dataKeyCache:    make(map[string]dataKeyCacheItem),
+		dataKeyRenewals: make(map[string]string),
+		dataKeyName:     defaultDataKeyName,
+		nonces:          newNonceGenerator(rand.Reader),
+		maxPayloadSize:  settings.KeyValue("security", "max_encryption_payload_size").MustInt(defaultMaxPayloadSize),
+	}
+	s.previousSecretKeys = util.SplitString(settings.KeyValue("security", "previous_secret_keys").Value())
+	s.decryptWithDeletedDataKeys = settings.KeyValue("security", "decrypt_with_deleted_data_keys").MustBool(false)
+	if s.maxPayloadSize <= 0 {
+		s.maxPayloadSize = defaultMaxPayloadSize
+	}
+
+	if maxConcurrent := settings.KeyValue("security", "kms_max_concurrent").MustInt(0); maxConcurrent > 0 {
+		s.providerCalls = make(chan struct{}, maxConcurrent)
+	}
+
+	for providerID, factory := range awskms.ProviderFactories(settings) {
+		s.RegisterProviderFactory(providerID, factory)
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	return s
@@ -56,22 +208,73 @@ type dataKeyCacheItem struct {
 	dataKey []byte
 }
 
+// DataKeyCacheStats reports the usage of the cache of decrypted DEKs since the service was created,
+// e.g. to tune its TTL from the hit ratio
+type DataKeyCacheStats struct {
+	// Hits is the number of DEK lookups answered from the cache
+	Hits uint64
+	// Misses is the number of DEK lookups that had to read the DEK from the store, expired ones included
+	Misses uint64
+	// Evictions is the number of DEKs removed from the cache because they expired or were deleted or re-encrypted
+	Evictions uint64
+	// Size is the number of DEKs currently cached
+	Size int
+}
+
+// HitRatio returns the share of the lookups answered from the cache, 0 when there has been none
+func (s DataKeyCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
 var b64 = base64.RawStdEncoding
 
-func (s *SecretsService) Encrypt(ctx context.Context, payload []byte, opt secrets.EncryptionOptions) ([]byte, error) {
+func (s *SecretsService) Encrypt(ctx context.Context, payload []byte, opts ...secrets.EncryptionOptions) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	if len(payload) > s.maxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes exceed the limit of %d bytes", secrets.ErrPayloadTooLarge, len(payload), s.maxPayloadSize)
+	}
+
 	// Use legacy encryption service if envelopeEncryptionFeatureToggle toggle is off
+	encryptionSettings := secrets.EncryptionSettings{}
+	secrets.WithoutScope()(&encryptionSettings)
+	for _, opt := range opts {
+		opt(&encryptionSettings)
+	}
+	if encryptionSettings.Provider == "" {
+		encryptionSettings.Provider = s.providerForScope(encryptionSettings.Scope)
+	}
+	// the provider is checked even when the legacy encryption ignores it, so that callers
+	// requesting an unknown provider fail the same way whether envelope encryption is on or not
+	if _, exists := s.lookupProvider(encryptionSettings.Provider); !exists {
+		return nil, fmt.Errorf("could not find encryption provider '%s'", encryptionSettings.Provider)
+	}
+
 	if !s.settings.IsFeatureToggleEnabled(envelopeEncryptionFeatureToggle) {
+		if encryptionSettings.AdditionalData != nil {
+			return nil, fmt.Errorf("encrypting with additional data requires envelope encryption")
+		}
 		return s.enc.Encrypt(ctx, payload, setting.SecretKey)
 	}
 
 	// If encryption envelopeEncryptionFeatureToggle toggle is on, use envelope encryption
-	scope := opt()
-	keyName := fmt.Sprintf("%s/%s@%s", time.Now().Format("2006-01-02"), scope, s.currentProvider)
+	if encryptionSettings.DataKeyName != "" {
+		return s.encryptWithDataKey(ctx, payload, encryptionSettings)
+	}
 
-	dataKey, err := s.dataKey(ctx, keyName)
+	scope, providerID := encryptionSettings.Scope, encryptionSettings.Provider
+	dataKey, keyName, err := s.activeDataKey(ctx, s.dataKeyName(scope, providerID))
 	if err != nil {
 		if errors.Is(err, secrets.ErrDataKeyNotFound) {
-			dataKey, err = s.newDataKey(ctx, keyName, scope)
+			if !s.scopeAllowed(scope) {
+				return nil, fmt.Errorf("%w: %s", secrets.ErrScopeNotAllowed, scope)
+			}
+			dataKey, err = s.newDataKey(ctx, keyName, scope, providerID, encryptionSettings.Label)
 			if err != nil {
 				return nil, err
 			}
@@ -80,27 +283,163 @@ func (s *SecretsService) Encrypt(ctx context.Context, payload []byte, opt secret
 		}
 	}
 
-	encrypted, err := s.enc.Encrypt(ctx, payload, string(dataKey))
+	return s.seal(ctx, payload, keyName, dataKey, encryptionSettings)
+}
+
+// encryptWithDataKey encrypts payload with the DEK pinned by secrets.WithDataKey, which is never created.
+// The DEK is looked up in the store even when it is cached, so that a DEK deactivated since isn't used.
+func (s *SecretsService) encryptWithDataKey(ctx context.Context, payload []byte, encryptionSettings secrets.EncryptionSettings) ([]byte, error) {
+	keyName := encryptionSettings.DataKeyName
+	if _, err := s.store.GetDataKey(ctx, keyName); err != nil {
+		return nil, fmt.Errorf("failed to get pinned data key '%s': %w", keyName, err)
+	}
+
+	dataKey, err := s.dataKey(ctx, keyName)
 	if err != nil {
 		return nil, err
 	}
 
-	prefix := make([]byte, b64.EncodedLen(len(keyName))+2)
-	b64.Encode(prefix[1:], []byte(keyName))
-	prefix[0] = '#'
-	prefix[len(prefix)-1] = '#'
+	return s.seal(ctx, payload, keyName, dataKey, encryptionSettings)
+}
 
-	blob := make([]byte, len(prefix)+len(encrypted))
-	copy(blob, prefix)
-	copy(blob[len(prefix):], encrypted)
+// seal encrypts payload with the decrypted DEK and wraps it in an envelope referencing the DEK
+func (s *SecretsService) seal(ctx context.Context, payload []byte, keyName string, dataKey []byte, encryptionSettings secrets.EncryptionSettings) ([]byte, error) {
+	if encryptionSettings.PerSecretDataKey {
+		return s.sealWithSecretDataKey(ctx, payload, keyName, dataKey, encryptionSettings.AdditionalData)
+	}
+
+	encrypted, err := s.encryptPayload(ctx, payload, dataKey, encryptionSettings.AdditionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeEnvelope(keyName, encrypted)
+}
+
+// sealWithSecretDataKey encrypts payload with a new random key of its own, wrapped by the DEK of the scope.
+// The wrapped key is authenticated along with the name of the DEK, so that it can't be moved to another envelope.
+func (s *SecretsService) sealWithSecretDataKey(ctx context.Context, payload []byte, keyName string, dataKey []byte, additionalData []byte) ([]byte, error) {
+	secretDataKey, err := newRandomDataKey()
+	if err != nil {
+		return nil, err
+	}
+	defer secrets.Wipe(secretDataKey)
+
+	wrapped, err := encryptAEAD(s.nonces, secretDataKey, string(dataKey), []byte(keyName))
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := s.encryptPayload(ctx, payload, secretDataKey, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeLayeredEnvelope(keyName, wrapped, encrypted)
+}
+
+// encryptPayload encrypts payload with key, with AES-GCM when there is additional data and AES-CFB otherwise
+func (s *SecretsService) encryptPayload(ctx context.Context, payload []byte, key []byte, additionalData []byte) ([]byte, error) {
+	if additionalData != nil {
+		return encryptAEAD(s.nonces, payload, string(key), additionalData)
+	}
+	return s.enc.Encrypt(ctx, payload, string(key))
+}
+
+// providerForScope returns the provider configured for the longest matching scope prefix,
+// or the current provider when none matches
+func (s *SecretsService) providerForScope(scope string) string {
+	for _, mapping := range s.scopeProviders {
+		if strings.HasPrefix(scope, mapping.prefix) {
+			return mapping.provider
+		}
+	}
+	return s.currentProvider
+}
+
+// scopeAllowed tells whether DEKs can be created for the scope, see WithAllowedScopes
+func (s *SecretsService) scopeAllowed(scope string) bool {
+	if len(s.allowedScopes) == 0 {
+		return true
+	}
+	for _, prefix := range s.allowedScopes {
+		if strings.HasPrefix(scope, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeEnvelope prefixes the encrypted payload with the header identifying its DEK:
+// '#', the envelope version byte, the length of the DEK name as a big endian uint16 and the DEK name itself.
+func encodeEnvelope(keyName string, encrypted []byte) ([]byte, error) {
+	if len(keyName) > math.MaxUint16 {
+		return nil, fmt.Errorf("data key name is too long")
+	}
+
+	blob := make([]byte, 4, 4+len(keyName)+len(encrypted))
+	blob[0] = '#'
+	blob[1] = secrets.EnvelopeVersion2
+	binary.BigEndian.PutUint16(blob[2:4], uint16(len(keyName)))
+	blob = append(blob, keyName...)
+	blob = append(blob, encrypted...)
 
 	return blob, nil
 }
 
-func (s *SecretsService) Decrypt(ctx context.Context, payload []byte) ([]byte, error) {
+// encodeLayeredEnvelope prefixes the encrypted payload with the header of encodeEnvelope, using the EnvelopeVersion3
+// version byte, followed by the length of the wrapped key of the payload as a big endian uint16 and the wrapped key itself.
+func encodeLayeredEnvelope(keyName string, wrappedKey []byte, encrypted []byte) ([]byte, error) {
+	if len(keyName) > math.MaxUint16 {
+		return nil, fmt.Errorf("data key name is too long")
+	}
+	if len(wrappedKey) > math.MaxUint16 {
+		return nil, fmt.Errorf("wrapped data key is too long")
+	}
+
+	blob := make([]byte, 4, 6+len(keyName)+len(wrappedKey)+len(encrypted))
+	blob[0] = '#'
+	blob[1] = secrets.EnvelopeVersion3
+	binary.BigEndian.PutUint16(blob[2:4], uint16(len(keyName)))
+	blob = append(blob, keyName...)
+	blob = append(blob, 0, 0)
+	binary.BigEndian.PutUint16(blob[len(blob)-2:], uint16(len(wrappedKey)))
+	blob = append(blob, wrappedKey...)
+	blob = append(blob, encrypted...)
+
+	return blob, nil
+}
+
+// splitWrappedDataKey splits the encrypted data of an EnvelopeVersion3 payload into the wrapped key of the payload
+// and the payload encrypted with it
+func splitWrappedDataKey(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 2 {
+		return nil, nil, fmt.Errorf("could not find valid wrapped key in encrypted payload")
+	}
+	keyLength := int(binary.BigEndian.Uint16(payload[:2]))
+	payload = payload[2:]
+	if len(payload) < keyLength {
+		return nil, nil, fmt.Errorf("could not find valid wrapped key in encrypted payload")
+	}
+	return payload[:keyLength], payload[keyLength:], nil
+}
+
+func (s *SecretsService) Decrypt(ctx context.Context, payload []byte, opts ...secrets.DecryptionOptions) ([]byte, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	decryptionSettings := secrets.DecryptionSettings{}
+	for _, opt := range opts {
+		opt(&decryptionSettings)
+	}
+
 	// Use legacy encryption service if envelopeEncryptionFeatureToggle toggle is off
 	if !s.settings.IsFeatureToggleEnabled(envelopeEncryptionFeatureToggle) {
-		return s.enc.Decrypt(ctx, payload, setting.SecretKey)
+		if decryptionSettings.AdditionalData != nil {
+			return nil, secrets.ErrAdditionalDataMismatch
+		}
+		return s.decryptLegacy(ctx, payload, setting.SecretKey, decryptionSettings.ValidateLegacy)
 	}
 
 	// If encryption envelopeEncryptionFeatureToggle toggle is on, use envelope encryption
@@ -108,38 +447,204 @@ func (s *SecretsService) Decrypt(ctx context.Context, payload []byte) ([]byte, e
 		return nil, fmt.Errorf("unable to decrypt empty payload")
 	}
 
-	var dataKey []byte
-
 	if payload[0] != '#' {
+		if decryptionSettings.AdditionalData != nil {
+			return nil, secrets.ErrAdditionalDataMismatch
+		}
 		secretKey := s.settings.KeyValue("security", "secret_key").Value()
-		dataKey = []byte(secretKey)
-	} else {
-		payload = payload[1:]
-		endOfKey := bytes.Index(payload, []byte{'#'})
-		if endOfKey == -1 {
-			return nil, fmt.Errorf("could not find valid key in encrypted payload")
-		}
-		b64Key := payload[:endOfKey]
-		payload = payload[endOfKey+1:]
-		key := make([]byte, b64.DecodedLen(len(b64Key)))
-		_, err := b64.Decode(key, b64Key)
+		return s.decryptLegacy(ctx, payload, secretKey, decryptionSettings.ValidateLegacy)
+	}
+
+	version, key, payload, err := parseEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := s.dataKey(ctx, key)
+	if errors.Is(err, secrets.ErrDataKeyNotFound) {
+		dataKey, err = s.deletedDataKey(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The DEK of the scope only wraps the key of the payload in layered envelopes
+	if version == secrets.EnvelopeVersion3 {
+		var wrapped []byte
+		wrapped, payload, err = splitWrappedDataKey(payload)
 		if err != nil {
 			return nil, err
 		}
-
-		dataKey, err = s.dataKey(ctx, string(key))
+		dataKey, err = decryptAEAD(wrapped, string(dataKey), []byte(key))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to unwrap the data key of the payload: %w", err)
 		}
+		defer secrets.Wipe(dataKey)
+	}
+
+	if isAEADPayload(payload) {
+		return decryptAEAD(payload, string(dataKey), decryptionSettings.AdditionalData)
+	}
+	// Payloads encrypted without additional data cannot satisfy an expected one
+	if decryptionSettings.AdditionalData != nil {
+		return nil, secrets.ErrAdditionalDataMismatch
 	}
 
 	return s.enc.Decrypt(ctx, payload, string(dataKey))
 }
 
-func (s *SecretsService) EncryptJsonData(ctx context.Context, kv map[string]string, opt secrets.EncryptionOptions) (map[string][]byte, error) {
+func (s *SecretsService) DecryptInto(ctx context.Context, payload []byte, fn func(plaintext []byte) error, opts ...secrets.DecryptionOptions) error {
+	decrypted, err := s.Decrypt(ctx, payload, opts...)
+	if err != nil {
+		return err
+	}
+	defer secrets.Wipe(decrypted)
+
+	return fn(decrypted)
+}
+
+// ReScope decrypts a secret and encrypts it again with the DEK of newScope, e.g. to move secrets encrypted
+// WithoutScope, or before envelope encryption, to a DEK of their own. It returns the new payload, which replaces
+// the old one in storage. Secrets encrypted with additional data cannot be re-scoped, they fail to decrypt.
+func (s *SecretsService) ReScope(ctx context.Context, payload []byte, newScope string) ([]byte, error) {
+	if newScope == "" {
+		return nil, fmt.Errorf("scope to re-scope secret to is missing")
+	}
+
+	opts := []secrets.EncryptionOptions{secrets.WithScope(newScope)}
+	if len(payload) > 1 && payload[0] == '#' && payload[1] == secrets.EnvelopeVersion3 {
+		opts = append(opts, secrets.WithPerSecretDataKey())
+	}
+
+	var encrypted []byte
+	err := s.DecryptInto(ctx, payload, func(plaintext []byte) error {
+		var err error
+		encrypted, err = s.Encrypt(ctx, plaintext, opts...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// decryptLegacy decrypts a payload encrypted directly with a secret key. When validate rejects the plaintext,
+// e.g. after secret_key has been rotated, the previous secret keys are tried in order, see secrets.WithLegacyValidator.
+// They are never tried without validate: AES-CFB is not authenticated, decrypting with another key doesn't fail.
+func (s *SecretsService) decryptLegacy(ctx context.Context, payload []byte, secretKey string, validate func([]byte) bool) ([]byte, error) {
+	decrypted, err := s.enc.Decrypt(ctx, payload, secretKey)
+	if validate == nil || len(s.previousSecretKeys) == 0 || (err == nil && validate(decrypted)) {
+		return decrypted, err
+	}
+
+	for _, previousKey := range s.previousSecretKeys {
+		previous, previousErr := s.enc.Decrypt(ctx, payload, previousKey)
+		if previousErr != nil {
+			continue
+		}
+		if validate(previous) {
+			secrets.Wipe(decrypted)
+			return previous, nil
+		}
+		secrets.Wipe(previous)
+	}
+
+	return decrypted, err
+}
+
+// parseEnvelope splits an envelope encrypted payload into the version of its envelope,
+// the name of its DEK and the encrypted data. Both the length-prefixed ('#', version byte, length, name)
+// and the older base64 delimited ("#<b64 name>#") layouts are supported. The encrypted data of layered
+// envelopes starts with the wrapped key of the payload, see splitWrappedDataKey.
+func parseEnvelope(payload []byte) (int, string, []byte, error) {
+	payload = payload[1:]
+
+	// The version byte is never a valid base64 character, so it cannot be mistaken for the older layout
+	if len(payload) > 0 && (payload[0] == secrets.EnvelopeVersion2 || payload[0] == secrets.EnvelopeVersion3) {
+		version := int(payload[0])
+		if len(payload) < 3 {
+			return 0, "", nil, fmt.Errorf("could not find valid key in encrypted payload")
+		}
+		keyLength := int(binary.BigEndian.Uint16(payload[1:3]))
+		payload = payload[3:]
+		if len(payload) < keyLength {
+			return 0, "", nil, fmt.Errorf("could not find valid key in encrypted payload")
+		}
+		return version, string(payload[:keyLength]), payload[keyLength:], nil
+	}
+
+	endOfKey := bytes.Index(payload, []byte{'#'})
+	if endOfKey == -1 {
+		return 0, "", nil, fmt.Errorf("could not find valid key in encrypted payload")
+	}
+	b64Key := payload[:endOfKey]
+	payload = payload[endOfKey+1:]
+	key := make([]byte, b64.DecodedLen(len(b64Key)))
+	_, err := b64.Decode(key, b64Key)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return secrets.EnvelopeVersion1, string(key), payload, nil
+}
+
+// IsLegacyEncrypted classifies ciphertext without decrypting it: envelope encrypted payloads start with '#',
+// which is never the first byte of a legacy one. A payload starting with '#' isn't legacy even if its envelope is invalid.
+func (s *SecretsService) IsLegacyEncrypted(ciphertext []byte) bool {
+	return len(ciphertext) > 0 && ciphertext[0] != '#'
+}
+
+// InspectEnvelope parses the header of an encrypted payload and describes how it was encrypted.
+// It neither decrypts the payload nor contacts any encryption provider.
+func (s *SecretsService) InspectEnvelope(payload []byte) (secrets.EnvelopeInfo, error) {
+	if len(payload) == 0 {
+		return secrets.EnvelopeInfo{}, fmt.Errorf("unable to inspect empty payload")
+	}
+
+	if payload[0] != '#' {
+		return secrets.EnvelopeInfo{
+			Version:       secrets.EnvelopeVersionLegacy,
+			Provider:      defaultProvider,
+			Cipher:        secrets.CipherAESCFB,
+			PayloadLength: len(payload),
+		}, nil
+	}
+
+	version, keyName, encrypted, err := parseEnvelope(payload)
+	if err != nil {
+		return secrets.EnvelopeInfo{}, err
+	}
+	if version == secrets.EnvelopeVersion3 {
+		if _, encrypted, err = splitWrappedDataKey(encrypted); err != nil {
+			return secrets.EnvelopeInfo{}, err
+		}
+	}
+
+	info := secrets.EnvelopeInfo{
+		Version:       version,
+		DataKeyName:   keyName,
+		Cipher:        secrets.CipherAESCFB,
+		PayloadLength: len(encrypted),
+	}
+	if isAEADPayload(encrypted) {
+		info.Cipher = secrets.CipherAESGCM
+	}
+
+	// Data key names look like "2021-10-28/user:10@secretKey"
+	if at := strings.LastIndex(keyName, "@"); at != -1 {
+		info.Provider = keyName[at+1:]
+		keyName = keyName[:at]
+	}
+	if slash := strings.Index(keyName, "/"); slash != -1 {
+		info.Scope = keyName[slash+1:]
+	}
+
+	return info, nil
+}
+
+func (s *SecretsService) EncryptJsonData(ctx context.Context, kv map[string]string, opts ...secrets.EncryptionOptions) (map[string][]byte, error) {
 	encrypted := make(map[string][]byte)
 	for key, value := range kv {
-		encryptedData, err := s.Encrypt(ctx, []byte(value), opt)
+		encryptedData, err := s.Encrypt(ctx, []byte(value), opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -175,8 +680,11 @@ func (s *SecretsService) GetDecryptedValue(ctx context.Context, sjd map[string][
 	return fallback
 }
 
+// dataKeyLength is the length of the DEKs, i.e. AES-128 keys
+const dataKeyLength = 16
+
 func newRandomDataKey() ([]byte, error) {
-	rawDataKey := make([]byte, 16)
+	rawDataKey := make([]byte, dataKeyLength)
 	_, err := rand.Read(rawDataKey)
 	if err != nil {
 		return nil, err
@@ -185,52 +693,166 @@ func newRandomDataKey() ([]byte, error) {
 }
 
 // newDataKey creates a new random DEK, caches it and returns its value
-func (s *SecretsService) newDataKey(ctx context.Context, name string, scope string) ([]byte, error) {
+func (s *SecretsService) newDataKey(ctx context.Context, name string, scope string, providerID string, label string) ([]byte, error) {
 	// 1. Create new DEK
 	dataKey, err := newRandomDataKey()
 	if err != nil {
 		return nil, err
 	}
-	provider, exists := s.providers[s.currentProvider]
+	provider, exists := s.lookupProvider(providerID)
 	if !exists {
-		return nil, fmt.Errorf("could not find encryption provider '%s'", s.currentProvider)
+		return nil, fmt.Errorf("could not find encryption provider '%s'", providerID)
 	}
 
 	// 2. Encrypt it
-	encrypted, err := provider.Encrypt(ctx, dataKey)
+	encrypted, err := s.providerEncrypt(ctx, provider, dataKey)
 	if err != nil {
 		return nil, err
 	}
 
 	// 3. Store its encrypted value in db
 	err = s.store.CreateDataKey(ctx, secrets.DataKey{
-		Active:        true, // TODO: right now we never mark a key as deactivated
+		Active:        true,
 		Name:          name,
-		Provider:      s.currentProvider,
+		Provider:      providerID,
 		EncryptedData: encrypted,
 		Scope:         scope,
+		Label:         label,
 	})
+	if errors.Is(err, secrets.ErrDataKeyExists) {
+		// Another encryption created the DEK concurrently, use theirs
+		return s.dataKey(ctx, name)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// 4. Cache its unencrypted value and return it
-	s.dataKeyCache[name] = dataKeyCacheItem{
-		expiry:  time.Now().Add(15 * time.Minute),
-		dataKey: dataKey,
-	}
+	s.cacheDataKey(name, dataKey)
 
 	return dataKey, nil
 }
 
+// activeDataKey returns the DEK named name, or the DEK renewing it when it has been deactivated, along with its name.
+// Renewing DEKs are named after the deactivated one, e.g. "2021-10-28.1/user:10@secretKey", so that a scope
+// keeps encrypting with a fresh DEK rather than failing until the next day. The latest of them is looked up in the
+// cache, then with a single store lookup. When it doesn't exist or is deactivated, it fails with
+// secrets.ErrDataKeyNotFound and returns the name the DEK to create should have.
+func (s *SecretsService) activeDataKey(ctx context.Context, name string) ([]byte, string, error) {
+	keyName := s.dataKeyRenewal(name)
+	if dataKey, exists := s.cachedDataKey(keyName); exists {
+		return dataKey, keyName, nil
+	}
+
+	prefix, suffix := dataKeyRenewalAffixes(name)
+	dataKeys, err := s.store.GetDataKeysByNameAffixes(ctx, prefix, suffix)
+	if err != nil {
+		return nil, "", err
+	}
+	var latest *secrets.DataKey
+	latestRenewal := -1
+	for _, dataKey := range dataKeys {
+		if renewal, ok := parseDataKeyRenewal(name, dataKey.Name); ok && renewal > latestRenewal {
+			latest, latestRenewal = dataKey, renewal
+		}
+	}
+
+	switch {
+	case latest == nil:
+		keyName = name
+	case latest.Active:
+		dataKey, err := s.decryptDataKey(ctx, latest)
+		if err != nil {
+			return nil, "", err
+		}
+		s.cacheDataKey(latest.Name, dataKey)
+		s.setDataKeyRenewal(name, latest.Name)
+		return dataKey, latest.Name, nil
+	case latestRenewal >= maxDataKeyRenewals:
+		return nil, "", fmt.Errorf("data key '%s' has been deactivated more than %d times", name, maxDataKeyRenewals)
+	default:
+		// a deactivated DEK is renewed even when it's corrupt, it is never used to encrypt anyway
+		keyName = renewedDataKeyName(name, latestRenewal+1)
+	}
+	s.setDataKeyRenewal(name, keyName)
+	return nil, keyName, secrets.ErrDataKeyNotFound
+}
+
+// dataKeyRenewal returns the name of the DEK last known to renew the DEK named name, name itself when there's none
+func (s *SecretsService) dataKeyRenewal(name string) string {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
+
+	if renewal, exists := s.dataKeyRenewals[name]; exists {
+		return renewal
+	}
+	return name
+}
+
+func (s *SecretsService) setDataKeyRenewal(name, renewal string) {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
+
+	if renewal == name {
+		delete(s.dataKeyRenewals, name)
+		return
+	}
+	s.dataKeyRenewals[name] = renewal
+}
+
+// dataKeyRenewalAffixes returns the prefix and the suffix shared by the name of a DEK and the names of its renewals,
+// see renewedDataKeyName
+func dataKeyRenewalAffixes(name string) (string, string) {
+	if slash := strings.Index(name, "/"); slash != -1 {
+		return name[:slash], name[slash:]
+	}
+	return "", name
+}
+
+// parseDataKeyRenewal returns which renewal of the DEK named name the DEK named candidate is, 0 for name itself.
+// It returns false when candidate isn't named after name the way renewedDataKeyName names renewals.
+func parseDataKeyRenewal(name, candidate string) (int, bool) {
+	if candidate == name {
+		return 0, true
+	}
+	prefix, suffix := dataKeyRenewalAffixes(name)
+	if len(candidate) < len(prefix)+len(suffix) || !strings.HasPrefix(candidate, prefix) || !strings.HasSuffix(candidate, suffix) {
+		return 0, false
+	}
+	renewal, err := strconv.Atoi(strings.Trim(candidate[len(prefix):len(candidate)-len(suffix)], "."))
+	if err != nil || renewal < 1 || renewedDataKeyName(name, renewal) != candidate {
+		return 0, false
+	}
+	return renewal, true
+}
+
+// renewedDataKeyName returns the name of the DEK renewing the DEK named name for the renewal-th time, name itself for 0.
+// The renewal is appended to the part before the scope, so that InspectEnvelope still finds the scope and provider.
+func renewedDataKeyName(name string, renewal int) string {
+	if renewal == 0 {
+		return name
+	}
+	if slash := strings.Index(name, "/"); slash != -1 {
+		return fmt.Sprintf("%s.%d%s", name[:slash], renewal, name[slash:])
+	}
+	return fmt.Sprintf("%d.%s", renewal, name)
+}
+
+// DeactivateDataKey soft-deletes the DEK and evicts it from the cache, so that it is no longer used to encrypt.
+// Payloads it encrypted can still be decrypted when decrypt_with_deleted_data_keys is enabled.
+func (s *SecretsService) DeactivateDataKey(ctx context.Context, name string) error {
+	if err := s.store.DeactivateDataKey(ctx, name); err != nil {
+		return err
+	}
+	s.evictDataKey(name)
+	logger.Info("Data key deactivated", "name", name)
+	return nil
+}
+
 // dataKey looks up DEK in cache or database, and decrypts it
 func (s *SecretsService) dataKey(ctx context.Context, name string) ([]byte, error) {
-	if item, exists := s.dataKeyCache[name]; exists {
-		if item.expiry.Before(time.Now()) && !item.expiry.IsZero() {
-			delete(s.dataKeyCache, name)
-		} else {
-			return item.dataKey, nil
-		}
+	if dataKey, exists := s.cachedDataKey(name); exists {
+		return dataKey, nil
 	}
 
 	// 1. get encrypted data key from database
@@ -240,29 +862,494 @@ func (s *SecretsService) dataKey(ctx context.Context, name string) ([]byte, erro
 	}
 
 	// 2. decrypt data key
-	provider, exists := s.providers[dataKey.Provider]
+	decrypted, err := s.decryptDataKey(ctx, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. cache data key
+	s.cacheDataKey(name, decrypted)
+
+	return decrypted, nil
+}
+
+// decryptionProvider returns the provider decrypting the DEKs stored with providerID,
+// a former provider name is routed to its current provider, see encryption_provider_aliases
+func (s *SecretsService) decryptionProvider(providerID string) (secrets.Provider, error) {
+	if alias, ok := s.providerAliases[providerID]; ok {
+		providerID = alias
+	}
+	provider, exists := s.lookupProvider(providerID)
 	if !exists {
-		return nil, fmt.Errorf("could not find encryption provider '%s'", dataKey.Provider)
+		return nil, fmt.Errorf("could not find encryption provider '%s'", providerID)
 	}
+	return provider, nil
+}
 
-	decrypted, err := provider.Decrypt(ctx, dataKey.EncryptedData)
+// deletedDataKey decrypts a soft-deleted DEK when decrypt_with_deleted_data_keys allows it, e.g. to recover secrets,
+// it fails with secrets.ErrDataKeyDeleted otherwise. The DEK isn't cached, so that it is never used to encrypt.
+func (s *SecretsService) deletedDataKey(ctx context.Context, name string) ([]byte, error) {
+	dataKey, err := s.store.GetDeletedDataKey(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	if !s.decryptWithDeletedDataKeys {
+		return nil, fmt.Errorf("%w: %s", secrets.ErrDataKeyDeleted, name)
+	}
+
+	logger.Warn("Decrypting with a deleted data key", "name", name)
+	return s.decryptDataKey(ctx, dataKey)
+}
+
+// decryptDataKey decrypts the material of a stored DEK with its provider and checks that it is a DEK,
+// so that corrupt material fails with secrets.ErrDataKeyCorrupt rather than decrypting the payloads to garbage
+func (s *SecretsService) decryptDataKey(ctx context.Context, dataKey *secrets.DataKey) ([]byte, error) {
+	provider, err := s.decryptionProvider(dataKey.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := s.providerDecrypt(ctx, provider, dataKey.EncryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key '%s': %w", dataKey.Name, err)
+	}
+	if len(decrypted) != dataKeyLength {
+		secrets.Wipe(decrypted)
+		logger.Error("Decrypted data key has an invalid length", "name", dataKey.Name, "length", len(decrypted))
+		return nil, fmt.Errorf("%w: '%s' decrypts to %d bytes instead of %d", secrets.ErrDataKeyCorrupt, dataKey.Name, len(decrypted), dataKeyLength)
+	}
+	return decrypted, nil
+}
+
+func (s *SecretsService) cachedDataKey(name string) ([]byte, bool) {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
+
+	item, exists := s.dataKeyCache[name]
+	if !exists {
+		s.dataKeyCacheStats.Misses++
+		return nil, false
+	}
+	if item.expiry.Before(time.Now()) && !item.expiry.IsZero() {
+		delete(s.dataKeyCache, name)
+		s.dataKeyCacheStats.Misses++
+		s.dataKeyCacheStats.Evictions++
+		return nil, false
+	}
+	s.dataKeyCacheStats.Hits++
+	return item.dataKey, true
+}
+
+func (s *SecretsService) cacheDataKey(name string, dataKey []byte) {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
 
-	// 3. cache data key
 	s.dataKeyCache[name] = dataKeyCacheItem{
 		expiry:  time.Now().Add(15 * time.Minute),
-		dataKey: decrypted,
+		dataKey: dataKey,
 	}
+}
 
-	return decrypted, nil
+func (s *SecretsService) evictDataKey(name string) {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
+
+	if _, exists := s.dataKeyCache[name]; exists {
+		delete(s.dataKeyCache, name)
+		s.dataKeyCacheStats.Evictions++
+	}
+}
+
+// CacheStats returns the usage statistics of the DEK cache
+func (s *SecretsService) CacheStats() DataKeyCacheStats {
+	s.dataKeyCacheMtx.Lock()
+	defer s.dataKeyCacheMtx.Unlock()
+
+	stats := s.dataKeyCacheStats
+	stats.Size = len(s.dataKeyCache)
+	return stats
+}
+
+// ListDataKeyInfo describes all the data keys, including their labels, without decrypting them
+func (s *SecretsService) ListDataKeyInfo(ctx context.Context) ([]secrets.DataKeyInfo, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]secrets.DataKeyInfo, 0, len(dataKeys))
+	for _, dataKey := range dataKeys {
+		infos = append(infos, secrets.DataKeyInfo{
+			Name:     dataKey.Name,
+			Scope:    dataKey.Scope,
+			Provider: dataKey.Provider,
+			Label:    dataKey.Label,
+			Active:   dataKey.Active,
+			Created:  dataKey.Created,
+			Updated:  dataKey.Updated,
+		})
+	}
+	return infos, nil
+}
+
+// ExportDataKeys returns a backup of all the data keys, ordered by name, to restore with ImportDataKeys,
+// e.g. for disaster recovery. The data keys are exported encrypted by their providers, they are never decrypted.
+func (s *SecretsService) ExportDataKeys(ctx context.Context) (*secrets.DataKeysBundle, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	dataKeys, err := s.store.GetAllDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &secrets.DataKeysBundle{DataKeys: make([]secrets.ExportedDataKey, 0, len(dataKeys))}
+	for _, dataKey := range dataKeys {
+		bundle.DataKeys = append(bundle.DataKeys, secrets.ExportedDataKey{
+			Name:          dataKey.Name,
+			Scope:         dataKey.Scope,
+			Provider:      dataKey.Provider,
+			Label:         dataKey.Label,
+			Active:        dataKey.Active,
+			EncryptedData: dataKey.EncryptedData,
+			Created:       dataKey.Created,
+		})
+	}
+	sort.Slice(bundle.DataKeys, func(i, j int) bool {
+		return bundle.DataKeys[i].Name < bundle.DataKeys[j].Name
+	})
+	return bundle, nil
+}
+
+// ImportDataKeys restores the data keys of an ExportDataKeys backup, the ones whose name already exists are skipped
+// and kept as they are. It returns the number of restored data keys.
+func (s *SecretsService) ImportDataKeys(ctx context.Context, bundle *secrets.DataKeysBundle) (int, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, exported := range bundle.DataKeys {
+		err := s.store.RestoreDataKey(ctx, secrets.DataKey{
+			Name:          exported.Name,
+			Scope:         exported.Scope,
+			Provider:      exported.Provider,
+			Label:         exported.Label,
+			Active:        exported.Active,
+			EncryptedData: exported.EncryptedData,
+			Created:       exported.Created,
+		})
+		if errors.Is(err, secrets.ErrDataKeyExists) {
+			logger.Debug("Skipping the import of an existing data key", "name", exported.Name)
+			continue
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to import data key '%s': %w", exported.Name, err)
+		}
+		imported++
+	}
+
+	logger.Info("Data keys imported", "imported", imported, "skipped", len(bundle.DataKeys)-imported)
+	return imported, nil
+}
+
+// ReEncryptDataKeysForProvider re-encrypts the DEKs encrypted by oldProvider with the current provider,
+// DEKs of other providers are left untouched. It returns the number of re-encrypted DEKs.
+// Since re-encrypted DEKs no longer belong to oldProvider, running it again is a no-op.
+func (s *SecretsService) ReEncryptDataKeysForProvider(ctx context.Context, oldProvider string) (int, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	if oldProvider == s.currentProvider {
+		return 0, nil
+	}
+
+	current, exists := s.lookupProvider(s.currentProvider)
+	if !exists {
+		return 0, fmt.Errorf("could not find encryption provider '%s'", s.currentProvider)
+	}
+	old, err := s.decryptionProvider(oldProvider)
+	if err != nil {
+		return 0, err
+	}
+
+	dataKeys, err := s.store.GetDataKeysByProvider(ctx, oldProvider)
+	if err != nil {
+		return 0, err
+	}
+
+	reEncrypted := 0
+	for _, dataKey := range dataKeys {
+		decrypted, err := s.providerDecrypt(ctx, old, dataKey.EncryptedData)
+		if err != nil {
+			return reEncrypted, fmt.Errorf("failed to decrypt data key '%s': %w", dataKey.Name, err)
+		}
+
+		encrypted, err := s.providerEncrypt(ctx, current, decrypted)
+		if err != nil {
+			return reEncrypted, fmt.Errorf("failed to encrypt data key '%s': %w", dataKey.Name, err)
+		}
+
+		dataKey.Provider = s.currentProvider
+		dataKey.EncryptedData = encrypted
+		if err := s.store.UpdateDataKey(ctx, *dataKey); err != nil {
+			return reEncrypted, err
+		}
+		reEncrypted++
+	}
+
+	logger.Info("Data keys re-encrypted", "from", oldProvider, "to", s.currentProvider, "count", reEncrypted)
+	return reEncrypted, nil
+}
+
+// selfTestPlaintext is the known plaintext encrypted and decrypted by SelfTest
+var selfTestPlaintext = []byte("grafana secrets self test")
+
+// SelfTest checks that a secret round-trips through the full envelope encryption path of the current provider,
+// e.g. after configuring a new provider: a temporary DEK is encrypted by the provider and stored, then read back
+// and decrypted by the provider to decrypt a known plaintext. The temporary DEK is deleted whether the test succeeds
+// or not, and no secret is persisted. Without envelope encryption, the legacy encryption is tested instead.
+func (s *SecretsService) SelfTest(ctx context.Context) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	if !s.settings.IsFeatureToggleEnabled(envelopeEncryptionFeatureToggle) {
+		encrypted, err := s.enc.Encrypt(ctx, selfTestPlaintext, setting.SecretKey)
+		if err != nil {
+			return fmt.Errorf("self test failed to encrypt: %w", err)
+		}
+		if err := checkSelfTestDecryption(s.decryptLegacy(ctx, encrypted, setting.SecretKey, nil)); err != nil {
+			return fmt.Errorf("self test failed: %w", err)
+		}
+		return nil
+	}
+
+	providerID := s.currentProvider
+	suffix, err := util.GetRandomString(10)
+	if err != nil {
+		return err
+	}
+	keyName := fmt.Sprintf("selftest-%s/selftest@%s", suffix, providerID)
+
+	defer func() {
+		s.evictDataKey(keyName)
+		if err := s.store.DeleteDataKey(ctx, keyName); err != nil {
+			logger.Warn("Failed to delete the data key of the self test", "name", keyName, "err", err)
+		}
+	}()
+
+	dataKey, err := s.newDataKey(ctx, keyName, "selftest", providerID, "")
+	if err != nil {
+		return fmt.Errorf("self test of provider '%s' failed to create a data key: %w", providerID, err)
+	}
+	encrypted, err := s.enc.Encrypt(ctx, selfTestPlaintext, string(dataKey))
+	if err != nil {
+		return fmt.Errorf("self test of provider '%s' failed to encrypt: %w", providerID, err)
+	}
+	envelope, err := encodeEnvelope(keyName, encrypted)
+	if err != nil {
+		return err
+	}
+
+	// the DEK was cached when it was created, decrypting must read it back and decrypt it with the provider
+	s.evictDataKey(keyName)
+	if err := checkSelfTestDecryption(s.Decrypt(ctx, envelope)); err != nil {
+		return fmt.Errorf("self test of provider '%s' failed: %w", providerID, err)
+	}
+	return nil
+}
+
+func checkSelfTestDecryption(decrypted []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to decrypt: %w", err)
+	}
+	if !bytes.Equal(decrypted, selfTestPlaintext) {
+		return errors.New("decrypted an unexpected plaintext")
+	}
+	return nil
+}
+
+// ExportDecrypted decrypts the ciphertexts in bulk and returns their plaintexts in the same order. Exporting secrets
+// in plain text is dangerous, so it fails with secrets.ErrExportNotAcknowledged unless opts acknowledges it,
+// and every export is audit logged. Nothing is returned when any of the ciphertexts fails to decrypt.
+func (s *SecretsService) ExportDecrypted(ctx context.Context, ciphertexts [][]byte, opts secrets.ExportDecryptedOptions) ([][]byte, error) {
+	if !opts.IUnderstandSecretsAreExportedInPlainText {
+		logger.Warn("Refused to export decrypted secrets without acknowledgement", "actor", opts.Actor, "reason", opts.Reason, "count", len(ciphertexts))
+		return nil, secrets.ErrExportNotAcknowledged
+	}
+
+	logger.Warn("Exporting decrypted secrets", "actor", opts.Actor, "reason", opts.Reason, "count", len(ciphertexts))
+
+	plaintexts := make([][]byte, 0, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		decrypted, err := s.Decrypt(ctx, ciphertext)
+		if err != nil {
+			for _, plaintext := range plaintexts {
+				secrets.Wipe(plaintext)
+			}
+			logger.Error("Failed to export decrypted secrets", "actor", opts.Actor, "index", i, "err", err)
+			return nil, fmt.Errorf("failed to decrypt secret %d: %w", i, err)
+		}
+		plaintexts = append(plaintexts, decrypted)
+	}
+
+	logger.Info("Exported decrypted secrets", "actor", opts.Actor, "count", len(plaintexts))
+	return plaintexts, nil
+}
+
+// DecryptBatchWithMeta decrypts the ciphertexts one by one and returns a result per ciphertext, in the same order,
+// with its plaintext or the error it failed with, and the envelope version, DEK and provider it was encrypted with,
+// e.g. to report the progress of a migration to another provider. A ciphertext failing to decrypt doesn't stop
+// the batch. The provider is the one the DEK is stored with, the provider decrypting it may be an alias of it.
+// Callers should Wipe the plaintexts once they are done with them.
+func (s *SecretsService) DecryptBatchWithMeta(ctx context.Context, ciphertexts [][]byte) ([]secrets.DecryptionResult, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+
+	// the provider of each DEK of the batch, so that DEKs shared by several ciphertexts are looked up once
+	providers := make(map[string]string)
+	results := make([]secrets.DecryptionResult, 0, len(ciphertexts))
+	for _, ciphertext := range ciphertexts {
+		var result secrets.DecryptionResult
+		if info, err := s.InspectEnvelope(ciphertext); err == nil {
+			result.Version = info.Version
+			result.DataKeyName = info.DataKeyName
+			result.Provider = info.Provider
+			if info.DataKeyName != "" {
+				provider, ok := providers[info.DataKeyName]
+				if !ok {
+					provider = s.storedDataKeyProvider(ctx, info.DataKeyName, info.Provider)
+					providers[info.DataKeyName] = provider
+				}
+				result.Provider = provider
+			}
+		}
+
+		result.Plaintext, result.Err = s.Decrypt(ctx, ciphertext)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// storedDataKeyProvider returns the provider the DEK is stored with, deleted DEKs included,
+// or fallback when the DEK cannot be found
+func (s *SecretsService) storedDataKeyProvider(ctx context.Context, name string, fallback string) string {
+	dataKey, err := s.store.GetDataKey(ctx, name)
+	if errors.Is(err, secrets.ErrDataKeyNotFound) {
+		dataKey, err = s.store.GetDeletedDataKey(ctx, name)
+	}
+	if err != nil {
+		return fallback
+	}
+	return dataKey.Provider
+}
+
+// acquireProvider waits until a provider call is allowed by the kms_max_concurrent limit,
+// the returned function must be called once the call is over
+func (s *SecretsService) acquireProvider(ctx context.Context) (func(), error) {
+	if s.providerCalls == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.providerCalls <- struct{}{}:
+		return func() { <-s.providerCalls }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *SecretsService) providerEncrypt(ctx context.Context, provider secrets.Provider, blob []byte) ([]byte, error) {
+	release, err := s.acquireProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return provider.Encrypt(ctx, blob)
+}
+
+func (s *SecretsService) providerDecrypt(ctx context.Context, provider secrets.Provider, blob []byte) ([]byte, error) {
+	release, err := s.acquireProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return provider.Decrypt(ctx, blob)
 }
 
 func (s *SecretsService) RegisterProvider(providerID string, provider secrets.Provider) {
 	s.providers[providerID] = provider
 }
 
+// RegisterProviderFactory registers a provider constructed by factory on its first call, see lazyProvider
+func (s *SecretsService) RegisterProviderFactory(providerID string, factory secrets.ProviderFactory) {
+	s.providers[providerID] = newLazyProvider(factory)
+}
+
+// InitProviders checks that the configured encryption provider has been registered.
+// Unless fallback is enabled in the settings, an unknown provider is an error.
+// Otherwise the default provider ('secretKey') is used instead.
+func (s *SecretsService) InitProviders() error {
+	fallback := s.settings.KeyValue("security", "encryption_provider_fallback").MustBool(false)
+
+	if _, exists := s.lookupProvider(s.currentProvider); !exists {
+		if !fallback {
+			return fmt.Errorf("encryption provider '%s' is not registered", s.currentProvider)
+		}
+
+		logger.Warn("Encryption provider is not registered, falling back to default provider",
+			"provider", s.currentProvider, "default", defaultProvider)
+		s.currentProvider = defaultProvider
+	}
+
+	scopeProviders := make([]scopeProvider, 0, len(s.scopeProviders))
+	for _, mapping := range s.scopeProviders {
+		if _, exists := s.lookupProvider(mapping.provider); !exists {
+			if !fallback {
+				return fmt.Errorf("encryption provider '%s' of scope prefix '%s' is not registered", mapping.provider, mapping.prefix)
+			}
+
+			logger.Warn("Encryption provider of scope prefix is not registered, falling back to the current provider",
+				"prefix", mapping.prefix, "provider", mapping.provider, "current", s.currentProvider)
+			continue
+		}
+		scopeProviders = append(scopeProviders, mapping)
+	}
+	s.scopeProviders = scopeProviders
+
+	for _, mapping := range s.scopeProviders {
+		if len(mapping.provider) > maxProviderIDLength {
+			return fmt.Errorf("encryption provider '%s' of scope prefix '%s' exceeds %d characters", mapping.provider, mapping.prefix, maxProviderIDLength)
+		}
+	}
+	if len(s.currentProvider) > maxProviderIDLength {
+		return fmt.Errorf("encryption provider '%s' exceeds %d characters", s.currentProvider, maxProviderIDLength)
+	}
+
+	for former, provider := range s.providerAliases {
+		if _, exists := s.lookupProvider(provider); !exists {
+			if !fallback {
+				return fmt.Errorf("encryption provider '%s' aliased by '%s' is not registered", provider, former)
+			}
+
+			logger.Warn("Encryption provider of alias is not registered, ignoring the alias",
+				"alias", former, "provider", provider)
+			delete(s.providerAliases, former)
+		}
+	}
+
+	return nil
+}
+
 func (s *SecretsService) CurrentProviderID() string {
 	return s.currentProvider
 }
@@ -270,3 +1357,94 @@ func (s *SecretsService) CurrentProviderID() string {
 func (s *SecretsService) GetProviders() map[string]secrets.Provider {
 	return s.providers
 }
+
+// RegisterUsageCounter registers a function reporting how many secrets of a consuming service depend on a DEK
+func (s *SecretsService) RegisterUsageCounter(counter secrets.UsageCounter) {
+	s.usageCounters = append(s.usageCounters, counter)
+}
+
+// CountSecretsForDataKey aggregates the number of secrets encrypted with the given DEK
+// across all the registered usage counters
+func (s *SecretsService) CountSecretsForDataKey(ctx context.Context, name string) (int64, error) {
+	if err := s.checkClosed(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, counter := range s.usageCounters {
+		count, err := counter(ctx, name)
+		if err != nil {
+			return 0, fmt.Errorf("failed to count secrets for data key '%s': %w", name, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// RegisterSecretUsage records the DEK ciphertext is encrypted with as used by the secret identified by secretRef.
+// Legacy ciphertexts don't depend on any DEK, they aren't recorded.
+func (s *SecretsService) RegisterSecretUsage(ctx context.Context, secretRef string, ciphertext []byte) error {
+	if err := s.checkClosed(); err != nil {
+		return err
+	}
+
+	info, err := s.InspectEnvelope(ciphertext)
+	if err != nil {
+		return fmt.Errorf("failed to register usage of secret '%s': %w", secretRef, err)
+	}
+	if info.Version == secrets.EnvelopeVersionLegacy {
+		return nil
+	}
+	return s.store.RegisterSecretUsage(ctx, secretRef, info.DataKeyName)
+}
+
+// SecretsForDataKey returns the references of the secrets registered with RegisterSecretUsage as encrypted
+// with the DEK. Secrets that weren't registered aren't returned, see CountSecretsForDataKey to count them.
+func (s *SecretsService) SecretsForDataKey(ctx context.Context, dataKeyName string) ([]string, error) {
+	if err := s.checkClosed(); err != nil {
+		return nil, err
+	}
+	return s.store.GetSecretsForDataKey(ctx, dataKeyName)
+}
+
+// Close flushes the DEK cache and closes the providers implementing secrets.ClosableProvider.
+// The service cannot be used afterwards, calls to it fail with secrets.ErrServiceClosed.
+func (s *SecretsService) Close(ctx context.Context) error {
+	s.closedMtx.Lock()
+	defer s.closedMtx.Unlock()
+
+	if s.closed {
+		return secrets.ErrServiceClosed
+	}
+	s.closed = true
+	s.dataKeyCacheMtx.Lock()
+	s.dataKeyCache = make(map[string]dataKeyCacheItem)
+	s.dataKeyRenewals = make(map[string]string)
+	s.dataKeyCacheMtx.Unlock()
+
+	var errs []string
+	for providerID, provider := range s.providers {
+		closable, ok := provider.(secrets.ClosableProvider)
+		if !ok {
+			continue
+		}
+		if err := closable.Close(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", providerID, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to close encryption providers: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func (s *SecretsService) checkClosed() error {
+	s.closedMtx.RLock()
+	defer s.closedMtx.RUnlock()
+
+	if s.closed {
+		return secrets.ErrServiceClosed
+	}
+	return nil
+}
@@ -1,19 +1,32 @@
 package manager
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/services/encryption/ossencryption"
 	"github.com/grafana/grafana/pkg/services/secrets"
 	"github.com/grafana/grafana/pkg/services/secrets/database"
+	"github.com/grafana/grafana/pkg/services/secrets/fakekms"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/setting"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/ini.v1"
+	"xorm.io/xorm"
 )
 
 func TestSecretsService_EnvelopeEncryption(t *testing.T) {
@@ -125,6 +138,28 @@ func TestSecretsService_DataKeys(t *testing.T) {
 		assert.Nil(t, res)
 	})
 
+	t.Run("updating a DEK", func(t *testing.T) {
+		k := dataKey
+		k.Provider = "other"
+		k.EncryptedData = []byte{0x01, 0x02}
+		err := store.UpdateDataKey(ctx, k)
+		require.NoError(t, err)
+
+		res, err := store.GetDataKey(ctx, dataKey.Name)
+		require.NoError(t, err)
+		assert.Equal(t, "other", res.Provider)
+		assert.Equal(t, k.EncryptedData, res.EncryptedData)
+
+		byProvider, err := store.GetDataKeysByProvider(ctx, "other")
+		require.NoError(t, err)
+		assert.Len(t, byProvider, 1)
+	})
+
+	t.Run("updating a DEK that does not exist", func(t *testing.T) {
+		err := store.UpdateDataKey(ctx, secrets.DataKey{Name: "unknown", Provider: "test"})
+		assert.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
 	t.Run("deleting DEK when no name provided must fail", func(t *testing.T) {
 		beforeDelete, err := store.GetAllDataKeys(ctx)
 		require.NoError(t, err)
@@ -184,3 +219,2256 @@ func TestSecretsService_GetCurrentProvider(t *testing.T) {
 		assert.Equal(t, "awskms.second_key", svc.currentProvider)
 	})
 }
+
+func TestSecretsService_CountSecretsForDataKey(t *testing.T) {
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+	ctx := context.Background()
+
+	t.Run("without registered counters should return zero", func(t *testing.T) {
+		count, err := svc.CountSecretsForDataKey(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+	})
+
+	t.Run("should aggregate the registered counters", func(t *testing.T) {
+		svc.RegisterUsageCounter(func(_ context.Context, name string) (int64, error) {
+			if name == "key" {
+				return 2, nil
+			}
+			return 0, nil
+		})
+		svc.RegisterUsageCounter(func(_ context.Context, name string) (int64, error) {
+			if name == "key" {
+				return 3, nil
+			}
+			return 1, nil
+		})
+
+		count, err := svc.CountSecretsForDataKey(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), count)
+
+		count, err = svc.CountSecretsForDataKey(ctx, "other")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("should fail when a counter fails", func(t *testing.T) {
+		svc.RegisterUsageCounter(func(context.Context, string) (int64, error) {
+			return 0, errors.New("table not found")
+		})
+
+		_, err := svc.CountSecretsForDataKey(ctx, "key")
+		require.Error(t, err)
+	})
+}
+
+func TestSecretsService_InspectEnvelope(t *testing.T) {
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+	t.Run("inspecting empty payload should return error", func(t *testing.T) {
+		_, err := svc.InspectEnvelope([]byte{})
+		require.Error(t, err)
+	})
+
+	t.Run("inspecting legacy payload", func(t *testing.T) {
+		encrypted := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeInfo{
+			Version:       secrets.EnvelopeVersionLegacy,
+			Provider:      "secretKey",
+			Cipher:        secrets.CipherAESCFB,
+			PayloadLength: len(encrypted),
+		}, info)
+	})
+
+	t.Run("inspecting envelope encrypted payload", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(context.Background(), []byte("grafana"), secrets.WithScope("user:10"))
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeVersion2, info.Version)
+		assert.Equal(t, "user:10", info.Scope)
+		assert.Equal(t, "secretKey", info.Provider)
+		assert.Equal(t, secrets.CipherAESCFB, info.Cipher)
+		assert.True(t, strings.HasSuffix(info.DataKeyName, "/user:10@secretKey"))
+		assert.Equal(t, len("grafana")+24, info.PayloadLength)
+	})
+
+	t.Run("inspecting payload with base64 delimited key", func(t *testing.T) {
+		info, err := svc.InspectEnvelope([]byte("#" + b64.EncodeToString([]byte("2021-10-28/root@secretKey")) + "#payload"))
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeVersion1, info.Version)
+		assert.Equal(t, "2021-10-28/root@secretKey", info.DataKeyName)
+		assert.Equal(t, len("payload"), info.PayloadLength)
+	})
+
+	t.Run("inspecting payload with missing key delimiter should return error", func(t *testing.T) {
+		_, err := svc.InspectEnvelope([]byte("#dGVzdA"))
+		require.Error(t, err)
+	})
+
+	t.Run("inspecting payload with truncated key should return error", func(t *testing.T) {
+		_, err := svc.InspectEnvelope([]byte{'#', secrets.EnvelopeVersion2, 0, 10, 'k', 'e', 'y'})
+		require.Error(t, err)
+	})
+}
+
+func TestSecretsService_IsLegacyEncrypted(t *testing.T) {
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+	t.Run("legacy payload should be legacy", func(t *testing.T) {
+		encrypted, err := svc.enc.Encrypt(context.Background(), []byte("grafana"), setting.SecretKey)
+		require.NoError(t, err)
+		assert.True(t, svc.IsLegacyEncrypted(encrypted))
+	})
+
+	t.Run("envelope encrypted payloads should not be legacy", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(context.Background(), []byte("grafana"))
+		require.NoError(t, err)
+		assert.False(t, svc.IsLegacyEncrypted(encrypted))
+		assert.False(t, svc.IsLegacyEncrypted([]byte("#"+b64.EncodeToString([]byte("2021-10-28/root@secretKey"))+"#payload")))
+	})
+
+	t.Run("invalid payloads should not be legacy", func(t *testing.T) {
+		assert.False(t, svc.IsLegacyEncrypted(nil))
+		assert.False(t, svc.IsLegacyEncrypted([]byte{}))
+		assert.False(t, svc.IsLegacyEncrypted([]byte("#dGVzdA")))
+		assert.False(t, svc.IsLegacyEncrypted([]byte{'#', secrets.EnvelopeVersion2, 0, 10, 'k', 'e', 'y'}))
+	})
+}
+
+func TestSecretsService_EnvelopeLayout(t *testing.T) {
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+	ctx := context.Background()
+
+	for _, scope := range []string{"user:10", "user#10", "org:#1#", "org:1\x00\x02", "user:\xff\xfe"} {
+		t.Run(fmt.Sprintf("encrypting with scope %q should round trip", scope), func(t *testing.T) {
+			encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+			require.NoError(t, err)
+
+			info, err := svc.InspectEnvelope(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, secrets.EnvelopeVersion2, info.Version)
+			assert.Equal(t, scope, info.Scope)
+
+			decrypted, err := svc.Decrypt(ctx, encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("grafana"), decrypted)
+		})
+	}
+
+	t.Run("decrypting payload with base64 delimited key should still work", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"))
+		require.NoError(t, err)
+		_, keyName, payload, err := parseEnvelope(encrypted)
+		require.NoError(t, err)
+
+		legacy := []byte("#" + b64.EncodeToString([]byte(keyName)) + "#")
+		legacy = append(legacy, payload...)
+
+		decrypted, err := svc.Decrypt(ctx, legacy)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("grafana"), decrypted)
+	})
+}
+
+type fakeProvider struct {
+	encryptCalls int
+	decryptCalls int
+}
+
+func (p *fakeProvider) Encrypt(_ context.Context, blob []byte) ([]byte, error) {
+	p.encryptCalls++
+	return blob, nil
+}
+
+func (p *fakeProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	p.decryptCalls++
+	return blob, nil
+}
+
+type fakeClosableProvider struct {
+	fakeProvider
+	closeCalls int
+	closeErr   error
+}
+
+func (p *fakeClosableProvider) Close(_ context.Context) error {
+	p.closeCalls++
+	return p.closeErr
+}
+
+// countingProvider records the highest number of concurrent calls it has seen
+type countingProvider struct {
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (p *countingProvider) call(blob []byte) ([]byte, error) {
+	inFlight := atomic.AddInt32(&p.inFlight, 1)
+	defer atomic.AddInt32(&p.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&p.maxInFlight)
+		if inFlight <= max || atomic.CompareAndSwapInt32(&p.maxInFlight, max, inFlight) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return blob, nil
+}
+
+func (p *countingProvider) Encrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return p.call(blob)
+}
+
+func (p *countingProvider) Decrypt(_ context.Context, blob []byte) ([]byte, error) {
+	return p.call(blob)
+}
+
+func TestSecretsService_WithProvider(t *testing.T) {
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+	ctx := context.Background()
+
+	provider := &fakeProvider{}
+	svc.RegisterProvider("fakeProvider", provider)
+
+	t.Run("encrypting with a provider override should use it for the DEK", func(t *testing.T) {
+		plaintext := []byte("very secret string")
+
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"), secrets.WithProvider("fakeProvider"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, provider.encryptCalls)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "fakeProvider", info.Provider)
+
+		dataKey, err := store.GetDataKey(ctx, info.DataKeyName)
+		require.NoError(t, err)
+		assert.Equal(t, "fakeProvider", dataKey.Provider)
+		assert.Equal(t, "user:1", dataKey.Scope)
+
+		// Drop the cached DEK to make sure it is decrypted by the overriding provider
+		delete(svc.dataKeyCache, info.DataKeyName)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+		assert.Equal(t, 1, provider.decryptCalls)
+	})
+
+	t.Run("encrypting without a provider override should use the current provider", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "secretKey", info.Provider)
+	})
+
+	t.Run("encrypting with an unknown provider should fail", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithProvider("unknown"))
+		require.Error(t, err)
+	})
+
+	t.Run("encrypting with an unknown provider should fail with envelope encryption disabled", func(t *testing.T) {
+		raw, err := ini.Load([]byte(`
+			[security]
+			secret_key = SdlklWklckeLS`))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		legacySvc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+
+		_, err = legacySvc.Encrypt(ctx, []byte("very secret string"), secrets.WithProvider("unknown"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not find encryption provider 'unknown'")
+
+		_, err = legacySvc.Encrypt(ctx, []byte("very secret string"), secrets.WithProvider("secretKey"))
+		require.NoError(t, err)
+	})
+}
+
+func TestSecretsService_InitProviders(t *testing.T) {
+	setup := func(t *testing.T, cfg string) *SecretsService {
+		raw, err := ini.Load([]byte(cfg))
+		require.NoError(t, err)
+		settings := &setting.OSSImpl{Cfg: &setting.Cfg{Raw: raw}}
+
+		return ProvideSecretsService(
+			database.ProvideSecretsStore(sqlstore.InitTestDB(t)),
+			bus.New(),
+			ossencryption.ProvideService(),
+			settings,
+		)
+	}
+
+	t.Run("When encryption_provider is the default provider, should succeed", func(t *testing.T) {
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld`)
+
+		require.NoError(t, svc.InitProviders())
+		assert.Equal(t, "secretKey", svc.CurrentProviderID())
+	})
+
+	t.Run("When encryption_provider has been registered, should succeed", func(t *testing.T) {
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld
+			encryption_provider = awskms.second_key`)
+		svc.RegisterProvider("awskms.second_key", &fakeProvider{})
+
+		require.NoError(t, svc.InitProviders())
+		assert.Equal(t, "awskms.second_key", svc.CurrentProviderID())
+	})
+
+	t.Run("When encryption_provider is not registered, should fail", func(t *testing.T) {
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld
+			encryption_provider = awskms.second_key`)
+
+		require.Error(t, svc.InitProviders())
+	})
+
+	t.Run("When encryption_provider is configured in an awskms settings section, should succeed", func(t *testing.T) {
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld
+			encryption_provider = awskms.second_key
+
+			[security.encryption.awskms.second_key]
+			key_id = alias/grafana
+			region = us-east-1`)
+
+		require.NoError(t, svc.InitProviders())
+		assert.Equal(t, "awskms.second_key", svc.CurrentProviderID())
+	})
+
+	t.Run("When encryption_provider exceeds the length of the stored provider, should fail", func(t *testing.T) {
+		first, second := "awskms."+strings.Repeat("a", 130), "awskms."+strings.Repeat("b", 130)
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld
+			encryption_provider = `+DualProviderID(first, second))
+		svc.RegisterProvider(first, &fakeProvider{})
+		svc.RegisterProvider(second, &fakeProvider{})
+
+		err := svc.InitProviders()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "exceeds 255 characters")
+	})
+
+	t.Run("When encryption_provider is not registered and fallback is enabled, should use 'secretKey'", func(t *testing.T) {
+		svc := setup(t, `[security]
+			secret_key = sdDkslslld
+			encryption_provider = awskms.second_key
+			encryption_provider_fallback = true`)
+
+		require.NoError(t, svc.InitProviders())
+		assert.Equal(t, "secretKey", svc.CurrentProviderID())
+	})
+}
+
+func TestSecretsService_ReEncryptDataKeysForProvider(t *testing.T) {
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+	ctx := context.Background()
+
+	deprecated := &fakeProvider{}
+	svc.RegisterProvider("deprecated", deprecated)
+
+	plaintext := []byte("very secret string")
+	encrypted := make([][]byte, 0)
+	for _, opts := range [][]secrets.EncryptionOptions{
+		{secrets.WithScope("user:1"), secrets.WithProvider("deprecated")},
+		{secrets.WithScope("user:2"), secrets.WithProvider("deprecated")},
+		{secrets.WithScope("user:3")},
+	} {
+		e, err := svc.Encrypt(ctx, plaintext, opts...)
+		require.NoError(t, err)
+		encrypted = append(encrypted, e)
+	}
+
+	before, err := store.GetDataKeysByProvider(ctx, "secretKey")
+	require.NoError(t, err)
+	require.Len(t, before, 1)
+
+	t.Run("should only re-encrypt data keys of the given provider", func(t *testing.T) {
+		count, err := svc.ReEncryptDataKeysForProvider(ctx, "deprecated")
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		keys, err := store.GetDataKeysByProvider(ctx, "deprecated")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		keys, err = store.GetDataKeysByProvider(ctx, "secretKey")
+		require.NoError(t, err)
+		assert.Len(t, keys, 3)
+
+		untouched, err := store.GetDataKey(ctx, before[0].Name)
+		require.NoError(t, err)
+		assert.Equal(t, before[0].EncryptedData, untouched.EncryptedData)
+	})
+
+	t.Run("should still decrypt secrets after re-encryption", func(t *testing.T) {
+		svc.dataKeyCache = make(map[string]dataKeyCacheItem)
+		decryptCalls := deprecated.decryptCalls
+
+		for _, e := range encrypted {
+			decrypted, err := svc.Decrypt(ctx, e)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, decrypted)
+		}
+		assert.Equal(t, decryptCalls, deprecated.decryptCalls, "deprecated provider should no longer be used")
+	})
+
+	t.Run("should be idempotent", func(t *testing.T) {
+		count, err := svc.ReEncryptDataKeysForProvider(ctx, "deprecated")
+		require.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("should fail for unknown provider", func(t *testing.T) {
+		_, err := svc.ReEncryptDataKeysForProvider(ctx, "unknown")
+		require.Error(t, err)
+	})
+}
+
+func TestSecretsService_AdditionalData(t *testing.T) {
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+	ctx := context.Background()
+	plaintext := []byte("very secret string")
+
+	t.Run("decrypting with matching additional data should succeed", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.CipherAESGCM, info.Cipher)
+	})
+
+	t.Run("decrypting with mismatched additional data should fail", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:2")))
+		require.ErrorIs(t, err, secrets.ErrAuthenticationFailed)
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrAuthenticationFailed)
+	})
+
+	t.Run("decrypting a payload encrypted without additional data should fail when some is expected", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext)
+		require.NoError(t, err)
+
+		_, err = svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+		require.ErrorIs(t, err, secrets.ErrAdditionalDataMismatch)
+	})
+
+	t.Run("tampered payload should fail to decrypt", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+
+		encrypted[len(encrypted)-1] ^= 0xff
+		_, err = svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+		require.ErrorIs(t, err, secrets.ErrAuthenticationFailed)
+	})
+}
+
+func TestSecretsService_Close(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("closing should close the providers and make further calls fail", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		closable := &fakeClosableProvider{}
+		svc.RegisterProvider("closable", closable)
+
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"))
+		require.NoError(t, err)
+		require.NotEmpty(t, svc.dataKeyCache)
+
+		require.NoError(t, svc.Close(ctx))
+		assert.Equal(t, 1, closable.closeCalls)
+		assert.Empty(t, svc.dataKeyCache)
+
+		_, err = svc.Encrypt(ctx, []byte("grafana"))
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+
+		_, err = svc.EncryptJsonData(ctx, map[string]string{"password": "grafana"})
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+
+		_, err = svc.DecryptJsonData(ctx, map[string][]byte{"password": encrypted})
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+
+		assert.Equal(t, "fallback", svc.GetDecryptedValue(ctx, map[string][]byte{"password": encrypted}, "password", "fallback"))
+
+		_, err = svc.CountSecretsForDataKey(ctx, "key")
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+
+		require.ErrorIs(t, svc.Close(ctx), secrets.ErrServiceClosed)
+		assert.Equal(t, 1, closable.closeCalls)
+	})
+
+	t.Run("closing should report providers failing to close", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		closable := &fakeClosableProvider{closeErr: errors.New("connection reset")}
+		svc.RegisterProvider("closable", closable)
+
+		err := svc.Close(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "closable: connection reset")
+
+		_, err = svc.Encrypt(ctx, []byte("grafana"))
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+	})
+}
+
+func TestSecretsService_DataKeyNameGenerator(t *testing.T) {
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store, WithDataKeyNameGenerator(func(scope, providerID string) string {
+		return "fixed/" + scope + "@" + providerID
+	}))
+	ctx := context.Background()
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:10"))
+	require.NoError(t, err)
+
+	dataKey, err := store.GetDataKey(ctx, "fixed/user:10@secretKey")
+	require.NoError(t, err)
+	assert.Equal(t, "user:10", dataKey.Scope)
+
+	info, err := svc.InspectEnvelope(encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "fixed/user:10@secretKey", info.DataKeyName)
+
+	decrypted, err := svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("grafana"), decrypted)
+}
+
+func TestSecretsService_PreviousSecretKeys(t *testing.T) {
+	ctx := context.Background()
+	enc := ossencryption.ProvideService()
+
+	setup := func(t *testing.T, envelopeEncryption bool) *SecretsService {
+		raw, err := ini.Load([]byte(`
+			[security]
+			secret_key = newSecretKey
+			previous_secret_keys = olderSecretKey, oldSecretKey`))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: envelopeEncryption}
+
+		return ProvideSecretsService(
+			database.ProvideSecretsStore(sqlstore.InitTestDB(t)),
+			bus.New(),
+			enc,
+			&setting.OSSImpl{Cfg: cfg},
+		)
+	}
+
+	// legacy payloads aren't authenticated, so the secrets are told apart by their content
+	validate := secrets.WithLegacyValidator(func(plaintext []byte) bool {
+		return strings.HasPrefix(string(plaintext), "very secret")
+	})
+
+	t.Run("decrypting legacy secret encrypted with a previous secret key should succeed", func(t *testing.T) {
+		svc := setup(t, true)
+
+		encrypted, err := enc.Encrypt(ctx, []byte("very secret string"), "oldSecretKey")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, validate)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("very secret string"), decrypted)
+	})
+
+	t.Run("decrypting legacy secret should not try previous secret keys without validator", func(t *testing.T) {
+		svc := setup(t, true)
+
+		encrypted, err := enc.Encrypt(ctx, []byte("very secret string"), "oldSecretKey")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.NotEqual(t, []byte("very secret string"), decrypted)
+	})
+
+	t.Run("decrypting legacy secret should skip previous secret keys the validator rejects", func(t *testing.T) {
+		svc := setup(t, true)
+
+		encrypted, err := enc.Encrypt(ctx, []byte("very secret string"), "oldSecretKey")
+		require.NoError(t, err)
+
+		var tried [][]byte
+		decrypted, err := svc.Decrypt(ctx, encrypted, secrets.WithLegacyValidator(func(plaintext []byte) bool {
+			tried = append(tried, append([]byte(nil), plaintext...))
+			return string(plaintext) == "very secret string"
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("very secret string"), decrypted)
+		// secret_key, then olderSecretKey, then oldSecretKey
+		assert.Len(t, tried, 3)
+	})
+
+	t.Run("decrypting legacy secret encrypted with the current secret key should succeed", func(t *testing.T) {
+		svc := setup(t, true)
+
+		encrypted, err := enc.Encrypt(ctx, []byte("very secret string"), "newSecretKey")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, validate)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("very secret string"), decrypted)
+	})
+
+	t.Run("decrypting legacy secret with envelope encryption disabled should try previous secret keys", func(t *testing.T) {
+		svc := setup(t, false)
+		secretKey := setting.SecretKey
+		setting.SecretKey = "newSecretKey"
+		t.Cleanup(func() { setting.SecretKey = secretKey })
+
+		encrypted, err := enc.Encrypt(ctx, []byte("very secret string"), "olderSecretKey")
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, validate)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("very secret string"), decrypted)
+
+		encrypted, err = svc.Encrypt(ctx, []byte("another secret"))
+		require.NoError(t, err)
+		decrypted, err = enc.Decrypt(ctx, encrypted, "newSecretKey")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("another secret"), decrypted)
+	})
+}
+
+func TestSecretsService_MaxConcurrentProviderCalls(t *testing.T) {
+	ctx := context.Background()
+
+	raw, err := ini.Load([]byte(`
+		[security]
+		secret_key = SdlklWklckeLS
+		encryption_provider = counting
+		kms_max_concurrent = 2`))
+	require.NoError(t, err)
+	cfg := &setting.Cfg{Raw: raw}
+	cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+	svc := ProvideSecretsService(
+		database.ProvideSecretsStore(sqlstore.InitTestDB(t)),
+		bus.New(),
+		ossencryption.ProvideService(),
+		&setting.OSSImpl{Cfg: cfg},
+	)
+	provider := &countingProvider{}
+	svc.RegisterProvider("counting", provider)
+
+	t.Run("concurrent provider calls should never exceed the limit", func(t *testing.T) {
+		// every scope gets its own DEK, so that decrypting each secret calls the provider
+		encrypted := make([][]byte, 10)
+		for i := range encrypted {
+			encrypted[i], err = svc.Encrypt(ctx, []byte(fmt.Sprintf("secret %d", i)), secrets.WithScope(fmt.Sprintf("datasource:%d", i)))
+			require.NoError(t, err)
+		}
+		svc.dataKeyCache = make(map[string]dataKeyCacheItem)
+		atomic.StoreInt32(&provider.maxInFlight, 0)
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(encrypted))
+		for i := range encrypted {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				decrypted, err := svc.Decrypt(ctx, encrypted[i])
+				if err == nil && string(decrypted) != fmt.Sprintf("secret %d", i) {
+					err = fmt.Errorf("unexpected secret %q", decrypted)
+				}
+				errs[i] = err
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&provider.maxInFlight))
+	})
+
+	t.Run("queued provider calls should give up when their context is done", func(t *testing.T) {
+		var releases []func()
+		for i := 0; i < 2; i++ {
+			release, err := svc.acquireProvider(ctx)
+			require.NoError(t, err)
+			releases = append(releases, release)
+		}
+		defer func() {
+			for _, release := range releases {
+				release()
+			}
+		}()
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := svc.providerDecrypt(canceled, provider, []byte("key"))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// slowLookupStore delays data key lookups, so that concurrent encryptions all miss the DEK before one of them creates it
+type slowLookupStore struct {
+	secrets.Store
+}
+
+func (s slowLookupStore) GetDataKey(ctx context.Context, name string) (*secrets.DataKey, error) {
+	dataKey, err := s.Store.GetDataKey(ctx, name)
+	time.Sleep(20 * time.Millisecond)
+	return dataKey, err
+}
+
+func (s slowLookupStore) GetDataKeysByNameAffixes(ctx context.Context, prefix, suffix string) ([]*secrets.DataKey, error) {
+	dataKeys, err := s.Store.GetDataKeysByNameAffixes(ctx, prefix, suffix)
+	time.Sleep(20 * time.Millisecond)
+	return dataKeys, err
+}
+
+func TestSecretsService_ConcurrentDataKeyCreation(t *testing.T) {
+	ctx := context.Background()
+	store := slowLookupStore{database.ProvideSecretsStore(sqlstore.InitTestDB(t))}
+	// every encryption uses the same DEK, which doesn't exist yet
+	svc := SetupTestService(t, store, WithDataKeyNameGenerator(func(scope, providerID string) string {
+		return scope + "@" + providerID
+	}))
+
+	const encryptions = 20
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	encrypted := make([][]byte, encryptions)
+	errs := make([]error, encryptions)
+	for i := 0; i < encryptions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			encrypted[i], errs[i] = svc.Encrypt(ctx, []byte(fmt.Sprintf("secret %d", i)), secrets.WithScope("user:1"))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	dataKeys, err := store.GetAllDataKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, dataKeys, 1)
+
+	// decrypt with the stored DEK rather than the cached one, which may belong to a losing goroutine
+	svc.dataKeyCache = make(map[string]dataKeyCacheItem)
+	for i, payload := range encrypted {
+		decrypted, err := svc.Decrypt(ctx, payload)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("secret %d", i), string(decrypted))
+	}
+}
+
+func TestSecretsService_DataKeyLabels(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+
+	_, err := svc.Encrypt(ctx, []byte("password"), secrets.WithScope("datasource:1"), secrets.WithLabel("datasources"))
+	require.NoError(t, err)
+	// the DEK already exists, so it keeps its label
+	_, err = svc.Encrypt(ctx, []byte("password"), secrets.WithScope("datasource:1"), secrets.WithLabel("alerting"))
+	require.NoError(t, err)
+	_, err = svc.Encrypt(ctx, []byte("password"), secrets.WithScope("user:1"))
+	require.NoError(t, err)
+
+	infos, err := svc.ListDataKeyInfo(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+
+	labels := map[string]string{}
+	for _, info := range infos {
+		assert.True(t, info.Active)
+		assert.Equal(t, svc.CurrentProviderID(), info.Provider)
+		assert.NotZero(t, info.Created)
+		labels[info.Scope] = info.Label
+	}
+	assert.Equal(t, map[string]string{"datasource:1": "datasources", "user:1": ""}, labels)
+
+	dataKey, err := store.GetDataKey(ctx, svc.dataKeyName("datasource:1", svc.CurrentProviderID()))
+	require.NoError(t, err)
+	assert.Equal(t, "datasources", dataKey.Label)
+}
+
+func TestSecretsService_DecryptInto(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+	encrypted, err := svc.Encrypt(ctx, []byte("very secret string"))
+	require.NoError(t, err)
+
+	t.Run("should wipe the plaintext after the callback", func(t *testing.T) {
+		var plaintext []byte
+		err := svc.DecryptInto(ctx, encrypted, func(decrypted []byte) error {
+			assert.Equal(t, "very secret string", string(decrypted))
+			plaintext = decrypted
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, make([]byte, len("very secret string")), plaintext)
+	})
+
+	t.Run("should wipe the plaintext when the callback fails", func(t *testing.T) {
+		callbackErr := errors.New("callback failed")
+		var plaintext []byte
+		err := svc.DecryptInto(ctx, encrypted, func(decrypted []byte) error {
+			plaintext = decrypted
+			return callbackErr
+		})
+		require.ErrorIs(t, err, callbackErr)
+		assert.Equal(t, make([]byte, len("very secret string")), plaintext)
+	})
+
+	t.Run("should not call the callback when decryption fails", func(t *testing.T) {
+		err := svc.DecryptInto(ctx, encrypted, func(decrypted []byte) error {
+			t.Fatal("unexpected callback")
+			return nil
+		}, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+		require.ErrorIs(t, err, secrets.ErrAdditionalDataMismatch)
+	})
+
+	t.Run("Wipe should zero the buffer", func(t *testing.T) {
+		b := []byte("password")
+		secrets.Wipe(b)
+		assert.Equal(t, make([]byte, 8), b)
+	})
+}
+
+func TestSecretsStore_GetDataKeysPage(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]secrets.Store{
+		"database": database.ProvideSecretsStore(sqlstore.InitTestDB(t)),
+		"fake":     fakes.NewFakeSecretsStore(),
+	}
+
+	for desc, store := range stores {
+		t.Run(desc, func(t *testing.T) {
+			// created out of order, pages are ordered by name
+			for _, i := range []int{3, 0, 4, 1, 2} {
+				err := store.CreateDataKey(ctx, secrets.DataKey{
+					Active:        true,
+					Name:          fmt.Sprintf("key-%d", i),
+					Provider:      "secretKey.v1",
+					EncryptedData: []byte{0x62, 0xAF, 0xA1, 0x1A},
+				})
+				require.NoError(t, err)
+			}
+
+			var names []string
+			for offset := 0; ; offset += 2 {
+				page, total, err := store.GetDataKeysPage(ctx, offset, 2)
+				require.NoError(t, err)
+				assert.Equal(t, int64(5), total)
+				if len(page) == 0 {
+					break
+				}
+				assert.LessOrEqual(t, len(page), 2)
+				for _, dataKey := range page {
+					names = append(names, dataKey.Name)
+				}
+			}
+			assert.Equal(t, []string{"key-0", "key-1", "key-2", "key-3", "key-4"}, names)
+
+			_, _, err := store.GetDataKeysPage(ctx, 0, 0)
+			require.Error(t, err)
+			_, _, err = store.GetDataKeysPage(ctx, -1, 2)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSecretsService_ScopeProviders(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T, scopeProviders string) (*SecretsService, *database.SecretsStoreImpl) {
+		raw, err := ini.Load([]byte(`[security]
+			secret_key = sdDkslslld
+			encryption_provider_by_scope = ` + scopeProviders))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+		return svc, store
+	}
+
+	t.Run("should create the DEKs of different scopes under their providers", func(t *testing.T) {
+		svc, store := setup(t, "user:=fakeUsers datasource:=fakeDatasources datasource:10=fakeDatasource10")
+		svc.RegisterProvider("fakeUsers", &fakeProvider{})
+		svc.RegisterProvider("fakeDatasources", &fakeProvider{})
+		svc.RegisterProvider("fakeDatasource10", &fakeProvider{})
+		require.NoError(t, svc.InitProviders())
+
+		for scope, provider := range map[string]string{
+			"user:1":        "fakeUsers",
+			"datasource:1":  "fakeDatasources",
+			"datasource:10": "fakeDatasource10",
+			"team:1":        "secretKey",
+		} {
+			encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope(scope))
+			require.NoError(t, err)
+
+			info, err := svc.InspectEnvelope(encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, provider, info.Provider, scope)
+
+			dataKey, err := store.GetDataKey(ctx, info.DataKeyName)
+			require.NoError(t, err)
+			assert.Equal(t, provider, dataKey.Provider, scope)
+
+			// the DEK is decrypted with the provider it was created with
+			delete(svc.dataKeyCache, info.DataKeyName)
+			decrypted, err := svc.Decrypt(ctx, encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, "very secret string", string(decrypted))
+		}
+	})
+
+	t.Run("an explicit provider should override the scope provider", func(t *testing.T) {
+		svc, _ := setup(t, "user:=fakeUsers")
+		svc.RegisterProvider("fakeUsers", &fakeProvider{})
+		require.NoError(t, svc.InitProviders())
+
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"), secrets.WithProvider("secretKey"))
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "secretKey", info.Provider)
+	})
+
+	t.Run("InitProviders should fail when a scope provider is not registered", func(t *testing.T) {
+		svc, _ := setup(t, "user:=fakeUsers")
+		require.Error(t, svc.InitProviders())
+	})
+
+	t.Run("invalid entries should be ignored", func(t *testing.T) {
+		svc, _ := setup(t, "user: =fakeUsers datasource:=")
+		assert.Empty(t, svc.scopeProviders)
+	})
+}
+
+func TestSecretsService_ProviderAliases(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	setup := func(t *testing.T, currentProvider, aliases string) (*SecretsService, *database.SecretsStoreImpl) {
+		raw, err := ini.Load([]byte(`[security]
+			secret_key = sdDkslslld
+			encryption_provider = ` + currentProvider + `
+			encryption_provider_aliases = ` + aliases))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		store := database.ProvideSecretsStore(sqlStore)
+		svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+		return svc, store
+	}
+
+	// the key of the provider was configured as awskms.first_key before being renamed to awskms.primary
+	kms := &fakeProvider{}
+	before, _ := setup(t, "awskms.first_key", "")
+	before.RegisterProvider("awskms.first_key", kms)
+	require.NoError(t, before.InitProviders())
+	encrypted, err := before.Encrypt(ctx, []byte("very secret string"), secrets.WithoutScope())
+	require.NoError(t, err)
+
+	t.Run("should fail to decrypt DEKs of a renamed provider without alias", func(t *testing.T) {
+		svc, _ := setup(t, "awskms.primary", "")
+		svc.RegisterProvider("awskms.primary", kms)
+		require.NoError(t, svc.InitProviders())
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+	})
+
+	t.Run("should decrypt DEKs of an aliased provider with the current provider", func(t *testing.T) {
+		svc, store := setup(t, "awskms.primary", "awskms.first_key=awskms.primary")
+		svc.RegisterProvider("awskms.primary", kms)
+		require.NoError(t, svc.InitProviders())
+
+		decryptCalls := kms.decryptCalls
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+		assert.Equal(t, decryptCalls+1, kms.decryptCalls)
+
+		// new secrets are encrypted with the current name
+		reencrypted, err := svc.Encrypt(ctx, decrypted, secrets.WithoutScope())
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(reencrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "awskms.primary", info.Provider)
+		dataKey, err := store.GetDataKey(ctx, info.DataKeyName)
+		require.NoError(t, err)
+		assert.Equal(t, "awskms.primary", dataKey.Provider)
+	})
+
+	t.Run("InitProviders should fail when an aliased provider is not registered", func(t *testing.T) {
+		svc, _ := setup(t, "secretKey", "awskms.first_key=awskms.primary")
+		require.Error(t, svc.InitProviders())
+	})
+
+	t.Run("invalid entries should be ignored", func(t *testing.T) {
+		svc, _ := setup(t, "secretKey", "awskms.first_key= =awskms.primary awskms.primary=awskms.primary")
+		assert.Empty(t, svc.providerAliases)
+	})
+}
+
+func TestSecretsService_AllowedScopes(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T, allowedScopes string, opts ...Option) *SecretsService {
+		raw, err := ini.Load([]byte(`[security]
+			secret_key = sdDkslslld
+			encryption_allowed_scopes = ` + allowedScopes))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		return NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg}, opts...)
+	}
+
+	t.Run("should create DEKs for allowed scopes", func(t *testing.T) {
+		svc := setup(t, "root user:")
+		for _, opt := range []secrets.EncryptionOptions{secrets.WithoutScope(), secrets.WithScope("user:1")} {
+			encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), opt)
+			require.NoError(t, err)
+			decrypted, err := svc.Decrypt(ctx, encrypted)
+			require.NoError(t, err)
+			assert.Equal(t, "very secret string", string(decrypted))
+		}
+	})
+
+	t.Run("should not create DEKs for other scopes", func(t *testing.T) {
+		svc := setup(t, "root user:")
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("datasource:1"))
+		require.ErrorIs(t, err, secrets.ErrScopeNotAllowed)
+
+		infos, err := svc.ListDataKeyInfo(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, infos)
+	})
+
+	t.Run("should allow every scope without allowlist", func(t *testing.T) {
+		svc := setup(t, "")
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("datasource:1"))
+		require.NoError(t, err)
+	})
+
+	t.Run("option should replace the setting", func(t *testing.T) {
+		svc := setup(t, "user:", WithAllowedScopes("datasource:"))
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("datasource:1"))
+		require.NoError(t, err)
+		_, err = svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.ErrorIs(t, err, secrets.ErrScopeNotAllowed)
+	})
+}
+
+func TestSecretsService_ExportImportDataKeys(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+
+	userSecret, err := svc.Encrypt(ctx, []byte("user secret"), secrets.WithScope("user:1"))
+	require.NoError(t, err)
+	datasourceSecret, err := svc.Encrypt(ctx, []byte("datasource secret"), secrets.WithScope("datasource:1"), secrets.WithLabel("datasources"))
+	require.NoError(t, err)
+
+	bundle, err := svc.ExportDataKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, bundle.DataKeys, 2)
+	for _, exported := range bundle.DataKeys {
+		stored, err := store.GetDataKey(ctx, exported.Name)
+		require.NoError(t, err)
+		assert.Equal(t, stored.EncryptedData, exported.EncryptedData, "data keys should be exported encrypted")
+		assert.Equal(t, stored.Provider, exported.Provider)
+		assert.Equal(t, stored.Scope, exported.Scope)
+		assert.True(t, exported.Active)
+	}
+
+	// the bundle survives serialization, e.g. to a backup file
+	serialized, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	var deserialized secrets.DataKeysBundle
+	require.NoError(t, json.Unmarshal(serialized, &deserialized))
+
+	t.Run("should restore the data keys into an empty instance", func(t *testing.T) {
+		restoredStore := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		restored := SetupTestService(t, restoredStore)
+
+		imported, err := restored.ImportDataKeys(ctx, &deserialized)
+		require.NoError(t, err)
+		assert.Equal(t, 2, imported)
+
+		for secret, expected := range map[string][]byte{"user secret": userSecret, "datasource secret": datasourceSecret} {
+			decrypted, err := restored.Decrypt(ctx, expected)
+			require.NoError(t, err)
+			assert.Equal(t, secret, string(decrypted))
+		}
+
+		infos, err := restored.ListDataKeyInfo(ctx)
+		require.NoError(t, err)
+		labels := make(map[string]string, len(infos))
+		for _, info := range infos {
+			labels[info.Scope] = info.Label
+		}
+		assert.Equal(t, map[string]string{"user:1": "", "datasource:1": "datasources"}, labels)
+	})
+
+	t.Run("should skip existing data keys", func(t *testing.T) {
+		existing := deserialized.DataKeys[0]
+		before, err := store.GetDataKey(ctx, existing.Name)
+		require.NoError(t, err)
+
+		deserialized.DataKeys[0].EncryptedData = []byte("tampered")
+		imported, err := svc.ImportDataKeys(ctx, &deserialized)
+		require.NoError(t, err)
+		assert.Equal(t, 0, imported)
+
+		after, err := store.GetDataKey(ctx, existing.Name)
+		require.NoError(t, err)
+		assert.Equal(t, before.EncryptedData, after.EncryptedData)
+	})
+}
+
+func TestSecretsService_WithDataKey(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:1"))
+	require.NoError(t, err)
+	info, err := svc.InspectEnvelope(encrypted)
+	require.NoError(t, err)
+	pinned := info.DataKeyName
+
+	t.Run("encrypting with a pinned data key should reference it", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithDataKey(pinned), secrets.WithScope("user:2"))
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, pinned, info.DataKeyName)
+		assert.Equal(t, "user:1", info.Scope)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+
+		keys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("encrypting with a pinned data key should support additional data", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithDataKey(pinned), secrets.WithAdditionalData([]byte("user:1")))
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("user:1")))
+		require.NoError(t, err)
+		assert.Equal(t, "grafana", string(decrypted))
+	})
+
+	t.Run("encrypting with an unknown data key should fail", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithDataKey("2021-10-28/unknown@secretKey"))
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
+	t.Run("encrypting with an inactive data key should fail even when it is cached", func(t *testing.T) {
+		require.NoError(t, store.DeactivateDataKey(ctx, pinned))
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithDataKey(pinned))
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+}
+
+func TestSecretsService_DeletedDataKeys(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T, decryptWithDeleted bool) (*SecretsService, *database.SecretsStoreImpl) {
+		raw, err := ini.Load([]byte(fmt.Sprintf(`[security]
+			secret_key = sdDkslslld
+			decrypt_with_deleted_data_keys = %t`, decryptWithDeleted)))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		return NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg}), store
+	}
+	encryptAndDelete := func(t *testing.T, svc *SecretsService, store *database.SecretsStoreImpl) []byte {
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		require.NoError(t, svc.DeactivateDataKey(ctx, info.DataKeyName))
+		return encrypted
+	}
+
+	t.Run("should fail to decrypt with a deleted data key", func(t *testing.T) {
+		svc, store := setup(t, false)
+		encrypted := encryptAndDelete(t, svc, store)
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrDataKeyDeleted)
+		require.False(t, errors.Is(err, secrets.ErrDataKeyNotFound))
+	})
+
+	t.Run("should decrypt with a deleted data key when allowed", func(t *testing.T) {
+		svc, store := setup(t, true)
+		encrypted := encryptAndDelete(t, svc, store)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		_, cached := svc.cachedDataKey(info.DataKeyName)
+		assert.False(t, cached, "deleted data keys should not be cached")
+	})
+
+	t.Run("should encrypt with a renewed data key once the data key is deactivated", func(t *testing.T) {
+		svc, store := setup(t, false)
+		encrypted := encryptAndDelete(t, svc, store)
+		deactivated, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+
+		for _, expected := range []string{".1/user:1@secretKey", ".2/user:1@secretKey"} {
+			renewed, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+			require.NoError(t, err)
+			info, err := svc.InspectEnvelope(renewed)
+			require.NoError(t, err)
+			assert.True(t, strings.HasSuffix(info.DataKeyName, expected), info.DataKeyName)
+			assert.Equal(t, deactivated.Scope, info.Scope)
+			assert.Equal(t, deactivated.Provider, info.Provider)
+
+			again, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+			require.NoError(t, err)
+			againInfo, err := svc.InspectEnvelope(again)
+			require.NoError(t, err)
+			assert.Equal(t, info.DataKeyName, againInfo.DataKeyName)
+
+			decrypted, err := svc.Decrypt(ctx, renewed)
+			require.NoError(t, err)
+			assert.Equal(t, "very secret string", string(decrypted))
+
+			require.NoError(t, svc.DeactivateDataKey(ctx, info.DataKeyName))
+		}
+	})
+
+	t.Run("should fail with not found when the data key doesn't exist at all", func(t *testing.T) {
+		svc, store := setup(t, true)
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		require.NoError(t, store.DeleteDataKey(ctx, info.DataKeyName))
+		svc.evictDataKey(info.DataKeyName)
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+}
+
+// lookupCountingStore counts the lookups of data keys by name
+type lookupCountingStore struct {
+	secrets.Store
+	lookups *int
+}
+
+func (s lookupCountingStore) GetDataKey(ctx context.Context, name string) (*secrets.DataKey, error) {
+	*s.lookups++
+	return s.Store.GetDataKey(ctx, name)
+}
+
+func (s lookupCountingStore) GetDeletedDataKey(ctx context.Context, name string) (*secrets.DataKey, error) {
+	*s.lookups++
+	return s.Store.GetDeletedDataKey(ctx, name)
+}
+
+func (s lookupCountingStore) GetDataKeysByNameAffixes(ctx context.Context, prefix, suffix string) ([]*secrets.DataKey, error) {
+	*s.lookups++
+	return s.Store.GetDataKeysByNameAffixes(ctx, prefix, suffix)
+}
+
+func TestSecretsService_RenewedDataKeyLookups(t *testing.T) {
+	ctx := context.Background()
+	var lookups int
+	store := lookupCountingStore{Store: database.ProvideSecretsStore(sqlstore.InitTestDB(t)), lookups: &lookups}
+
+	// deactivate the DEK of the scope and its first renewals
+	svc := SetupTestService(t, store)
+	var keyName string
+	for renewal := 0; renewal <= 5; renewal++ {
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		keyName = info.DataKeyName
+		if renewal < 5 {
+			require.NoError(t, svc.DeactivateDataKey(ctx, keyName))
+		}
+	}
+	require.True(t, strings.HasSuffix(keyName, ".5/user:1@secretKey"), keyName)
+
+	// another instance doesn't have the renewals cached
+	other := SetupTestService(t, store)
+	encryptWithLookups := func(t *testing.T) (string, int, DataKeyCacheStats) {
+		t.Helper()
+		lookups = 0
+		before := other.CacheStats()
+		encrypted, err := other.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+		info, err := other.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		stats := other.CacheStats()
+		return info.DataKeyName, lookups, DataKeyCacheStats{Hits: stats.Hits - before.Hits, Misses: stats.Misses - before.Misses}
+	}
+
+	t.Run("should find the latest renewal with a single lookup", func(t *testing.T) {
+		name, lookups, stats := encryptWithLookups(t)
+		assert.Equal(t, keyName, name)
+		assert.Equal(t, 1, lookups)
+		assert.Equal(t, DataKeyCacheStats{Misses: 1}, stats)
+	})
+
+	t.Run("should find the latest renewal in the cache afterwards", func(t *testing.T) {
+		name, lookups, stats := encryptWithLookups(t)
+		assert.Equal(t, keyName, name)
+		assert.Equal(t, 0, lookups)
+		assert.Equal(t, DataKeyCacheStats{Hits: 1}, stats)
+	})
+
+	t.Run("should renew the latest renewal once it is deactivated", func(t *testing.T) {
+		require.NoError(t, other.DeactivateDataKey(ctx, keyName))
+
+		name, lookups, stats := encryptWithLookups(t)
+		assert.True(t, strings.HasSuffix(name, ".6/user:1@secretKey"), name)
+		assert.Equal(t, 1, lookups)
+		assert.Equal(t, DataKeyCacheStats{Misses: 1}, stats)
+
+		name, lookups, stats = encryptWithLookups(t)
+		assert.True(t, strings.HasSuffix(name, ".6/user:1@secretKey"), name)
+		assert.Equal(t, 0, lookups)
+		assert.Equal(t, DataKeyCacheStats{Hits: 1}, stats)
+	})
+}
+
+func TestSecretsService_ProviderFactory(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should construct the provider once and reuse it across concurrent calls", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		var constructions int32
+		provider := &countingProvider{}
+		svc.RegisterProviderFactory("lazyProvider", func(context.Context) (secrets.Provider, error) {
+			atomic.AddInt32(&constructions, 1)
+			return provider, nil
+		})
+		assert.Equal(t, int32(0), atomic.LoadInt32(&constructions))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(fmt.Sprintf("user:%d", i)), secrets.WithProvider("lazyProvider"))
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&constructions))
+		assert.Same(t, svc.GetProviders()["lazyProvider"].(*lazyProvider).provider, provider)
+	})
+
+	t.Run("should retry a failed construction", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		constructions := 0
+		svc.RegisterProviderFactory("lazyProvider", func(context.Context) (secrets.Provider, error) {
+			constructions++
+			if constructions == 1 {
+				return nil, errors.New("client unavailable")
+			}
+			return &fakeProvider{}, nil
+		})
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:1"), secrets.WithProvider("lazyProvider"))
+		require.Error(t, err)
+		_, err = svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:1"), secrets.WithProvider("lazyProvider"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, constructions)
+	})
+
+	t.Run("closing the service should release the constructed provider", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		provider := &fakeClosableProvider{}
+		svc.RegisterProviderFactory("lazyProvider", func(context.Context) (secrets.Provider, error) {
+			return provider, nil
+		})
+		unused := &fakeClosableProvider{}
+		svc.RegisterProviderFactory("unusedProvider", func(context.Context) (secrets.Provider, error) {
+			return unused, nil
+		})
+
+		_, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:1"), secrets.WithProvider("lazyProvider"))
+		require.NoError(t, err)
+
+		require.NoError(t, svc.Close(ctx))
+		assert.Equal(t, 1, provider.closeCalls)
+		assert.Equal(t, 0, unused.closeCalls)
+	})
+}
+
+func TestSecretsService_FakeKMSProvider(t *testing.T) {
+	ctx := context.Background()
+	raw, err := ini.Load([]byte(`[security]
+		secret_key = sdDkslslld
+		encryption_provider = fakekms.key`))
+	require.NoError(t, err)
+	cfg := &setting.Cfg{Raw: raw}
+	cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+	provider := fakekms.Register(svc, "key")
+	require.NoError(t, svc.InitProviders())
+
+	t.Run("should select the fake KMS provider", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, provider.EncryptCalls())
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, fakekms.ProviderID("key"), info.Provider)
+	})
+
+	t.Run("should surface the injected failures", func(t *testing.T) {
+		provider.FailNext = 1
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:2"))
+		require.ErrorIs(t, err, fakekms.ErrInjectedFailure)
+
+		// the failed call didn't create a DEK, the next one does
+		_, err = svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:2"))
+		require.NoError(t, err)
+	})
+}
+
+// aeadNonce extracts the nonce of a payload encrypted with additional data
+func aeadNonce(t *testing.T, encrypted []byte) []byte {
+	t.Helper()
+	_, _, payload, err := parseEnvelope(encrypted)
+	require.NoError(t, err)
+	require.True(t, isAEADPayload(payload))
+	offset := len(aesGcmPrefix) + saltLength
+	return payload[offset : offset+12]
+}
+
+// repeatingReader returns the same bytes on every read
+type repeatingReader struct {
+	b byte
+}
+
+func (r repeatingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	return len(p), nil
+}
+
+// counterReader returns deterministic nonces, each read fills the buffer with the next counter value
+type counterReader struct {
+	next byte
+}
+
+func (r *counterReader) Read(p []byte) (int, error) {
+	r.next++
+	for i := range p {
+		p[i] = r.next
+	}
+	return len(p), nil
+}
+
+func TestSecretsService_Nonces(t *testing.T) {
+	ctx := context.Background()
+	additionalData := secrets.WithAdditionalData([]byte("datasource:1"))
+
+	t.Run("should use a unique nonce for each encryption", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+		nonces := make(map[string]struct{})
+		for i := 0; i < 200; i++ {
+			encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), additionalData)
+			require.NoError(t, err)
+			nonces[string(aeadNonce(t, encrypted))] = struct{}{}
+		}
+		assert.Len(t, nonces, 200)
+	})
+
+	t.Run("should use the nonces of the configured source", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)), WithNonceSource(&counterReader{}))
+
+		for i := 1; i <= 3; i++ {
+			encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), additionalData)
+			require.NoError(t, err)
+			assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 12), aeadNonce(t, encrypted))
+
+			decrypted, err := svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+			require.NoError(t, err)
+			assert.Equal(t, "very secret string", string(decrypted))
+		}
+	})
+
+	t.Run("should reject an all-zero nonce", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)), WithNonceSource(repeatingReader{}))
+
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), additionalData)
+		require.ErrorIs(t, err, secrets.ErrInvalidNonce)
+	})
+
+	t.Run("should reject a duplicate nonce", func(t *testing.T) {
+		svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)), WithNonceSource(repeatingReader{b: 1}))
+
+		_, err := svc.Encrypt(ctx, []byte("very secret string"), additionalData)
+		require.NoError(t, err)
+		_, err = svc.Encrypt(ctx, []byte("very secret string"), additionalData)
+		require.ErrorIs(t, err, secrets.ErrInvalidNonce)
+	})
+
+	t.Run("should forget the oldest nonces", func(t *testing.T) {
+		generator := newNonceGenerator(rand.Reader)
+		first, err := generator.next(12)
+		require.NoError(t, err)
+		for i := 0; i < recentNoncesSize; i++ {
+			_, err := generator.next(12)
+			require.NoError(t, err)
+		}
+		assert.Len(t, generator.recent, recentNoncesSize)
+		assert.Len(t, generator.order, recentNoncesSize)
+		assert.NotContains(t, generator.recent, string(first))
+	})
+}
+
+func TestSecretsService_ExportDecrypted(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+	var ciphertexts [][]byte
+	for _, plaintext := range []string{"password", "token"} {
+		encrypted, err := svc.Encrypt(ctx, []byte(plaintext), secrets.WithScope("datasource:1"))
+		require.NoError(t, err)
+		ciphertexts = append(ciphertexts, encrypted)
+	}
+
+	t.Run("should refuse to export without acknowledgement", func(t *testing.T) {
+		plaintexts, err := svc.ExportDecrypted(ctx, ciphertexts, secrets.ExportDecryptedOptions{Actor: "admin"})
+		require.ErrorIs(t, err, secrets.ErrExportNotAcknowledged)
+		assert.Nil(t, plaintexts)
+	})
+
+	t.Run("should export the plaintexts in order", func(t *testing.T) {
+		plaintexts, err := svc.ExportDecrypted(ctx, ciphertexts, secrets.ExportDecryptedOptions{
+			IUnderstandSecretsAreExportedInPlainText: true,
+			Actor:                                    "admin",
+			Reason:                                   "migration",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("password"), []byte("token")}, plaintexts)
+	})
+
+	t.Run("should not export anything when a secret fails to decrypt", func(t *testing.T) {
+		plaintexts, err := svc.ExportDecrypted(ctx, append(ciphertexts, []byte{}), secrets.ExportDecryptedOptions{
+			IUnderstandSecretsAreExportedInPlainText: true,
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "secret 2")
+		assert.Nil(t, plaintexts)
+	})
+}
+
+func TestSecretsService_ReScope(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+
+	t.Run("should re-scope an unscoped secret under a new DEK", func(t *testing.T) {
+		unscoped, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithoutScope())
+		require.NoError(t, err)
+		unscopedInfo, err := svc.InspectEnvelope(unscoped)
+		require.NoError(t, err)
+		assert.Equal(t, "root", unscopedInfo.Scope)
+
+		rescoped, err := svc.ReScope(ctx, unscoped, "datasource:1")
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, "datasource:1", info.Scope)
+		assert.NotEqual(t, unscopedInfo.DataKeyName, info.DataKeyName)
+
+		dataKey, err := store.GetDataKey(ctx, info.DataKeyName)
+		require.NoError(t, err)
+		assert.Equal(t, "datasource:1", dataKey.Scope)
+
+		decrypted, err := svc.Decrypt(ctx, rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+	})
+
+	t.Run("should re-scope a legacy secret", func(t *testing.T) {
+		legacy, err := ossencryption.ProvideService().Encrypt(ctx, []byte("very secret string"), svc.settings.KeyValue("security", "secret_key").Value())
+		require.NoError(t, err)
+
+		rescoped, err := svc.ReScope(ctx, legacy, "user:1")
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, "user:1", info.Scope)
+
+		decrypted, err := svc.Decrypt(ctx, rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+	})
+
+	t.Run("should fail without scope", func(t *testing.T) {
+		unscoped, err := svc.Encrypt(ctx, []byte("very secret string"))
+		require.NoError(t, err)
+
+		_, err = svc.ReScope(ctx, unscoped, "")
+		require.Error(t, err)
+	})
+}
+
+func TestSecretsService_MaxPayloadSize(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+	assert.Equal(t, defaultMaxPayloadSize, svc.maxPayloadSize)
+	svc.maxPayloadSize = 16
+
+	t.Run("should encrypt a payload at the limit", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, bytes.Repeat([]byte("a"), 16))
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Len(t, decrypted, 16)
+	})
+
+	t.Run("should reject a payload above the limit", func(t *testing.T) {
+		_, err := svc.Encrypt(ctx, bytes.Repeat([]byte("a"), 17))
+		require.ErrorIs(t, err, secrets.ErrPayloadTooLarge)
+
+		_, err = svc.EncryptJsonData(ctx, map[string]string{"password": strings.Repeat("a", 17)})
+		require.ErrorIs(t, err, secrets.ErrPayloadTooLarge)
+	})
+
+	t.Run("should read the limit from the settings", func(t *testing.T) {
+		raw, err := ini.Load([]byte(`[security]
+			max_encryption_payload_size = 8`))
+		require.NoError(t, err)
+		svc := ProvideSecretsService(database.ProvideSecretsStore(sqlstore.InitTestDB(t)), bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: &setting.Cfg{Raw: raw}})
+
+		_, err = svc.Encrypt(ctx, []byte("123456789"))
+		require.ErrorIs(t, err, secrets.ErrPayloadTooLarge)
+	})
+}
+
+func TestSecretsService_SelfTest(t *testing.T) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (*SecretsService, secrets.Store, *fakekms.FakeKMSProvider) {
+		raw, err := ini.Load([]byte(`[security]
+		secret_key = sdDkslslld
+		encryption_provider = fakekms.key`))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+		provider := fakekms.Register(svc, "key")
+		require.NoError(t, svc.InitProviders())
+		return svc, store, provider
+	}
+
+	t.Run("should round-trip through a working provider without leaving a data key", func(t *testing.T) {
+		svc, store, provider := setup(t)
+
+		require.NoError(t, svc.SelfTest(ctx))
+		assert.Equal(t, 1, provider.EncryptCalls())
+		assert.Equal(t, 1, provider.DecryptCalls(), "the data key should be decrypted by the provider")
+
+		dataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, dataKeys)
+	})
+
+	t.Run("should fail with a broken provider without leaving a data key", func(t *testing.T) {
+		svc, store, provider := setup(t)
+
+		provider.FailDecrypt = true
+		err := svc.SelfTest(ctx)
+		require.ErrorIs(t, err, fakekms.ErrInjectedFailure)
+
+		provider.FailDecrypt = false
+		provider.FailEncrypt = true
+		err = svc.SelfTest(ctx)
+		require.ErrorIs(t, err, fakekms.ErrInjectedFailure)
+
+		dataKeys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, dataKeys)
+	})
+
+	t.Run("should test the legacy encryption without envelope encryption", func(t *testing.T) {
+		raw, err := ini.Load([]byte(`[security]
+		secret_key = sdDkslslld`))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+
+		store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+		svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+
+		require.NoError(t, svc.SelfTest(ctx))
+	})
+}
+
+func TestSecretsService_ExternalStore(t *testing.T) {
+	ctx := context.Background()
+	engine, err := xorm.NewEngine("sqlite3", filepath.Join(t.TempDir(), "data_keys.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, engine.Close()) })
+
+	store, err := database.NewExternalSecretsStore(engine, setting.NewCfg())
+	require.NoError(t, err)
+	svc := SetupTestService(t, store)
+
+	grafanaStore := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+
+	encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"), secrets.WithLabel("users"))
+	require.NoError(t, err)
+
+	decrypted, err := svc.Decrypt(ctx, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "very secret string", string(decrypted))
+
+	t.Run("should keep the data keys in the external database only", func(t *testing.T) {
+		keys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, "user:1", keys[0].Scope)
+		assert.Equal(t, "users", keys[0].Label)
+
+		keys, err = grafanaStore.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("should reuse the data keys table when set up again", func(t *testing.T) {
+		reopened, err := database.NewExternalSecretsStore(engine, setting.NewCfg())
+		require.NoError(t, err)
+
+		decrypted, err := SetupTestService(t, reopened).Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+	})
+
+	t.Run("should deactivate and delete data keys", func(t *testing.T) {
+		keys, err := store.GetAllDataKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		name := keys[0].Name
+
+		require.NoError(t, store.DeactivateDataKey(ctx, name))
+		_, err = store.GetDataKey(ctx, name)
+		assert.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+		_, err = store.GetDeletedDataKey(ctx, name)
+		require.NoError(t, err)
+
+		require.NoError(t, store.DeleteDataKey(ctx, name))
+		_, err = store.GetDeletedDataKey(ctx, name)
+		assert.ErrorIs(t, err, secrets.ErrDataKeyNotFound)
+	})
+
+	t.Run("should pass the self test", func(t *testing.T) {
+		require.NoError(t, svc.SelfTest(ctx))
+	})
+}
+
+func TestSecretsService_CacheStats(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+
+	encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithoutScope())
+	require.NoError(t, err)
+	info, err := svc.InspectEnvelope(encrypted)
+	require.NoError(t, err)
+	before := svc.CacheStats()
+	assert.Equal(t, 1, before.Size)
+
+	t.Run("should count hits", func(t *testing.T) {
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+
+		stats := svc.CacheStats()
+		assert.Equal(t, before.Hits+1, stats.Hits)
+		assert.Equal(t, before.Misses, stats.Misses)
+		assert.Equal(t, 1, stats.Size)
+		before = stats
+	})
+
+	t.Run("should count misses and evictions of expired data keys", func(t *testing.T) {
+		svc.dataKeyCacheMtx.Lock()
+		item := svc.dataKeyCache[info.DataKeyName]
+		item.expiry = time.Now().Add(-time.Minute)
+		svc.dataKeyCache[info.DataKeyName] = item
+		svc.dataKeyCacheMtx.Unlock()
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+
+		stats := svc.CacheStats()
+		assert.Equal(t, before.Hits, stats.Hits)
+		assert.Equal(t, before.Misses+1, stats.Misses)
+		assert.Equal(t, before.Evictions+1, stats.Evictions)
+		assert.Equal(t, 1, stats.Size, "the data key should be cached again")
+		before = stats
+	})
+
+	t.Run("should count evictions of present data keys only", func(t *testing.T) {
+		svc.evictDataKey(info.DataKeyName)
+		svc.evictDataKey(info.DataKeyName)
+
+		stats := svc.CacheStats()
+		assert.Equal(t, before.Evictions+1, stats.Evictions)
+		assert.Equal(t, 0, stats.Size)
+	})
+
+	t.Run("should compute the hit ratio", func(t *testing.T) {
+		assert.Equal(t, 0.0, DataKeyCacheStats{}.HitRatio())
+		assert.Equal(t, 0.75, DataKeyCacheStats{Hits: 3, Misses: 1}.HitRatio())
+	})
+}
+
+func TestSecretsService_PerSecretDataKey(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+	plaintext := []byte("very secret string")
+
+	t.Run("should round-trip payloads encrypted with a data key of their own", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"), secrets.WithPerSecretDataKey())
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeVersion3, info.Version)
+		assert.Equal(t, "user:1", info.Scope)
+		assert.Equal(t, secrets.CipherAESCFB, info.Cipher)
+	})
+
+	t.Run("should round-trip payloads encrypted with additional data", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"), secrets.WithPerSecretDataKey(),
+			secrets.WithAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:1")))
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+
+		_, err = svc.Decrypt(ctx, encrypted, secrets.WithExpectedAdditionalData([]byte("datasource:2")))
+		require.ErrorIs(t, err, secrets.ErrAuthenticationFailed)
+	})
+
+	t.Run("should wrap a different key for every secret of the scope", func(t *testing.T) {
+		first, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:2"), secrets.WithPerSecretDataKey())
+		require.NoError(t, err)
+		second, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:2"), secrets.WithPerSecretDataKey())
+		require.NoError(t, err)
+
+		_, name, firstData, err := parseEnvelope(first)
+		require.NoError(t, err)
+		_, _, secondData, err := parseEnvelope(second)
+		require.NoError(t, err)
+		firstKey, _, err := splitWrappedDataKey(firstData)
+		require.NoError(t, err)
+		secondKey, _, err := splitWrappedDataKey(secondData)
+		require.NoError(t, err)
+		assert.NotEqual(t, firstKey, secondKey)
+
+		keys, err := store.GetDataKeysByProvider(ctx, "secretKey")
+		require.NoError(t, err)
+		scoped := 0
+		for _, key := range keys {
+			if key.Scope == "user:2" {
+				scoped++
+				assert.Equal(t, name, key.Name)
+			}
+		}
+		assert.Equal(t, 1, scoped, "the scope should keep a single data key")
+	})
+
+	t.Run("should fail to decrypt a tampered wrapped key", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"), secrets.WithPerSecretDataKey())
+		require.NoError(t, err)
+
+		_, name, _, err := parseEnvelope(encrypted)
+		require.NoError(t, err)
+		// the wrapped key starts after the header and the length of the wrapped key
+		encrypted[4+len(name)+2+len(aesGcmPrefix)+saltLength] ^= 0xff
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+	})
+
+	t.Run("should still decrypt payloads encrypted with the data key of the scope", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"))
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeVersion2, info.Version)
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+
+	t.Run("should keep a data key per secret when re-scoping", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, plaintext, secrets.WithScope("user:1"), secrets.WithPerSecretDataKey())
+		require.NoError(t, err)
+
+		rescoped, err := svc.ReScope(ctx, encrypted, "user:3")
+		require.NoError(t, err)
+
+		info, err := svc.InspectEnvelope(rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, secrets.EnvelopeVersion3, info.Version)
+		assert.Equal(t, "user:3", info.Scope)
+
+		decrypted, err := svc.Decrypt(ctx, rescoped)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	})
+}
+
+func TestSecretsService_DecryptBatchWithMeta(t *testing.T) {
+	ctx := context.Background()
+	svc := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+	svc.RegisterProvider("fakeProvider", &fakeProvider{})
+
+	current, err := svc.Encrypt(ctx, []byte("current secret"), secrets.WithScope("user:1"))
+	require.NoError(t, err)
+	currentInfo, err := svc.InspectEnvelope(current)
+	require.NoError(t, err)
+	overridden, err := svc.Encrypt(ctx, []byte("overridden secret"), secrets.WithScope("user:2"), secrets.WithProvider("fakeProvider"))
+	require.NoError(t, err)
+	overriddenInfo, err := svc.InspectEnvelope(overridden)
+	require.NoError(t, err)
+	legacy := []byte{122, 56, 53, 113, 101, 117, 73, 89, 20, 254, 36, 112, 112, 16, 128, 232, 227, 52, 166, 108, 192, 5, 28, 125, 126, 42, 197, 190, 251, 36, 94}
+	missingDataKey, err := encodeEnvelope("2021-11-01/user:3@secretKey", []byte("payload"))
+	require.NoError(t, err)
+
+	results, err := svc.DecryptBatchWithMeta(ctx, [][]byte{current, overridden, legacy, missingDataKey, []byte("#invalid"), nil, current})
+	require.NoError(t, err)
+	require.Len(t, results, 7)
+
+	t.Run("should decrypt and describe envelope encrypted ciphertexts", func(t *testing.T) {
+		require.NoError(t, results[0].Err)
+		assert.Equal(t, "current secret", string(results[0].Plaintext))
+		assert.Equal(t, secrets.EnvelopeVersion2, results[0].Version)
+		assert.Equal(t, currentInfo.DataKeyName, results[0].DataKeyName)
+		assert.Equal(t, "secretKey", results[0].Provider)
+
+		require.NoError(t, results[1].Err)
+		assert.Equal(t, "overridden secret", string(results[1].Plaintext))
+		assert.Equal(t, overriddenInfo.DataKeyName, results[1].DataKeyName)
+		assert.Equal(t, "fakeProvider", results[1].Provider)
+
+		assert.Equal(t, results[0], results[6])
+	})
+
+	t.Run("should decrypt and describe legacy ciphertexts", func(t *testing.T) {
+		require.NoError(t, results[2].Err)
+		assert.Equal(t, "grafana", string(results[2].Plaintext))
+		assert.Equal(t, secrets.EnvelopeVersionLegacy, results[2].Version)
+		assert.Empty(t, results[2].DataKeyName)
+		assert.Equal(t, "secretKey", results[2].Provider)
+	})
+
+	t.Run("should report failures along with what the envelope tells", func(t *testing.T) {
+		assert.ErrorIs(t, results[3].Err, secrets.ErrDataKeyNotFound)
+		assert.Nil(t, results[3].Plaintext)
+		assert.Equal(t, "2021-11-01/user:3@secretKey", results[3].DataKeyName)
+		assert.Equal(t, "secretKey", results[3].Provider, "the provider should be read from the name of a missing data key")
+
+		for _, result := range results[4:6] {
+			assert.Error(t, result.Err)
+			assert.Nil(t, result.Plaintext)
+			assert.Empty(t, result.DataKeyName)
+			assert.Empty(t, result.Provider)
+		}
+	})
+
+	t.Run("should fail once the service is closed", func(t *testing.T) {
+		closed := SetupTestService(t, database.ProvideSecretsStore(sqlstore.InitTestDB(t)))
+		require.NoError(t, closed.Close(ctx))
+
+		_, err := closed.DecryptBatchWithMeta(ctx, [][]byte{current})
+		assert.ErrorIs(t, err, secrets.ErrServiceClosed)
+	})
+}
+
+func TestSecretsService_CorruptDataKeys(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	store := database.ProvideSecretsStore(sqlStore)
+	svc := SetupTestService(t, store)
+
+	// corrupt replaces the stored material of the data key of a new secret of scope, and returns the secret
+	corrupt := func(t *testing.T, scope string, material []byte) ([]byte, string) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+
+		err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.Exec("UPDATE data_keys SET encrypted_data = ? WHERE name = ?", material, info.DataKeyName)
+			return err
+		})
+		require.NoError(t, err)
+		svc.evictDataKey(info.DataKeyName)
+		return encrypted, info.DataKeyName
+	}
+
+	t.Run("should fail with a corrupt error naming a data key without material", func(t *testing.T) {
+		encrypted, name := corrupt(t, "user:1", []byte{})
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrDataKeyCorrupt)
+		assert.Contains(t, err.Error(), name)
+
+		_, err = store.GetDataKey(ctx, name)
+		require.ErrorIs(t, err, secrets.ErrDataKeyCorrupt)
+	})
+
+	t.Run("should fail with a corrupt error naming a data key decrypting to something else than a data key", func(t *testing.T) {
+		material, err := svc.providers[svc.CurrentProviderID()].Encrypt(ctx, []byte("short"))
+		require.NoError(t, err)
+		encrypted, name := corrupt(t, "user:2", material)
+
+		_, err = svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, secrets.ErrDataKeyCorrupt)
+		assert.Contains(t, err.Error(), name)
+		_, cached := svc.cachedDataKey(name)
+		assert.False(t, cached, "corrupt data keys should not be cached")
+	})
+
+	t.Run("should fail naming a data key the provider can't decrypt", func(t *testing.T) {
+		encrypted, name := corrupt(t, "user:3", []byte("not a data key"))
+
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), name)
+	})
+
+	t.Run("should keep decrypting the secrets of the other data keys", func(t *testing.T) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope("user:4"))
+		require.NoError(t, err)
+		_, _ = corrupt(t, "user:5", []byte{})
+
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "grafana", string(decrypted))
+	})
+}
+
+func TestSecretsService_DualProvider(t *testing.T) {
+	ctx := context.Background()
+	dualID := DualProviderID(fakekms.ProviderID("first"), fakekms.ProviderID("second"))
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	setup := func(t *testing.T, register func(svc *SecretsService)) *SecretsService {
+		raw, err := ini.Load([]byte(`[security]
+			secret_key = sdDkslslld
+			encryption_provider = ` + dualID))
+		require.NoError(t, err)
+		cfg := &setting.Cfg{Raw: raw}
+		cfg.FeatureToggles = map[string]bool{envelopeEncryptionFeatureToggle: true}
+
+		svc := NewSecretsService(store, bus.New(), ossencryption.ProvideService(), &setting.OSSImpl{Cfg: cfg})
+		register(svc)
+		return svc
+	}
+
+	var first, second *fakekms.FakeKMSProvider
+	svc := setup(t, func(svc *SecretsService) {
+		first = fakekms.Register(svc, "first")
+		second = fakekms.Register(svc, "second")
+	})
+	require.NoError(t, svc.InitProviders())
+
+	encrypted, err := svc.Encrypt(ctx, []byte("very secret string"), secrets.WithScope("user:1"))
+	require.NoError(t, err)
+
+	t.Run("should wrap the data keys with both providers", func(t *testing.T) {
+		assert.Equal(t, 1, first.EncryptCalls())
+		assert.Equal(t, 1, second.EncryptCalls())
+
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, dualID, info.Provider)
+		dataKey, err := store.GetDataKey(ctx, info.DataKeyName)
+		require.NoError(t, err)
+		assert.Equal(t, dualID, dataKey.Provider)
+	})
+
+	t.Run("should decrypt with both providers", func(t *testing.T) {
+		svc := setup(t, func(svc *SecretsService) {
+			fakekms.Register(svc, "first")
+			fakekms.Register(svc, "second")
+		})
+		decrypted, err := svc.Decrypt(ctx, encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, "very secret string", string(decrypted))
+	})
+
+	t.Run("should fail to decrypt without one of the providers", func(t *testing.T) {
+		for _, registered := range []string{"first", "second"} {
+			svc := setup(t, func(svc *SecretsService) {
+				fakekms.Register(svc, registered)
+			})
+			require.Error(t, svc.InitProviders())
+
+			_, err := svc.Decrypt(ctx, encrypted)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), dualID)
+		}
+	})
+
+	t.Run("should fail to decrypt when one of the providers holds another key", func(t *testing.T) {
+		svc := setup(t, func(svc *SecretsService) {
+			fakekms.Register(svc, "first")
+			svc.RegisterProvider(fakekms.ProviderID("second"), fakekms.New("other"))
+		})
+		_, err := svc.Decrypt(ctx, encrypted)
+		require.ErrorIs(t, err, fakekms.ErrWrongKey)
+	})
+
+	t.Run("should not resolve ambiguous provider pairs", func(t *testing.T) {
+		svc := setup(t, func(svc *SecretsService) {})
+		for _, id := range []string{"a", "a.b", "b.c", "c"} {
+			svc.RegisterProvider(id, fakekms.New(id))
+		}
+
+		_, exists := svc.lookupProvider("dual.a.b.c")
+		assert.False(t, exists)
+		_, exists = svc.lookupProvider(DualProviderID("a", "c"))
+		assert.True(t, exists)
+		_, exists = svc.lookupProvider("dual.a")
+		assert.False(t, exists)
+	})
+}
+
+func TestSecretsService_SecretUsage(t *testing.T) {
+	ctx := context.Background()
+	store := database.ProvideSecretsStore(sqlstore.InitTestDB(t))
+	svc := SetupTestService(t, store)
+
+	encrypt := func(t *testing.T, scope string) ([]byte, string) {
+		encrypted, err := svc.Encrypt(ctx, []byte("grafana"), secrets.WithScope(scope))
+		require.NoError(t, err)
+		info, err := svc.InspectEnvelope(encrypted)
+		require.NoError(t, err)
+		return encrypted, info.DataKeyName
+	}
+	first, firstKey := encrypt(t, "datasource:1")
+	second, secondKey := encrypt(t, "datasource:2")
+
+	t.Run("should return the secrets registered for a data key", func(t *testing.T) {
+		require.NoError(t, svc.RegisterSecretUsage(ctx, "datasource:1:password", first))
+		require.NoError(t, svc.RegisterSecretUsage(ctx, "datasource:1:basicAuthPassword", first))
+		require.NoError(t, svc.RegisterSecretUsage(ctx, "datasource:2:password", second))
+
+		refs, err := svc.SecretsForDataKey(ctx, firstKey)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"datasource:1:basicAuthPassword", "datasource:1:password"}, refs)
+
+		refs, err = svc.SecretsForDataKey(ctx, secondKey)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"datasource:2:password"}, refs)
+	})
+
+	t.Run("should return no secrets for a data key without registered secrets", func(t *testing.T) {
+		refs, err := svc.SecretsForDataKey(ctx, "unknown")
+		require.NoError(t, err)
+		assert.Empty(t, refs)
+	})
+
+	t.Run("should move a secret registered again to its new data key", func(t *testing.T) {
+		require.NoError(t, svc.RegisterSecretUsage(ctx, "datasource:1:password", second))
+
+		refs, err := svc.SecretsForDataKey(ctx, firstKey)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"datasource:1:basicAuthPassword"}, refs)
+
+		refs, err = svc.SecretsForDataKey(ctx, secondKey)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"datasource:1:password", "datasource:2:password"}, refs)
+	})
+
+	t.Run("should not register legacy secrets", func(t *testing.T) {
+		legacy, err := ossencryption.ProvideService().Encrypt(ctx, []byte("grafana"), setting.SecretKey)
+		require.NoError(t, err)
+		require.NoError(t, svc.RegisterSecretUsage(ctx, "datasource:3:password", legacy))
+
+		refs, err := svc.SecretsForDataKey(ctx, firstKey)
+		require.NoError(t, err)
+		assert.NotContains(t, refs, "datasource:3:password")
+	})
+
+	t.Run("should fail to register invalid usages", func(t *testing.T) {
+		require.Error(t, svc.RegisterSecretUsage(ctx, "", first))
+		require.Error(t, svc.RegisterSecretUsage(ctx, "datasource:1:password", nil))
+	})
+
+	t.Run("should fail once closed", func(t *testing.T) {
+		svc := SetupTestService(t, store)
+		require.NoError(t, svc.Close(ctx))
+
+		require.ErrorIs(t, svc.RegisterSecretUsage(ctx, "datasource:1:password", first), secrets.ErrServiceClosed)
+		_, err := svc.SecretsForDataKey(ctx, firstKey)
+		require.ErrorIs(t, err, secrets.ErrServiceClosed)
+	})
+}
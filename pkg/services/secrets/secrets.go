@@ -9,26 +9,77 @@ import (
 // Service is an envelope encryption service in charge of encrypting/decrypting secrets.
 // It is a replacement for encryption.Service
 type Service interface {
-	Encrypt(ctx context.Context, payload []byte, opt EncryptionOptions) ([]byte, error)
-	Decrypt(ctx context.Context, payload []byte) ([]byte, error)
-	EncryptJsonData(ctx context.Context, kv map[string]string, opt EncryptionOptions) (map[string][]byte, error)
+	Encrypt(ctx context.Context, payload []byte, opts ...EncryptionOptions) ([]byte, error)
+	// Decrypt returns the plaintext of payload, callers should Wipe it once they are done with it
+	// rather than leave it in memory until it is garbage collected, or use DecryptInto.
+	Decrypt(ctx context.Context, payload []byte, opts ...DecryptionOptions) ([]byte, error)
+	// DecryptInto decrypts payload and passes the plaintext to fn, the plaintext is wiped once fn returns
+	// so fn must not retain it. It returns the error of fn, if any.
+	DecryptInto(ctx context.Context, payload []byte, fn func(plaintext []byte) error, opts ...DecryptionOptions) error
+	// IsLegacyEncrypted returns whether ciphertext was encrypted directly with the secret key rather than
+	// envelope encrypted, from its header only. It is false for an empty ciphertext.
+	IsLegacyEncrypted(ciphertext []byte) bool
+	EncryptJsonData(ctx context.Context, kv map[string]string, opts ...EncryptionOptions) (map[string][]byte, error)
 	DecryptJsonData(ctx context.Context, sjd map[string][]byte) (map[string]string, error)
 	GetDecryptedValue(ctx context.Context, sjd map[string][]byte, key, fallback string) string
+	RegisterUsageCounter(counter UsageCounter)
+	CountSecretsForDataKey(ctx context.Context, name string) (int64, error)
+	// RegisterSecretUsage records which data key the ciphertext of the secret identified by secretRef,
+	// an opaque reference chosen by the consuming service, e.g. "datasource:1:password", is encrypted with.
+	// Registering is optional, it lets SecretsForDataKey tell which secrets a data key can't be deleted without.
+	RegisterSecretUsage(ctx context.Context, secretRef string, ciphertext []byte) error
+	// SecretsForDataKey returns the references of the registered secrets encrypted with the data key
+	SecretsForDataKey(ctx context.Context, dataKeyName string) ([]string, error)
+	// Close releases the resources held by the providers and flushes the DEK cache,
+	// any call made afterwards fails with ErrServiceClosed.
+	Close(ctx context.Context) error
 }
 
+// UsageCounter returns the number of secrets, stored by a consuming service,
+// that have been encrypted with the data key (DEK) identified by dataKeyName
+type UsageCounter func(ctx context.Context, dataKeyName string) (int64, error)
+
 type ProvidersRegistrar interface {
 	CurrentProviderID() string
 	GetProviders() map[string]Provider
 	RegisterProvider(providerID string, provider Provider)
+	// RegisterProviderFactory registers a provider constructed on its first use, e.g. one holding a KMS client,
+	// the constructed provider is then reused by every call until the Service is closed.
+	RegisterProviderFactory(providerID string, factory ProviderFactory)
+	// InitProviders must be called once all the providers are registered,
+	// it checks that the configured current provider is one of them.
+	InitProviders() error
+	// Close releases the resources held by the providers once the server shuts down, see Service.Close
+	Close(ctx context.Context) error
 }
 
 // Store defines methods to interact with secrets storage
 type Store interface {
 	GetDataKey(ctx context.Context, name string) (*DataKey, error)
 	GetAllDataKeys(ctx context.Context) ([]*DataKey, error)
+	// GetDataKeysPage returns at most limit data keys ordered by name, skipping the first offset ones,
+	// along with the total number of data keys
+	GetDataKeysPage(ctx context.Context, offset, limit int) ([]*DataKey, int64, error)
+	GetDataKeysByProvider(ctx context.Context, provider string) ([]*DataKey, error)
+	// GetDataKeysByNameAffixes returns the active and soft-deleted data keys whose name starts with prefix
+	// and ends with suffix, in a single lookup
+	GetDataKeysByNameAffixes(ctx context.Context, prefix, suffix string) ([]*DataKey, error)
 	CreateDataKey(ctx context.Context, dataKey DataKey) error
 	CreateDataKeyWithDBSession(ctx context.Context, dataKey DataKey, sess *xorm.Session) error
+	UpdateDataKey(ctx context.Context, dataKey DataKey) error
+	// RestoreDataKey inserts a data key as it is, including its active flag and creation time, e.g. from a backup.
+	// It returns an error wrapping ErrDataKeyExists when a data key has the same name.
+	RestoreDataKey(ctx context.Context, dataKey DataKey) error
 	DeleteDataKey(ctx context.Context, name string) error
+	// DeactivateDataKey soft-deletes a data key: GetDataKey no longer returns it, but GetDeletedDataKey does
+	DeactivateDataKey(ctx context.Context, name string) error
+	// GetDeletedDataKey returns a soft-deleted data key, or ErrDataKeyNotFound when there's none with the name
+	GetDeletedDataKey(ctx context.Context, name string) (*DataKey, error)
+	// RegisterSecretUsage records that the secret identified by secretRef is encrypted with the data key,
+	// replacing the data key previously recorded for secretRef, if any
+	RegisterSecretUsage(ctx context.Context, secretRef string, dataKeyName string) error
+	// GetSecretsForDataKey returns the references of the secrets recorded as encrypted with the data key, sorted
+	GetSecretsForDataKey(ctx context.Context, dataKeyName string) ([]string, error)
 }
 
 // Provider is a key encryption key provider for envelope encryption
@@ -36,3 +87,19 @@ type Provider interface {
 	Encrypt(ctx context.Context, blob []byte) ([]byte, error)
 	Decrypt(ctx context.Context, blob []byte) ([]byte, error)
 }
+
+// ProviderFactory constructs a Provider, see ProvidersRegistrar.RegisterProviderFactory
+type ProviderFactory func(ctx context.Context) (Provider, error)
+
+// ClosableProvider is a Provider holding resources, e.g. KMS clients, to release when the Service is closed
+type ClosableProvider interface {
+	Provider
+	Close(ctx context.Context) error
+}
+
+// Wipe overwrites b with zeros, e.g. once done with a plaintext returned by Service.Decrypt
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -7,30 +7,232 @@ import (
 
 var ErrDataKeyNotFound = errors.New("data key not found")
 
+// ErrDataKeyDeleted is returned when decrypting a payload whose data key has been soft-deleted, i.e. deactivated,
+// unless decrypt_with_deleted_data_keys allows it
+var ErrDataKeyDeleted = errors.New("data key has been deleted")
+
+// ErrDataKeyExists is returned when creating a data key with the name of an existing one
+var ErrDataKeyExists = errors.New("data key already exists")
+
+// ErrServiceClosed is returned by the Service once it has been closed
+var ErrServiceClosed = errors.New("secrets service is closed")
+
+// ErrAdditionalDataMismatch is returned when additional authenticated data are expected
+// from a payload that has been encrypted without any
+var ErrAdditionalDataMismatch = errors.New("additional authenticated data mismatch")
+
+// ErrAuthenticationFailed is returned when an authenticated payload fails to decrypt, either because it has been
+// tampered with, because its data key is not the one it has been encrypted with, or because its additional
+// authenticated data are not the expected ones. These causes can't be told apart.
+var ErrAuthenticationFailed = errors.New("authenticated decryption failed")
+
+// ErrExportNotAcknowledged is returned when exporting decrypted secrets without acknowledging it, see ExportDecryptedOptions
+var ErrExportNotAcknowledged = errors.New("exporting decrypted secrets must be acknowledged")
+
+// ErrPayloadTooLarge is returned when encrypting a payload larger than the max_encryption_payload_size setting
+var ErrPayloadTooLarge = errors.New("payload is too large to encrypt")
+
+// ErrScopeNotAllowed is returned when encrypting requires a new data key for a scope outside of the allowlist
+// of the Service, see encryption_allowed_scopes
+var ErrScopeNotAllowed = errors.New("scope is not allowed to create data keys")
+
+// ErrDataKeyCorrupt is returned when the stored material of a data key is missing or isn't a valid data key,
+// it is wrapped in an error naming the key
+var ErrDataKeyCorrupt = errors.New("data key is corrupt")
+
+// ErrInvalidNonce is returned when the nonce source of the Service returns a nonce unsafe to encrypt with
+var ErrInvalidNonce = errors.New("invalid encryption nonce")
+
 type DataKey struct {
 	Active        bool
 	Name          string
 	Scope         string
 	Provider      string
+	Label         string
 	EncryptedData []byte
 	Created       time.Time
 	Updated       time.Time
 }
 
-type EncryptionOptions func() string
+// DataKeyInfo describes a data key without its encrypted data.
+// Label is a free-form annotation of the data key for reporting, e.g. "datasources", it plays no part in encryption.
+type DataKeyInfo struct {
+	Name     string
+	Scope    string
+	Provider string
+	Label    string
+	Active   bool
+	Created  time.Time
+	Updated  time.Time
+}
+
+// DataKeysBundle is a backup of data keys, see SecretsService.ExportDataKeys. The data keys are still encrypted
+// by their providers, so restoring them requires the same providers but exposes no plaintext data key.
+type DataKeysBundle struct {
+	DataKeys []ExportedDataKey `json:"dataKeys"`
+}
+
+// ExportedDataKey is a data key of a DataKeysBundle
+type ExportedDataKey struct {
+	Name          string    `json:"name"`
+	Scope         string    `json:"scope"`
+	Provider      string    `json:"provider"`
+	Label         string    `json:"label"`
+	Active        bool      `json:"active"`
+	EncryptedData []byte    `json:"encryptedData"`
+	Created       time.Time `json:"created"`
+}
+
+const (
+	// EnvelopeVersionLegacy identifies payloads encrypted directly with the secret key, they carry no header
+	EnvelopeVersionLegacy = 0
+	// EnvelopeVersion1 identifies payloads prefixed with the base64 encoded name of their data key, e.g. "#<key>#<payload>"
+	EnvelopeVersion1 = 1
+	// EnvelopeVersion2 identifies payloads prefixed with '#', this version byte, the length of the name
+	// of their data key as a big endian uint16 and the name itself, so that names may contain any byte
+	EnvelopeVersion2 = 2
+	// EnvelopeVersion3 identifies payloads encrypted with a data key of their own, see WithPerSecretDataKey.
+	// The header of EnvelopeVersion2 naming the data key of the scope is followed by the length of the wrapped
+	// data key of the payload as a big endian uint16 and the wrapped data key itself.
+	EnvelopeVersion3 = 3
+
+	CipherAESCFB = "aes-cfb"
+	CipherAESGCM = "aes-gcm"
+)
+
+// EnvelopeInfo describes the envelope of an encrypted payload
+type EnvelopeInfo struct {
+	Version       int
+	DataKeyName   string
+	Scope         string
+	Provider      string
+	Cipher        string
+	PayloadLength int
+}
+
+// EncryptionSettings holds the settings applied by EncryptionOptions when encrypting a payload
+type EncryptionSettings struct {
+	// Scope the data key for encryption (DEK) is bound to
+	Scope string
+	// Provider overrides the encryption provider of the scope, see encryption_provider_by_scope, when not empty
+	Provider string
+	// AdditionalData is authenticated along with the payload, it must be provided again to decrypt it
+	AdditionalData []byte
+	// Label annotates the data key when it is created, existing data keys keep their label
+	Label string
+	// DataKeyName pins the data key to encrypt with, when not empty, see WithDataKey
+	DataKeyName string
+	// PerSecretDataKey encrypts the payload with a data key of its own, see WithPerSecretDataKey
+	PerSecretDataKey bool
+}
+
+type EncryptionOptions func(*EncryptionSettings)
 
 // WithoutScope uses a root level data key for encryption (DEK),
 // in other words this DEK is not bound to any specific scope (not attached to any user, org, etc.).
 func WithoutScope() EncryptionOptions {
-	return func() string {
-		return "root"
+	return func(s *EncryptionSettings) {
+		s.Scope = "root"
 	}
 }
 
 // WithScope uses a data key for encryption bound to some specific scope (i.e., user, org, etc.).
 // Scope should look like "user:10", "org:1".
 func WithScope(scope string) EncryptionOptions {
-	return func() string {
-		return scope
+	return func(s *EncryptionSettings) {
+		s.Scope = scope
 	}
 }
+
+// WithLabel labels the data key for encryption (DEK) created for the scope, e.g. "datasources" or "alerting".
+// Labels are metadata for reporting, see DataKeyInfo, they don't select the DEK.
+func WithLabel(label string) EncryptionOptions {
+	return func(s *EncryptionSettings) {
+		s.Label = label
+	}
+}
+
+// WithProvider encrypts the data key for encryption (DEK) with the given provider
+// instead of the current one, e.g. to keep high-sensitivity secrets on a specific KMS.
+func WithProvider(providerID string) EncryptionOptions {
+	return func(s *EncryptionSettings) {
+		s.Provider = providerID
+	}
+}
+
+// WithDataKey encrypts with the existing and active data key for encryption (DEK) of the given name,
+// e.g. for tests needing reproducible envelopes. The scope and the provider of the DEK are the ones it was
+// created with, WithScope and WithProvider are ignored. Encrypting fails when there is no such active DEK.
+func WithDataKey(name string) EncryptionOptions {
+	return func(s *EncryptionSettings) {
+		s.DataKeyName = name
+	}
+}
+
+// WithPerSecretDataKey encrypts the payload with a new random data key of its own, wrapped by the data key
+// for encryption (DEK) of the scope acting as key encryption key, and stored in the envelope. Exposing the key
+// of one secret then doesn't expose the other secrets of the scope. Decrypt unwraps the key from the envelope.
+func WithPerSecretDataKey() EncryptionOptions {
+	return func(s *EncryptionSettings) {
+		s.PerSecretDataKey = true
+	}
+}
+
+// WithAdditionalData binds the encrypted payload to some context, e.g. the ID of the entity it belongs to.
+// The payload is encrypted with AES-GCM, and decrypting it requires the same additional data,
+// see WithExpectedAdditionalData. Additional data is not stored in the payload.
+func WithAdditionalData(additionalData []byte) EncryptionOptions {
+	return func(s *EncryptionSettings) {
+		s.AdditionalData = additionalData
+	}
+}
+
+// DecryptionSettings holds the settings applied by DecryptionOptions when decrypting a payload
+type DecryptionSettings struct {
+	// AdditionalData must match the additional data the payload has been encrypted with
+	AdditionalData []byte
+	// ValidateLegacy tells whether the plaintext of a legacy payload is the expected secret, see WithLegacyValidator
+	ValidateLegacy func(plaintext []byte) bool
+}
+
+type DecryptionOptions func(*DecryptionSettings)
+
+// WithExpectedAdditionalData decrypts a payload encrypted using WithAdditionalData,
+// decryption fails with ErrAuthenticationFailed when additional data differ, and with ErrAdditionalDataMismatch
+// when the payload has been encrypted without additional data.
+func WithExpectedAdditionalData(additionalData []byte) DecryptionOptions {
+	return func(s *DecryptionSettings) {
+		s.AdditionalData = additionalData
+	}
+}
+
+// WithLegacyValidator lets Decrypt try the previous secret keys, see previous_secret_keys, on legacy payloads whose
+// plaintext decrypted with secret_key isn't valid. Legacy payloads aren't authenticated, decrypting one with the wrong
+// key returns garbage rather than failing, so only the caller can tell its secrets apart, e.g. by parsing them.
+// The first plaintext validate accepts is returned, or the plaintext decrypted with secret_key when none is.
+func WithLegacyValidator(validate func(plaintext []byte) bool) DecryptionOptions {
+	return func(s *DecryptionSettings) {
+		s.ValidateLegacy = validate
+	}
+}
+
+// DecryptionResult is the outcome of decrypting one ciphertext of a batch, see DecryptBatchWithMeta
+type DecryptionResult struct {
+	// Plaintext is nil when Err is set
+	Plaintext []byte
+	// Version, DataKeyName and Provider describe the envelope of the ciphertext, they are zero when it is invalid.
+	// Legacy ciphertexts have no data key, their provider is the secret key one.
+	Version     int
+	DataKeyName string
+	Provider    string
+	Err         error
+}
+
+// ExportDecryptedOptions guards the export of decrypted secrets, e.g. to migrate them to a system handling its own encryption
+type ExportDecryptedOptions struct {
+	// IUnderstandSecretsAreExportedInPlainText must be set, the exported secrets are no longer protected by envelope encryption
+	IUnderstandSecretsAreExportedInPlainText bool
+	// Actor and Reason are written to the audit log, e.g. "admin" and "migration to vault"
+	Actor  string
+	Reason string
+}
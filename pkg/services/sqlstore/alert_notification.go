@@ -451,7 +451,8 @@ func (ss *SQLStore) UpdateAlertNotificationWithUid(ctx context.Context, cmd *mod
 		Settings:              cmd.Settings,
 		SecureSettings:        cmd.SecureSettings,
 
-		OrgId: cmd.OrgId,
+		OrgId:                   cmd.OrgId,
+		EncryptedSecureSettings: cmd.EncryptedSecureSettings,
 	}
 
 	if err := bus.DispatchCtx(ctx, updateNotification); err != nil {
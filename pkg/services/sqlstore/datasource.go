@@ -251,10 +251,20 @@ func (ss *SQLStore) UpdateDataSource(ctx context.Context, cmd *models.UpdateData
 			return models.ErrDataSourceUpdatingOldVersion
 		}
 
-		err = updateIsDefaultFlag(ds, sess)
+		if err := updateIsDefaultFlag(ds, sess); err != nil {
+			return err
+		}
 
 		cmd.Result = ds
-		return err
+
+		sess.publishAfterCommit(&events.DataSourceUpdated{
+			Timestamp: time.Now(),
+			Name:      cmd.Name,
+			ID:        ds.Id,
+			UID:       cmd.Uid,
+			OrgID:     cmd.OrgId,
+		})
+		return nil
 	})
 }
 
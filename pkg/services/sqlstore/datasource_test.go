@@ -205,6 +205,31 @@ func TestDataAccess(t *testing.T) {
 			err := sqlStore.UpdateDataSource(context.Background(), cmd)
 			require.NoError(t, err)
 		})
+
+		t.Run("fires an event when the datasource is updated", func(t *testing.T) {
+			sqlStore := InitTestDB(t)
+			ds := initDatasource(sqlStore)
+
+			var updated *events.DataSourceUpdated
+			bus.AddEventListener(func(e *events.DataSourceUpdated) error {
+				updated = e
+				return nil
+			})
+
+			cmd := defaultUpdateDatasourceCommand
+			cmd.Id = ds.Id
+			cmd.Name = "renamed"
+			err := sqlStore.UpdateDataSource(context.Background(), &cmd)
+			require.NoError(t, err)
+
+			require.Eventually(t, func() bool {
+				return assert.NotNil(t, updated)
+			}, time.Second, time.Millisecond)
+
+			assert.Equal(t, ds.Id, updated.ID)
+			assert.Equal(t, "renamed", updated.Name)
+			assert.Equal(t, int64(10), updated.OrgID)
+		})
 	})
 
 	t.Run("DeleteDataSourceById", func(t *testing.T) {
@@ -49,3 +49,41 @@ func TestMigrations(t *testing.T) {
 	require.True(t, has)
 	require.Equal(t, expectedMigrations, result.Count)
 }
+
+func TestBackfillColumnMigration(t *testing.T) {
+	testDB := sqlutil.SQLite3TestDB()
+	x, err := xorm.NewEngine(testDB.DriverName, testDB.ConnStr)
+	require.NoError(t, err)
+	require.NoError(t, NewDialect(x).CleanDB())
+
+	prefs := Table{
+		Name: "backfill_prefs",
+		Columns: []*Column{
+			{Name: "id", Type: DB_BigInt, IsPrimaryKey: true, IsAutoIncrement: true},
+			{Name: "team_id", Type: DB_BigInt, Nullable: false},
+			{Name: "cadence", Type: DB_NVarchar, Length: 10, Nullable: true},
+		},
+	}
+
+	mg := NewMigrator(x, &setting.Cfg{})
+	addMigrationLogMigrations(mg)
+	mg.AddMigration("create backfill_prefs table", NewAddTableMigration(prefs))
+	mg.AddMigration("seed backfill_prefs", NewRawSQLMigration(
+		"INSERT INTO backfill_prefs (team_id, cadence) VALUES (0, NULL), (0, ''), (0, 'weekly'), (1, NULL), (2, '')"))
+	mg.AddMigration("backfill unset cadences of users", NewBackfillColumnMigration(prefs, "cadence", "off", "team_id = 0"))
+	mg.AddMigration("backfill unset cadences", NewBackfillColumnMigration(prefs, "cadence", "it's daily", ""))
+	require.NoError(t, mg.Start())
+
+	var rows []struct {
+		TeamId  int64
+		Cadence string
+	}
+	require.NoError(t, x.SQL("SELECT team_id, cadence FROM backfill_prefs ORDER BY id").Find(&rows))
+
+	cadences := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cadences = append(cadences, row.Cadence)
+	}
+	// the predicate overrides the default of backfilling NULL and empty values only
+	require.Equal(t, []string{"off", "off", "off", "it's daily", "it's daily"}, cadences)
+}
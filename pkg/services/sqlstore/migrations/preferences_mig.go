@@ -46,4 +46,24 @@ func addPreferencesMigrations(mg *Migrator) {
 	mg.AddMigration("Add column week_start in preferences", NewAddColumnMigration(preferencesV2, &Column{
 		Name: "week_start", Type: DB_NVarchar, Length: 10, Nullable: true,
 	}))
+
+	mg.AddMigration("Add column accent_color in preferences", NewAddColumnMigration(preferencesV2, &Column{
+		Name: "accent_color", Type: DB_NVarchar, Length: 7, Nullable: true,
+	}))
+
+	mg.AddMigration("Add column default_explore_datasource_uid in preferences", NewAddColumnMigration(preferencesV2, &Column{
+		Name: "default_explore_datasource_uid", Type: DB_NVarchar, Length: 40, Nullable: true,
+	}))
+
+	mg.AddMigration("Add column digest_cadence in preferences", NewAddColumnMigration(preferencesV2, &Column{
+		Name: "digest_cadence", Type: DB_NVarchar, Length: 10, Nullable: true,
+	}))
+
+	mg.AddMigration("Add column last_explore_range in preferences", NewAddColumnMigration(preferencesV2, &Column{
+		Name: "last_explore_range", Type: DB_Text, Nullable: true,
+	}))
+
+	mg.AddMigration("Add column default_refresh_interval in preferences", NewAddColumnMigration(preferencesV2, &Column{
+		Name: "default_refresh_interval", Type: DB_NVarchar, Length: 20, Nullable: true,
+	}))
 }
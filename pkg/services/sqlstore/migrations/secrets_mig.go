@@ -18,4 +18,37 @@ func addSecretsMigration(mg *migrator.Migrator) {
 	}
 
 	mg.AddMigration("create data_keys table", migrator.NewAddTableMigration(dataKeysV1))
+
+	mg.AddMigration("add label column to data_keys", migrator.NewAddColumnMigration(dataKeysV1, &migrator.Column{
+		Name: "label", Type: migrator.DB_NVarchar, Length: 100, Nullable: true,
+	}))
+
+	// dual-control provider IDs, see DualProviderID, name two providers and exceed the former length of 50
+	mg.AddMigration("alter data_keys.provider to length 255", migrator.NewRawSQLMigration("").
+		Postgres("ALTER TABLE data_keys ALTER COLUMN provider TYPE VARCHAR(255);").
+		Mysql("ALTER TABLE data_keys MODIFY provider VARCHAR(255) NOT NULL;"))
+
+	// data_key_usage optionally records the data key each secret of the consuming services is encrypted with
+	dataKeyUsageV1 := migrator.Table{
+		Name: "data_key_usage",
+		Columns: []*migrator.Column{
+			{Name: "secret_ref", Type: migrator.DB_NVarchar, Length: 190, IsPrimaryKey: true},
+			{Name: "data_key_name", Type: migrator.DB_NVarchar, Length: 100, Nullable: false},
+			{Name: "created", Type: migrator.DB_DateTime, Nullable: false},
+			{Name: "updated", Type: migrator.DB_DateTime, Nullable: false},
+		},
+		Indices: []*migrator.Index{
+			{Cols: []string{"data_key_name"}},
+		},
+	}
+
+	mg.AddMigration("create data_key_usage table", migrator.NewAddTableMigration(dataKeyUsageV1))
+	mg.AddMigration("add index data_key_usage.data_key_name", migrator.NewAddIndexMigration(dataKeyUsageV1, dataKeyUsageV1.Indices[0]))
+}
+
+// AddExternalDataKeysMigrations adds the migrations setting up the data_keys and data_key_usage tables alone,
+// in a database other than the Grafana one the data keys are stored in
+func AddExternalDataKeysMigrations(mg *migrator.Migrator) {
+	addMigrationLogMigrations(mg)
+	addSecretsMigration(mg)
 }
@@ -53,6 +53,7 @@ type Dialect interface {
 	IsUniqueConstraintViolation(err error) bool
 	ErrorMessage(err error) string
 	IsDeadlock(err error) bool
+	IsLockTimeout(err error) bool
 }
 
 type dialectFunc func(*xorm.Engine) Dialect
@@ -1,6 +1,7 @@
 package migrator
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -108,6 +109,36 @@ func (m *AddColumnMigration) SQL(dialect Dialect) string {
 	return dialect.AddColumnSQL(m.tableName, m.column)
 }
 
+// BackfillColumnMigration sets a column to a value in the rows matching a predicate, e.g. so that the existing rows
+// get a default for a new column rather than an empty value treated as unset
+type BackfillColumnMigration struct {
+	MigrationBase
+	tableName string
+	column    string
+	value     string
+	predicate string
+}
+
+// NewBackfillColumnMigration returns a migration setting column to value in the rows of table matching predicate,
+// a raw SQL condition. Without predicate, the rows where column is NULL or empty are backfilled.
+func NewBackfillColumnMigration(table Table, column, value, predicate string) *BackfillColumnMigration {
+	return &BackfillColumnMigration{tableName: table.Name, column: column, value: value, predicate: predicate}
+}
+
+func (m *BackfillColumnMigration) SQL(dialect Dialect) string {
+	quote := dialect.Quote
+	predicate := m.predicate
+	if predicate == "" {
+		predicate = fmt.Sprintf("%s IS NULL OR %s = ''", quote(m.column), quote(m.column))
+	}
+
+	value := strings.ReplaceAll(m.value, "'", "''")
+	if dialect.DriverName() == MySQL {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+	}
+	return fmt.Sprintf("UPDATE %s SET %s = '%s' WHERE %s", quote(m.tableName), quote(m.column), value, predicate)
+}
+
 type AddIndexMigration struct {
 	MigrationBase
 	tableName string
@@ -201,6 +201,10 @@ func (db *MySQLDialect) IsDeadlock(err error) bool {
 	return db.isThisError(err, mysqlerr.ER_LOCK_DEADLOCK)
 }
 
+func (db *MySQLDialect) IsLockTimeout(err error) bool {
+	return db.isThisError(err, mysqlerr.ER_LOCK_WAIT_TIMEOUT)
+}
+
 // UpsertSQL returns the upsert sql statement for PostgreSQL dialect
 func (db *MySQLDialect) UpsertSQL(tableName string, keyCols, updateCols []string) string {
 	columnsStr := strings.Builder{}
@@ -209,6 +209,11 @@ func (db *PostgresDialect) IsDeadlock(err error) bool {
 	return db.isThisError(err, "40P01")
 }
 
+// IsLockTimeout tells whether err is a lock_not_available error, as raised when lock_timeout expires
+func (db *PostgresDialect) IsLockTimeout(err error) bool {
+	return db.isThisError(err, "55P03")
+}
+
 func (db *PostgresDialect) PostInsertId(table string, sess *xorm.Session) error {
 	if table != "org" {
 		return nil
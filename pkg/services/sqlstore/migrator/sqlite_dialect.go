@@ -143,13 +143,20 @@ func (db *SQLite3) ErrorMessage(err error) string {
 }
 
 func (db *SQLite3) IsUniqueConstraintViolation(err error) bool {
-	return db.isThisError(err, int(sqlite3.ErrConstraintUnique))
+	// Duplicate primary keys are reported with their own code, unlike with the other databases
+	return db.isThisError(err, int(sqlite3.ErrConstraintUnique)) || db.isThisError(err, int(sqlite3.ErrConstraintPrimaryKey))
 }
 
 func (db *SQLite3) IsDeadlock(err error) bool {
 	return false // No deadlock
 }
 
+// IsLockTimeout tells whether err reports the database as busy, as happens when the busy timeout expires
+func (db *SQLite3) IsLockTimeout(err error) bool {
+	var driverErr sqlite3.Error
+	return errors.As(err, &driverErr) && driverErr.Code == sqlite3.ErrBusy
+}
+
 // UpsertSQL returns the upsert sql statement for SQLite dialect
 func (db *SQLite3) UpsertSQL(tableName string, keyCols, updateCols []string) string {
 	columnsStr := strings.Builder{}
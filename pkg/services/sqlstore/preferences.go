@@ -2,64 +2,172 @@ package sqlstore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
 )
 
 func (ss *SQLStore) addPreferencesQueryAndCommandHandlers() {
 	bus.AddHandlerCtx("sql", ss.GetPreferences)
+	bus.AddHandlerCtx("sql", ss.GetTeamPreferences)
+	bus.AddHandlerCtx("sql", ss.GetTeamsPreferences)
 	bus.AddHandlerCtx("sql", ss.GetPreferencesWithDefaults)
+	bus.AddHandlerCtx("sql", ss.GetPreferencesWithDefaultsExplained)
+	bus.AddHandlerCtx("sql", ss.GetPreferencesWithNonDefaults)
 	bus.AddHandlerCtx("sql", ss.SavePreferences)
 }
 
 func (ss *SQLStore) GetPreferencesWithDefaults(ctx context.Context, query *models.GetPreferencesWithDefaultsQuery) error {
 	return ss.WithDbSession(ctx, func(dbSession *DBSession) error {
-		params := make([]interface{}, 0)
-		filter := ""
-
-		if len(query.User.Teams) > 0 {
-			filter = "(org_id=? AND team_id IN (?" + strings.Repeat(",?", len(query.User.Teams)-1) + ")) OR "
-			params = append(params, query.User.OrgId)
-			for _, v := range query.User.Teams {
-				params = append(params, v)
-			}
+		prefs, err := getUserPreferencesRows(dbSession, query.User)
+		if err != nil {
+			return err
+		}
+		if err := ignoreMissingExploreDatasources(dbSession, query.User.OrgId, prefs); err != nil {
+			return err
 		}
 
-		filter += "(org_id=? AND user_id=? AND team_id=0) OR (org_id=? AND team_id=0 AND user_id=0)"
-		params = append(params, query.User.OrgId)
-		params = append(params, query.User.UserId)
-		params = append(params, query.User.OrgId)
-		prefs := make([]*models.Preferences, 0)
-		err := dbSession.Where(filter, params...).
-			OrderBy("user_id ASC, team_id ASC").
-			Find(&prefs)
+		res := ss.defaultPreferences(query.User)
+		mergePreferences(res, prefs)
+
+		query.Result = res
+		return nil
+	})
+}
+
+// GetPreferencesWithNonDefaults returns the same preferences as GetPreferencesWithDefaults
+// along with the names of those differing from their defaults, e.g. to offer resetting them.
+func (ss *SQLStore) GetPreferencesWithNonDefaults(ctx context.Context, query *models.GetPreferencesWithNonDefaultsQuery) error {
+	return ss.WithDbSession(ctx, func(dbSession *DBSession) error {
+		prefs, err := getUserPreferencesRows(dbSession, query.User)
+		if err != nil {
+			return err
+		}
+		if err := ignoreMissingExploreDatasources(dbSession, query.User.OrgId, prefs); err != nil {
+			return err
+		}
+
+		defaults := ss.defaultPreferences(query.User)
+		res := *defaults
+		mergePreferences(&res, prefs)
 
+		nonDefault := make(map[string]struct{})
+		for name := range diffPreferences(*defaults, res) {
+			nonDefault[name] = struct{}{}
+		}
+
+		query.Result = &models.PreferencesWithNonDefaults{Preferences: &res, NonDefault: nonDefault}
+		return nil
+	})
+}
+
+// defaultPreferences returns the preferences of a user having none saved at any level
+func (ss *SQLStore) defaultPreferences(user *models.SignedInUser) *models.Preferences {
+	return &models.Preferences{
+		Theme:           ss.Cfg.DefaultTheme,
+		Timezone:        ss.Cfg.DateFormats.DefaultTimezone,
+		WeekStart:       ss.Cfg.DateFormats.DefaultWeekStart,
+		HomeDashboardId: ss.Cfg.DefaultHomeDashboardIDByRole[string(user.OrgRole)],
+		DigestCadence:   models.DigestCadenceOff,
+	}
+}
+
+// mergePreferences sets the preferences of res to those set by prefs, given in increasing order of precedence
+func mergePreferences(res *models.Preferences, prefs []*models.Preferences) {
+	for _, p := range prefs {
+		if p.Theme != "" {
+			res.Theme = p.Theme
+		}
+		if p.Timezone != "" {
+			res.Timezone = p.Timezone
+		}
+		if p.WeekStart != "" {
+			res.WeekStart = p.WeekStart
+		}
+		if p.HomeDashboardId != 0 {
+			res.HomeDashboardId = p.HomeDashboardId
+		}
+		if p.AccentColor != "" {
+			res.AccentColor = p.AccentColor
+		}
+		if p.DefaultExploreDatasourceUid != "" {
+			res.DefaultExploreDatasourceUid = p.DefaultExploreDatasourceUid
+		}
+		if p.DigestCadence != "" {
+			res.DigestCadence = p.DigestCadence
+		}
+		if p.DefaultRefreshInterval != "" {
+			res.DefaultRefreshInterval = p.DefaultRefreshInterval
+		}
+	}
+}
+
+// GetPreferencesWithDefaultsExplained returns the same preferences as GetPreferencesWithDefaults
+// and tells for each of them which level (user, team, org or default) supplied it.
+func (ss *SQLStore) GetPreferencesWithDefaultsExplained(ctx context.Context, query *models.GetPreferencesWithDefaultsExplainedQuery) error {
+	return ss.WithDbSession(ctx, func(dbSession *DBSession) error {
+		prefs, err := getUserPreferencesRows(dbSession, query.User)
 		if err != nil {
 			return err
 		}
+		if err := ignoreMissingExploreDatasources(dbSession, query.User.OrgId, prefs); err != nil {
+			return err
+		}
+
+		res := map[string]models.ExplainedPreference{
+			"theme":           {Value: ss.Cfg.DefaultTheme, Source: models.PreferencesLevelDefault},
+			"timezone":        {Value: ss.Cfg.DateFormats.DefaultTimezone, Source: models.PreferencesLevelDefault},
+			"weekStart":       {Value: ss.Cfg.DateFormats.DefaultWeekStart, Source: models.PreferencesLevelDefault},
+			"homeDashboardId": {Value: ss.Cfg.DefaultHomeDashboardIDByRole[string(query.User.OrgRole)], Source: models.PreferencesLevelDefault},
+			"accentColor":     {Value: "", Source: models.PreferencesLevelDefault},
 
-		res := &models.Preferences{
-			Theme:           ss.Cfg.DefaultTheme,
-			Timezone:        ss.Cfg.DateFormats.DefaultTimezone,
-			WeekStart:       ss.Cfg.DateFormats.DefaultWeekStart,
-			HomeDashboardId: 0,
+			"defaultExploreDatasourceUid": {Value: "", Source: models.PreferencesLevelDefault},
+			"digestCadence":               {Value: models.DigestCadenceOff, Source: models.PreferencesLevelDefault},
+			"defaultRefreshInterval":      {Value: "", Source: models.PreferencesLevelDefault},
 		}
 
 		for _, p := range prefs {
+			explain := func(value interface{}) models.ExplainedPreference {
+				switch {
+				case p.UserId != 0:
+					return models.ExplainedPreference{Value: value, Source: models.PreferencesLevelUser}
+				case p.TeamId != 0:
+					return models.ExplainedPreference{Value: value, Source: models.PreferencesLevelTeam, TeamId: p.TeamId}
+				default:
+					return models.ExplainedPreference{Value: value, Source: models.PreferencesLevelOrg}
+				}
+			}
+
 			if p.Theme != "" {
-				res.Theme = p.Theme
+				res["theme"] = explain(p.Theme)
 			}
 			if p.Timezone != "" {
-				res.Timezone = p.Timezone
+				res["timezone"] = explain(p.Timezone)
 			}
 			if p.WeekStart != "" {
-				res.WeekStart = p.WeekStart
+				res["weekStart"] = explain(p.WeekStart)
 			}
 			if p.HomeDashboardId != 0 {
-				res.HomeDashboardId = p.HomeDashboardId
+				res["homeDashboardId"] = explain(p.HomeDashboardId)
+			}
+			if p.AccentColor != "" {
+				res["accentColor"] = explain(p.AccentColor)
+			}
+			if p.DefaultExploreDatasourceUid != "" {
+				res["defaultExploreDatasourceUid"] = explain(p.DefaultExploreDatasourceUid)
+			}
+			if p.DigestCadence != "" {
+				res["digestCadence"] = explain(p.DigestCadence)
+			}
+			if p.DefaultRefreshInterval != "" {
+				res["defaultRefreshInterval"] = explain(p.DefaultRefreshInterval)
 			}
 		}
 
@@ -68,6 +176,66 @@ func (ss *SQLStore) GetPreferencesWithDefaults(ctx context.Context, query *model
 	})
 }
 
+// getUserPreferencesRows returns the org, teams and user preferences applying to a user,
+// in increasing order of precedence, so that the merged value of a preference is the one of the last row setting it.
+// When several teams of the user set the same preference, e.g. a home dashboard for their members, the team
+// with the highest id wins. This does not depend on the order of user.Teams nor on when the preferences were saved.
+func getUserPreferencesRows(dbSession *DBSession, user *models.SignedInUser) ([]*models.Preferences, error) {
+	params := make([]interface{}, 0)
+	filter := ""
+
+	if len(user.Teams) > 0 {
+		filter = "(org_id=? AND team_id IN (?" + strings.Repeat(",?", len(user.Teams)-1) + ")) OR "
+		params = append(params, user.OrgId)
+		for _, v := range user.Teams {
+			params = append(params, v)
+		}
+	}
+
+	filter += "(org_id=? AND user_id=? AND team_id=0) OR (org_id=? AND team_id=0 AND user_id=0)"
+	params = append(params, user.OrgId)
+	params = append(params, user.UserId)
+	params = append(params, user.OrgId)
+	prefs := make([]*models.Preferences, 0)
+	err := dbSession.Where(filter, params...).
+		// the org row (user_id=0, team_id=0) and the team rows (user_id=0) come before the user row,
+		// team rows are ordered by team_id for a deterministic tie-break between teams
+		OrderBy("user_id ASC, team_id ASC").
+		Find(&prefs)
+	return prefs, err
+}
+
+// ignoreMissingExploreDatasources unsets the default Explore datasource of the rows whose datasource
+// does not exist in the org anymore, so that merging them falls back to the next level setting one
+func ignoreMissingExploreDatasources(dbSession *DBSession, orgID int64, prefs []*models.Preferences) error {
+	uids := make([]interface{}, 0, len(prefs))
+	for _, p := range prefs {
+		if p.DefaultExploreDatasourceUid != "" {
+			uids = append(uids, p.DefaultExploreDatasourceUid)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	existing := make([]string, 0, len(uids))
+	err := dbSession.Table("data_source").Where("org_id=?", orgID).In("uid", uids...).Cols("uid").Find(&existing)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]struct{}, len(existing))
+	for _, uid := range existing {
+		exists[uid] = struct{}{}
+	}
+
+	for _, p := range prefs {
+		if _, ok := exists[p.DefaultExploreDatasourceUid]; !ok {
+			p.DefaultExploreDatasourceUid = ""
+		}
+	}
+	return nil
+}
+
 func (ss *SQLStore) GetPreferences(ctx context.Context, query *models.GetPreferencesQuery) error {
 	return ss.WithDbSession(ctx, func(sess *DBSession) error {
 		var prefs models.Preferences
@@ -87,14 +255,101 @@ func (ss *SQLStore) GetPreferences(ctx context.Context, query *models.GetPrefere
 	})
 }
 
+// GetTeamPreferences returns the team preferences row, or empty preferences when the team has none
+func (ss *SQLStore) GetTeamPreferences(ctx context.Context, query *models.GetTeamPreferencesQuery) error {
+	return ss.WithDbSession(ctx, func(sess *DBSession) error {
+		var prefs models.Preferences
+		exists, err := sess.Where("org_id=? AND team_id=? AND user_id=0", query.OrgId, query.TeamId).Get(&prefs)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			query.Result = &prefs
+		} else {
+			query.Result = new(models.Preferences)
+		}
+
+		return nil
+	})
+}
+
+// GetTeamsPreferences returns the preferences rows of the teams in a single query
+func (ss *SQLStore) GetTeamsPreferences(ctx context.Context, query *models.GetTeamsPreferencesQuery) error {
+	query.Result = make(map[int64]*models.Preferences)
+	if len(query.TeamIds) == 0 {
+		return nil
+	}
+
+	return ss.WithDbSession(ctx, func(sess *DBSession) error {
+		prefs := make([]*models.Preferences, 0)
+		err := sess.Where("org_id=? AND user_id=0", query.OrgId).In("team_id", query.TeamIds).Find(&prefs)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range prefs {
+			query.Result[p.TeamId] = p
+		}
+		return nil
+	})
+}
+
+// savedPreferencesColumns are the columns SavePreferences updates. They are listed rather than updating all
+// the columns, so that columns written elsewhere, or added by a newer version after a rollback, are left untouched.
+var savedPreferencesColumns = []string{
+	"version",
+	"home_dashboard_id",
+	"timezone",
+	"week_start",
+	"theme",
+	"accent_color",
+	"default_explore_datasource_uid",
+	"digest_cadence",
+	"last_explore_range",
+	"default_refresh_interval",
+	"updated",
+}
+
 func (ss *SQLStore) SavePreferences(ctx context.Context, cmd *models.SavePreferencesCommand) error {
+	if !models.IsValidAccentColor(cmd.AccentColor) {
+		return models.ErrInvalidAccentColor
+	}
+	if !models.IsValidDigestCadence(cmd.DigestCadence) {
+		return models.ErrInvalidDigestCadence
+	}
+	if !models.IsValidRefreshInterval(cmd.DefaultRefreshInterval) {
+		return models.ErrInvalidRefreshInterval
+	}
+
+	// the explore range is a user preference, it isn't merged from teams and orgs
+	lastExploreRange := ""
+	if cmd.LastExploreRange != nil && cmd.UserId != 0 && cmd.TeamId == 0 {
+		raw, err := json.Marshal(cmd.LastExploreRange)
+		if err != nil {
+			return err
+		}
+		lastExploreRange = string(raw)
+	}
+
+	return ss.withPreferencesLockTimeout(ctx, func(ctx context.Context) error {
+		return ss.savePreferences(ctx, cmd, lastExploreRange)
+	})
+}
+
+func (ss *SQLStore) savePreferences(ctx context.Context, cmd *models.SavePreferencesCommand, lastExploreRange string) error {
 	return ss.WithTransactionalDbSession(ctx, func(sess *DBSession) error {
+		if err := ss.setPreferencesLockTimeout(sess); err != nil {
+			return err
+		}
+
 		var prefs models.Preferences
 		exists, err := sess.Where("org_id=? AND user_id=? AND team_id=?", cmd.OrgId, cmd.UserId, cmd.TeamId).Get(&prefs)
 		if err != nil {
 			return err
 		}
 
+		old := prefs
 		if !exists {
 			prefs = models.Preferences{
 				UserId:          cmd.UserId,
@@ -104,18 +359,218 @@ func (ss *SQLStore) SavePreferences(ctx context.Context, cmd *models.SavePrefere
 				Timezone:        cmd.Timezone,
 				WeekStart:       cmd.WeekStart,
 				Theme:           cmd.Theme,
+				AccentColor:     cmd.AccentColor,
 				Created:         time.Now(),
 				Updated:         time.Now(),
+
+				DefaultExploreDatasourceUid: cmd.DefaultExploreDatasourceUid,
+				DigestCadence:               cmd.DigestCadence,
+				LastExploreRange:            lastExploreRange,
+				DefaultRefreshInterval:      cmd.DefaultRefreshInterval,
+			}
+			if _, err = sess.Insert(&prefs); err != nil {
+				return err
+			}
+		} else {
+			prefs.HomeDashboardId = cmd.HomeDashboardId
+			prefs.Timezone = cmd.Timezone
+			prefs.WeekStart = cmd.WeekStart
+			prefs.Theme = cmd.Theme
+			prefs.AccentColor = cmd.AccentColor
+			prefs.DefaultExploreDatasourceUid = cmd.DefaultExploreDatasourceUid
+			prefs.DigestCadence = cmd.DigestCadence
+			prefs.LastExploreRange = lastExploreRange
+			prefs.DefaultRefreshInterval = cmd.DefaultRefreshInterval
+			prefs.Updated = time.Now()
+			prefs.Version += 1
+			if _, err = sess.ID(prefs.Id).Cols(savedPreferencesColumns...).Update(&prefs); err != nil {
+				return err
+			}
+		}
+
+		if changes := diffPreferences(old, prefs); len(changes) > 0 {
+			sess.publishAfterCommit(&events.PreferencesUpdated{
+				Timestamp: prefs.Updated,
+				OrgID:     prefs.OrgId,
+				UserID:    prefs.UserId,
+				TeamID:    prefs.TeamId,
+				UpdatedBy: cmd.UpdatedBy,
+				Changes:   changes,
+			})
+		}
+		return nil
+	})
+}
+
+// withPreferencesLockTimeout calls fn with ctx bounded by the configured preferences lock timeout, if any,
+// and reports the statements that timed out waiting for a lock as models.ErrPreferencesLockTimeout.
+func (ss *SQLStore) withPreferencesLockTimeout(ctx context.Context, fn func(ctx context.Context) error) error {
+	timeout := ss.dbCfg.PreferencesLockTimeout
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(timeoutCtx)
+	if err == nil {
+		return nil
+	}
+	// the deadline of the parent context isn't ours to report
+	if ctx.Err() == nil && (errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) || ss.Dialect.IsLockTimeout(err)) {
+		ss.log.Warn("Timed out saving preferences", "timeout", timeout, "error", err)
+		return models.ErrPreferencesLockTimeout
+	}
+	return err
+}
+
+// setPreferencesLockTimeout makes the database give up on locks held longer than the configured timeout,
+// rather than only cancelling the statements once the context expires. Only Postgres scopes the setting
+// to the transaction, the other databases rely on the context.
+func (ss *SQLStore) setPreferencesLockTimeout(sess *DBSession) error {
+	timeout := ss.dbCfg.PreferencesLockTimeout
+	if timeout <= 0 || ss.Dialect.DriverName() != migrator.Postgres {
+		return nil
+	}
+	// lock_timeout is in milliseconds and 0 disables it
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := sess.Exec(fmt.Sprintf("SET LOCAL lock_timeout = %d", ms))
+	return err
+}
+
+// ExportUserPreferences returns the preferences the user saved in the org as JSON, e.g. for GDPR exports or backups.
+// The user's teams and org preferences are not part of the export.
+func (ss *SQLStore) ExportUserPreferences(ctx context.Context, orgID, userID int64) ([]byte, error) {
+	query := &models.GetPreferencesQuery{OrgId: orgID, UserId: userID}
+	if err := ss.GetPreferences(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(models.ExportedPreferences{
+		HomeDashboardId: query.Result.HomeDashboardId,
+		Timezone:        query.Result.Timezone,
+		WeekStart:       query.Result.WeekStart,
+		Theme:           query.Result.Theme,
+		AccentColor:     query.Result.AccentColor,
+
+		DefaultExploreDatasourceUid: query.Result.DefaultExploreDatasourceUid,
+		DigestCadence:               query.Result.DigestCadence,
+		LastExploreRange:            models.ParseExploreRange(query.Result.LastExploreRange),
+		DefaultRefreshInterval:      query.Result.DefaultRefreshInterval,
+	})
+}
+
+// ImportUserPreferences replaces the preferences of the user in the org with the ones of an ExportUserPreferences export
+func (ss *SQLStore) ImportUserPreferences(ctx context.Context, orgID, userID int64, data []byte) error {
+	var exported models.ExportedPreferences
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return fmt.Errorf("invalid preferences export: %w", err)
+	}
+
+	return ss.SavePreferences(ctx, &models.SavePreferencesCommand{
+		OrgId:           orgID,
+		UserId:          userID,
+		UpdatedBy:       userID,
+		HomeDashboardId: exported.HomeDashboardId,
+		Timezone:        exported.Timezone,
+		WeekStart:       exported.WeekStart,
+		Theme:           exported.Theme,
+		AccentColor:     exported.AccentColor,
+
+		DefaultExploreDatasourceUid: exported.DefaultExploreDatasourceUid,
+		DigestCadence:               exported.DigestCadence,
+		LastExploreRange:            exported.LastExploreRange,
+		DefaultRefreshInterval:      exported.DefaultRefreshInterval,
+	})
+}
+
+// CountPreferencesByHomeDashboard returns how many users, teams and orgs have the dashboard set as their home dashboard,
+// e.g. to warn before deleting it. The counts are keyed by level, levels without any preference are counted as 0.
+func (ss *SQLStore) CountPreferencesByHomeDashboard(ctx context.Context, dashboardID int64) (map[models.PreferencesLevel]int64, error) {
+	counts := map[models.PreferencesLevel]int64{
+		models.PreferencesLevelUser: 0,
+		models.PreferencesLevelTeam: 0,
+		models.PreferencesLevelOrg:  0,
+	}
+
+	err := ss.WithDbSession(ctx, func(dbSession *DBSession) error {
+		prefs := make([]*models.Preferences, 0)
+		if err := dbSession.Cols("user_id", "team_id").Where("home_dashboard_id=?", dashboardID).Find(&prefs); err != nil {
+			return err
+		}
+
+		for _, p := range prefs {
+			switch {
+			case p.UserId != 0:
+				counts[models.PreferencesLevelUser]++
+			case p.TeamId != 0:
+				counts[models.PreferencesLevelTeam]++
+			default:
+				counts[models.PreferencesLevelOrg]++
 			}
-			_, err = sess.Insert(&prefs)
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// ListUsersWithThemeOverride returns the theme of the users of the org who saved one, keyed by user ID,
+// e.g. to find the users a theme rollout won't apply to. The users following their team or org theme are not listed.
+func (ss *SQLStore) ListUsersWithThemeOverride(ctx context.Context, orgID int64) (map[int64]string, error) {
+	themes := make(map[int64]string)
+	err := ss.WithDbSession(ctx, func(dbSession *DBSession) error {
+		prefs := make([]*models.Preferences, 0)
+		err := dbSession.Cols("user_id", "theme").
+			Where("org_id=? AND user_id<>0 AND team_id=0 AND theme<>''", orgID).
+			Find(&prefs)
+		if err != nil {
 			return err
 		}
-		prefs.HomeDashboardId = cmd.HomeDashboardId
-		prefs.WeekStart = cmd.WeekStart
-		prefs.Theme = cmd.Theme
-		prefs.Updated = time.Now()
-		prefs.Version += 1
-		_, err = sess.ID(prefs.Id).AllCols().Update(&prefs)
-		return err
+
+		for _, p := range prefs {
+			themes[p.UserId] = p.Theme
+		}
+		return nil
 	})
+	return themes, err
+}
+
+// diffPreferences returns the preferences that differ between old and updated, keyed by their JSON name
+func diffPreferences(old, updated models.Preferences) map[string]events.PreferenceChange {
+	changes := make(map[string]events.PreferenceChange)
+	if old.HomeDashboardId != updated.HomeDashboardId {
+		changes["homeDashboardId"] = events.PreferenceChange{Old: old.HomeDashboardId, New: updated.HomeDashboardId}
+	}
+	if old.Timezone != updated.Timezone {
+		changes["timezone"] = events.PreferenceChange{Old: old.Timezone, New: updated.Timezone}
+	}
+	if old.WeekStart != updated.WeekStart {
+		changes["weekStart"] = events.PreferenceChange{Old: old.WeekStart, New: updated.WeekStart}
+	}
+	if old.Theme != updated.Theme {
+		changes["theme"] = events.PreferenceChange{Old: old.Theme, New: updated.Theme}
+	}
+	if old.AccentColor != updated.AccentColor {
+		changes["accentColor"] = events.PreferenceChange{Old: old.AccentColor, New: updated.AccentColor}
+	}
+	if old.DefaultExploreDatasourceUid != updated.DefaultExploreDatasourceUid {
+		changes["defaultExploreDatasourceUid"] = events.PreferenceChange{Old: old.DefaultExploreDatasourceUid, New: updated.DefaultExploreDatasourceUid}
+	}
+	if old.DigestCadence != updated.DigestCadence {
+		changes["digestCadence"] = events.PreferenceChange{Old: old.DigestCadence, New: updated.DigestCadence}
+	}
+	if old.DefaultRefreshInterval != updated.DefaultRefreshInterval {
+		changes["defaultRefreshInterval"] = events.PreferenceChange{Old: old.DefaultRefreshInterval, New: updated.DefaultRefreshInterval}
+	}
+	if old.LastExploreRange != updated.LastExploreRange {
+		changes["lastExploreRange"] = events.PreferenceChange{
+			Old: models.ParseExploreRange(old.LastExploreRange),
+			New: models.ParseExploreRange(updated.LastExploreRange),
+		}
+	}
+	return changes
 }
@@ -6,8 +6,12 @@ package sqlstore
 import (
 	"context"
 	"testing"
+	"time"
 
+	"github.com/grafana/grafana/pkg/bus"
+	"github.com/grafana/grafana/pkg/events"
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
 	"github.com/stretchr/testify/require"
 )
 
@@ -66,6 +70,44 @@ func TestPreferencesDataAccess(t *testing.T) {
 		require.Equal(t, int64(3), query.Result.HomeDashboardId)
 	})
 
+	t.Run("GetPreferencesWithDefaults with two teams home dashboard should return the highest team id home dashboard", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, HomeDashboardId: 1})
+		require.NoError(t, err)
+		// the team with the highest id saves its preferences first
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, TeamId: 5, HomeDashboardId: 5})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, TeamId: 4, HomeDashboardId: 4})
+		require.NoError(t, err)
+
+		for _, teams := range [][]int64{{4, 5}, {5, 4}} {
+			user := &models.SignedInUser{OrgId: 1, UserId: 2, Teams: teams}
+			query := &models.GetPreferencesWithDefaultsQuery{User: user}
+			err = ss.GetPreferencesWithDefaults(context.Background(), query)
+			require.NoError(t, err)
+			require.Equal(t, int64(5), query.Result.HomeDashboardId)
+
+			explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: user}
+			err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+			require.NoError(t, err)
+			require.Equal(t, models.ExplainedPreference{Value: int64(5), Source: models.PreferencesLevelTeam, TeamId: 5}, explained.Result["homeDashboardId"])
+		}
+	})
+
+	t.Run("GetPreferencesWithDefaults with two teams should return the home dashboard of the team setting one", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, HomeDashboardId: 1})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, TeamId: 6, HomeDashboardId: 6})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, TeamId: 7, Theme: "dark"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 1, UserId: 2, Teams: []int64{6, 7}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, int64(6), query.Result.HomeDashboardId)
+		require.Equal(t, "dark", query.Result.Theme)
+	})
+
 	t.Run("GetPreferencesWithDefaults with saved org and other teams home dashboard should return org home dashboard", func(t *testing.T) {
 		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, HomeDashboardId: 1})
 		require.NoError(t, err)
@@ -115,4 +157,617 @@ func TestPreferencesDataAccess(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, int64(1), query.Result.HomeDashboardId)
 	})
+
+	t.Run("SavePreferences should update the timezone of existing preferences", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, UserId: 7, Timezone: "browser"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, UserId: 7, Timezone: "utc"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesQuery{OrgId: 1, UserId: 7}
+		err = ss.GetPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "utc", query.Result.Timezone)
+	})
+
+	t.Run("SavePreferences should publish the changed preferences", func(t *testing.T) {
+		var updated []*events.PreferencesUpdated
+		bus.AddEventListener(func(e *events.PreferencesUpdated) error {
+			updated = append(updated, e)
+			return nil
+		})
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, UserId: 5, UpdatedBy: 5, Theme: "light"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, UserId: 5, UpdatedBy: 6, Theme: "dark"})
+		require.NoError(t, err)
+		// Saving the same preferences again is not a change
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 1, UserId: 5, UpdatedBy: 6, Theme: "dark"})
+		require.NoError(t, err)
+
+		require.Len(t, updated, 2)
+		require.Equal(t, map[string]events.PreferenceChange{"theme": {Old: "", New: "light"}}, updated[0].Changes)
+
+		require.Equal(t, int64(1), updated[1].OrgID)
+		require.Equal(t, int64(5), updated[1].UserID)
+		require.Equal(t, int64(6), updated[1].UpdatedBy)
+		require.Equal(t, map[string]events.PreferenceChange{"theme": {Old: "light", New: "dark"}}, updated[1].Changes)
+	})
+
+	t.Run("GetPreferencesWithDefaultsExplained should tell which level supplies each preference", func(t *testing.T) {
+		ss.Cfg.DefaultTheme = "light"
+		ss.Cfg.DateFormats.DefaultTimezone = "UTC"
+		ss.Cfg.DateFormats.DefaultWeekStart = ""
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 2, HomeDashboardId: 1, Timezone: "browser"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 2, TeamId: 2, HomeDashboardId: 2, WeekStart: "monday"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 2, TeamId: 3, HomeDashboardId: 3})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 2, UserId: 1, Theme: "dark"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsExplainedQuery{
+			User: &models.SignedInUser{OrgId: 2, UserId: 1, Teams: []int64{2, 3}},
+		}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, map[string]models.ExplainedPreference{
+			"theme":           {Value: "dark", Source: models.PreferencesLevelUser},
+			"timezone":        {Value: "browser", Source: models.PreferencesLevelOrg},
+			"weekStart":       {Value: "monday", Source: models.PreferencesLevelTeam, TeamId: 2},
+			"homeDashboardId": {Value: int64(3), Source: models.PreferencesLevelTeam, TeamId: 3},
+			"accentColor":     {Value: "", Source: models.PreferencesLevelDefault},
+
+			"defaultExploreDatasourceUid": {Value: "", Source: models.PreferencesLevelDefault},
+			"digestCadence":               {Value: "off", Source: models.PreferencesLevelDefault},
+			"defaultRefreshInterval":      {Value: "", Source: models.PreferencesLevelDefault},
+		}, query.Result)
+
+		query = &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 3, UserId: 1}}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, map[string]models.ExplainedPreference{
+			"theme":           {Value: "light", Source: models.PreferencesLevelDefault},
+			"timezone":        {Value: "UTC", Source: models.PreferencesLevelDefault},
+			"weekStart":       {Value: "", Source: models.PreferencesLevelDefault},
+			"homeDashboardId": {Value: int64(0), Source: models.PreferencesLevelDefault},
+			"accentColor":     {Value: "", Source: models.PreferencesLevelDefault},
+
+			"defaultExploreDatasourceUid": {Value: "", Source: models.PreferencesLevelDefault},
+			"digestCadence":               {Value: "off", Source: models.PreferencesLevelDefault},
+			"defaultRefreshInterval":      {Value: "", Source: models.PreferencesLevelDefault},
+		}, query.Result)
+	})
+
+	t.Run("GetTeamPreferences should return the team preferences", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 4, TeamId: 7, HomeDashboardId: 7, Theme: "dark"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 4, UserId: 1, HomeDashboardId: 1})
+		require.NoError(t, err)
+
+		query := &models.GetTeamPreferencesQuery{OrgId: 4, TeamId: 7}
+		err = ss.GetTeamPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, int64(7), query.Result.TeamId)
+		require.Equal(t, int64(0), query.Result.UserId)
+		require.Equal(t, int64(7), query.Result.HomeDashboardId)
+		require.Equal(t, "dark", query.Result.Theme)
+	})
+
+	t.Run("GetTeamPreferences without saved team preferences should return empty preferences", func(t *testing.T) {
+		query := &models.GetTeamPreferencesQuery{OrgId: 4, TeamId: 8}
+		err := ss.GetTeamPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, &models.Preferences{}, query.Result)
+	})
+
+	t.Run("GetTeamsPreferences should return the preferences of the teams which have some", func(t *testing.T) {
+		for _, cmd := range []*models.SavePreferencesCommand{
+			{OrgId: 15, TeamId: 1, Theme: "dark"},
+			{OrgId: 15, TeamId: 3, Timezone: "UTC"},
+			{OrgId: 15, UserId: 1, TeamId: 2, Theme: "light"},
+			{OrgId: 16, TeamId: 2, Theme: "light"},
+		} {
+			require.NoError(t, ss.SavePreferences(context.Background(), cmd))
+		}
+
+		query := &models.GetTeamsPreferencesQuery{OrgId: 15, TeamIds: []int64{1, 2, 3, 4}}
+		err := ss.GetTeamsPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Len(t, query.Result, 2)
+		require.Equal(t, "dark", query.Result[1].Theme)
+		require.Equal(t, "UTC", query.Result[3].Timezone)
+		require.NotContains(t, query.Result, int64(2))
+		require.NotContains(t, query.Result, int64(4))
+	})
+
+	t.Run("GetTeamsPreferences without teams should return no preferences", func(t *testing.T) {
+		query := &models.GetTeamsPreferencesQuery{OrgId: 15}
+		err := ss.GetTeamsPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Empty(t, query.Result)
+	})
+
+	t.Run("GetPreferencesWithDefaults should use the default home dashboard of the user role", func(t *testing.T) {
+		ss.Cfg.DefaultHomeDashboardIDByRole = map[string]int64{"Admin": 10, "Viewer": 12}
+		defer func() { ss.Cfg.DefaultHomeDashboardIDByRole = nil }()
+
+		viewer := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 5, UserId: 1, OrgRole: models.ROLE_VIEWER}}
+		err := ss.GetPreferencesWithDefaults(context.Background(), viewer)
+		require.NoError(t, err)
+		require.Equal(t, int64(12), viewer.Result.HomeDashboardId)
+
+		admin := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 5, UserId: 2, OrgRole: models.ROLE_ADMIN}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), admin)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), admin.Result.HomeDashboardId)
+
+		editor := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 5, UserId: 3, OrgRole: models.ROLE_EDITOR}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), editor)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), editor.Result.HomeDashboardId)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: viewer.User}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+		require.NoError(t, err)
+		require.Equal(t, models.ExplainedPreference{Value: int64(12), Source: models.PreferencesLevelDefault}, explained.Result["homeDashboardId"])
+	})
+
+	t.Run("GetPreferencesWithDefaults with saved org home dashboard should override the role default", func(t *testing.T) {
+		ss.Cfg.DefaultHomeDashboardIDByRole = map[string]int64{"Admin": 10, "Viewer": 12}
+		defer func() { ss.Cfg.DefaultHomeDashboardIDByRole = nil }()
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 6, HomeDashboardId: 4})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 6, UserId: 1, OrgRole: models.ROLE_VIEWER}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), query.Result.HomeDashboardId)
+	})
+	t.Run("SavePreferences should reject invalid accent colors", func(t *testing.T) {
+		for _, color := range []string{"blue", "#12345", "1f60c4", "#1f60c4ff", "#gggggg"} {
+			err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 7, UserId: 1, AccentColor: color})
+			require.ErrorIs(t, err, models.ErrInvalidAccentColor, color)
+		}
+
+		query := &models.GetPreferencesQuery{OrgId: 7, UserId: 1}
+		err := ss.GetPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Zero(t, query.Result.Id)
+	})
+
+	t.Run("GetPreferencesWithDefaults should merge the accent color by precedence", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 8, AccentColor: "#1f60c4"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 8, TeamId: 2, AccentColor: "#F2CC0C"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 8, UserId: 1, AccentColor: "#fff"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 8, UserId: 1, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "#fff", query.Result.AccentColor)
+
+		query = &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 8, UserId: 2, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "#F2CC0C", query.Result.AccentColor)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 8, UserId: 3}}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+		require.NoError(t, err)
+		require.Equal(t, models.ExplainedPreference{Value: "#1f60c4", Source: models.PreferencesLevelOrg}, explained.Result["accentColor"])
+	})
+	t.Run("ImportUserPreferences should restore the preferences of ExportUserPreferences", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{
+			OrgId: 9, UserId: 1, HomeDashboardId: 3, Timezone: "utc", WeekStart: "monday", Theme: "dark", AccentColor: "#1f60c4",
+			DefaultExploreDatasourceUid: "loki", DigestCadence: "daily", LastExploreRange: &models.ExploreRange{From: "now-1h", To: "now"},
+			DefaultRefreshInterval: "1m",
+		})
+		require.NoError(t, err)
+		// team preferences are not part of the user's export
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 9, TeamId: 1, Theme: "light"})
+		require.NoError(t, err)
+
+		exported, err := ss.ExportUserPreferences(context.Background(), 9, 1)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"homeDashboardId":3,"timezone":"utc","weekStart":"monday","theme":"dark","accentColor":"#1f60c4","defaultExploreDatasourceUid":"loki","digestCadence":"daily","lastExploreRange":{"from":"now-1h","to":"now"},"defaultRefreshInterval":"1m"}`, string(exported))
+
+		err = ss.ImportUserPreferences(context.Background(), 10, 2, exported)
+		require.NoError(t, err)
+
+		original := &models.GetPreferencesQuery{OrgId: 9, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), original))
+		imported := &models.GetPreferencesQuery{OrgId: 10, UserId: 2}
+		require.NoError(t, ss.GetPreferences(context.Background(), imported))
+		require.Equal(t, original.Result.HomeDashboardId, imported.Result.HomeDashboardId)
+		require.Equal(t, original.Result.Timezone, imported.Result.Timezone)
+		require.Equal(t, original.Result.WeekStart, imported.Result.WeekStart)
+		require.Equal(t, original.Result.Theme, imported.Result.Theme)
+		require.Equal(t, original.Result.AccentColor, imported.Result.AccentColor)
+		require.Equal(t, original.Result.DefaultExploreDatasourceUid, imported.Result.DefaultExploreDatasourceUid)
+		require.Equal(t, original.Result.DigestCadence, imported.Result.DigestCadence)
+		require.Equal(t, original.Result.LastExploreRange, imported.Result.LastExploreRange)
+
+		reexported, err := ss.ExportUserPreferences(context.Background(), 10, 2)
+		require.NoError(t, err)
+		require.JSONEq(t, string(exported), string(reexported))
+	})
+
+	t.Run("ImportUserPreferences should reject invalid exports", func(t *testing.T) {
+		err := ss.ImportUserPreferences(context.Background(), 11, 1, []byte(`{"theme":`))
+		require.Error(t, err)
+
+		err = ss.ImportUserPreferences(context.Background(), 11, 1, []byte(`{"accentColor":"blue"}`))
+		require.ErrorIs(t, err, models.ErrInvalidAccentColor)
+	})
+
+	t.Run("CountPreferencesByHomeDashboard should count the users, teams and orgs using the home dashboard", func(t *testing.T) {
+		for _, cmd := range []*models.SavePreferencesCommand{
+			{OrgId: 1, UserId: 10, HomeDashboardId: 42},
+			{OrgId: 1, UserId: 11, HomeDashboardId: 42},
+			{OrgId: 2, UserId: 10, HomeDashboardId: 42},
+			{OrgId: 1, UserId: 12, HomeDashboardId: 43},
+			{OrgId: 1, TeamId: 10, HomeDashboardId: 42},
+			{OrgId: 1, TeamId: 11, HomeDashboardId: 42},
+			{OrgId: 3, HomeDashboardId: 42},
+		} {
+			require.NoError(t, ss.SavePreferences(context.Background(), cmd))
+		}
+
+		counts, err := ss.CountPreferencesByHomeDashboard(context.Background(), 42)
+		require.NoError(t, err)
+		require.Equal(t, map[models.PreferencesLevel]int64{
+			models.PreferencesLevelUser: 3,
+			models.PreferencesLevelTeam: 2,
+			models.PreferencesLevelOrg:  1,
+		}, counts)
+
+		counts, err = ss.CountPreferencesByHomeDashboard(context.Background(), 44)
+		require.NoError(t, err)
+		require.Equal(t, map[models.PreferencesLevel]int64{
+			models.PreferencesLevelUser: 0,
+			models.PreferencesLevelTeam: 0,
+			models.PreferencesLevelOrg:  0,
+		}, counts)
+	})
+
+	t.Run("ListUsersWithThemeOverride should list the users of the org who saved a theme", func(t *testing.T) {
+		for _, cmd := range []*models.SavePreferencesCommand{
+			{OrgId: 19, Theme: "light"},
+			{OrgId: 19, TeamId: 1, Theme: "dark"},
+			{OrgId: 19, UserId: 1, Theme: "dark"},
+			{OrgId: 19, UserId: 2, Theme: "light"},
+			{OrgId: 19, UserId: 3, Timezone: "UTC"},
+			{OrgId: 19, UserId: 4},
+			{OrgId: 20, UserId: 5, Theme: "dark"},
+		} {
+			require.NoError(t, ss.SavePreferences(context.Background(), cmd))
+		}
+
+		themes, err := ss.ListUsersWithThemeOverride(context.Background(), 19)
+		require.NoError(t, err)
+		require.Equal(t, map[int64]string{1: "dark", 2: "light"}, themes)
+
+		themes, err = ss.ListUsersWithThemeOverride(context.Background(), 21)
+		require.NoError(t, err)
+		require.Empty(t, themes)
+	})
+
+	t.Run("GetPreferencesWithDefaults should merge the default Explore datasource by precedence", func(t *testing.T) {
+		for _, uid := range []string{"prometheus", "loki", "tempo"} {
+			err := ss.AddDataSource(context.Background(), &models.AddDataSourceCommand{
+				OrgId: 12, Name: uid, Uid: uid, Type: models.DS_PROMETHEUS, Access: models.DS_ACCESS_PROXY, Url: "http://test",
+			})
+			require.NoError(t, err)
+		}
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 12, DefaultExploreDatasourceUid: "prometheus"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 12, TeamId: 2, DefaultExploreDatasourceUid: "loki"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 12, UserId: 1, DefaultExploreDatasourceUid: "tempo"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 12, UserId: 1, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "tempo", query.Result.DefaultExploreDatasourceUid)
+
+		query = &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 12, UserId: 2, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "loki", query.Result.DefaultExploreDatasourceUid)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 12, UserId: 3}}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+		require.NoError(t, err)
+		require.Equal(t, models.ExplainedPreference{Value: "prometheus", Source: models.PreferencesLevelOrg}, explained.Result["defaultExploreDatasourceUid"])
+	})
+
+	t.Run("SavePreferences should reject invalid digest cadences", func(t *testing.T) {
+		for _, cadence := range []string{"monthly", "Daily", " daily", "1h"} {
+			err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 13, UserId: 1, DigestCadence: cadence})
+			require.ErrorIs(t, err, models.ErrInvalidDigestCadence, cadence)
+		}
+
+		query := &models.GetPreferencesQuery{OrgId: 13, UserId: 1}
+		err := ss.GetPreferences(context.Background(), query)
+		require.NoError(t, err)
+		require.Zero(t, query.Result.Id)
+	})
+
+	t.Run("GetPreferencesWithDefaults should merge the digest cadence by precedence", func(t *testing.T) {
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 14, UserId: 1, Teams: []int64{2}}}
+		err := ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, models.DigestCadenceOff, query.Result.DigestCadence)
+
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 14, DigestCadence: models.DigestCadenceWeekly})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 14, TeamId: 2, DigestCadence: models.DigestCadenceDaily})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 14, UserId: 1, DigestCadence: models.DigestCadenceHourly})
+		require.NoError(t, err)
+
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, models.DigestCadenceHourly, query.Result.DigestCadence)
+
+		query = &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 14, UserId: 2, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, models.DigestCadenceDaily, query.Result.DigestCadence)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 14, UserId: 3}}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+		require.NoError(t, err)
+		require.Equal(t, models.ExplainedPreference{Value: models.DigestCadenceWeekly, Source: models.PreferencesLevelOrg}, explained.Result["digestCadence"])
+	})
+
+	t.Run("SavePreferences should reject invalid default refresh intervals", func(t *testing.T) {
+		for _, interval := range []string{"never", "5", "-1m", "0s", "Off"} {
+			err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 22, UserId: 1, DefaultRefreshInterval: interval})
+			require.ErrorIs(t, err, models.ErrInvalidRefreshInterval, interval)
+		}
+
+		for _, interval := range []string{"", models.RefreshIntervalOff, "30s", "5m", "1h", "1d"} {
+			err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 22, UserId: 1, DefaultRefreshInterval: interval})
+			require.NoError(t, err, interval)
+		}
+	})
+
+	t.Run("GetPreferencesWithDefaults should merge the default refresh interval by precedence", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 23, DefaultRefreshInterval: "1h"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 23, TeamId: 2, DefaultRefreshInterval: "5m"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 23, UserId: 1, DefaultRefreshInterval: models.RefreshIntervalOff})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 23, UserId: 1, Teams: []int64{2}}}
+		require.NoError(t, ss.GetPreferencesWithDefaults(context.Background(), query))
+		require.Equal(t, models.RefreshIntervalOff, query.Result.DefaultRefreshInterval)
+
+		query = &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 23, UserId: 2, Teams: []int64{2}}}
+		require.NoError(t, ss.GetPreferencesWithDefaults(context.Background(), query))
+		require.Equal(t, "5m", query.Result.DefaultRefreshInterval)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 23, UserId: 3}}
+		require.NoError(t, ss.GetPreferencesWithDefaultsExplained(context.Background(), explained))
+		require.Equal(t, models.ExplainedPreference{Value: "1h", Source: models.PreferencesLevelOrg}, explained.Result["defaultRefreshInterval"])
+	})
+
+	t.Run("SavePreferences should save the last explore range of users", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{
+			OrgId: 17, UserId: 1, LastExploreRange: &models.ExploreRange{From: "now-6h", To: "now"},
+		})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesQuery{OrgId: 17, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Equal(t, &models.ExploreRange{From: "now-6h", To: "now"}, models.ParseExploreRange(query.Result.LastExploreRange))
+
+		// the explore range isn't saved, nor merged, for teams and orgs
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{
+			OrgId: 17, TeamId: 1, LastExploreRange: &models.ExploreRange{From: "now-1d", To: "now"},
+		})
+		require.NoError(t, err)
+		team := &models.GetPreferencesQuery{OrgId: 17, TeamId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), team))
+		require.Empty(t, team.Result.LastExploreRange)
+
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 17, UserId: 1})
+		require.NoError(t, err)
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Nil(t, models.ParseExploreRange(query.Result.LastExploreRange))
+	})
+
+	t.Run("Malformed stored explore ranges should be ignored", func(t *testing.T) {
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{
+			OrgId: 18, UserId: 1, Theme: "dark", LastExploreRange: &models.ExploreRange{From: "now-6h", To: "now"},
+		})
+		require.NoError(t, err)
+		err = ss.WithDbSession(context.Background(), func(sess *DBSession) error {
+			_, err := sess.Exec("UPDATE preferences SET last_explore_range=? WHERE org_id=? AND user_id=?", `{"from":`, 18, 1)
+			return err
+		})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesQuery{OrgId: 18, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Equal(t, "dark", query.Result.Theme)
+		require.Nil(t, models.ParseExploreRange(query.Result.LastExploreRange))
+
+		exported, err := ss.ExportUserPreferences(context.Background(), 18, 1)
+		require.NoError(t, err)
+		require.Contains(t, string(exported), `"lastExploreRange":null`)
+	})
+
+	t.Run("SavePreferences should only update the columns of the preferences", func(t *testing.T) {
+		err := ss.WithDbSession(context.Background(), func(sess *DBSession) error {
+			// a column unknown to this version, e.g. added by a newer one before a rollback
+			_, err := sess.Exec("ALTER TABLE preferences ADD COLUMN future_setting VARCHAR(20) NULL")
+			return err
+		})
+		require.NoError(t, err)
+
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 24, UserId: 1, Theme: "dark"})
+		require.NoError(t, err)
+		err = ss.WithDbSession(context.Background(), func(sess *DBSession) error {
+			_, err := sess.Exec("UPDATE preferences SET future_setting=? WHERE org_id=? AND user_id=?", "kept", 24, 1)
+			return err
+		})
+		require.NoError(t, err)
+
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 24, UserId: 1, Theme: "light"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesQuery{OrgId: 24, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Equal(t, "light", query.Result.Theme)
+		require.Equal(t, 1, query.Result.Version)
+
+		err = ss.WithDbSession(context.Background(), func(sess *DBSession) error {
+			rows, err := sess.Query("SELECT future_setting FROM preferences WHERE org_id=? AND user_id=?", 24, 1)
+			require.NoError(t, err)
+			require.Len(t, rows, 1)
+			require.Equal(t, "kept", string(rows[0]["future_setting"]))
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("SavePreferences should update every column but the identifying ones and the creation time", func(t *testing.T) {
+		table := ss.engine.TableInfo(&models.Preferences{})
+		var expected []string
+		for _, column := range table.ColumnsSeq() {
+			switch column {
+			case "id", "org_id", "user_id", "team_id", "created":
+			default:
+				expected = append(expected, column)
+			}
+		}
+		require.ElementsMatch(t, expected, savedPreferencesColumns)
+	})
+
+	t.Run("GetPreferencesWithNonDefaults should tell which preferences differ from their defaults", func(t *testing.T) {
+		ss.Cfg.DefaultTheme = "light"
+		ss.Cfg.DateFormats.DefaultTimezone = "UTC"
+		ss.Cfg.DateFormats.DefaultWeekStart = ""
+
+		// the team sets the default theme again, which doesn't make it differ
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 27, Timezone: "browser"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 27, TeamId: 2, Theme: "light", WeekStart: "monday"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 27, UserId: 1, DigestCadence: models.DigestCadenceWeekly})
+		require.NoError(t, err)
+
+		user := &models.SignedInUser{OrgId: 27, UserId: 1, Teams: []int64{2}}
+		query := &models.GetPreferencesWithNonDefaultsQuery{User: user}
+		err = ss.GetPreferencesWithNonDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, map[string]struct{}{
+			"timezone":      {},
+			"weekStart":     {},
+			"digestCadence": {},
+		}, query.Result.NonDefault)
+
+		effective := &models.GetPreferencesWithDefaultsQuery{User: user}
+		require.NoError(t, ss.GetPreferencesWithDefaults(context.Background(), effective))
+		require.Equal(t, effective.Result, query.Result.Preferences)
+	})
+
+	t.Run("GetPreferencesWithNonDefaults without saved preferences should return none", func(t *testing.T) {
+		query := &models.GetPreferencesWithNonDefaultsQuery{User: &models.SignedInUser{OrgId: 28, UserId: 1}}
+		err := ss.GetPreferencesWithNonDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Empty(t, query.Result.NonDefault)
+		require.Equal(t, "light", query.Result.Preferences.Theme)
+	})
+
+	t.Run("SavePreferences should save within the lock timeout", func(t *testing.T) {
+		setPreferencesLockTimeout(t, ss, time.Second)
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 25, UserId: 1, Theme: "dark"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesQuery{OrgId: 25, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Equal(t, "dark", query.Result.Theme)
+	})
+
+	t.Run("SavePreferences should time out waiting for locked preferences", func(t *testing.T) {
+		// SQLite in shared cache mode fails locked tables right away instead of waiting for them
+		if ss.Dialect.DriverName() == migrator.SQLite {
+			t.Skip("locks aren't waited for with SQLite")
+		}
+
+		err := ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 26, UserId: 1, Theme: "dark"})
+		require.NoError(t, err)
+
+		sess := ss.engine.NewSession()
+		defer sess.Close()
+		require.NoError(t, sess.Begin())
+		_, err = sess.Exec("UPDATE preferences SET theme=? WHERE org_id=? AND user_id=?", "light", 26, 1)
+		require.NoError(t, err)
+
+		setPreferencesLockTimeout(t, ss, 100*time.Millisecond)
+		start := time.Now()
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 26, UserId: 1, Theme: "system"})
+		require.ErrorIs(t, err, models.ErrPreferencesLockTimeout)
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.NoError(t, sess.Rollback())
+
+		query := &models.GetPreferencesQuery{OrgId: 26, UserId: 1}
+		require.NoError(t, ss.GetPreferences(context.Background(), query))
+		require.Equal(t, "dark", query.Result.Theme)
+	})
+
+	t.Run("GetPreferencesWithDefaults should fall back when the default Explore datasource does not exist", func(t *testing.T) {
+		err := ss.AddDataSource(context.Background(), &models.AddDataSourceCommand{
+			OrgId: 29, Name: "loki", Uid: "loki", Type: models.DS_PROMETHEUS, Access: models.DS_ACCESS_PROXY, Url: "http://test",
+		})
+		require.NoError(t, err)
+		// a datasource of another org is not a datasource of org 29
+		err = ss.AddDataSource(context.Background(), &models.AddDataSourceCommand{
+			OrgId: 30, Name: "prometheus", Uid: "prometheus", Type: models.DS_PROMETHEUS, Access: models.DS_ACCESS_PROXY, Url: "http://test",
+		})
+		require.NoError(t, err)
+
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 29, DefaultExploreDatasourceUid: "prometheus"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 29, TeamId: 2, DefaultExploreDatasourceUid: "loki"})
+		require.NoError(t, err)
+		err = ss.SavePreferences(context.Background(), &models.SavePreferencesCommand{OrgId: 29, UserId: 1, DefaultExploreDatasourceUid: "deleted"})
+		require.NoError(t, err)
+
+		query := &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 29, UserId: 1, Teams: []int64{2}}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, "loki", query.Result.DefaultExploreDatasourceUid)
+
+		query = &models.GetPreferencesWithDefaultsQuery{User: &models.SignedInUser{OrgId: 29, UserId: 1}}
+		err = ss.GetPreferencesWithDefaults(context.Background(), query)
+		require.NoError(t, err)
+		require.Empty(t, query.Result.DefaultExploreDatasourceUid)
+
+		explained := &models.GetPreferencesWithDefaultsExplainedQuery{User: &models.SignedInUser{OrgId: 29, UserId: 1}}
+		err = ss.GetPreferencesWithDefaultsExplained(context.Background(), explained)
+		require.NoError(t, err)
+		require.Equal(t, models.ExplainedPreference{Value: "", Source: models.PreferencesLevelDefault}, explained.Result["defaultExploreDatasourceUid"])
+	})
+}
+
+// setPreferencesLockTimeout sets the preferences lock timeout of the shared test store for the duration of the test
+func setPreferencesLockTimeout(t *testing.T, ss *SQLStore, timeout time.Duration) {
+	t.Helper()
+	previous := ss.dbCfg.PreferencesLockTimeout
+	ss.dbCfg.PreferencesLockTimeout = timeout
+	t.Cleanup(func() { ss.dbCfg.PreferencesLockTimeout = previous })
 }
@@ -426,6 +426,7 @@ func (ss *SQLStore) readConfig() error {
 
 	ss.dbCfg.CacheMode = sec.Key("cache_mode").MustString("private")
 	ss.dbCfg.SkipMigrations = sec.Key("skip_migrations").MustBool()
+	ss.dbCfg.PreferencesLockTimeout = sec.Key("preferences_lock_timeout").MustDuration(0)
 	return nil
 }
 
@@ -607,4 +608,6 @@ type DatabaseConfig struct {
 	CacheMode        string
 	UrlQueryParams   map[string][]string
 	SkipMigrations   bool
+
+	PreferencesLockTimeout time.Duration
 }
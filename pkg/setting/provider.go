@@ -75,6 +75,9 @@ type KeyValue interface {
 	// MustBool returns the value's boolean representation
 	// Otherwise returns the given default.
 	MustBool(defaultVal bool) bool
+	// MustInt returns the value's integer representation
+	// Otherwise returns the given default.
+	MustInt(defaultVal int) int
 	// MustDuration returns the value's time.Duration
 	// representation. Otherwise returns the given default.
 	MustDuration(defaultVal time.Duration) time.Duration
@@ -155,6 +158,10 @@ func (k *keyValImpl) MustBool(defaultVal bool) bool {
 	return k.key.MustBool(defaultVal)
 }
 
+func (k *keyValImpl) MustInt(defaultVal int) int {
+	return k.key.MustInt(defaultVal)
+}
+
 func (k *keyValImpl) MustDuration(defaultVal time.Duration) time.Duration {
 	return k.key.MustDuration(defaultVal)
 }
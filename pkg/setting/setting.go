@@ -271,6 +271,8 @@ type Cfg struct {
 
 	// Dashboards
 	DefaultHomeDashboardPath string
+	// DefaultHomeDashboardIDByRole maps org roles to the home dashboard of users, teams and orgs without one
+	DefaultHomeDashboardIDByRole map[string]int64
 
 	// Auth
 	LoginCookieName              string
@@ -878,6 +880,18 @@ func (cfg *Cfg) Load(args CommandLineArgs) error {
 	MinRefreshInterval = valueAsString(dashboards, "min_refresh_interval", "5s")
 
 	cfg.DefaultHomeDashboardPath = dashboards.Key("default_home_dashboard_path").MustString("")
+	cfg.DefaultHomeDashboardIDByRole = make(map[string]int64)
+	for _, roleAndID := range util.SplitString(valueAsString(dashboards, "default_home_dashboard_id_by_role", "")) {
+		split := strings.SplitN(roleAndID, ":", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("invalid default_home_dashboard_id_by_role entry %q, expected <role>:<dashboard id>", roleAndID)
+		}
+		id, err := strconv.ParseInt(split[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid default_home_dashboard_id_by_role entry %q: %w", roleAndID, err)
+		}
+		cfg.DefaultHomeDashboardIDByRole[split[0]] = id
+	}
 
 	if err := readUserSettings(iniFile, cfg); err != nil {
 		return err
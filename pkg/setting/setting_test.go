@@ -142,6 +142,28 @@ func TestLoadingSettings(t *testing.T) {
 		require.Equal(t, "test2", cfg.Domain)
 	})
 
+	t.Run("Should parse default home dashboard ids by role", func(t *testing.T) {
+		cfg := NewCfg()
+		err := cfg.Load(CommandLineArgs{
+			HomePath: "../../",
+			Args: []string{
+				"cfg:default.dashboards.default_home_dashboard_id_by_role=Admin:10 Viewer:12",
+			},
+		})
+		require.Nil(t, err)
+
+		require.Equal(t, map[string]int64{"Admin": 10, "Viewer": 12}, cfg.DefaultHomeDashboardIDByRole)
+
+		cfg = NewCfg()
+		err = cfg.Load(CommandLineArgs{
+			HomePath: "../../",
+			Args: []string{
+				"cfg:default.dashboards.default_home_dashboard_id_by_role=Admin:home",
+			},
+		})
+		require.Error(t, err)
+	})
+
 	t.Run("Defaults can be overridden in specified config file", func(t *testing.T) {
 		if runtime.GOOS == windows {
 			cfg := NewCfg()